@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/ipfs/go-ipfs-api/options"
+	"github.com/multiformats/go-multihash"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// archiveManifestVersion is the version of the manifest format written by exports
+const archiveManifestVersion = 1
+
+// carMaxSectionSize bounds the size of a single CAR block read during imports
+const carMaxSectionSize = 16 << 20
+
+// blobArchive exports public blobs as a CAR archive and imports such archives back
+// The first root of an archive is a raw block holding the JSON manifest of the exported
+// mappings and owners; the other roots are the CIDs of the blobs
+type blobArchive struct {
+	db          *sql.DB
+	publicShell *shell.Shell
+	store       blossom.BlobIndex
+	blocks      *blocklist
+	previews    *previewGenerator
+	metadata    *fileMetadataPublisher
+}
+
+// archiveManifest lists the blobs in an archive with what's needed to recreate them
+type archiveManifest struct {
+	Version   int           `json:"version"`
+	CreatedAt int64         `json:"created_at"`
+	Blobs     []archiveBlob `json:"blobs"`
+}
+
+// archiveBlob is a blob in an archive manifest
+type archiveBlob struct {
+	SHA256    string         `json:"sha256"`
+	CID       string         `json:"cid"`
+	Extension string         `json:"extension"`
+	Type      string         `json:"type"`
+	Size      int            `json:"size"`
+	Owners    []archiveOwner `json:"owners"`
+}
+
+// archiveOwner is a pubkey owning a blob in an archive manifest
+type archiveOwner struct {
+	Pubkey     string `json:"pubkey"`
+	UploadedAt int64  `json:"uploaded_at"`
+}
+
+// archiveSelection restricts an export to the uploads of a pubkey and/or a time range
+// Zero values don't restrict anything
+type archiveSelection struct {
+	Pubkey string
+	Since  int64
+	Until  int64
+}
+
+// archiveImportResult reports the outcome of an import
+type archiveImportResult struct {
+	Imported int                  `json:"imported"`
+	Existing int                  `json:"existing"`
+	Failed   []archiveImportError `json:"failed"`
+}
+
+// archiveImportError is a blob of an archive that couldn't be imported
+type archiveImportError struct {
+	SHA256 string `json:"sha256"`
+	Reason string `json:"reason"`
+}
+
+// Manifest lists the public, non-banned blobs matching a selection with their owners
+func (ba *blobArchive) Manifest(ctx context.Context, sel archiveSelection) (*archiveManifest, error) {
+	query := `
+	SELECT u.sha256, u.pubkey, u.uploaded_at, u.size, m.ipfs_cid, COALESCE(m.extension, '')
+	FROM blob_usage u
+	JOIN ipfs_blossom_mapping m ON m.sha256 = u.sha256
+	WHERE u.sha256 NOT IN (SELECT sha256 FROM private_blobs)
+	AND u.sha256 NOT IN (SELECT sha256 FROM banned_blobs)
+	AND (? = '' OR u.pubkey = ?)
+	AND (? = 0 OR u.uploaded_at >= ?)
+	AND (? = 0 OR u.uploaded_at <= ?)
+	ORDER BY m.created_at, u.sha256, u.uploaded_at`
+	rows, err := ba.db.QueryContext(ctx, query, sel.Pubkey, sel.Pubkey, sel.Since, sel.Since, sel.Until, sel.Until)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blobs: %w", err)
+	}
+	defer rows.Close()
+
+	manifest := &archiveManifest{Version: archiveManifestVersion, CreatedAt: time.Now().Unix(), Blobs: []archiveBlob{}}
+	index := make(map[string]int)
+	for rows.Next() {
+		var sha256, pubkey, ipfsCID, ext string
+		var uploadedAt int64
+		var size int
+		if err := rows.Scan(&sha256, &pubkey, &uploadedAt, &size, &ipfsCID, &ext); err != nil {
+			return nil, fmt.Errorf("failed to scan blob: %w", err)
+		}
+		i, ok := index[sha256]
+		if !ok {
+			i = len(manifest.Blobs)
+			index[sha256] = i
+			manifest.Blobs = append(manifest.Blobs, archiveBlob{
+				SHA256:    sha256,
+				CID:       ipfsCID,
+				Extension: ext,
+				Type:      typeForExtension(ext),
+				Size:      size,
+			})
+		}
+		manifest.Blobs[i].Owners = append(manifest.Blobs[i].Owners, archiveOwner{Pubkey: pubkey, UploadedAt: uploadedAt})
+	}
+	return manifest, rows.Err()
+}
+
+// Export writes a CARv1 archive holding the manifest and the DAGs of all its blobs
+func (ba *blobArchive) Export(ctx context.Context, w io.Writer, manifest *archiveManifest) error {
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestHash, err := multihash.Sum(manifestJSON, multihash.SHA2_256, -1)
+	if err != nil {
+		return err
+	}
+	manifestCID := cid.NewCidV1(cid.Raw, manifestHash)
+
+	roots := []cid.Cid{manifestCID}
+	for _, blob := range manifest.Blobs {
+		c, err := cid.Decode(blob.CID)
+		if err != nil {
+			return fmt.Errorf("invalid cid %s of sha256=%s: %w", blob.CID, blob.SHA256, err)
+		}
+		roots = append(roots, c)
+	}
+
+	cw := &carWriter{w: w, seen: make(map[string]bool)}
+	if err := cw.writeHeader(roots); err != nil {
+		return err
+	}
+	if err := cw.writeBlock(manifestCID, manifestJSON); err != nil {
+		return err
+	}
+	for _, blob := range manifest.Blobs {
+		resp, err := ba.publicShell.Request("dag/export", blob.CID).Send(ctx)
+		if err == nil && resp.Error != nil {
+			resp.Close()
+			err = resp.Error
+		}
+		if err != nil {
+			return fmt.Errorf("failed to export cid=%s: %w", blob.CID, err)
+		}
+		err = cw.copyBlocks(resp.Output)
+		resp.Close()
+		if err != nil {
+			return fmt.Errorf("failed to export cid=%s: %w", blob.CID, err)
+		}
+	}
+
+	log.Printf("Exported %d blobs", len(manifest.Blobs))
+	return nil
+}
+
+// Import loads a CARv1 or CARv2 archive written by Export into IPFS, verifies the sha256
+// of every blob in its manifest and recreates their mappings and blob index entries
+func (ba *blobArchive) Import(ctx context.Context, archive io.ReadSeeker) (*archiveImportResult, error) {
+	manifest, err := readArchiveManifest(archive)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// Only verified blobs are pinned, so nothing else in the archive is kept
+	if _, err := ba.publicShell.DagImportWithOpts(archive, options.Dag.PinRoots(false), options.Dag.Silent(true)); err != nil {
+		return nil, fmt.Errorf("failed to import archive into IPFS: %w", err)
+	}
+
+	result := &archiveImportResult{Failed: []archiveImportError{}}
+	for _, blob := range manifest.Blobs {
+		existing, err := ba.importBlob(ctx, blob)
+		if err != nil {
+			log.Printf("Failed to import sha256=%s: %v", blob.SHA256, err)
+			result.Failed = append(result.Failed, archiveImportError{SHA256: blob.SHA256, Reason: err.Error()})
+			continue
+		}
+		if existing {
+			result.Existing++
+		} else {
+			result.Imported++
+		}
+	}
+
+	log.Printf("Imported %d blobs (%d already stored, %d failed)", result.Imported, result.Existing, len(result.Failed))
+	return result, nil
+}
+
+// importBlob verifies an imported blob against its sha256, maps it and records its owners
+// Returns true if the blob was already stored
+func (ba *blobArchive) importBlob(ctx context.Context, blob archiveBlob) (bool, error) {
+	if !nostr.IsValid32ByteHex(blob.SHA256) {
+		return false, errors.New("invalid sha256")
+	}
+	if _, err := cid.Decode(blob.CID); err != nil {
+		return false, errors.New("invalid cid")
+	}
+
+	// The content must be in the archive: don't go looking for it on the network
+	resp, err := ba.publicShell.Request("cat", blob.CID).Option("offline", true).Send(ctx)
+	if err == nil && resp.Error != nil {
+		resp.Close()
+		err = resp.Error
+	}
+	if err != nil {
+		return false, fmt.Errorf("content missing from archive: %w", err)
+	}
+	body, err := io.ReadAll(resp.Output)
+	resp.Close()
+	if err != nil {
+		return false, fmt.Errorf("failed to read content: %w", err)
+	}
+	if sha256Hex(body) != blob.SHA256 {
+		return false, errors.New("content doesn't match sha256")
+	}
+	if err := ba.blocks.CheckUpload(ctx, blob.SHA256, body); err != nil {
+		return false, err
+	}
+	// The archive may use other chunking than this node, so its CID is checked as well
+	if banned, err := isCIDBanned(ctx, ba.db, blob.CID); err != nil {
+		return false, fmt.Errorf("failed to check CID ban: %w", err)
+	} else if banned {
+		return false, errBlobBanned
+	}
+
+	ext := normalizeExtension(sniffContentType(body), blob.Extension)
+	existingCID, err := lookupBlobCID(ctx, ba.db, blob.SHA256)
+	if err != nil {
+		return false, err
+	}
+	if existingCID == "" {
+		if err := ba.publicShell.Pin(blob.CID); err != nil {
+			return false, fmt.Errorf("failed to pin: %w", err)
+		}
+		query := `INSERT OR REPLACE INTO ipfs_blossom_mapping (sha256, ipfs_cid, extension) VALUES (?, ?, ?)`
+		if _, err := ba.db.ExecContext(ctx, query, blob.SHA256, blob.CID, ext); err != nil {
+			return false, fmt.Errorf("failed to store mapping: %w", err)
+		}
+		if err := ba.previews.Generate(ctx, blob.SHA256, ext, body); err != nil {
+			log.Printf("Failed to generate previews for sha256=%s: %v", blob.SHA256, err)
+		}
+		if ba.metadata != nil {
+			if err := ba.metadata.Publish(ctx, blob.SHA256, ext, len(body)); err != nil {
+				log.Printf("Failed to publish file metadata for sha256=%s: %v", blob.SHA256, err)
+			}
+		}
+	}
+
+	for _, owner := range blob.Owners {
+		descriptor := blossom.BlobDescriptor{
+			SHA256:   blob.SHA256,
+			Size:     len(body),
+			Type:     typeForExtension(ext),
+			Uploaded: nostr.Timestamp(owner.UploadedAt),
+		}
+		if err := keepImportedOwner(ctx, ba.db, ba.store, descriptor, owner.Pubkey); err != nil {
+			return false, err
+		}
+	}
+	return existingCID != "", nil
+}
+
+// keepImportedOwner records a pubkey as owner of an imported blob in the blob index,
+// keeping its original upload time. Invalid and banned pubkeys are skipped
+func keepImportedOwner(ctx context.Context, db *sql.DB, store blossom.BlobIndex, descriptor blossom.BlobDescriptor, pubkey string) error {
+	if !nostr.IsValid32ByteHex(pubkey) {
+		return nil
+	}
+	if banned, err := isPubkeyBanned(ctx, db, pubkey); err != nil || banned {
+		return nil
+	}
+	if err := store.Keep(ctx, descriptor, pubkey); err != nil {
+		return fmt.Errorf("failed to record owner %s: %w", pubkey, err)
+	}
+	// Keep the original upload time rather than the import time
+	query := `UPDATE blob_usage SET uploaded_at = ? WHERE pubkey = ? AND sha256 = ?`
+	if _, err := db.ExecContext(ctx, query, int64(descriptor.Uploaded), pubkey, descriptor.SHA256); err != nil {
+		return fmt.Errorf("failed to record owner %s: %w", pubkey, err)
+	}
+	return nil
+}
+
+// readArchiveManifest finds and decodes the manifest block of an archive
+func readArchiveManifest(archive io.Reader) (*archiveManifest, error) {
+	cr, err := newCARReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	if len(cr.roots) == 0 {
+		return nil, errors.New("archive has no roots")
+	}
+	manifestCID := cr.roots[0]
+	for {
+		c, data, err := cr.next()
+		if err == io.EOF {
+			return nil, errors.New("archive has no manifest")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !c.Equals(manifestCID) {
+			continue
+		}
+		if sum, err := c.Prefix().Sum(data); err != nil || !sum.Equals(c) {
+			return nil, errors.New("manifest doesn't match its cid")
+		}
+		var manifest archiveManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %w", err)
+		}
+		if manifest.Version != archiveManifestVersion {
+			return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+		}
+		return &manifest, nil
+	}
+}
+
+// carWriter writes a CARv1 stream, skipping blocks that were already written
+type carWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+// writeHeader writes the DAG-CBOR header of a CARv1 stream
+func (cw *carWriter) writeHeader(roots []cid.Cid) error {
+	var header bytes.Buffer
+	header.WriteByte(0xa2) // map of 2 entries, keys in DAG-CBOR order
+	writeCBORHead(&header, 3, uint64(len("roots")))
+	header.WriteString("roots")
+	writeCBORHead(&header, 4, uint64(len(roots)))
+	for _, root := range roots {
+		writeCBORHead(&header, 6, 42) // CID tag
+		rootBytes := root.Bytes()
+		writeCBORHead(&header, 2, uint64(len(rootBytes)+1))
+		header.WriteByte(0x00) // multibase identity prefix
+		header.Write(rootBytes)
+	}
+	writeCBORHead(&header, 3, uint64(len("version")))
+	header.WriteString("version")
+	writeCBORHead(&header, 0, 1)
+
+	if _, err := cw.w.Write(binary.AppendUvarint(nil, uint64(header.Len()))); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(header.Bytes())
+	return err
+}
+
+// writeBlock writes a block section
+func (cw *carWriter) writeBlock(c cid.Cid, data []byte) error {
+	key := c.KeyString()
+	if cw.seen[key] {
+		return nil
+	}
+	cw.seen[key] = true
+
+	cidBytes := c.Bytes()
+	if _, err := cw.w.Write(binary.AppendUvarint(nil, uint64(len(cidBytes)+len(data)))); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(cidBytes); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(data)
+	return err
+}
+
+// copyBlocks copies the blocks of another CAR stream
+func (cw *carWriter) copyBlocks(r io.Reader) error {
+	cr, err := newCARReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		c, data, err := cr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := cw.writeBlock(c, data); err != nil {
+			return err
+		}
+	}
+}
+
+// writeCBORHead writes the head of a CBOR data item with its major type and argument
+func writeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg <= 0xff:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= 0xffffffff:
+		buf.WriteByte(major<<5 | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
+
+// carReader reads the blocks of a CARv1 stream, or of the CARv1 payload of a CARv2 file
+type carReader struct {
+	r     *bufio.Reader
+	roots []cid.Cid
+}
+
+// newCARReader reads the header of a CAR stream
+func newCARReader(r io.Reader) (*carReader, error) {
+	br := bufio.NewReader(r)
+	version, roots, err := readCARHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case 1:
+		return &carReader{r: br, roots: roots}, nil
+	case 2:
+		// The pragma is followed by a fixed header locating the CARv1 payload
+		var v2Header [40]byte
+		if _, err := io.ReadFull(br, v2Header[:]); err != nil {
+			return nil, fmt.Errorf("invalid CARv2 header: %w", err)
+		}
+		dataOffset := binary.LittleEndian.Uint64(v2Header[16:24])
+		dataSize := binary.LittleEndian.Uint64(v2Header[24:32])
+		const pragmaSize = 11
+		if dataOffset < pragmaSize+40 {
+			return nil, errors.New("invalid CARv2 data offset")
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(dataOffset-pragmaSize-40)); err != nil {
+			return nil, fmt.Errorf("invalid CARv2 data offset: %w", err)
+		}
+		payload := bufio.NewReader(io.LimitReader(br, int64(dataSize)))
+		version, roots, err := readCARHeader(payload)
+		if err != nil {
+			return nil, err
+		}
+		if version != 1 {
+			return nil, fmt.Errorf("unsupported CARv2 payload version %d", version)
+		}
+		return &carReader{r: payload, roots: roots}, nil
+	default:
+		return nil, fmt.Errorf("unsupported CAR version %d", version)
+	}
+}
+
+// next returns the next block of the stream, or io.EOF at its end
+func (cr *carReader) next() (cid.Cid, []byte, error) {
+	size, err := binary.ReadUvarint(cr.r)
+	if err == io.EOF {
+		return cid.Undef, nil, io.EOF
+	}
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("invalid CAR section: %w", err)
+	}
+	if size == 0 || size > carMaxSectionSize {
+		return cid.Undef, nil, fmt.Errorf("invalid CAR section size %d", size)
+	}
+	section := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, section); err != nil {
+		return cid.Undef, nil, fmt.Errorf("truncated CAR section: %w", err)
+	}
+	n, c, err := cid.CidFromBytes(section)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("invalid CAR block cid: %w", err)
+	}
+	return c, section[n:], nil
+}
+
+// readCARHeader reads the DAG-CBOR header of a CAR stream, returning its version and roots
+func readCARHeader(r *bufio.Reader) (uint64, []cid.Cid, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid CAR header: %w", err)
+	}
+	if size == 0 || size > carMaxSectionSize {
+		return 0, nil, fmt.Errorf("invalid CAR header size %d", size)
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, fmt.Errorf("truncated CAR header: %w", err)
+	}
+
+	hr := bytes.NewReader(header)
+	major, entries, err := readCBORHead(hr)
+	if err != nil || major != 5 {
+		return 0, nil, errors.New("CAR header is not a map")
+	}
+	var version uint64
+	var roots []cid.Cid
+	for i := uint64(0); i < entries; i++ {
+		key, err := readCBORText(hr)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch key {
+		case "version":
+			major, value, err := readCBORHead(hr)
+			if err != nil || major != 0 {
+				return 0, nil, errors.New("invalid CAR header version")
+			}
+			version = value
+		case "roots":
+			major, count, err := readCBORHead(hr)
+			if err != nil || major != 4 || count > uint64(hr.Len()) {
+				return 0, nil, errors.New("invalid CAR header roots")
+			}
+			for j := uint64(0); j < count; j++ {
+				root, err := readCBORCID(hr)
+				if err != nil {
+					return 0, nil, err
+				}
+				roots = append(roots, root)
+			}
+		default:
+			return 0, nil, fmt.Errorf("unsupported CAR header field %q", key)
+		}
+	}
+	return version, roots, nil
+}
+
+// readCBORHead reads the head of a CBOR data item, returning its major type and argument
+func readCBORHead(r *bytes.Reader) (byte, uint64, error) {
+	initial, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := initial>>5, initial&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, errors.New("unsupported CBOR item")
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, 0, err
+	}
+	return major, binary.BigEndian.Uint64(buf), nil
+}
+
+// readCBORText reads a CBOR text string
+func readCBORText(r *bytes.Reader) (string, error) {
+	major, length, err := readCBORHead(r)
+	if err != nil || major != 3 || length > uint64(r.Len()) {
+		return "", errors.New("invalid CBOR text")
+	}
+	text := make([]byte, length)
+	if _, err := io.ReadFull(r, text); err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// readCBORCID reads a DAG-CBOR CID link: tag 42 on a byte string with a 0x00 prefix
+func readCBORCID(r *bytes.Reader) (cid.Cid, error) {
+	major, tag, err := readCBORHead(r)
+	if err != nil || major != 6 || tag != 42 {
+		return cid.Undef, errors.New("invalid CBOR CID tag")
+	}
+	major, length, err := readCBORHead(r)
+	if err != nil || major != 2 || length < 2 || length > uint64(r.Len()) {
+		return cid.Undef, errors.New("invalid CBOR CID bytes")
+	}
+	link := make([]byte, length)
+	if _, err := io.ReadFull(r, link); err != nil {
+		return cid.Undef, err
+	}
+	if link[0] != 0x00 {
+		return cid.Undef, errors.New("invalid CBOR CID prefix")
+	}
+	return cid.Cast(link[1:])
+}
+
+// parseArchiveTime parses a selection bound given as a unix timestamp, a date or an RFC 3339 time
+func parseArchiveTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("invalid time %q: use a unix timestamp, YYYY-MM-DD or RFC 3339", value)
+}
+
+// parseArchiveSelection builds a selection from a pubkey (npub or hex) and time bounds
+func parseArchiveSelection(pubkey string, since string, until string) (archiveSelection, error) {
+	var sel archiveSelection
+	var err error
+	if pubkey != "" {
+		if sel.Pubkey, err = normalizePubkey(pubkey); err != nil {
+			return sel, err
+		}
+	}
+	if sel.Since, err = parseArchiveTime(since); err != nil {
+		return sel, err
+	}
+	if sel.Until, err = parseArchiveTime(until); err != nil {
+		return sel, err
+	}
+	return sel, nil
+}
+
+// archiveHandler serves GET /admin/export and POST /admin/import to admins authenticated with NIP-98
+func archiveHandler(ba *blobArchive, adminPubkeys map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, err := readNIP98Auth(r, nil)
+		if err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !adminPubkeys[auth.PubKey] {
+			w.Header().Set("X-Reason", "only admins can export and import blobs")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/admin/export" && r.Method == "GET":
+			query := r.URL.Query()
+			sel, err := parseArchiveSelection(query.Get("pubkey"), query.Get("since"), query.Get("until"))
+			if err != nil {
+				w.Header().Set("X-Reason", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			manifest, err := ba.Manifest(r.Context(), sel)
+			if err != nil {
+				log.Printf("Failed to build export manifest: %v", err)
+				w.Header().Set("X-Reason", "failed to list blobs")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if query.Get("manifest") == "true" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(manifest)
+				return
+			}
+			w.Header().Set("Content-Type", gatewayContentTypeCAR+"; version=1")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"blobs-%d.car\"", manifest.CreatedAt))
+			if err := ba.Export(r.Context(), w, manifest); err != nil {
+				// Headers are gone, the truncated archive will fail to import
+				log.Printf("Failed to export blobs: %v", err)
+			}
+
+		case r.URL.Path == "/admin/import" && r.Method == "POST":
+			// The archive is only imported if it is the one the admin signed for
+			payloadTag := auth.Tags.Find("payload")
+			if payloadTag == nil {
+				w.Header().Set("X-Reason", "missing 'payload' tag in auth event")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// Spool the archive to disk: it is read twice and can be large
+			tmp, err := os.CreateTemp("", "blossom-import-*.car")
+			if err != nil {
+				w.Header().Set("X-Reason", "failed to store archive")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
+
+			hash := sha256.New()
+			if _, err := io.Copy(tmp, io.TeeReader(r.Body, hash)); err != nil {
+				w.Header().Set("X-Reason", "can't read request body")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if payloadTag[1] != hex.EncodeToString(hash.Sum(nil)) {
+				w.Header().Set("X-Reason", "invalid auth event payload hash")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				w.Header().Set("X-Reason", "failed to read stored archive")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			result, err := ba.Import(r.Context(), tmp)
+			if err != nil {
+				w.Header().Set("X-Reason", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// runArchiveCommand runs the export or import command given on the command line
+func runArchiveCommand(ctx context.Context, ba *blobArchive, args []string) error {
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		pubkey := fs.String("pubkey", "", "only export blobs uploaded by this pubkey (npub or hex)")
+		since := fs.String("since", "", "only export blobs uploaded at or after this time (unix timestamp, YYYY-MM-DD or RFC 3339)")
+		until := fs.String("until", "", "only export blobs uploaded at or before this time (unix timestamp, YYYY-MM-DD or RFC 3339)")
+		output := fs.String("o", "blobs.car", "archive file to write")
+		manifestOutput := fs.String("manifest", "", "also write the JSON manifest to this file")
+		fs.Parse(args[1:])
+
+		sel, err := parseArchiveSelection(*pubkey, *since, *until)
+		if err != nil {
+			return err
+		}
+		manifest, err := ba.Manifest(ctx, sel)
+		if err != nil {
+			return err
+		}
+		if *manifestOutput != "" {
+			manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(*manifestOutput, manifestJSON, 0644); err != nil {
+				return err
+			}
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bw := bufio.NewWriter(f)
+		if err := ba.Export(ctx, bw, manifest); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		return f.Close()
+
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return errors.New("usage: import <archive.car>")
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		result, err := ba.Import(ctx, f)
+		if err != nil {
+			return err
+		}
+		for _, failed := range result.Failed {
+			fmt.Fprintf(os.Stderr, "failed %s: %s\n", failed.SHA256, failed.Reason)
+		}
+		fmt.Printf("imported %d blobs, %d already stored, %d failed\n", result.Imported, result.Existing, len(result.Failed))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q: use export, import or import-blossom", strings.TrimSpace(args[0]))
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// newTestArchive creates a blob archive over a fresh database and fake IPFS node
+func newTestArchive(t *testing.T) (*blobArchive, *fakeIPFS) {
+	t.Helper()
+	store, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	return &blobArchive{
+		db:          db,
+		publicShell: ipfsShell,
+		store: usageTrackingIndex{
+			BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://blossom.example.com"},
+			db:        db,
+		},
+		blocks:   &blocklist{db: db, publicShell: ipfsShell},
+		previews: newPreviewGenerator(db, ipfsShell, nil, 0),
+	}, node
+}
+
+// addTestBlob stores content as a blob owned by pubkeys with the given upload times
+func addTestBlob(t *testing.T, ba *blobArchive, node *fakeIPFS, content string, ext string, owners map[string]int64) string {
+	t.Helper()
+	sha256 := sha256Hex([]byte(content))
+	query := `INSERT INTO ipfs_blossom_mapping (sha256, ipfs_cid, extension) VALUES (?, ?, ?)`
+	if _, err := ba.db.Exec(query, sha256, node.put([]byte(content)), ext); err != nil {
+		t.Fatalf("failed to store mapping: %v", err)
+	}
+	for pubkey, uploadedAt := range owners {
+		query := `INSERT INTO blob_usage (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+		if _, err := ba.db.Exec(query, pubkey, sha256, len(content), uploadedAt); err != nil {
+			t.Fatalf("failed to record usage: %v", err)
+		}
+	}
+	return sha256
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	_, alice := newTestKey(t)
+	_, bob := newTestKey(t)
+
+	source, sourceNode := newTestArchive(t)
+	first := addTestBlob(t, source, sourceNode, "first blob", ".txt", map[string]int64{alice: 1700000000, bob: 1700000100})
+	second := addTestBlob(t, source, sourceNode, "second blob", ".txt", map[string]int64{alice: 1700000200})
+
+	// Private and banned blobs are never exported
+	private := addTestBlob(t, source, sourceNode, "private blob", ".txt", map[string]int64{alice: 1700000300})
+	if _, err := source.db.Exec(`INSERT INTO private_blobs (sha256) VALUES (?)`, private); err != nil {
+		t.Fatalf("failed to mark blob private: %v", err)
+	}
+	banned := addTestBlob(t, source, sourceNode, "banned blob", ".txt", map[string]int64{alice: 1700000400})
+	if _, err := source.db.Exec(`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`, banned, "test"); err != nil {
+		t.Fatalf("failed to ban blob: %v", err)
+	}
+
+	manifest, err := source.Manifest(ctx, archiveSelection{})
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	if len(manifest.Blobs) != 2 {
+		t.Fatalf("manifest has %d blobs, want 2", len(manifest.Blobs))
+	}
+	var archive bytes.Buffer
+	if err := source.Export(ctx, &archive, manifest); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		prepare      func(t *testing.T, ba *blobArchive, node *fakeIPFS)
+		wantImported int
+		wantExisting int
+		wantFailed   []string
+	}{
+		{name: "empty server", wantImported: 2},
+		{
+			name: "blob already stored",
+			prepare: func(t *testing.T, ba *blobArchive, node *fakeIPFS) {
+				addTestBlob(t, ba, node, "first blob", ".txt", nil)
+			},
+			wantImported: 1, wantExisting: 1,
+		},
+		{
+			name: "blob banned on this server",
+			prepare: func(t *testing.T, ba *blobArchive, node *fakeIPFS) {
+				if _, err := ba.db.Exec(`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`, second, "test"); err != nil {
+					t.Fatalf("failed to ban blob: %v", err)
+				}
+			},
+			wantImported: 1, wantFailed: []string{second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, destNode := newTestArchive(t)
+			if tt.prepare != nil {
+				tt.prepare(t, dest, destNode)
+			}
+
+			result, err := dest.Import(ctx, bytes.NewReader(archive.Bytes()))
+			if err != nil {
+				t.Fatalf("Import() error = %v", err)
+			}
+			if result.Imported != tt.wantImported || result.Existing != tt.wantExisting || len(result.Failed) != len(tt.wantFailed) {
+				t.Fatalf("Import() = %+v, want %d imported, %d existing, %d failed", result, tt.wantImported, tt.wantExisting, len(tt.wantFailed))
+			}
+			for i, failed := range result.Failed {
+				if failed.SHA256 != tt.wantFailed[i] {
+					t.Errorf("failed blob %d = %s, want %s", i, failed.SHA256, tt.wantFailed[i])
+				}
+			}
+			if len(destNode.pins) != tt.wantImported {
+				t.Errorf("pinned %d CIDs, want %d", len(destNode.pins), tt.wantImported)
+			}
+
+			for _, blob := range manifest.Blobs {
+				if len(tt.wantFailed) > 0 && blob.SHA256 == tt.wantFailed[0] {
+					continue
+				}
+				cid, err := lookupBlobCID(ctx, dest.db, blob.SHA256)
+				if err != nil || cid == "" {
+					t.Fatalf("sha256=%s isn't mapped after the import: %v", blob.SHA256, err)
+				}
+				if data, ok := destNode.get(cid); !ok || sha256Hex(data) != blob.SHA256 {
+					t.Errorf("content of sha256=%s isn't in the IPFS node", blob.SHA256)
+				}
+				for _, owner := range blob.Owners {
+					var uploadedAt int64
+					query := `SELECT uploaded_at FROM blob_usage WHERE pubkey = ? AND sha256 = ?`
+					if err := dest.db.QueryRow(query, owner.Pubkey, blob.SHA256).Scan(&uploadedAt); err != nil {
+						t.Fatalf("owner %s of sha256=%s wasn't recorded: %v", owner.Pubkey, blob.SHA256, err)
+					}
+					if uploadedAt != owner.UploadedAt {
+						t.Errorf("upload time of sha256=%s by %s = %d, want %d", blob.SHA256, owner.Pubkey, uploadedAt, owner.UploadedAt)
+					}
+				}
+			}
+
+			var owners int
+			if err := dest.db.QueryRow(`SELECT COUNT(*) FROM blob_usage WHERE sha256 = ?`, first).Scan(&owners); err != nil {
+				t.Fatalf("failed to count owners: %v", err)
+			}
+			if owners != 2 {
+				t.Errorf("sha256=%s has %d owners, want 2", first, owners)
+			}
+			for _, sha256 := range []string{private, banned} {
+				if cid, _ := lookupBlobCID(ctx, dest.db, sha256); cid != "" {
+					t.Errorf("sha256=%s was imported but never exported", sha256)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveImportRejectsTamperedContent(t *testing.T) {
+	ctx := context.Background()
+	_, alice := newTestKey(t)
+
+	source, sourceNode := newTestArchive(t)
+	sha256 := addTestBlob(t, source, sourceNode, "genuine blob", ".txt", map[string]int64{alice: 1700000000})
+	manifest, err := source.Manifest(ctx, archiveSelection{})
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+
+	// The manifest claims the CID holds other content
+	claimed := sha256Hex([]byte("other blob"))
+	manifest.Blobs[0].SHA256 = claimed
+	var archive bytes.Buffer
+	if err := source.Export(ctx, &archive, manifest); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	dest, destNode := newTestArchive(t)
+	result, err := dest.Import(ctx, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if result.Imported != 0 || len(result.Failed) != 1 || result.Failed[0].SHA256 != claimed {
+		t.Fatalf("Import() = %+v, want the tampered blob to fail", result)
+	}
+	for _, c := range []string{claimed, sha256} {
+		var owned bool
+		err := dest.db.QueryRow(`SELECT 1 FROM blob_usage WHERE sha256 = ?`, c).Scan(&owned)
+		if err != sql.ErrNoRows {
+			t.Errorf("sha256=%s has owners after a failed import: %v", c, err)
+		}
+	}
+	if len(destNode.pins) != 0 {
+		t.Errorf("pinned %d CIDs of a failed import", len(destNode.pins))
+	}
+}
+
+func TestArchiveHandlerImport(t *testing.T) {
+	const importURL = "https://example.com/admin/import"
+	ctx := context.Background()
+	adminSK, admin := newTestKey(t)
+	otherSK, _ := newTestKey(t)
+
+	source, sourceNode := newTestArchive(t)
+	addTestBlob(t, source, sourceNode, "imported blob", ".txt", map[string]int64{admin: 1700000000})
+	manifest, err := source.Manifest(ctx, archiveSelection{})
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	var archive bytes.Buffer
+	if err := source.Export(ctx, &archive, manifest); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		auth         func() string
+		wantStatus   int
+		wantImported bool
+	}{
+		{name: "signed archive", auth: func() string { return nip98AuthHeader(t, adminSK, importURL, "POST", archive.Bytes()) }, wantStatus: http.StatusOK, wantImported: true},
+		{name: "missing payload tag", auth: func() string { return nip98AuthHeader(t, adminSK, importURL, "POST", nil) }, wantStatus: http.StatusUnauthorized},
+		{name: "payload of another archive", auth: func() string { return nip98AuthHeader(t, adminSK, importURL, "POST", []byte("other")) }, wantStatus: http.StatusUnauthorized},
+		{name: "not an admin", auth: func() string { return nip98AuthHeader(t, otherSK, importURL, "POST", archive.Bytes()) }, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, _ := newTestArchive(t)
+			req := httptest.NewRequest("POST", "/admin/import", bytes.NewReader(archive.Bytes()))
+			req.Header.Set("Authorization", tt.auth())
+			rec := httptest.NewRecorder()
+			archiveHandler(dest, map[string]bool{admin: true}).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			var count int
+			dest.db.QueryRow(`SELECT COUNT(*) FROM ipfs_blossom_mapping`).Scan(&count)
+			if imported := count > 0; imported != tt.wantImported {
+				t.Errorf("imported = %v, want %v", imported, tt.wantImported)
+			}
+		})
+	}
+}
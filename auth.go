@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nip98MaxClockSkew is how far (in seconds) a NIP-98 auth event's created_at may be from now
+const nip98MaxClockSkew = 60
+
+// nip98SeenEvents remembers the NIP-98 events already used, so a captured Authorization
+// header can't be replayed while its created_at is still within the clock skew
+var nip98SeenEvents = newReplayCache()
+
+// replayCache remembers event IDs until their events expire
+type replayCache struct {
+	mu        sync.Mutex
+	expiries  map[string]nostr.Timestamp
+	lastPrune nostr.Timestamp
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{expiries: make(map[string]nostr.Timestamp)}
+}
+
+// Use records an event ID until expiry and reports whether it was already used
+func (rc *replayCache) Use(id string, expiry nostr.Timestamp) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := nostr.Now()
+	if now != rc.lastPrune {
+		for seen, seenExpiry := range rc.expiries {
+			if seenExpiry < now {
+				delete(rc.expiries, seen)
+			}
+		}
+		rc.lastPrune = now
+	}
+
+	if _, used := rc.expiries[id]; used {
+		return true
+	}
+	rc.expiries[id] = expiry
+	return false
+}
+
+// readNIP98Auth parses and validates a NIP-98 HTTP Auth event from the Authorization header
+// The "u" tag must be the full request URL and the "method" tag the request method
+// The payload is the raw request body, used to verify the "payload" tag
+func readNIP98Auth(r *http.Request, payload []byte) (*nostr.Event, error) {
+	return verifyNIP98Auth(r, payload, false)
+}
+
+// readNIP86Auth validates the NIP-98 event of a NIP-86 management call, whose "u" tag may
+// be the server root and whose "method" tag is optional
+func readNIP86Auth(r *http.Request, payload []byte) (*nostr.Event, error) {
+	return verifyNIP98Auth(r, payload, true)
+}
+
+func verifyNIP98Auth(r *http.Request, payload []byte, management bool) (*nostr.Event, error) {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Nostr ") {
+		return nil, errors.New("missing auth")
+	}
+
+	eventJSON, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token[6:]))
+	if err != nil {
+		return nil, errors.New("invalid base64 auth")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(eventJSON, &evt); err != nil {
+		return nil, errors.New("invalid auth event json")
+	}
+	if evt.Kind != nostr.KindHTTPAuth {
+		return nil, fmt.Errorf("invalid auth event kind %d", evt.Kind)
+	}
+	if !evt.CheckID() {
+		return nil, errors.New("invalid auth event id")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, errors.New("invalid auth event signature")
+	}
+
+	// created_at must be close to the current time
+	now := nostr.Now()
+	if evt.CreatedAt < now-nip98MaxClockSkew || evt.CreatedAt > now+nip98MaxClockSkew {
+		return nil, errors.New("auth event is too old or too far in the future")
+	}
+
+	// The "u" tag must point to this server
+	uTag := evt.Tags.Find("u")
+	if uTag == nil {
+		return nil, errors.New("missing 'u' tag in auth event")
+	}
+	if !nip98URLMatches(uTag[1], r) && !(management && nostr.NormalizeURL(uTag[1]) == nostr.NormalizeURL(requestBaseURL(r))) {
+		return nil, fmt.Errorf("invalid 'u' tag, got '%s', expected '%s'", uTag[1], requestURL(r))
+	}
+
+	// The "method" tag is optional for relay management calls, but must match when present
+	methodTag := evt.Tags.Find("method")
+	if methodTag == nil && !management {
+		return nil, errors.New("missing 'method' tag in auth event")
+	}
+	if methodTag != nil && !strings.EqualFold(methodTag[1], r.Method) {
+		return nil, fmt.Errorf("invalid 'method' tag, got '%s', expected '%s'", methodTag[1], r.Method)
+	}
+
+	// When the request has a body, the "payload" tag must carry its sha256
+	if len(payload) > 0 {
+		payloadHash := sha256.Sum256(payload)
+		if evt.Tags.FindWithValue("payload", hex.EncodeToString(payloadHash[:])) == nil {
+			return nil, errors.New("invalid auth event payload hash")
+		}
+	}
+
+	// Each event authorizes a single request
+	if nip98SeenEvents.Use(evt.ID, evt.CreatedAt+nip98MaxClockSkew) {
+		return nil, errors.New("auth event was already used")
+	}
+
+	return &evt, nil
+}
+
+// nip98URLMatches checks the "u" tag of a NIP-98 event against the full request URL,
+// with or without its query
+func nip98URLMatches(u string, r *http.Request) bool {
+	normalized := nostr.NormalizeURL(u)
+	if normalized == "" {
+		return false
+	}
+	if r.URL.RawQuery != "" && normalized == nostr.NormalizeURL(requestURL(r)+"?"+r.URL.RawQuery) {
+		return true
+	}
+	return normalized == nostr.NormalizeURL(requestURL(r))
+}
+
+// forwardedHeaderProxies are the reverse proxies, from TRUSTED_PROXIES, whose
+// X-Forwarded-Host and X-Forwarded-Proto headers are honoured
+var forwardedHeaderProxies []*net.IPNet
+
+// requestBaseURL reconstructs the public base URL of the server from the request,
+// honouring X-Forwarded-Host and X-Forwarded-Proto when it comes from a trusted reverse proxy
+func requestBaseURL(r *http.Request) string {
+	var host, proto string
+	if remoteIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && ipInNetworks(remoteIP, forwardedHeaderProxies) {
+		host = r.Header.Get("X-Forwarded-Host")
+		proto = r.Header.Get("X-Forwarded-Proto")
+	}
+	if host == "" {
+		host = r.Host
+	}
+
+	if proto == "" {
+		if r.TLS != nil {
+			proto = "https"
+		} else if host == "localhost" || strings.Contains(host, ":") {
+			proto = "http"
+		} else if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); err == nil {
+			// naked IP address
+			proto = "http"
+		} else {
+			proto = "https"
+		}
+	}
+
+	return proto + "://" + host
+}
+
+// requestURL reconstructs the full public URL of the request (without query string)
+func requestURL(r *http.Request) string {
+	return requestBaseURL(r) + r.URL.Path
+}
+
+// readBlossomAuth parses and validates a Blossom (BUD-01, kind 24242) authorization event
+// from the Authorization header. Returns nil without error when there is no Nostr auth header
+func readBlossomAuth(r *http.Request) (*nostr.Event, error) {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Nostr ") {
+		return nil, nil
+	}
+
+	eventJSON, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token[6:]))
+	if err != nil {
+		return nil, errors.New("invalid base64 token")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(eventJSON, &evt); err != nil {
+		return nil, errors.New("broken event")
+	}
+	if evt.Kind != 24242 || !evt.CheckID() {
+		return nil, errors.New("invalid event")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, errors.New("invalid signature")
+	}
+
+	expirationTag := evt.Tags.Find("expiration")
+	if expirationTag == nil {
+		return nil, errors.New("missing \"expiration\" tag")
+	}
+	expiration, _ := strconv.ParseInt(expirationTag[1], 10, 64)
+	if nostr.Timestamp(expiration) < nostr.Now() {
+		return nil, errors.New("event expired")
+	}
+
+	return &evt, nil
+}
+
+// readAuthPubkey returns the signer of a Blossom or NIP-98 Authorization header without
+// checking what the event authorizes, for keying rate limits. Events that are expired or
+// outside the NIP-98 clock skew are ignored so old captured events can't drain a budget
+func readAuthPubkey(r *http.Request) string {
+	if auth, err := readBlossomAuth(r); err == nil && auth != nil {
+		return auth.PubKey
+	}
+
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Nostr ") {
+		return ""
+	}
+	eventJSON, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token[6:]))
+	if err != nil {
+		return ""
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(eventJSON, &evt); err != nil {
+		return ""
+	}
+	if evt.Kind != nostr.KindHTTPAuth || !evt.CheckID() {
+		return ""
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return ""
+	}
+	now := nostr.Now()
+	if evt.CreatedAt < now-nip98MaxClockSkew || evt.CreatedAt > now+nip98MaxClockSkew {
+		return ""
+	}
+	return evt.PubKey
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReadNIP98Auth(t *testing.T) {
+	sk, pubkey := newTestKey(t)
+	body := []byte(`{"method":"banblob","params":[]}`)
+	bodyHash := sha256.Sum256(body)
+
+	tests := []struct {
+		name    string
+		kind    int
+		tags    nostr.Tags
+		created nostr.Timestamp // offset from now
+		payload []byte
+		nip86   bool
+		wantErr bool
+	}{
+		{name: "request URL and method", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "POST"}}},
+		{name: "server root", tags: nostr.Tags{{"u", "https://blossom.example.com"}, {"method", "POST"}}, wantErr: true},
+		{name: "missing method tag", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}}, wantErr: true},
+		{name: "NIP-86 server root", tags: nostr.Tags{{"u", "https://blossom.example.com"}}, nip86: true},
+		{name: "NIP-86 request URL", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}}, nip86: true},
+		{name: "NIP-86 other method", tags: nostr.Tags{{"u", "https://blossom.example.com"}, {"method", "GET"}}, nip86: true, wantErr: true},
+		{name: "matching payload", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "POST"}, {"payload", hex.EncodeToString(bodyHash[:])}}, payload: body},
+		{name: "missing payload tag", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "POST"}}, payload: body, wantErr: true},
+		{name: "payload of another body", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "POST"}, {"payload", hex.EncodeToString(bodyHash[:])}}, payload: []byte("{}"), wantErr: true},
+		{name: "wrong kind", kind: 1, tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "POST"}}, wantErr: true},
+		{name: "missing u tag", tags: nostr.Tags{{"method", "POST"}}, wantErr: true},
+		{name: "other server", tags: nostr.Tags{{"u", "https://evil.example.com/admin"}, {"method", "POST"}}, wantErr: true},
+		{name: "other path", tags: nostr.Tags{{"u", "https://blossom.example.com/usage"}, {"method", "POST"}}, wantErr: true},
+		{name: "other method", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "GET"}}, wantErr: true},
+		{name: "too old", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "POST"}}, created: -2 * nip98MaxClockSkew, wantErr: true},
+		{name: "too far in the future", tags: nostr.Tags{{"u", "https://blossom.example.com/admin"}, {"method", "POST"}}, created: 2 * nip98MaxClockSkew, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind := tt.kind
+			if kind == 0 {
+				kind = nostr.KindHTTPAuth
+			}
+			evt := &nostr.Event{Kind: kind, Tags: tt.tags, CreatedAt: nostr.Now() + tt.created}
+			if err := evt.Sign(sk); err != nil {
+				t.Fatalf("failed to sign event: %v", err)
+			}
+
+			read := readNIP98Auth
+			if tt.nip86 {
+				read = readNIP86Auth
+			}
+			req := httptest.NewRequest("POST", "https://blossom.example.com/admin", nil)
+			req.Header.Set("Authorization", authHeader(t, evt))
+			auth, err := read(req, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readNIP98Auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && auth.PubKey != pubkey {
+				t.Errorf("pubkey = %s, want %s", auth.PubKey, pubkey)
+			}
+		})
+	}
+}
+
+func TestReadNIP98AuthRejectsReplays(t *testing.T) {
+	sk, _ := newTestKey(t)
+	header := nip98AuthHeader(t, sk, "https://blossom.example.com/usage", "GET", nil)
+
+	for i, wantErr := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "https://blossom.example.com/usage", nil)
+		req.Header.Set("Authorization", header)
+		if _, err := readNIP98Auth(req, nil); (err != nil) != wantErr {
+			t.Errorf("request %d: readNIP98Auth() error = %v, wantErr %v", i+1, err, wantErr)
+		}
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	rc := newReplayCache()
+	now := nostr.Now()
+
+	if rc.Use("a", now+60) {
+		t.Errorf("first use of an event was reported as a replay")
+	}
+	if !rc.Use("a", now+60) {
+		t.Errorf("second use of an event wasn't reported as a replay")
+	}
+
+	// Expired events are forgotten on the next prune
+	rc.Use("b", now-1)
+	rc.lastPrune = 0
+	rc.Use("c", now+60)
+	if _, remembered := rc.expiries["b"]; remembered {
+		t.Errorf("expired event is still remembered")
+	}
+	if _, remembered := rc.expiries["a"]; !remembered {
+		t.Errorf("unexpired event was forgotten")
+	}
+}
+
+func TestReadNIP98AuthRejectsTamperedEvents(t *testing.T) {
+	sk, _ := newTestKey(t)
+	evt := signTestEvent(t, sk, nostr.KindHTTPAuth, nostr.Tags{{"u", "https://blossom.example.com/admin"}}, "")
+	evt.Tags = append(evt.Tags, nostr.Tag{"method", "POST"})
+
+	req := httptest.NewRequest("POST", "https://blossom.example.com/admin", nil)
+	req.Header.Set("Authorization", authHeader(t, evt))
+	if _, err := readNIP98Auth(req, nil); err == nil {
+		t.Errorf("readNIP98Auth() accepted an event whose id doesn't match its content")
+	}
+
+	req.Header.Set("Authorization", "Nostr not-base64")
+	if _, err := readNIP98Auth(req, nil); err == nil {
+		t.Errorf("readNIP98Auth() accepted an invalid token")
+	}
+}
+
+func TestRequestBaseURL(t *testing.T) {
+	_, proxyNet, _ := net.ParseCIDR("10.0.0.0/8")
+	forwardedHeaderProxies = []*net.IPNet{proxyNet}
+	t.Cleanup(func() { forwardedHeaderProxies = nil })
+	forwarded := map[string]string{"X-Forwarded-Host": "blossom.example.com", "X-Forwarded-Proto": "https"}
+
+	tests := []struct {
+		name       string
+		target     string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{name: "host name", target: "http://blossom.example.com/upload", want: "https://blossom.example.com"},
+		{name: "host with port", target: "http://localhost:3334/upload", want: "http://localhost:3334"},
+		{name: "naked IP address", target: "http://192.168.1.10/upload", want: "http://192.168.1.10"},
+		{name: "TLS", target: "https://blossom.example.com:8443/upload", want: "https://blossom.example.com:8443"},
+		{name: "forwarded by trusted proxy", target: "http://localhost:3334/upload", remoteAddr: "10.0.0.5:4000", headers: forwarded, want: "https://blossom.example.com"},
+		{name: "forwarded by untrusted client", target: "http://localhost:3334/upload", remoteAddr: "203.0.113.7:4000", headers: forwarded, want: "http://localhost:3334"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if got := requestBaseURL(req); got != tt.want {
+				t.Errorf("requestBaseURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
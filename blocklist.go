@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// blocklistFetchTimeout bounds how long fetching a Nostr blocklist from relays may take
+const blocklistFetchTimeout = 15 * time.Second
+
+// Blocklist target types recorded in the audit log
+const (
+	blockTargetSHA256 = "sha256"
+	blockTargetCID    = "cid"
+)
+
+// blocklist blocks blobs by sha256 or IPFS CID, keeps an audit log of every change
+// and imports shared blocklists from files and Nostr lists
+type blocklist struct {
+	db          *sql.DB
+	publicShell *shell.Shell
+	private     *privateBlobs
+
+	// unpin removes blocked content from the IPFS nodes when set
+	unpin bool
+
+	// metadata removes the file metadata events of blocked blobs when publishing is enabled
+	metadata *fileMetadataPublisher
+
+	// mfs unlinks blocked blobs from MFS when MFS organisation is enabled
+	mfs *mfsOrganizer
+
+	files      []string
+	nostrLists []nostr.EntityPointer
+	relays     []string
+	pool       *nostr.SimplePool
+}
+
+// blocklistAuditEntry is a change to the blocklist returned by the listblocklistaudit method
+type blocklistAuditEntry struct {
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	Target     string `json:"target"`
+	Reason     string `json:"reason"`
+	Actor      string `json:"actor"`
+	Source     string `json:"source"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// newBlocklist creates the blocklist, importing from the given files and Nostr list addresses
+func newBlocklist(db *sql.DB, publicShell *shell.Shell, private *privateBlobs, unpin bool, files []string, nostrLists []nostr.EntityPointer, relays []string) *blocklist {
+	bl := &blocklist{
+		db:          db,
+		publicShell: publicShell,
+		private:     private,
+		unpin:       unpin,
+		files:       files,
+		nostrLists:  nostrLists,
+		relays:      relays,
+	}
+	if len(nostrLists) > 0 {
+		bl.pool = nostr.NewSimplePool(context.Background())
+	}
+	return bl
+}
+
+// createBlocklistTables creates the CID blocklist and audit tables if they don't exist
+// Blocked sha256 hashes are kept in banned_blobs, shared with the NIP-86 banblob method
+func createBlocklistTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS banned_cids (
+		cid TEXT PRIMARY KEY,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS blocklist_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target TEXT NOT NULL,
+		reason TEXT,
+		actor TEXT NOT NULL,
+		source TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// parseBlocklistFiles parses a comma-separated list of blocklist file paths from environment variable
+func parseBlocklistFiles(filesStr string) []string {
+	var files []string
+	for _, path := range strings.Split(filesStr, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// parseNostrLists parses a comma-separated list of naddr addresses of Nostr blocklists from environment variable
+func parseNostrLists(listsStr string) ([]nostr.EntityPointer, error) {
+	var lists []nostr.EntityPointer
+	for _, entry := range strings.Split(listsStr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, value, err := nip19.Decode(entry)
+		if err != nil || prefix != "naddr" {
+			return nil, fmt.Errorf("blocklist %q must be an naddr", entry)
+		}
+		lists = append(lists, value.(nostr.EntityPointer))
+	}
+	return lists, nil
+}
+
+// normalizeCID parses a CID and returns it as CIDv1, so v0 and v1 forms of the same content match
+func normalizeCID(cidStr string) (string, error) {
+	c, err := cid.Decode(strings.TrimSpace(cidStr))
+	if err != nil {
+		return "", err
+	}
+	return cid.NewCidV1(c.Type(), c.Hash()).String(), nil
+}
+
+// isCIDBanned checks whether an IPFS CID is on the blocklist
+func isCIDBanned(ctx context.Context, db *sql.DB, cidStr string) (bool, error) {
+	normalized, err := normalizeCID(cidStr)
+	if err != nil {
+		return false, nil
+	}
+	var count int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM banned_cids WHERE cid = ?`, normalized).Scan(&count)
+	return count > 0, err
+}
+
+// Block adds a sha256 or CID to the blocklist and records who blocked it and why
+// Returns false if it was already blocked
+func (bl *blocklist) Block(ctx context.Context, targetType string, target string, reason string, actor string, source string) (bool, error) {
+	var query string
+	switch targetType {
+	case blockTargetSHA256:
+		query = `INSERT OR IGNORE INTO banned_blobs (sha256, reason) VALUES (?, ?)`
+	case blockTargetCID:
+		query = `INSERT OR IGNORE INTO banned_cids (cid, reason) VALUES (?, ?)`
+	default:
+		return false, fmt.Errorf("unknown blocklist target type %q", targetType)
+	}
+
+	result, err := bl.db.ExecContext(ctx, query, target, reason)
+	if err != nil {
+		return false, fmt.Errorf("failed to block %s: %w", targetType, err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+
+	if err := bl.audit(ctx, "block", targetType, target, reason, actor, source); err != nil {
+		return true, err
+	}
+	log.Printf("Blocked %s %s (reason: %s) by %s via %s", targetType, target, reason, actor, source)
+
+	if targetType == blockTargetSHA256 {
+		if err := bl.metadata.Remove(ctx, target); err != nil {
+			log.Printf("Failed to remove file metadata of blocked sha256=%s: %v", target, err)
+		}
+		if err := bl.mfs.Remove(ctx, target); err != nil {
+			log.Printf("Failed to unlink blocked sha256=%s from MFS: %v", target, err)
+		}
+	}
+	if bl.unpin {
+		bl.unpinTarget(ctx, targetType, target)
+	}
+	return true, nil
+}
+
+// Unblock removes a sha256 or CID from the blocklist and records who unblocked it and why
+func (bl *blocklist) Unblock(ctx context.Context, targetType string, target string, reason string, actor string, source string) error {
+	var query string
+	switch targetType {
+	case blockTargetSHA256:
+		query = `DELETE FROM banned_blobs WHERE sha256 = ?`
+	case blockTargetCID:
+		query = `DELETE FROM banned_cids WHERE cid = ?`
+	default:
+		return fmt.Errorf("unknown blocklist target type %q", targetType)
+	}
+
+	if _, err := bl.db.ExecContext(ctx, query, target); err != nil {
+		return fmt.Errorf("failed to unblock %s: %w", targetType, err)
+	}
+	log.Printf("Unblocked %s %s (reason: %s) by %s via %s", targetType, target, reason, actor, source)
+	return bl.audit(ctx, "unblock", targetType, target, reason, actor, source)
+}
+
+// audit records a blocklist change
+func (bl *blocklist) audit(ctx context.Context, action string, targetType string, target string, reason string, actor string, source string) error {
+	query := `INSERT INTO blocklist_audit (action, target_type, target, reason, actor, source, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if _, err := bl.db.ExecContext(ctx, query, action, targetType, target, reason, actor, source, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to record blocklist audit entry: %w", err)
+	}
+	return nil
+}
+
+// AuditLog returns the most recent blocklist changes, newest first
+func (bl *blocklist) AuditLog(ctx context.Context, limit int) ([]blocklistAuditEntry, error) {
+	query := `SELECT action, target_type, target, COALESCE(reason, ''), actor, source, created_at FROM blocklist_audit ORDER BY id DESC LIMIT ?`
+	rows, err := bl.db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []blocklistAuditEntry{}
+	for rows.Next() {
+		var entry blocklistAuditEntry
+		if err := rows.Scan(&entry.Action, &entry.TargetType, &entry.Target, &entry.Reason, &entry.Actor, &entry.Source, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// unpinTarget unpins blocked content from the IPFS node holding it
+func (bl *blocklist) unpinTarget(ctx context.Context, targetType string, target string) {
+	ipfsShell := bl.publicShell
+	cidStr := target
+	if targetType == blockTargetSHA256 {
+		if err := bl.db.QueryRowContext(ctx, `SELECT ipfs_cid FROM ipfs_blossom_mapping WHERE sha256 = ?`, target).Scan(&cidStr); err != nil {
+			return
+		}
+		if isPrivate, err := bl.private.IsPrivate(ctx, target); err == nil && isPrivate && bl.private.ipfsShell != nil {
+			ipfsShell = bl.private.ipfsShell
+		}
+	}
+
+	if err := ipfsShell.Unpin(cidStr); err != nil {
+		log.Printf("Failed to unpin blocked cid=%s: %v", cidStr, err)
+		return
+	}
+	log.Printf("Unpinned blocked cid=%s", cidStr)
+}
+
+// CheckUpload rejects blobs whose sha256 or (when CIDs are blocked) IPFS CID is on the blocklist
+func (bl *blocklist) CheckUpload(ctx context.Context, sha256 string, body []byte) error {
+	return bl.checkContent(ctx, sha256, bytes.NewReader(body))
+}
+
+// checkContent is CheckUpload for content that isn't held in memory
+// The content is only read when CIDs are blocked
+func (bl *blocklist) checkContent(ctx context.Context, sha256 string, content io.Reader) error {
+	if banned, err := isBlobBanned(ctx, bl.db, sha256); err != nil {
+		return fmt.Errorf("failed to check blob ban: %w", err)
+	} else if banned {
+		return errBlobBanned
+	}
+
+	var blockedCIDs int
+	if err := bl.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM banned_cids`).Scan(&blockedCIDs); err != nil {
+		return fmt.Errorf("failed to check blocked CIDs: %w", err)
+	}
+	if blockedCIDs == 0 {
+		return nil
+	}
+
+	// Only hash the content, so nothing is stored before the CID is checked
+	cidStr, err := bl.publicShell.Add(content, shell.OnlyHash(true))
+	if err != nil {
+		return fmt.Errorf("failed to compute CID: %w", err)
+	}
+	if banned, err := isCIDBanned(ctx, bl.db, cidStr); err != nil {
+		return fmt.Errorf("failed to check CID ban: %w", err)
+	} else if banned {
+		return errBlobBanned
+	}
+	return nil
+}
+
+// parseBlocklistEntry parses a blocklist entry: a sha256 or a CID, optionally followed by a reason
+func parseBlocklistEntry(line string) (string, string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", "", false
+	}
+	target, reason, _ := strings.Cut(line, " ")
+	reason = strings.TrimSpace(reason)
+
+	if nostr.IsValid32ByteHex(target) {
+		return blockTargetSHA256, strings.ToLower(target), reason, true
+	}
+	if normalized, err := normalizeCID(target); err == nil {
+		return blockTargetCID, normalized, reason, true
+	}
+	return "", "", "", false
+}
+
+// importFile imports a blocklist file with one sha256 or CID per line, optionally followed by a reason
+func (bl *blocklist) importFile(ctx context.Context, path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	imported := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		targetType, target, reason, ok := parseBlocklistEntry(scanner.Text())
+		if !ok {
+			continue
+		}
+		if reason == "" {
+			reason = "imported from " + path
+		}
+		added, err := bl.Block(ctx, targetType, target, reason, "import", "file:"+path)
+		if err != nil {
+			return imported, err
+		}
+		if added {
+			imported++
+		}
+	}
+	return imported, scanner.Err()
+}
+
+// importNostrList imports the latest version of a Nostr blocklist
+// Blobs are listed in "x" tags (sha256) and "cid" tags, with an optional reason as third element
+func (bl *blocklist) importNostrList(ctx context.Context, pointer nostr.EntityPointer) (int, error) {
+	filter := nostr.Filter{
+		Kinds:   []int{pointer.Kind},
+		Authors: []string{pointer.PublicKey},
+	}
+	if pointer.Identifier != "" {
+		filter.Tags = nostr.TagMap{"d": []string{pointer.Identifier}}
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, blocklistFetchTimeout)
+	defer cancel()
+
+	latest := make(map[string]*nostr.Event)
+	for ie := range bl.pool.FetchMany(fetchCtx, append(pointer.Relays, bl.relays...), filter) {
+		if ok, _ := ie.Event.CheckSignature(); ok {
+			keepLatestEvent(latest, ie.Event)
+		}
+	}
+	evt, ok := latest[pointer.PublicKey]
+	if !ok {
+		return 0, fmt.Errorf("list not found on relays")
+	}
+
+	source := "nostr:" + pointer.AsTagReference()
+	imported := 0
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || (tag[0] != "x" && tag[0] != "cid") {
+			continue
+		}
+		targetType, target, _, ok := parseBlocklistEntry(tag[1])
+		if !ok {
+			continue
+		}
+		reason := "imported from list " + pointer.AsTagReference()
+		if len(tag) >= 3 && tag[2] != "" {
+			reason = tag[2]
+		}
+		added, err := bl.Block(ctx, targetType, target, reason, evt.PubKey, source)
+		if err != nil {
+			return imported, err
+		}
+		if added {
+			imported++
+		}
+	}
+	return imported, nil
+}
+
+// Import imports every configured blocklist file and Nostr list
+// Imports only add entries; removing an entry from a shared list doesn't unblock it here
+func (bl *blocklist) Import(ctx context.Context) {
+	for _, path := range bl.files {
+		imported, err := bl.importFile(ctx, path)
+		if err != nil {
+			log.Printf("Failed to import blocklist file %s: %v", path, err)
+		}
+		if imported > 0 {
+			log.Printf("Imported %d blocklist entries from %s", imported, path)
+		}
+	}
+	for _, pointer := range bl.nostrLists {
+		imported, err := bl.importNostrList(ctx, pointer)
+		if err != nil {
+			log.Printf("Failed to import Nostr blocklist %s: %v", pointer.AsTagReference(), err)
+		}
+		if imported > 0 {
+			log.Printf("Imported %d blocklist entries from Nostr list %s", imported, pointer.AsTagReference())
+		}
+	}
+}
+
+// Start imports the configured blocklists immediately and then on every interval until ctx is done
+func (bl *blocklist) Start(ctx context.Context, interval time.Duration) {
+	if len(bl.files) == 0 && len(bl.nostrLists) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			bl.Import(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// blocklistMiddleware answers uploads of blocked blobs with 451. Uploads announcing a blocked
+// sha256 in the X-SHA-256 header are rejected before the body is read; while anything is blocked,
+// the body of every upload is spooled to disk and hashed before blossom gets to read it
+func blocklistMiddleware(next http.Handler, bl *blocklist) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if (r.Method == "PUT" || r.Method == "HEAD") && (path == "/upload" || path == "/media") {
+			if sha256 := strings.ToLower(r.Header.Get("X-SHA-256")); nostr.IsValid32ByteHex(sha256) {
+				if banned, err := isBlobBanned(r.Context(), bl.db, sha256); err == nil && banned {
+					w.Header().Set("X-Reason", errBlobBanned.Error())
+					w.WriteHeader(http.StatusUnavailableForLegalReasons)
+					return
+				}
+			}
+		}
+
+		// The optimized /media upload is checked against the original by the media optimizer
+		if r.Method == "PUT" && path == "/upload" && r.ContentLength > 0 {
+			var blocked bool
+			query := `SELECT EXISTS (SELECT 1 FROM banned_blobs) OR EXISTS (SELECT 1 FROM banned_cids)`
+			if err := bl.db.QueryRowContext(r.Context(), query).Scan(&blocked); err != nil {
+				log.Printf("Failed to check blocklist: %v", err)
+				w.Header().Set("X-Reason", "failed to check blocklist")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if blocked {
+				body, status, reason := bl.spoolUpload(r)
+				if status != 0 {
+					w.Header().Set("X-Reason", reason)
+					w.WriteHeader(status)
+					return
+				}
+				defer os.Remove(body.Name())
+				defer body.Close()
+				r.Body = body
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// spoolUpload copies the body of an upload to a temporary file while hashing it, and checks the
+// content against the blocklist. Returns the file, rewound for the next reader, or the HTTP status
+// and reason to reject the upload with
+func (bl *blocklist) spoolUpload(r *http.Request) (*os.File, int, string) {
+	tmp, err := os.CreateTemp("", "blossom-upload-*")
+	if err != nil {
+		log.Printf("Failed to spool upload: %v", err)
+		return nil, http.StatusInternalServerError, "failed to store upload"
+	}
+	reject := func(status int, reason string) (*os.File, int, string) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, status, reason
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(tmp, io.TeeReader(io.LimitReader(r.Body, r.ContentLength), hash)); err != nil {
+		return reject(http.StatusBadRequest, "failed to read upload body")
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return reject(http.StatusInternalServerError, "failed to read stored upload")
+	}
+	// Hide the file's Close from the IPFS client, which closes what it reads
+	if err := bl.checkContent(r.Context(), hex.EncodeToString(hash.Sum(nil)), struct{ io.Reader }{tmp}); err != nil {
+		if errors.Is(err, errBlobBanned) {
+			return reject(http.StatusUnavailableForLegalReasons, err.Error())
+		}
+		log.Printf("Failed to check upload against the blocklist: %v", err)
+		return reject(http.StatusInternalServerError, "failed to check blocklist")
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return reject(http.StatusInternalServerError, "failed to read stored upload")
+	}
+	return tmp, 0, ""
+}
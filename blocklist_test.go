@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// testBlockedCID is a CIDv1 used as a blocklist target
+var testBlockedCID = rawCID([]byte("blocked content"))
+
+func TestParseBlocklistEntry(t *testing.T) {
+	const sha = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	hash, _ := multihash.Sum([]byte("dag-pb content"), multihash.SHA2_256, -1)
+	cidV0 := cid.NewCidV0(hash).String()
+	cidV1 := cid.NewCidV1(cid.DagProtobuf, hash).String()
+
+	tests := []struct {
+		line       string
+		wantType   string
+		wantTarget string
+		wantReason string
+		wantOK     bool
+	}{
+		{line: sha + " csam report 123", wantType: blockTargetSHA256, wantTarget: sha, wantReason: "csam report 123", wantOK: true},
+		{line: "  " + sha, wantType: blockTargetSHA256, wantTarget: sha, wantOK: true},
+		{line: cidV0 + " malware", wantType: blockTargetCID, wantTarget: cidV1, wantReason: "malware", wantOK: true},
+		{line: cidV1, wantType: blockTargetCID, wantTarget: cidV1, wantOK: true},
+		{line: "# comment"},
+		{line: ""},
+		{line: "not-a-hash-or-cid spam"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			targetType, target, reason, ok := parseBlocklistEntry(tt.line)
+			if ok != tt.wantOK || targetType != tt.wantType || target != tt.wantTarget || reason != tt.wantReason {
+				t.Errorf("parseBlocklistEntry() = %q, %q, %q, %v, want %q, %q, %q, %v",
+					targetType, target, reason, ok, tt.wantType, tt.wantTarget, tt.wantReason, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestBlocklistImportFile(t *testing.T) {
+	_, db := newTestDB(t)
+	bl := newBlocklist(db, nil, &privateBlobs{db: db}, false, nil, nil, nil)
+	ctx := context.Background()
+	const sha = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	content := "# shared blocklist\n" + sha + " known abuse\n" + testBlockedCID + "\ngarbage\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write blocklist: %v", err)
+	}
+
+	imported, err := bl.importFile(ctx, path)
+	if err != nil || imported != 2 {
+		t.Fatalf("importFile() = %d, %v, want 2 entries", imported, err)
+	}
+	// Entries already on the blocklist aren't imported again
+	if imported, err := bl.importFile(ctx, path); err != nil || imported != 0 {
+		t.Errorf("second importFile() = %d, %v, want nothing new", imported, err)
+	}
+
+	if banned, _ := isBlobBanned(ctx, db, sha); !banned {
+		t.Errorf("sha256 from the file isn't banned")
+	}
+	if banned, _ := isCIDBanned(ctx, db, testBlockedCID); !banned {
+		t.Errorf("CID from the file isn't banned")
+	}
+
+	entries, err := bl.AuditLog(ctx, 10)
+	if err != nil {
+		t.Fatalf("AuditLog() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("audit log has %d entries, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Action != "block" || entry.Actor != "import" || entry.Source != "file:"+path {
+			t.Errorf("audit entry = %+v", entry)
+		}
+	}
+}
+
+func TestBlocklistCheckUpload(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("uploaded content")
+	hash := sha256.Sum256(content)
+	sha := hex.EncodeToString(hash[:])
+
+	tests := []struct {
+		name       string
+		targetType string
+		target     string
+		wantBanned bool
+	}{
+		{name: "not blocked"},
+		{name: "blocked sha256", targetType: blockTargetSHA256, target: sha, wantBanned: true},
+		{name: "blocked CID", targetType: blockTargetCID, target: rawCID(content), wantBanned: true},
+		{name: "other CID blocked", targetType: blockTargetCID, target: testBlockedCID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			node, ipfsShell := newFakeIPFS(t)
+			bl := newBlocklist(db, ipfsShell, &privateBlobs{db: db}, false, nil, nil, nil)
+			if tt.target != "" {
+				if _, err := bl.Block(ctx, tt.targetType, tt.target, "test", "admin", "test"); err != nil {
+					t.Fatalf("Block() error = %v", err)
+				}
+			}
+
+			err := bl.CheckUpload(ctx, sha, content)
+			if tt.wantBanned && !errors.Is(err, errBlobBanned) {
+				t.Errorf("CheckUpload() error = %v, want %v", err, errBlobBanned)
+			} else if !tt.wantBanned && err != nil {
+				t.Errorf("CheckUpload() error = %v", err)
+			}
+			// Computing the CID must not store the content
+			if _, stored := node.get(rawCID(content)); stored {
+				t.Errorf("content was stored while checking the upload")
+			}
+		})
+	}
+}
+
+func TestBlocklistUnpin(t *testing.T) {
+	_, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	bl := newBlocklist(db, ipfsShell, &privateBlobs{db: db}, true, nil, nil, nil)
+	ctx := context.Background()
+
+	content := []byte("content blocked after upload")
+	hash := sha256.Sum256(content)
+	sha := hex.EncodeToString(hash[:])
+	cidStr, err := storeBlobInIPFS(ctx, ipfsShell, db, sha, ".txt", content)
+	if err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+
+	if _, err := bl.Block(ctx, blockTargetSHA256, sha, "test", "admin", "test"); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+	if node.pinned(cidStr) {
+		t.Errorf("blocked blob is still pinned")
+	}
+}
+
+func TestBlocklistMiddleware(t *testing.T) {
+	bannedContent := []byte("banned content")
+	cidBannedContent := []byte("content banned by CID")
+	allowedContent := []byte("allowed content")
+	banned := sha256Hex(bannedContent)
+	allowed := sha256Hex(allowedContent)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		sha256     string
+		body       []byte
+		noBlocks   bool
+		wantStatus int
+	}{
+		{name: "banned upload", method: "PUT", path: "/upload", sha256: banned, body: bannedContent, wantStatus: http.StatusUnavailableForLegalReasons},
+		{name: "banned upload check", method: "HEAD", path: "/upload", sha256: strings.ToUpper(banned), wantStatus: http.StatusUnavailableForLegalReasons},
+		{name: "banned media upload", method: "PUT", path: "/media", sha256: banned, body: bannedContent, wantStatus: http.StatusUnavailableForLegalReasons},
+		{name: "allowed upload", method: "PUT", path: "/upload", sha256: allowed, body: allowedContent, wantStatus: http.StatusOK},
+		{name: "allowed upload without hash", method: "PUT", path: "/upload", body: allowedContent, wantStatus: http.StatusOK},
+		{name: "banned upload without hash", method: "PUT", path: "/upload", body: bannedContent, wantStatus: http.StatusUnavailableForLegalReasons},
+		{name: "banned upload announcing another hash", method: "PUT", path: "/upload", sha256: allowed, body: bannedContent, wantStatus: http.StatusUnavailableForLegalReasons},
+		{name: "upload banned by CID", method: "PUT", path: "/upload", body: cidBannedContent, wantStatus: http.StatusUnavailableForLegalReasons},
+		{name: "nothing blocked", method: "PUT", path: "/upload", body: bannedContent, noBlocks: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			_, ipfsShell := newFakeIPFS(t)
+			bl := newBlocklist(db, ipfsShell, &privateBlobs{db: db}, false, nil, nil, nil)
+			if !tt.noBlocks {
+				if _, err := bl.Block(context.Background(), blockTargetSHA256, banned, "test", "admin", "test"); err != nil {
+					t.Fatalf("Block() error = %v", err)
+				}
+				if _, err := bl.Block(context.Background(), blockTargetCID, rawCID(cidBannedContent), "test", "admin", "test"); err != nil {
+					t.Fatalf("Block() error = %v", err)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			if tt.sha256 != "" {
+				req.Header.Set("X-SHA-256", tt.sha256)
+			}
+			var received []byte
+			rec := httptest.NewRecorder()
+			blocklistMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received, _ = io.ReadAll(r.Body)
+			}), bl).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			// Accepted uploads reach blossom with their whole body
+			if rec.Code == http.StatusOK && !bytes.Equal(received, tt.body) {
+				t.Errorf("next handler read %q, want %q", received, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Blossom import progress states
+const (
+	blossomImportPending = "pending"
+	blossomImportDone    = "done"
+	blossomImportFailed  = "failed"
+)
+
+// blossomImportListPage is the page size requested from servers supporting paginated lists
+const blossomImportListPage = 1000
+
+// blossomImportMaxAttempts is how many times a failed blob is retried by later runs
+const blossomImportMaxAttempts = 3
+
+// blossomImporter copies the blobs of pubkeys from other Blossom servers: it lists them,
+// downloads and verifies each blob, stores it in IPFS and recreates its ownership
+// Progress is kept in blossom_imports, so an interrupted import continues where it stopped
+type blossomImporter struct {
+	db          *sql.DB
+	publicShell *shell.Shell
+	store       blossom.BlobIndex
+	blocks      *blocklist
+	previews    *previewGenerator
+	metadata    *fileMetadataPublisher
+	mirror      *blobMirror
+}
+
+// blossomImportJob is a blob of a pubkey to import from a server
+type blossomImportJob struct {
+	server     string
+	pubkey     string
+	sha256     string
+	url        string
+	blobType   string
+	uploadedAt int64
+}
+
+// blossomImportResult counts the outcome of an import run
+type blossomImportResult struct {
+	Imported int
+	Failed   int
+}
+
+// createBlossomImportTable creates the table tracking the progress of Blossom imports if it doesn't exist
+func createBlossomImportTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS blossom_imports (
+		server TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		url TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT '',
+		uploaded_at INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (server, pubkey, sha256)
+	);
+	CREATE INDEX IF NOT EXISTS idx_blossom_imports_status ON blossom_imports (status);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// Run imports the blobs of the pubkeys from the servers with at most concurrency downloads at once
+// Servers that can't be listed are skipped, but blobs already queued from them are still imported
+func (bi *blossomImporter) Run(ctx context.Context, servers []string, pubkeys []string, concurrency int) (blossomImportResult, error) {
+	var result blossomImportResult
+	for _, server := range servers {
+		for _, pubkey := range pubkeys {
+			queued, err := bi.queue(ctx, server, pubkey)
+			if err != nil {
+				log.Printf("Failed to list blobs of %s on %s: %v", pubkey, server, err)
+				continue
+			}
+			log.Printf("Listed %d blobs of %s on %s", queued, pubkey, server)
+		}
+	}
+
+	jobs, err := bi.pendingJobs(ctx, servers, pubkeys)
+	if err != nil {
+		return result, err
+	}
+	log.Printf("Importing %d blobs with %d workers", len(jobs), concurrency)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan blossomImportJob)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range ch {
+				err := bi.importBlob(ctx, job)
+				if err := bi.record(ctx, job, err); err != nil {
+					log.Printf("Failed to record import progress of sha256=%s: %v", job.sha256, err)
+				}
+
+				mu.Lock()
+				if err != nil {
+					log.Printf("Failed to import sha256=%s of %s from %s: %v", job.sha256, job.pubkey, job.server, err)
+					result.Failed++
+				} else {
+					result.Imported++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		ch <- job
+	}
+	close(ch)
+	wg.Wait()
+
+	log.Printf("Blossom import finished: %d imported, %d failed", result.Imported, result.Failed)
+	return result, ctx.Err()
+}
+
+// queue lists the blobs of a pubkey on a server and records the ones not seen before as pending
+func (bi *blossomImporter) queue(ctx context.Context, server string, pubkey string) (int, error) {
+	queued := 0
+	seen := make(map[string]bool)
+	cursor := ""
+	for {
+		descriptors, err := bi.list(ctx, server, pubkey, cursor)
+		if err != nil {
+			return queued, err
+		}
+
+		added := 0
+		for _, descriptor := range descriptors {
+			sha256 := strings.ToLower(descriptor.SHA256)
+			if !nostr.IsValid32ByteHex(sha256) || seen[sha256] {
+				continue
+			}
+			seen[sha256] = true
+			added++
+
+			blobURL := descriptor.URL
+			if blobURL == "" {
+				blobURL = server + "/" + sha256
+			}
+			query := `
+			INSERT OR IGNORE INTO blossom_imports (server, pubkey, sha256, url, type, uploaded_at, status, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+			result, err := bi.db.ExecContext(ctx, query, server, pubkey, sha256, blobURL, descriptor.Type, int64(descriptor.Uploaded), blossomImportPending, time.Now().Unix())
+			if err != nil {
+				return queued, fmt.Errorf("failed to queue sha256=%s: %w", sha256, err)
+			}
+			if affected, _ := result.RowsAffected(); affected > 0 {
+				queued++
+			}
+		}
+
+		// Servers without pagination return everything at once and ignore the cursor
+		if len(descriptors) < blossomImportListPage || added == 0 {
+			return queued, nil
+		}
+		cursor = descriptors[len(descriptors)-1].SHA256
+	}
+}
+
+// list fetches a page of the BUD-02 blob list of a pubkey from a server
+func (bi *blossomImporter) list(ctx context.Context, server string, pubkey string, cursor string) ([]blossom.BlobDescriptor, error) {
+	listURL := fmt.Sprintf("%s/list/%s?limit=%d", server, pubkey, blossomImportListPage)
+	if cursor != "" {
+		listURL += "&cursor=" + url.QueryEscape(cursor)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", listURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := bi.mirror.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	var descriptors []blossom.BlobDescriptor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&descriptors); err != nil {
+		return nil, fmt.Errorf("invalid list response: %w", err)
+	}
+	return descriptors, nil
+}
+
+// pendingJobs returns the blobs of the pubkeys on the servers that still have to be imported
+func (bi *blossomImporter) pendingJobs(ctx context.Context, servers []string, pubkeys []string) ([]blossomImportJob, error) {
+	query := `
+	SELECT server, pubkey, sha256, url, type, uploaded_at FROM blossom_imports
+	WHERE status != ? AND attempts < ?
+	ORDER BY server, pubkey, uploaded_at`
+	rows, err := bi.db.QueryContext(ctx, query, blossomImportDone, blossomImportMaxAttempts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query import progress: %w", err)
+	}
+	defer rows.Close()
+
+	wantServer := make(map[string]bool)
+	for _, server := range servers {
+		wantServer[server] = true
+	}
+	wantPubkey := make(map[string]bool)
+	for _, pubkey := range pubkeys {
+		wantPubkey[pubkey] = true
+	}
+
+	var jobs []blossomImportJob
+	for rows.Next() {
+		var job blossomImportJob
+		if err := rows.Scan(&job.server, &job.pubkey, &job.sha256, &job.url, &job.blobType, &job.uploadedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan import progress: %w", err)
+		}
+		if wantServer[job.server] && wantPubkey[job.pubkey] {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, rows.Err()
+}
+
+// importBlob downloads, verifies and stores a blob unless it is already stored, then records its owner
+func (bi *blossomImporter) importBlob(ctx context.Context, job blossomImportJob) error {
+	existingCID, err := lookupBlobCID(ctx, bi.db, job.sha256)
+	if err != nil {
+		return err
+	}
+
+	var ext string
+	size := 0
+	if existingCID != "" {
+		bi.db.QueryRowContext(ctx, `SELECT COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, job.sha256).Scan(&ext)
+		if existing, err := bi.store.Get(ctx, job.sha256); err == nil && existing != nil {
+			size = existing.Size
+		}
+	} else {
+		body, hash, contentType, err := bi.mirror.download(ctx, job.url)
+		if err != nil {
+			return fmt.Errorf("failed to download: %w", err)
+		}
+		if hash != job.sha256 {
+			return errors.New("content doesn't match sha256")
+		}
+		if err := bi.blocks.CheckUpload(ctx, job.sha256, body); err != nil {
+			return err
+		}
+
+		// Declared extension from the listed type, the origin's Content-Type or the URL, checked against the sniffed type
+		declaredExt := ""
+		if parsed, err := url.Parse(job.url); err == nil {
+			declaredExt = path.Ext(parsed.Path)
+		}
+		for _, declaredType := range []string{contentType, job.blobType} {
+			if declaredType == "" {
+				continue
+			}
+			if exts, _ := mime.ExtensionsByType(baseMIMEType(declaredType)); len(exts) > 0 {
+				declaredExt = exts[0]
+			}
+		}
+		ext = normalizeExtension(sniffContentType(body), declaredExt)
+		size = len(body)
+
+		if _, err := storeBlobInIPFS(ctx, bi.publicShell, bi.db, job.sha256, ext, body); err != nil {
+			return err
+		}
+		if err := bi.previews.Generate(ctx, job.sha256, ext, body); err != nil {
+			log.Printf("Failed to generate previews for sha256=%s: %v", job.sha256, err)
+		}
+		if bi.metadata != nil {
+			if err := bi.metadata.Publish(ctx, job.sha256, ext, len(body)); err != nil {
+				log.Printf("Failed to publish file metadata for sha256=%s: %v", job.sha256, err)
+			}
+		}
+	}
+
+	uploadedAt := job.uploadedAt
+	if uploadedAt == 0 {
+		uploadedAt = time.Now().Unix()
+	}
+	descriptor := blossom.BlobDescriptor{
+		SHA256:   job.sha256,
+		Size:     size,
+		Type:     typeForExtension(ext),
+		Uploaded: nostr.Timestamp(uploadedAt),
+	}
+	return keepImportedOwner(ctx, bi.db, bi.store, descriptor, job.pubkey)
+}
+
+// record stores the outcome of importing a blob
+func (bi *blossomImporter) record(ctx context.Context, job blossomImportJob, importErr error) error {
+	status, errMsg := blossomImportDone, ""
+	if importErr != nil {
+		status, errMsg = blossomImportFailed, importErr.Error()
+	}
+	query := `
+	UPDATE blossom_imports SET status = ?, error = ?, attempts = attempts + 1, updated_at = ?
+	WHERE server = ? AND pubkey = ? AND sha256 = ?`
+	// Progress is recorded even if the run is being interrupted
+	_, err := bi.db.ExecContext(context.WithoutCancel(ctx), query, status, errMsg, time.Now().Unix(), job.server, job.pubkey, job.sha256)
+	return err
+}
+
+// parseImportServers parses a comma-separated list of Blossom server URLs
+func parseImportServers(value string) ([]string, error) {
+	var servers []string
+	for _, server := range strings.Split(value, ",") {
+		server = strings.TrimRight(strings.TrimSpace(server), "/")
+		if server == "" {
+			continue
+		}
+		parsed, err := url.Parse(server)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("server %q must be an absolute http(s) URL", server)
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no servers given")
+	}
+	return servers, nil
+}
+
+// runBlossomImportCommand runs the import-blossom command given on the command line
+func runBlossomImportCommand(ctx context.Context, bi *blossomImporter, args []string) error {
+	fs := flag.NewFlagSet("import-blossom", flag.ExitOnError)
+	serversFlag := fs.String("servers", "", "comma-separated list of Blossom server URLs to import from")
+	pubkeysFlag := fs.String("pubkeys", "", "comma-separated list of pubkeys (npub or hex) whose blobs are imported")
+	concurrency := fs.Int("concurrency", 4, "number of blobs downloaded at once")
+	fs.Parse(args)
+
+	servers, err := parseImportServers(*serversFlag)
+	if err != nil {
+		return err
+	}
+	pubkeySet, err := parsePubkeyWhitelist(*pubkeysFlag)
+	if err != nil {
+		return err
+	}
+	if len(pubkeySet) == 0 {
+		return errors.New("no pubkeys given")
+	}
+	pubkeys := make([]string, 0, len(pubkeySet))
+	for pubkey := range pubkeySet {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	if *concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	result, err := bi.Run(ctx, servers, pubkeys, *concurrency)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d blobs, %d failed\n", result.Imported, result.Failed)
+	return nil
+}
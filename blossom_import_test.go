@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseImportServers(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "https://a.example.com", want: []string{"https://a.example.com"}},
+		{input: " https://a.example.com/ ,http://b.example.com:3000,", want: []string{"https://a.example.com", "http://b.example.com:3000"}},
+		{input: "", wantErr: true},
+		{input: "a.example.com", wantErr: true},
+		{input: "ftp://a.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseImportServers(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseImportServers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseImportServers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlossomImporterRun(t *testing.T) {
+	ctx := context.Background()
+	store, db := newTestDB(t)
+	if err := createBlossomImportTable(db); err != nil {
+		t.Fatalf("createBlossomImportTable() error = %v", err)
+	}
+	node, ipfsShell := newFakeIPFS(t)
+	_, alice := newTestKey(t)
+
+	good := []byte("blob to import")
+	image := encodeTestImage(t, "png", 20, 20)
+	banned := []byte("banned blob to import")
+	tampered := []byte("content the origin swaps")
+	uploaded := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+
+	// The origin serves blobs by hash, except the tampered one which it answers with other bytes
+	var downloads atomic.Int32
+	mux := http.NewServeMux()
+	origin := httptest.NewServer(mux)
+	t.Cleanup(origin.Close)
+	content := map[string][]byte{
+		sha256Hex(good):     good,
+		sha256Hex(image):    image,
+		sha256Hex(banned):   banned,
+		sha256Hex(tampered): []byte("something else"),
+	}
+	mux.HandleFunc("/list/"+alice, func(w http.ResponseWriter, r *http.Request) {
+		descriptors := []blossom.BlobDescriptor{
+			{URL: origin.URL + "/" + sha256Hex(good) + ".txt", SHA256: sha256Hex(good), Type: "text/plain", Uploaded: nostr.Timestamp(uploaded)},
+			{SHA256: sha256Hex(image), Type: "image/png"},
+			{SHA256: sha256Hex(banned)},
+			{SHA256: sha256Hex(tampered)},
+			{SHA256: "not a hash"},
+		}
+		json.NewEncoder(w).Encode(descriptors)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		data, ok := content[strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), ".", 2)[0]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		downloads.Add(1)
+		w.Write(data)
+	})
+
+	index := usageTrackingIndex{BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://blossom.example.com"}, db: db}
+	blocks := newBlocklist(db, ipfsShell, &privateBlobs{db: db}, false, nil, nil, nil)
+	if _, err := blocks.Block(ctx, blockTargetSHA256, sha256Hex(banned), "test", "admin", "test"); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+	importer := &blossomImporter{
+		db:          db,
+		publicShell: ipfsShell,
+		store:       index,
+		blocks:      blocks,
+		previews:    newPreviewGenerator(db, ipfsShell, []int{8}, 1_000_000),
+		mirror:      newBlobMirror(nil, 1<<20, 10*time.Second, true),
+	}
+
+	// Failed blobs are retried by later runs until they reach the maximum attempts
+	runs := []struct {
+		wantResult    blossomImportResult
+		wantDownloads int32
+	}{
+		{wantResult: blossomImportResult{Imported: 2, Failed: 2}, wantDownloads: 4},
+		{wantResult: blossomImportResult{Failed: 2}, wantDownloads: 2},
+		{wantResult: blossomImportResult{Failed: 2}, wantDownloads: 2},
+		{wantDownloads: 0},
+	}
+	for i, run := range runs {
+		downloads.Store(0)
+		result, err := importer.Run(ctx, []string{origin.URL}, []string{alice}, 2)
+		if err != nil {
+			t.Fatalf("run %d: Run() error = %v", i, err)
+		}
+		if result != run.wantResult || downloads.Load() != run.wantDownloads {
+			t.Errorf("run %d: result = %+v with %d downloads, want %+v with %d", i, result, downloads.Load(), run.wantResult, run.wantDownloads)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		sha256     string
+		wantStored bool
+		wantType   string
+		wantStatus string
+	}{
+		{name: "listed with url", sha256: sha256Hex(good), wantStored: true, wantType: "text/plain", wantStatus: blossomImportDone},
+		{name: "listed without url", sha256: sha256Hex(image), wantStored: true, wantType: "image/png", wantStatus: blossomImportDone},
+		{name: "banned", sha256: sha256Hex(banned), wantStatus: blossomImportFailed},
+		{name: "tampered", sha256: sha256Hex(tampered), wantStatus: blossomImportFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status string
+			var attempts int
+			query := `SELECT status, attempts FROM blossom_imports WHERE sha256 = ?`
+			if err := db.QueryRow(query, tt.sha256).Scan(&status, &attempts); err != nil {
+				t.Fatalf("failed to read import progress: %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", status, tt.wantStatus)
+			}
+
+			cidStr, _ := lookupBlobCID(ctx, db, tt.sha256)
+			if (cidStr != "" && node.pinned(cidStr)) != tt.wantStored {
+				t.Fatalf("blob stored = %v, want %v", cidStr != "", tt.wantStored)
+			}
+			descriptor, err := index.Get(ctx, tt.sha256)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if (descriptor != nil) != tt.wantStored {
+				t.Fatalf("owner recorded = %v, want %v", descriptor != nil, tt.wantStored)
+			}
+			if !tt.wantStored {
+				return
+			}
+			if descriptor.Type != tt.wantType {
+				t.Errorf("type = %q, want %q", descriptor.Type, tt.wantType)
+			}
+			var uploadedAt int64
+			db.QueryRow(`SELECT uploaded_at FROM blob_usage WHERE pubkey = ? AND sha256 = ?`, alice, tt.sha256).Scan(&uploadedAt)
+			if tt.sha256 == sha256Hex(good) && uploadedAt != uploaded {
+				t.Errorf("uploaded_at = %d, want the original upload time %d", uploadedAt, uploaded)
+			}
+		})
+	}
+
+	if thumbs, _ := blobThumbnails(ctx, db, sha256Hex(image)); len(thumbs) != 1 {
+		t.Errorf("imported image has %d thumbnails, want 1", len(thumbs))
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/multiformats/go-multihash"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// cidLookup resolves public blobs between their Blossom sha256 and their IPFS CID,
+// and serves them by CID under /ipfs/. Private blobs are never resolved, since their CIDs are not handed out
+type cidLookup struct {
+	server      *blossom.BlossomServer
+	db          *sql.DB
+	private     *privateBlobs
+	publicShell *shell.Shell
+	gatewayURL  string
+	retention   *retentionPolicy
+}
+
+// cidForms returns the strings a CID may be stored as in the mapping table:
+// the CIDv1 base32 form and, for dag-pb sha2-256 content, the CIDv0 form
+func cidForms(cidStr string) ([]string, error) {
+	c, err := cid.Decode(strings.TrimSpace(cidStr))
+	if err != nil {
+		return nil, err
+	}
+	forms := []string{cid.NewCidV1(c.Type(), c.Hash()).String()}
+	if c.Type() == cid.DagProtobuf {
+		if decoded, err := multihash.Decode(c.Hash()); err == nil && decoded.Code == multihash.SHA2_256 {
+			forms = append(forms, cid.NewCidV0(c.Hash()).String())
+		}
+	}
+	return forms, nil
+}
+
+// lookupBlobByCID returns the sha256 of the blob stored under any of the forms of a CID,
+// or an empty string if no blob maps to it
+func lookupBlobByCID(ctx context.Context, db *sql.DB, forms []string) (string, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(forms)), ",")
+	args := make([]interface{}, len(forms))
+	for i, form := range forms {
+		args[i] = form
+	}
+
+	var sha256 string
+	query := `SELECT sha256 FROM ipfs_blossom_mapping WHERE ipfs_cid IN (` + placeholders + `) ORDER BY created_at LIMIT 1`
+	err := db.QueryRowContext(ctx, query, args...).Scan(&sha256)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query mapping: %w", err)
+	}
+	return sha256, nil
+}
+
+// checkServable answers the request and returns false when a blob must not be resolved:
+// it is private, banned or quarantined
+func (cl *cidLookup) checkServable(w http.ResponseWriter, r *http.Request, sha256 string) bool {
+	if private, err := cl.private.IsPrivate(r.Context(), sha256); err != nil {
+		w.Header().Set("X-Reason", "failed to check blob visibility")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	} else if private {
+		w.Header().Set("X-Reason", "blob not found")
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	if banned, err := isBlobBanned(r.Context(), cl.db, sha256); err == nil && banned {
+		w.Header().Set("X-Reason", errBlobBanned.Error())
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+		return false
+	}
+	if quarantined, err := isBlobQuarantined(r.Context(), cl.db, sha256); err == nil && quarantined {
+		w.Header().Set("X-Reason", "blob is quarantined pending review")
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// serveByCID handles GET /cid/<cid>: clients asking for JSON get the blob descriptor,
+// others are redirected to the blob URL
+func (cl *cidLookup) serveByCID(w http.ResponseWriter, r *http.Request, cidStr string) {
+	forms, err := cidForms(cidStr)
+	if err != nil {
+		w.Header().Set("X-Reason", "invalid cid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sha256, err := lookupBlobByCID(r.Context(), cl.db, forms)
+	if err != nil {
+		log.Printf("Failed to look up cid=%s: %v", cidStr, err)
+		w.Header().Set("X-Reason", "failed to look up cid")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if sha256 == "" {
+		w.Header().Set("X-Reason", "no blob with this cid")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if banned, err := isCIDBanned(r.Context(), cl.db, cidStr); err == nil && banned {
+		w.Header().Set("X-Reason", errBlobBanned.Error())
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+		return
+	}
+	if !cl.checkServable(w, r, sha256) {
+		return
+	}
+
+	if r.Method == "GET" {
+		cl.retention.RecordAccess(r.Context(), sha256)
+	}
+
+	var ipfsCID, ext string
+	cl.db.QueryRowContext(r.Context(), `SELECT ipfs_cid, COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&ipfsCID, &ext)
+
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Redirect(w, r, requestBaseURL(r)+"/"+sha256+ext, http.StatusFound)
+		return
+	}
+
+	existing, err := cl.server.Store.Get(r.Context(), sha256)
+	if err != nil || existing == nil {
+		w.Header().Set("X-Reason", "blob not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	descriptor := map[string]interface{}{
+		"url":      cl.gatewayBlobURL(ipfsCID, ext),
+		"sha256":   sha256,
+		"size":     existing.Size,
+		"type":     existing.Type,
+		"uploaded": existing.Uploaded,
+		"cid":      ipfsCID,
+	}
+	addBlobPreviews(r.Context(), cl.db, cl.gatewayURL, descriptor)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(descriptor)
+}
+
+// serveCID handles GET /<sha256>/cid, returning the CID of a blob with its pin status and gateway URLs
+func (cl *cidLookup) serveCID(w http.ResponseWriter, r *http.Request, sha256 string) {
+	var ipfsCID, ext string
+	err := cl.db.QueryRowContext(r.Context(), `SELECT ipfs_cid, COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&ipfsCID, &ext)
+	if err == sql.ErrNoRows {
+		w.Header().Set("X-Reason", "blob not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up cid for sha256=%s: %v", sha256, err)
+		w.Header().Set("X-Reason", "failed to look up cid")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !cl.checkServable(w, r, sha256) {
+		return
+	}
+
+	forms, err := cidForms(ipfsCID)
+	if err != nil {
+		log.Printf("Stored cid=%s of sha256=%s is invalid: %v", ipfsCID, sha256, err)
+		w.Header().Set("X-Reason", "stored cid is invalid")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	gatewayURLs := make([]string, len(forms))
+	for i, form := range forms {
+		gatewayURLs[i] = cl.gatewayBlobURL(form, ext)
+	}
+	response := map[string]interface{}{
+		"sha256":       sha256,
+		"cid":          ipfsCID,
+		"cidv1":        forms[0],
+		"url":          cl.gatewayBlobURL(ipfsCID, ext),
+		"gateway_urls": gatewayURLs,
+	}
+	if len(forms) > 1 {
+		response["cidv0"] = forms[1]
+	}
+	if pinned, err := isPinned(r.Context(), cl.publicShell, ipfsCID); err != nil {
+		log.Printf("Failed to check pin status of cid=%s: %v", ipfsCID, err)
+	} else {
+		response["pinned"] = pinned
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// gatewayBlobURL builds the public gateway URL of a CID with the blob's filename
+func (cl *cidLookup) gatewayBlobURL(cidStr string, ext string) string {
+	gatewayURL := cl.gatewayURL + cidStr
+	if ext != "" {
+		gatewayURL += "?filename=" + url.QueryEscape("file"+ext)
+	}
+	return gatewayURL
+}
+
+// isPinned reports whether a CID is pinned on an IPFS node
+func isPinned(ctx context.Context, ipfsShell *shell.Shell, cidStr string) (bool, error) {
+	var raw struct{ Keys map[string]shell.PinInfo }
+	err := ipfsShell.Request("pin/ls", cidStr).Exec(ctx, &raw)
+	if err != nil {
+		if strings.Contains(err.Error(), "not pinned") {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(raw.Keys) > 0, nil
+}
+
+// cidLookupMiddleware serves GET /cid/<cid> and GET /<sha256>/cid
+func cidLookupMiddleware(next http.Handler, cl *cidLookup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := r.URL.Path
+		switch {
+		case strings.HasPrefix(path, "/cid/"):
+			cl.serveByCID(w, r, strings.TrimPrefix(path, "/cid/"))
+
+		case len(path) == 69 && strings.HasSuffix(path, "/cid") && nostr.IsValid32ByteHex(strings.ToLower(path[1:65])):
+			cl.serveCID(w, r, strings.ToLower(path[1:65]))
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCIDForms(t *testing.T) {
+	hash, _ := multihash.Sum([]byte("dag-pb content"), multihash.SHA2_256, -1)
+	cidV0 := cid.NewCidV0(hash).String()
+	cidV1 := cid.NewCidV1(cid.DagProtobuf, hash).String()
+	raw := rawCID([]byte("raw content"))
+
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "CIDv0", input: cidV0, want: []string{cidV1, cidV0}},
+		{name: "dag-pb CIDv1", input: " " + cidV1, want: []string{cidV1, cidV0}},
+		{name: "raw CIDv1", input: raw, want: []string{raw}},
+		{name: "invalid", input: "not-a-cid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cidForms(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cidForms() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("cidForms() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCIDLookupMiddleware(t *testing.T) {
+	const gatewayURL = "https://gateway.example.com/ipfs/"
+	ctx := context.Background()
+	store, db := newTestDB(t)
+	_, ipfsShell := newFakeIPFS(t)
+	_, pubkey := newTestKey(t)
+	server := &blossom.BlossomServer{
+		ServiceURL: "https://blossom.example.com",
+		Store:      blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://blossom.example.com"},
+	}
+
+	blobs := map[string][]byte{
+		"public":      []byte("public blob"),
+		"private":     []byte("private blob"),
+		"banned":      []byte("banned blob"),
+		"quarantined": []byte("quarantined blob"),
+		"unpinned":    []byte("unpinned blob"),
+	}
+	cids := make(map[string]string)
+	for name, content := range blobs {
+		sha := sha256Hex(content)
+		c, err := storeBlobInIPFS(ctx, ipfsShell, db, sha, ".txt", content)
+		if err != nil {
+			t.Fatalf("storeBlobInIPFS() error = %v", err)
+		}
+		cids[name] = c
+		blob := blossom.BlobDescriptor{SHA256: sha, Size: len(content), Type: "text/plain", Uploaded: nostr.Now()}
+		if err := server.Store.Keep(ctx, blob, pubkey); err != nil {
+			t.Fatalf("Keep() error = %v", err)
+		}
+	}
+	private := &privateBlobs{db: db}
+	if err := private.MarkPrivate(ctx, sha256Hex(blobs["private"])); err != nil {
+		t.Fatalf("MarkPrivate() error = %v", err)
+	}
+	for query, args := range map[string][]any{
+		`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`:                {sha256Hex(blobs["banned"]), "test"},
+		`INSERT INTO blob_reviews (sha256, status, updated_at) VALUES (?, ?, 0)`: {sha256Hex(blobs["quarantined"]), reviewQuarantined},
+	} {
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatalf("failed to set up blob state: %v", err)
+		}
+	}
+	if err := ipfsShell.Unpin(cids["unpinned"]); err != nil {
+		t.Fatalf("Unpin() error = %v", err)
+	}
+
+	handler := cidLookupMiddleware(http.NotFoundHandler(), &cidLookup{server: server, db: db, private: private, publicShell: ipfsShell, gatewayURL: gatewayURL})
+
+	tests := []struct {
+		name         string
+		path         string
+		accept       string
+		wantStatus   int
+		wantLocation string
+		wantSHA256   string
+		wantPinned   any
+	}{
+		// Redirects follow the host the request was made to, not the configured service URL
+		{name: "cid redirects", path: "/cid/" + cids["public"], wantStatus: http.StatusFound, wantLocation: "https://example.com/" + sha256Hex(blobs["public"]) + ".txt"},
+		{name: "cid descriptor", path: "/cid/" + cids["public"], accept: "application/json", wantStatus: http.StatusOK, wantSHA256: sha256Hex(blobs["public"])},
+		{name: "unknown cid", path: "/cid/" + rawCID([]byte("unknown")), wantStatus: http.StatusNotFound},
+		{name: "invalid cid", path: "/cid/nonsense", wantStatus: http.StatusBadRequest},
+		{name: "private cid", path: "/cid/" + cids["private"], wantStatus: http.StatusNotFound},
+		{name: "banned cid", path: "/cid/" + cids["banned"], wantStatus: http.StatusUnavailableForLegalReasons},
+		{name: "quarantined cid", path: "/cid/" + cids["quarantined"], wantStatus: http.StatusForbidden},
+		{name: "sha256 lookup", path: "/" + sha256Hex(blobs["public"]) + "/cid", wantStatus: http.StatusOK, wantSHA256: sha256Hex(blobs["public"]), wantPinned: true},
+		{name: "uppercase sha256 lookup", path: "/" + strings.ToUpper(sha256Hex(blobs["public"])) + "/cid", wantStatus: http.StatusOK, wantSHA256: sha256Hex(blobs["public"]), wantPinned: true},
+		{name: "unpinned sha256 lookup", path: "/" + sha256Hex(blobs["unpinned"]) + "/cid", wantStatus: http.StatusOK, wantSHA256: sha256Hex(blobs["unpinned"]), wantPinned: false},
+		{name: "unknown sha256", path: "/" + sha256Hex([]byte("unknown")) + "/cid", wantStatus: http.StatusNotFound},
+		{name: "private sha256", path: "/" + sha256Hex(blobs["private"]) + "/cid", wantStatus: http.StatusNotFound},
+		{name: "banned sha256", path: "/" + sha256Hex(blobs["banned"]) + "/cid", wantStatus: http.StatusUnavailableForLegalReasons},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			if location := rec.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", location, tt.wantLocation)
+			}
+			if tt.wantSHA256 == "" {
+				return
+			}
+			var response map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+			}
+			if response["sha256"] != tt.wantSHA256 || response["pinned"] != tt.wantPinned {
+				t.Errorf("response = %v, want sha256 %s and pinned %v", response, tt.wantSHA256, tt.wantPinned)
+			}
+			if url, _ := response["url"].(string); !strings.HasPrefix(url, gatewayURL) {
+				t.Errorf("url = %q, want a gateway URL", url)
+			}
+		})
+	}
+}
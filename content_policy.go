@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/liamg/magic"
+)
+
+// sniffLength is the number of leading bytes inspected to detect the content type of an upload
+const sniffLength = 512
+
+// contentPolicy allows or denies uploads by sniffed MIME type and extension
+// Type patterns may use a "/*" wildcard subtype (e.g. "image/*"); deny rules win over allow rules
+type contentPolicy struct {
+	allowedTypes      []string
+	deniedTypes       []string
+	allowedExtensions map[string]bool
+	deniedExtensions  map[string]bool
+}
+
+// newContentPolicy builds a content policy from comma-separated type and extension lists
+func newContentPolicy(allowedTypes, deniedTypes, allowedExtensions, deniedExtensions string) *contentPolicy {
+	return &contentPolicy{
+		allowedTypes:      parseTypeList(allowedTypes),
+		deniedTypes:       parseTypeList(deniedTypes),
+		allowedExtensions: parseExtensionList(allowedExtensions),
+		deniedExtensions:  parseExtensionList(deniedExtensions),
+	}
+}
+
+// parseTypeList parses a comma-separated list of MIME types or wildcard patterns
+func parseTypeList(typesStr string) []string {
+	var types []string
+	for _, t := range strings.Split(typesStr, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// parseExtensionList parses a comma-separated list of extensions, with or without the leading dot
+func parseExtensionList(extsStr string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(extsStr, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[ext] = true
+	}
+	return exts
+}
+
+// Enabled reports whether any rule is configured
+func (cp *contentPolicy) Enabled() bool {
+	return len(cp.allowedTypes) > 0 || len(cp.deniedTypes) > 0 || len(cp.allowedExtensions) > 0 || len(cp.deniedExtensions) > 0
+}
+
+// Check returns a rejection reason if the MIME type or extension is not allowed, or "" if it is
+func (cp *contentPolicy) Check(mimeType string, ext string) string {
+	mimeType = baseMIMEType(mimeType)
+	ext = strings.ToLower(ext)
+
+	if matchesTypePattern(mimeType, cp.deniedTypes) {
+		return "content type " + mimeType + " is not allowed"
+	}
+	if ext != "" && cp.deniedExtensions[ext] {
+		return "file extension " + ext + " is not allowed"
+	}
+	if len(cp.allowedTypes) > 0 && !matchesTypePattern(mimeType, cp.allowedTypes) {
+		return "content type " + mimeType + " is not allowed"
+	}
+	if len(cp.allowedExtensions) > 0 && !cp.allowedExtensions[ext] {
+		return "file extension " + ext + " is not allowed"
+	}
+	return ""
+}
+
+// matchesTypePattern checks a MIME type against exact types and "type/*" wildcards
+func matchesTypePattern(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == mimeType || pattern == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseMIMEType strips parameters (e.g. "; charset=utf-8") and lowercases a MIME type
+func baseMIMEType(mimeType string) string {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// sniffContentType detects the MIME type of content from its leading bytes
+// Magic number lookup is tried first, falling back to the standard library sniffer
+func sniffContentType(head []byte) string {
+	if len(head) > sniffLength {
+		head = head[:sniffLength]
+	}
+	if ft, _ := magic.Lookup(head); ft != nil && ft.MIME != "" {
+		return baseMIMEType(ft.MIME)
+	}
+	return baseMIMEType(http.DetectContentType(head))
+}
+
+// extensionForType returns the canonical file extension for a MIME type
+func extensionForType(mimeType string) string {
+	switch baseMIMEType(mimeType) {
+	case "":
+		return ""
+	case "application/octet-stream":
+		return ".bin"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	case "video/mp4":
+		return ".mp4"
+	case "text/plain":
+		return ".txt"
+	case "text/html":
+		return ".html"
+	case "application/vnd.android.package-archive":
+		return ".apk"
+	}
+
+	exts, _ := mime.ExtensionsByType(mimeType)
+	if len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// typeForExtension returns the MIME type for a file extension, or application/octet-stream if unknown
+func typeForExtension(ext string) string {
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		return baseMIMEType(mimeType)
+	}
+	return "application/octet-stream"
+}
+
+// normalizeExtension picks the extension to store for a blob from its sniffed type
+// The declared extension is only kept where sniffing can't tell the difference:
+// APKs are zip files and most text formats sniff as text/plain
+func normalizeExtension(sniffedType string, declaredExt string) string {
+	declaredExt = strings.ToLower(declaredExt)
+	declaredType := typeForExtension(declaredExt)
+
+	switch {
+	case sniffedType == "application/zip" && declaredExt == ".apk":
+		return declaredExt
+	case sniffedType == "text/plain" && declaredType != "text/html" &&
+		(strings.HasPrefix(declaredType, "text/") || declaredType == "application/json"):
+		return declaredExt
+	}
+	return extensionForType(sniffedType)
+}
+
+// enforceContentPolicy wraps a handler to sniff the first bytes of PUT /upload and /media bodies
+// and reject disallowed content with 415 before it reaches the blossom handlers
+// Body-less uploads of stored blobs are left to the RejectUpload hooks, which see the stored type
+func enforceContentPolicy(next http.Handler, policy *contentPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || (r.URL.Path != "/upload" && r.URL.Path != "/media") || r.Body == nil || r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		head := make([]byte, sniffLength)
+		n, err := io.ReadFull(r.Body, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			w.Header().Set("X-Reason", "failed to read upload body: "+err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		head = head[:n]
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+		sniffedType := sniffContentType(head)
+		ext := normalizeExtension(sniffedType, extensionForType(r.Header.Get("Content-Type")))
+		if reason := policy.Check(sniffedType, ext); reason != "" {
+			log.Printf("Rejected upload by content policy: sniffed=%s declared=%s: %s", sniffedType, r.Header.Get("Content-Type"), reason)
+			w.Header().Set("X-Reason", reason)
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var (
+	testPNG  = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89"
+	testJPEG = "\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"
+	testHTML = "<!DOCTYPE html><html><body><script>alert(1)</script></body></html>"
+)
+
+func TestContentPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    *contentPolicy
+		mimeType  string
+		ext       string
+		wantAllow bool
+	}{
+		{name: "no rules", policy: newContentPolicy("", "", "", ""), mimeType: "text/html", ext: ".html", wantAllow: true},
+		{name: "allowed wildcard", policy: newContentPolicy("image/*", "", "", ""), mimeType: "image/png", ext: ".png", wantAllow: true},
+		{name: "outside allowed wildcard", policy: newContentPolicy("image/*", "", "", ""), mimeType: "text/html", ext: ".html"},
+		{name: "denied type", policy: newContentPolicy("", "text/html", "", ""), mimeType: "text/html; charset=utf-8", ext: ".html"},
+		{name: "denied type wins over allowed", policy: newContentPolicy("*/*", "application/x-msdownload", "", ""), mimeType: "application/x-msdownload", ext: ".exe"},
+		{name: "denied extension", policy: newContentPolicy("", "", "", "exe, .BAT"), mimeType: "application/octet-stream", ext: ".bat"},
+		{name: "allowed extension", policy: newContentPolicy("", "", ".png,jpg", ""), mimeType: "image/jpeg", ext: ".jpg", wantAllow: true},
+		{name: "outside allowed extensions", policy: newContentPolicy("", "", ".png,jpg", ""), mimeType: "image/gif", ext: ".gif"},
+		{name: "type case", policy: newContentPolicy("IMAGE/PNG", "", "", ""), mimeType: "image/png", ext: ".png", wantAllow: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := tt.policy.Check(tt.mimeType, tt.ext)
+			if (reason == "") != tt.wantAllow {
+				t.Errorf("Check(%q, %q) = %q, want allowed %v", tt.mimeType, tt.ext, reason, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestSniffAndNormalizeExtension(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		declaredExt string
+		wantType    string
+		wantExt     string
+	}{
+		{name: "png", content: testPNG, declaredExt: ".png", wantType: "image/png", wantExt: ".png"},
+		{name: "png declared as text", content: testPNG, declaredExt: ".txt", wantType: "image/png", wantExt: ".png"},
+		{name: "jpeg declared as gif", content: testJPEG, declaredExt: ".gif", wantType: "image/jpeg", wantExt: ".jpg"},
+		{name: "html declared as png", content: testHTML, declaredExt: ".png", wantType: "text/html", wantExt: ".html"},
+		{name: "plain text", content: "hello world", declaredExt: "", wantType: "text/plain", wantExt: ".txt"},
+		{name: "markdown keeps its extension", content: "# hello", declaredExt: ".md", wantType: "text/plain", wantExt: ".md"},
+		{name: "json keeps its extension", content: `{"a":1}`, declaredExt: ".json", wantType: "text/plain", wantExt: ".json"},
+		{name: "text can't claim to be html", content: "hello", declaredExt: ".html", wantType: "text/plain", wantExt: ".txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sniffed := sniffContentType([]byte(tt.content))
+			if sniffed != tt.wantType {
+				t.Errorf("sniffContentType() = %q, want %q", sniffed, tt.wantType)
+			}
+			if ext := normalizeExtension(sniffed, tt.declaredExt); ext != tt.wantExt {
+				t.Errorf("normalizeExtension(%q, %q) = %q, want %q", sniffed, tt.declaredExt, ext, tt.wantExt)
+			}
+		})
+	}
+}
+
+func TestEnforceContentPolicy(t *testing.T) {
+	policy := newContentPolicy("image/*", "", "", "")
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		wantPassed  bool
+	}{
+		{name: "allowed image", method: "PUT", path: "/upload", contentType: "image/png", body: testPNG, wantPassed: true},
+		{name: "html declared as image", method: "PUT", path: "/upload", contentType: "image/png", body: testHTML},
+		{name: "media upload", method: "PUT", path: "/media", contentType: "text/plain", body: "plain text"},
+		{name: "other path", method: "PUT", path: "/mirror", body: `{"url":"https://example.com/a.html"}`, wantPassed: true},
+		{name: "download", method: "GET", path: "/upload", wantPassed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			passed := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				passed = true
+				body, _ := io.ReadAll(r.Body)
+				received = string(body)
+			})
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			enforceContentPolicy(next, policy).ServeHTTP(rec, req)
+
+			if passed != tt.wantPassed {
+				t.Fatalf("passed = %v (status %d, %s), want %v", passed, rec.Code, rec.Header().Get("X-Reason"), tt.wantPassed)
+			}
+			if !passed && rec.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+			}
+			// The sniffed bytes are handed on with the rest of the body
+			if passed && received != tt.body {
+				t.Errorf("body = %q, want %q", received, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// claimableWithoutBody reports whether a stored blob may be uploaded without its body
+// Knowing a hash doesn't prove holding the content, and ownership grants access to private
+// blobs, so only public blobs that are served to anyone can be claimed by hash
+func claimableWithoutBody(ctx context.Context, db *sql.DB, private *privateBlobs, sha256 string) (bool, error) {
+	if isPrivate, err := private.IsPrivate(ctx, sha256); err != nil || isPrivate {
+		return false, err
+	}
+	if banned, err := isBlobBanned(ctx, db, sha256); err != nil || banned {
+		return false, err
+	}
+	if quarantined, err := isBlobQuarantined(ctx, db, sha256); err != nil || quarantined {
+		return false, err
+	}
+	return true, nil
+}
+
+// dedupUploadMiddleware accepts PUT /upload requests without a body for public blobs that are
+// already stored: the X-SHA-256 header names the blob and the uploader is recorded as a new owner.
+// Uploads with a body, of unknown blobs, or of private or quarantined blobs go to the blossom
+// handler as usual, which requires the body
+func dedupUploadMiddleware(next http.Handler, server *blossom.BlossomServer, db *sql.DB, private *privateBlobs) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sha256 := strings.ToLower(r.Header.Get("X-SHA-256"))
+		if r.Method != "PUT" || r.URL.Path != "/upload" || r.ContentLength != 0 || !nostr.IsValid32ByteHex(sha256) || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cid, err := lookupBlobCID(r.Context(), db, sha256)
+		if err != nil || cid == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if claimable, err := claimableWithoutBody(r.Context(), db, private, sha256); err != nil || !claimable {
+			next.ServeHTTP(w, r)
+			return
+		}
+		existing, err := server.Store.Get(r.Context(), sha256)
+		if err != nil || existing == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth, err := readBlossomAuth(r)
+		if err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if auth == nil {
+			w.Header().Set("X-Reason", "missing \"Authorization\" header")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if auth.Tags.FindWithValue("t", "upload") == nil {
+			w.Header().Set("X-Reason", "invalid \"Authorization\" event \"t\" tag")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// Without a body, the x tag is the only proof the uploader has the content
+		if auth.Tags.FindWithValue("x", sha256) == nil {
+			w.Header().Set("X-Reason", "\"Authorization\" event must have an \"x\" tag matching X-SHA-256")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var ext string
+		db.QueryRowContext(r.Context(), `SELECT COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&ext)
+
+		for _, reject := range server.RejectUpload {
+			if rejected, reason, code := reject(r.Context(), auth, existing.Size, ext); rejected {
+				w.Header().Set("X-Reason", reason)
+				w.WriteHeader(code)
+				return
+			}
+		}
+
+		descriptor := blossom.BlobDescriptor{
+			URL:      server.ServiceURL + "/" + sha256 + ext,
+			SHA256:   sha256,
+			Size:     existing.Size,
+			Type:     existing.Type,
+			Uploaded: nostr.Now(),
+		}
+		if err := server.Store.Keep(r.Context(), descriptor, auth.PubKey); err != nil {
+			w.Header().Set("X-Reason", "failed to save metadata: "+err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Deduplicated body-less upload: sha256=%s -> cid=%s for %s", sha256, cid, auth.PubKey)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(descriptor)
+	})
+}
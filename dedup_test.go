@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDedupUploadMiddleware(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	const unknown = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	tests := []struct {
+		name       string
+		hash       string // X-SHA-256 header, defaults to the stored blob
+		body       string
+		state      string // "private", "banned" or "quarantined"
+		authHash   string // x tag of the auth event, defaults to the stored blob
+		noAuth     bool
+		rejected   bool
+		wantPassed bool // the request goes to the blossom handler, which requires the body
+		wantStatus int
+		wantOwner  bool
+	}{
+		{name: "public blob claimed by hash", wantStatus: http.StatusOK, wantOwner: true},
+		{name: "upload with a body", body: "content", wantPassed: true},
+		{name: "unknown blob", hash: unknown, authHash: unknown, wantPassed: true},
+		{name: "private blob", state: "private", wantPassed: true},
+		{name: "banned blob", state: "banned", wantPassed: true},
+		{name: "quarantined blob", state: "quarantined", wantPassed: true},
+		{name: "missing authorization", noAuth: true, wantStatus: http.StatusUnauthorized},
+		{name: "x tag for another blob", authHash: unknown, wantStatus: http.StatusForbidden},
+		{name: "rejected uploader", rejected: true, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, db := newTestDB(t)
+			_, ipfsShell := newFakeIPFS(t)
+			_, owner := newTestKey(t)
+			sk, uploader := newTestKey(t)
+			ctx := context.Background()
+
+			server := &blossom.BlossomServer{
+				ServiceURL: "https://blossom.example.com",
+				Store: usageTrackingIndex{
+					BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://blossom.example.com"},
+					db:        db,
+				},
+			}
+			server.RejectUpload = append(server.RejectUpload, func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+				if tt.rejected {
+					return true, "pubkey is not allowed to upload", http.StatusForbidden
+				}
+				return false, "", 0
+			})
+			private := &privateBlobs{mode: privateModeOptIn, db: db, ipfsShell: ipfsShell}
+
+			// The blob is stored and owned by someone else
+			query := `INSERT INTO ipfs_blossom_mapping (sha256, ipfs_cid, extension) VALUES (?, ?, ?)`
+			if _, err := db.Exec(query, sha256, "bafkreifake", ".png"); err != nil {
+				t.Fatalf("failed to store mapping: %v", err)
+			}
+			blob := blossom.BlobDescriptor{SHA256: sha256, Size: 1024, Type: "image/png", Uploaded: nostr.Now()}
+			if err := server.Store.Keep(ctx, blob, owner); err != nil {
+				t.Fatalf("Keep() error = %v", err)
+			}
+			switch tt.state {
+			case "private":
+				if err := private.MarkPrivate(ctx, sha256); err != nil {
+					t.Fatalf("MarkPrivate() error = %v", err)
+				}
+			case "banned":
+				if _, err := db.Exec(`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`, sha256, "test"); err != nil {
+					t.Fatalf("failed to ban blob: %v", err)
+				}
+			case "quarantined":
+				query := `INSERT INTO blob_reviews (sha256, status, updated_at) VALUES (?, ?, ?)`
+				if _, err := db.Exec(query, sha256, reviewQuarantined, nostr.Now()); err != nil {
+					t.Fatalf("failed to quarantine blob: %v", err)
+				}
+			}
+
+			passed := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				passed = true
+			})
+
+			hash, authHash := tt.hash, tt.authHash
+			if hash == "" {
+				hash = sha256
+			}
+			if authHash == "" {
+				authHash = sha256
+			}
+			req := httptest.NewRequest("PUT", "/upload", strings.NewReader(tt.body))
+			req.Header.Set("X-SHA-256", hash)
+			if !tt.noAuth {
+				req.Header.Set("Authorization", blossomAuthHeader(t, sk, "upload", nostr.Tag{"x", authHash}))
+			}
+			rec := httptest.NewRecorder()
+			dedupUploadMiddleware(next, server, db, private).ServeHTTP(rec, req)
+
+			if passed != tt.wantPassed {
+				t.Fatalf("passed to the blossom handler = %v, want %v", passed, tt.wantPassed)
+			}
+			if !tt.wantPassed && rec.Code != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+
+			var owned bool
+			err := db.QueryRow(`SELECT 1 FROM blob_usage WHERE pubkey = ? AND sha256 = ?`, uploader, sha256).Scan(&owned)
+			if err != nil && err != sql.ErrNoRows {
+				t.Fatalf("failed to query usage: %v", err)
+			}
+			if owned != tt.wantOwner {
+				t.Errorf("uploader owns the blob = %v, want %v", owned, tt.wantOwner)
+			}
+		})
+	}
+}
+
+func TestEnforceContentPolicySkipsBodylessUploads(t *testing.T) {
+	policy := newContentPolicy("image/*", "", "", "")
+
+	tests := []struct {
+		name       string
+		body       string
+		wantPassed bool
+	}{
+		{name: "body-less deduplicated upload", wantPassed: true},
+		{name: "denied content", body: "plain text", wantPassed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passed := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				passed = true
+			})
+			req := httptest.NewRequest("PUT", "/upload", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			enforceContentPolicy(next, policy).ServeHTTP(rec, req)
+
+			if passed != tt.wantPassed {
+				t.Errorf("passed = %v (status %d, %s), want %v", passed, rec.Code, rec.Header().Get("X-Reason"), tt.wantPassed)
+			}
+		})
+	}
+}
+
+func TestStoreBlobInIPFSDeduplicates(t *testing.T) {
+	_, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	ctx := context.Background()
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+	// Uploads run in order against the same database
+	tests := []struct {
+		name      string
+		ext       string
+		body      string
+		wantAdded bool
+	}{
+		{name: "first upload", ext: ".png", body: "content", wantAdded: true},
+		// A second upload keeps the existing CID and extension without adding anything to IPFS
+		{name: "known blob", ext: ".bin", body: "other content"},
+		{name: "known blob again", ext: ".txt", body: "yet other content"},
+	}
+
+	firstCID := rawCID([]byte(tests[0].body))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid, added, err := addBlobToIPFS(ctx, ipfsShell, db, sha256, tt.ext, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("addBlobToIPFS() error = %v", err)
+			}
+			if added != tt.wantAdded {
+				t.Errorf("added = %v, want %v", added, tt.wantAdded)
+			}
+			if cid != firstCID {
+				t.Errorf("cid = %s, want %s", cid, firstCID)
+			}
+			if _, inIPFS := node.get(rawCID([]byte(tt.body))); inIPFS != tt.wantAdded {
+				t.Errorf("content in IPFS = %v, want %v", inIPFS, tt.wantAdded)
+			}
+
+			var ext string
+			if err := db.QueryRow(`SELECT extension FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&ext); err != nil || ext != ".png" {
+				t.Errorf("extension = %q, %v, want .png", ext, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// downloadLinkSecretSetting is the relay_settings key of the generated link signing secret
+const downloadLinkSecretSetting = "download_link_secret"
+
+// Default and maximum lifetime of a download link
+const (
+	downloadLinkDefaultTTL = 24 * time.Hour
+	downloadLinkMaxTTL     = 30 * 24 * time.Hour
+)
+
+// Errors returned when redeeming a download link
+var (
+	errLinkInvalid   = errors.New("invalid download link")
+	errLinkExpired   = errors.New("download link expired")
+	errLinkRevoked   = errors.New("download link revoked")
+	errLinkExhausted = errors.New("download link has no downloads left")
+)
+
+// downloadLink is a signed, expiring link to a blob minted by one of its owners
+type downloadLink struct {
+	ID           string `json:"id"`
+	SHA256       string `json:"sha256"`
+	Pubkey       string `json:"pubkey"`
+	URL          string `json:"url,omitempty"`
+	ExpiresAt    int64  `json:"expires_at"`
+	MaxDownloads int64  `json:"max_downloads"`
+	Downloads    int64  `json:"downloads"`
+	Revoked      bool   `json:"revoked"`
+}
+
+// downloadLinks mints and redeems HMAC-signed download links
+// The signature makes links unforgeable; the table makes them revocable and countable
+type downloadLinks struct {
+	db           *sql.DB
+	secret       []byte
+	adminPubkeys map[string]bool
+}
+
+// createDownloadLinksTable creates the table of minted download links if it doesn't exist
+func createDownloadLinksTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS download_links (
+		id TEXT PRIMARY KEY,
+		sha256 TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		max_downloads INTEGER NOT NULL DEFAULT 0,
+		downloads INTEGER NOT NULL DEFAULT 0,
+		revoked INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_download_links_pubkey ON download_links(pubkey);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// newDownloadLinks creates the download links with the given signing secret
+// Without a secret, one is generated once and kept in relay_settings so links survive restarts
+func newDownloadLinks(db *sql.DB, secret string, adminPubkeys map[string]bool) (*downloadLinks, error) {
+	if secret == "" {
+		err := db.QueryRow(`SELECT value FROM relay_settings WHERE key = ?`, downloadLinkSecretSetting).Scan(&secret)
+		if err == sql.ErrNoRows {
+			generated := make([]byte, 32)
+			if _, err := rand.Read(generated); err != nil {
+				return nil, fmt.Errorf("failed to generate link secret: %w", err)
+			}
+			secret = hex.EncodeToString(generated)
+			if err := saveRelaySetting(context.Background(), db, downloadLinkSecretSetting, secret); err != nil {
+				return nil, err
+			}
+			log.Printf("Generated download link signing secret")
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to load link secret: %w", err)
+		}
+	}
+
+	return &downloadLinks{
+		db:           db,
+		secret:       []byte(secret),
+		adminPubkeys: adminPubkeys,
+	}, nil
+}
+
+// sign computes the HMAC of a link's id, blob and expiry
+func (dl *downloadLinks) sign(id string, sha256Hex string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, dl.secret)
+	fmt.Fprintf(mac, "%s:%s:%d", id, sha256Hex, expiresAt)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isOwner reports whether a pubkey uploaded a blob
+func (dl *downloadLinks) isOwner(ctx context.Context, pubkey string, sha256Hex string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM blob_usage WHERE pubkey = ? AND sha256 = ?`
+	err := dl.db.QueryRowContext(ctx, query, pubkey, sha256Hex).Scan(&count)
+	return count > 0, err
+}
+
+// Mint creates a link to a blob valid for ttl and at most maxDownloads downloads (0 is unlimited)
+func (dl *downloadLinks) Mint(ctx context.Context, pubkey string, sha256Hex string, ttl time.Duration, maxDownloads int64, baseURL string) (*downloadLink, error) {
+	var ext string
+	query := `SELECT COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`
+	if err := dl.db.QueryRowContext(ctx, query, sha256Hex).Scan(&ext); err != nil {
+		return nil, fmt.Errorf("blob not found: %w", err)
+	}
+	if ext == "" {
+		ext = ".bin"
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate link id: %w", err)
+	}
+
+	link := &downloadLink{
+		ID:           hex.EncodeToString(idBytes),
+		SHA256:       sha256Hex,
+		Pubkey:       pubkey,
+		ExpiresAt:    time.Now().Add(ttl).Unix(),
+		MaxDownloads: maxDownloads,
+	}
+	query = `INSERT INTO download_links (id, sha256, pubkey, expires_at, max_downloads) VALUES (?, ?, ?, ?, ?)`
+	if _, err := dl.db.ExecContext(ctx, query, link.ID, link.SHA256, link.Pubkey, link.ExpiresAt, link.MaxDownloads); err != nil {
+		return nil, fmt.Errorf("failed to store link: %w", err)
+	}
+
+	params := url.Values{}
+	params.Set("link", link.ID)
+	params.Set("exp", strconv.FormatInt(link.ExpiresAt, 10))
+	params.Set("sig", dl.sign(link.ID, link.SHA256, link.ExpiresAt))
+	link.URL = baseURL + "/" + sha256Hex + ext + "?" + params.Encode()
+	return link, nil
+}
+
+// Revoke revokes a link; only the pubkey that minted it and admins can
+func (dl *downloadLinks) Revoke(ctx context.Context, pubkey string, id string) (bool, error) {
+	query := `UPDATE download_links SET revoked = 1 WHERE id = ? AND (pubkey = ? OR ?)`
+	result, err := dl.db.ExecContext(ctx, query, id, pubkey, dl.adminPubkeys[pubkey])
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// List returns the links minted by a pubkey
+func (dl *downloadLinks) List(ctx context.Context, pubkey string) ([]downloadLink, error) {
+	query := `SELECT id, sha256, pubkey, expires_at, max_downloads, downloads, revoked FROM download_links WHERE pubkey = ? ORDER BY created_at DESC`
+	rows, err := dl.db.QueryContext(ctx, query, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []downloadLink{}
+	for rows.Next() {
+		var link downloadLink
+		if err := rows.Scan(&link.ID, &link.SHA256, &link.Pubkey, &link.ExpiresAt, &link.MaxDownloads, &link.Downloads, &link.Revoked); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// hasLink reports whether a request carries download link parameters
+func hasLink(r *http.Request) bool {
+	return r.URL.Query().Get("link") != ""
+}
+
+// Redeem checks the download link of a request for a blob
+// GET requests use up one download; HEAD requests only check the link
+func (dl *downloadLinks) Redeem(r *http.Request, sha256Hex string) error {
+	query := r.URL.Query()
+	id := query.Get("link")
+	expiresAt, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(query.Get("sig")), []byte(dl.sign(id, sha256Hex, expiresAt))) {
+		return errLinkInvalid
+	}
+	if time.Now().Unix() > expiresAt {
+		return errLinkExpired
+	}
+
+	var revoked bool
+	var maxDownloads, downloads int64
+	err = dl.db.QueryRowContext(r.Context(), `SELECT revoked, max_downloads, downloads FROM download_links WHERE id = ? AND sha256 = ?`, id, sha256Hex).
+		Scan(&revoked, &maxDownloads, &downloads)
+	if err == sql.ErrNoRows {
+		return errLinkInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query link: %w", err)
+	}
+	if revoked {
+		return errLinkRevoked
+	}
+	if maxDownloads > 0 && downloads >= maxDownloads {
+		return errLinkExhausted
+	}
+	if r.Method != "GET" {
+		return nil
+	}
+
+	// Count the download, guarding against concurrent requests racing past the limit
+	update := `UPDATE download_links SET downloads = downloads + 1 WHERE id = ? AND (max_downloads = 0 OR downloads < max_downloads)`
+	result, err := dl.db.ExecContext(r.Context(), update, id)
+	if err != nil {
+		return fmt.Errorf("failed to count download: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errLinkExhausted
+	}
+	return nil
+}
+
+// writeLinkError answers a request whose download link can't be redeemed
+func writeLinkError(w http.ResponseWriter, err error) {
+	w.Header().Set("X-Reason", err.Error())
+	switch err {
+	case errLinkInvalid:
+		w.WriteHeader(http.StatusForbidden)
+	case errLinkExpired, errLinkRevoked, errLinkExhausted:
+		w.WriteHeader(http.StatusGone)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// downloadLinksHandler serves the NIP-98 authenticated link endpoints:
+// GET /links lists, POST /links mints and DELETE /links/<id> revokes links
+func downloadLinksHandler(dl *downloadLinks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload []byte
+		if r.Method == "POST" {
+			var err error
+			payload, err = io.ReadAll(io.LimitReader(r.Body, 4096))
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		auth, err := readNIP98Auth(r, payload)
+		if err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		pubkey := auth.PubKey
+
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/links":
+			links, err := dl.List(r.Context(), pubkey)
+			if err != nil {
+				http.Error(w, "failed to list links", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(links)
+
+		case r.Method == "POST" && r.URL.Path == "/links":
+			var req struct {
+				SHA256       string `json:"sha256"`
+				ExpiresIn    int64  `json:"expires_in"`
+				MaxDownloads int64  `json:"max_downloads"`
+			}
+			if err := json.Unmarshal(payload, &req); err != nil || !nostr.IsValid32ByteHex(req.SHA256) {
+				w.Header().Set("X-Reason", "body must be a JSON object with a \"sha256\" field")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ttl := downloadLinkDefaultTTL
+			if req.ExpiresIn > 0 {
+				ttl = time.Duration(req.ExpiresIn) * time.Second
+			}
+			if ttl > downloadLinkMaxTTL || req.MaxDownloads < 0 {
+				w.Header().Set("X-Reason", fmt.Sprintf("links can last at most %s and need a non-negative download count", downloadLinkMaxTTL))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			owner, err := dl.isOwner(r.Context(), pubkey, req.SHA256)
+			if err != nil {
+				http.Error(w, "failed to check blob owner", http.StatusInternalServerError)
+				return
+			}
+			if !owner && !dl.adminPubkeys[pubkey] {
+				w.Header().Set("X-Reason", "only owners of the blob can create links to it")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			link, err := dl.Mint(r.Context(), pubkey, req.SHA256, ttl, req.MaxDownloads, requestBaseURL(r))
+			if err != nil {
+				log.Printf("Failed to mint download link for sha256=%s: %v", req.SHA256, err)
+				w.Header().Set("X-Reason", "failed to create link")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Pubkey %s created download link %s for sha256=%s", pubkey, link.ID, link.SHA256)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(link)
+
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/links/"):
+			id := strings.TrimPrefix(r.URL.Path, "/links/")
+			revoked, err := dl.Revoke(r.Context(), pubkey, id)
+			if err != nil {
+				http.Error(w, "failed to revoke link", http.StatusInternalServerError)
+				return
+			}
+			if !revoked {
+				w.Header().Set("X-Reason", "link not found")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			log.Printf("Pubkey %s revoked download link %s", pubkey, id)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
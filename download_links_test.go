@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDownloadLinkRedemption(t *testing.T) {
+	const content = "private content"
+
+	tests := []struct {
+		name         string
+		ttl          time.Duration
+		maxDownloads int64
+		prepare      func(t *testing.T, dl *downloadLinks, link *downloadLink, linkURL *url.URL)
+		methods      []string
+		wantStatuses []int
+	}{
+		{name: "valid link", ttl: time.Hour, methods: []string{"GET", "GET"}, wantStatuses: []int{http.StatusOK, http.StatusOK}},
+		{name: "download limit", ttl: time.Hour, maxDownloads: 1, methods: []string{"GET", "GET"}, wantStatuses: []int{http.StatusOK, http.StatusGone}},
+		{name: "HEAD requests don't count", ttl: time.Hour, maxDownloads: 1, methods: []string{"HEAD", "HEAD", "GET", "HEAD"}, wantStatuses: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusGone}},
+		{name: "expired link", ttl: -time.Minute, methods: []string{"GET"}, wantStatuses: []int{http.StatusGone}},
+		{
+			name: "revoked link", ttl: time.Hour, methods: []string{"GET"}, wantStatuses: []int{http.StatusGone},
+			prepare: func(t *testing.T, dl *downloadLinks, link *downloadLink, linkURL *url.URL) {
+				if ok, err := dl.Revoke(context.Background(), link.Pubkey, link.ID); err != nil || !ok {
+					t.Fatalf("Revoke() = %v, %v", ok, err)
+				}
+			},
+		},
+		{
+			name: "tampered signature", ttl: time.Hour, methods: []string{"GET"}, wantStatuses: []int{http.StatusForbidden},
+			prepare: func(t *testing.T, dl *downloadLinks, link *downloadLink, linkURL *url.URL) {
+				query := linkURL.Query()
+				query.Set("sig", dl.sign(link.ID, link.SHA256, link.ExpiresAt+1))
+				linkURL.RawQuery = query.Encode()
+			},
+		},
+		{
+			name: "extended expiry", ttl: time.Hour, methods: []string{"GET"}, wantStatuses: []int{http.StatusForbidden},
+			prepare: func(t *testing.T, dl *downloadLinks, link *downloadLink, linkURL *url.URL) {
+				query := linkURL.Query()
+				query.Set("exp", "99999999999")
+				linkURL.RawQuery = query.Encode()
+			},
+		},
+		{
+			name: "signed by another secret", ttl: time.Hour, methods: []string{"GET"}, wantStatuses: []int{http.StatusForbidden},
+			prepare: func(t *testing.T, dl *downloadLinks, link *downloadLink, linkURL *url.URL) {
+				other := &downloadLinks{secret: []byte("another secret")}
+				query := linkURL.Query()
+				query.Set("sig", other.sign(link.ID, link.SHA256, link.ExpiresAt))
+				linkURL.RawQuery = query.Encode()
+			},
+		},
+		{
+			name: "unknown link id", ttl: time.Hour, methods: []string{"GET"}, wantStatuses: []int{http.StatusForbidden},
+			prepare: func(t *testing.T, dl *downloadLinks, link *downloadLink, linkURL *url.URL) {
+				if _, err := dl.db.Exec(`DELETE FROM download_links WHERE id = ?`, link.ID); err != nil {
+					t.Fatalf("failed to delete link: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb, sha256Hex, _ := setupPrivateBlob(t, content)
+			var owner string
+			if err := pb.db.QueryRow(`SELECT pubkey FROM blob_usage WHERE sha256 = ?`, sha256Hex).Scan(&owner); err != nil {
+				t.Fatalf("failed to query owner: %v", err)
+			}
+
+			dl, err := newDownloadLinks(pb.db, "", nil)
+			if err != nil {
+				t.Fatalf("newDownloadLinks() error = %v", err)
+			}
+			pb.links = dl
+
+			link, err := dl.Mint(context.Background(), owner, sha256Hex, tt.ttl, tt.maxDownloads, "https://blossom.example.com")
+			if err != nil {
+				t.Fatalf("Mint() error = %v", err)
+			}
+			linkURL, err := url.Parse(link.URL)
+			if err != nil {
+				t.Fatalf("invalid link URL %q: %v", link.URL, err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, dl, link, linkURL)
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("private blob was passed to the public handler")
+			})
+			for i, method := range tt.methods {
+				rec := httptest.NewRecorder()
+				privateBlobMiddleware(next, pb).ServeHTTP(rec, httptest.NewRequest(method, linkURL.String(), nil))
+				if rec.Code != tt.wantStatuses[i] {
+					t.Fatalf("%s #%d status = %d (%s), want %d", method, i+1, rec.Code, rec.Header().Get("X-Reason"), tt.wantStatuses[i])
+				}
+				if rec.Code == http.StatusOK && method == "GET" && rec.Body.String() != content {
+					t.Errorf("body = %q, want %q", rec.Body.String(), content)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadLinkSecretPersists(t *testing.T) {
+	_, db := newTestDB(t)
+
+	first, err := newDownloadLinks(db, "", nil)
+	if err != nil {
+		t.Fatalf("newDownloadLinks() error = %v", err)
+	}
+	second, err := newDownloadLinks(db, "", nil)
+	if err != nil {
+		t.Fatalf("newDownloadLinks() error = %v", err)
+	}
+	if string(first.secret) != string(second.secret) {
+		t.Errorf("generated secret wasn't reused after a restart")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// blobEncryptionAlgorithm identifies the envelope format stored in blob_encryption
+const blobEncryptionAlgorithm = "aes-256-gcm"
+
+// blobEncryption implements envelope encryption for blobs stored in IPFS
+// Every blob gets a random data key that encrypts the content; the data key is wrapped
+// with a server master key. Master keys are versioned so they can be rotated
+type blobEncryption struct {
+	db           *sql.DB
+	currentKeyID string
+	masterKeys   map[string][]byte
+}
+
+// parseMasterKeys parses a comma-separated list of "<id>:<key>" master keys from environment variable
+// Keys are 32 bytes, hex or base64 encoded. The first key is used to wrap new data keys
+func parseMasterKeys(keysStr string) (string, map[string][]byte, error) {
+	if keysStr == "" {
+		return "", nil, nil
+	}
+
+	var currentKeyID string
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(keysStr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return "", nil, fmt.Errorf("master key must be in <id>:<key> format")
+		}
+
+		key, err := hex.DecodeString(encoded)
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		if err != nil || len(key) != 32 {
+			return "", nil, fmt.Errorf("master key %q must be 32 bytes, hex or base64 encoded", id)
+		}
+		if _, exists := keys[id]; exists {
+			return "", nil, fmt.Errorf("duplicate master key id %q", id)
+		}
+
+		keys[id] = key
+		if currentKeyID == "" {
+			currentKeyID = id
+		}
+	}
+	return currentKeyID, keys, nil
+}
+
+// newBlobEncryption creates the blob encryption with the given master keys
+func newBlobEncryption(db *sql.DB, currentKeyID string, masterKeys map[string][]byte) *blobEncryption {
+	return &blobEncryption{
+		db:           db,
+		currentKeyID: currentKeyID,
+		masterKeys:   masterKeys,
+	}
+}
+
+// createEncryptionTable creates the table holding wrapped data keys if it doesn't exist
+func createEncryptionTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS blob_encryption (
+		sha256 TEXT PRIMARY KEY,
+		algorithm TEXT NOT NULL,
+		key_id TEXT NOT NULL,
+		wrapped_key BLOB NOT NULL,
+		nonce BLOB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// newGCM creates an AES-GCM cipher for a 32 byte key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAESGCM encrypts plaintext with key, prepending a random nonce to the ciphertext
+func sealAESGCM(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAESGCM decrypts a ciphertext produced by sealAESGCM
+func openAESGCM(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+// Encrypt encrypts a blob with a fresh data key and stores the wrapped key
+// The sha256 of the plaintext is bound to both layers as additional data
+func (be *blobEncryption) Encrypt(ctx context.Context, sha256 string, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	ciphertext, err := sealAESGCM(dataKey, plaintext, []byte(sha256))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt blob: %w", err)
+	}
+	wrappedKey, err := sealAESGCM(be.masterKeys[be.currentKeyID], dataKey, []byte(sha256))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	// The nonce is prepended to the ciphertext; it is also stored so Decrypt can check that
+	// the content loaded from IPFS is the ciphertext the data key was made for
+	gcm, _ := newGCM(dataKey)
+	nonce := ciphertext[:gcm.NonceSize()]
+
+	query := `INSERT OR REPLACE INTO blob_encryption (sha256, algorithm, key_id, wrapped_key, nonce) VALUES (?, ?, ?, ?, ?)`
+	if _, err := be.db.ExecContext(ctx, query, sha256, blobEncryptionAlgorithm, be.currentKeyID, wrappedKey, nonce); err != nil {
+		return nil, fmt.Errorf("failed to store data key: %w", err)
+	}
+
+	log.Printf("Encrypted blob sha256=%s with master key %s", sha256, be.currentKeyID)
+	return ciphertext, nil
+}
+
+// Decrypt unwraps the data key of a blob and decrypts its content
+// Blobs stored before encryption was enabled are returned as they are
+func (be *blobEncryption) Decrypt(ctx context.Context, sha256 string, data []byte) ([]byte, error) {
+	var algorithm, keyID string
+	var wrappedKey, nonce []byte
+	query := `SELECT algorithm, key_id, wrapped_key, nonce FROM blob_encryption WHERE sha256 = ?`
+	err := be.db.QueryRowContext(ctx, query, sha256).Scan(&algorithm, &keyID, &wrappedKey, &nonce)
+	if err == sql.ErrNoRows {
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query data key: %w", err)
+	}
+	if algorithm != blobEncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", algorithm)
+	}
+	if !bytes.HasPrefix(data, nonce) {
+		return nil, errors.New("stored content doesn't match its data key")
+	}
+
+	masterKey, ok := be.masterKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", keyID)
+	}
+	dataKey, err := openAESGCM(masterKey, wrappedKey, []byte(sha256))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	plaintext, err := openAESGCM(dataKey, data, []byte(sha256))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt blob: %w", err)
+	}
+	return plaintext, nil
+}
+
+// RotateKeys re-wraps every data key that isn't wrapped with the current master key
+// Blob content doesn't change, so nothing has to be re-uploaded to IPFS
+func (be *blobEncryption) RotateKeys(ctx context.Context) (int, error) {
+	rows, err := be.db.QueryContext(ctx, `SELECT sha256, key_id, wrapped_key FROM blob_encryption WHERE key_id != ?`, be.currentKeyID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query data keys: %w", err)
+	}
+
+	type wrapped struct {
+		sha256 string
+		keyID  string
+		key    []byte
+	}
+	var pending []wrapped
+	for rows.Next() {
+		var w wrapped
+		if err := rows.Scan(&w.sha256, &w.keyID, &w.key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, w := range pending {
+		masterKey, ok := be.masterKeys[w.keyID]
+		if !ok {
+			log.Printf("Cannot rotate data key of sha256=%s: master key %q is not configured", w.sha256, w.keyID)
+			continue
+		}
+		dataKey, err := openAESGCM(masterKey, w.key, []byte(w.sha256))
+		if err != nil {
+			return rotated, fmt.Errorf("failed to unwrap data key of sha256=%s: %w", w.sha256, err)
+		}
+		rewrapped, err := sealAESGCM(be.masterKeys[be.currentKeyID], dataKey, []byte(w.sha256))
+		if err != nil {
+			return rotated, fmt.Errorf("failed to wrap data key of sha256=%s: %w", w.sha256, err)
+		}
+		query := `UPDATE blob_encryption SET key_id = ?, wrapped_key = ? WHERE sha256 = ?`
+		if _, err := be.db.ExecContext(ctx, query, be.currentKeyID, rewrapped, w.sha256); err != nil {
+			return rotated, fmt.Errorf("failed to store rotated data key: %w", err)
+		}
+		rotated++
+	}
+
+	if rotated > 0 {
+		log.Printf("Rotated %d data keys to master key %s", rotated, be.currentKeyID)
+	}
+	return rotated, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseMasterKeys(t *testing.T) {
+	hexKey := strings.Repeat("ab", 32)
+	base64Key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	tests := []struct {
+		name        string
+		keys        string
+		wantCurrent string
+		wantKeys    int
+		wantErr     bool
+	}{
+		{name: "disabled", keys: ""},
+		{name: "hex key", keys: "k1:" + hexKey, wantCurrent: "k1", wantKeys: 1},
+		{name: "first key is current", keys: "k2:" + base64Key + ", k1:" + hexKey, wantCurrent: "k2", wantKeys: 2},
+		{name: "missing id", keys: hexKey, wantErr: true},
+		{name: "empty id", keys: ":" + hexKey, wantErr: true},
+		{name: "short key", keys: "k1:abcd", wantErr: true},
+		{name: "duplicate id", keys: "k1:" + hexKey + ",k1:" + base64Key, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, keys, err := parseMasterKeys(tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMasterKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if current != tt.wantCurrent || len(keys) != tt.wantKeys {
+				t.Errorf("parseMasterKeys() = %q with %d keys, want %q with %d keys", current, len(keys), tt.wantCurrent, tt.wantKeys)
+			}
+		})
+	}
+}
+
+// testMasterKey returns a 32 byte master key filled with b
+func testMasterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestBlobEncryptionEnvelope(t *testing.T) {
+	const sha = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	plaintext := []byte("private content")
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte)
+		wantErr bool
+	}{
+		{
+			name: "round trip",
+			tamper: func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte) {
+				return sha, ciphertext
+			},
+		},
+		{
+			name: "tampered ciphertext",
+			tamper: func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte) {
+				ciphertext[len(ciphertext)-1] ^= 1
+				return sha, ciphertext
+			},
+			wantErr: true,
+		},
+		{
+			name: "truncated ciphertext",
+			tamper: func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte) {
+				return sha, ciphertext[:4]
+			},
+			wantErr: true,
+		},
+		{
+			name: "data key moved to another blob",
+			tamper: func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte) {
+				const other = "0000000000000000000000000000000000000000000000000000000000000000"
+				if _, err := be.db.Exec(`UPDATE blob_encryption SET sha256 = ? WHERE sha256 = ?`, other, sha); err != nil {
+					t.Fatalf("failed to move data key: %v", err)
+				}
+				return other, ciphertext
+			},
+			wantErr: true,
+		},
+		{
+			name: "content of another blob",
+			tamper: func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte) {
+				const other = "0000000000000000000000000000000000000000000000000000000000000000"
+				otherCiphertext, err := be.Encrypt(ctx, other, []byte("other content"))
+				if err != nil {
+					t.Fatalf("Encrypt() error = %v", err)
+				}
+				return sha, otherCiphertext
+			},
+			wantErr: true,
+		},
+		{
+			name: "master key removed",
+			tamper: func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte) {
+				delete(be.masterKeys, "k1")
+				return sha, ciphertext
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported algorithm",
+			tamper: func(t *testing.T, be *blobEncryption, ciphertext []byte) (string, []byte) {
+				if _, err := be.db.Exec(`UPDATE blob_encryption SET algorithm = ?`, "rot13"); err != nil {
+					t.Fatalf("failed to update algorithm: %v", err)
+				}
+				return sha, ciphertext
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			be := newBlobEncryption(db, "k1", map[string][]byte{"k1": testMasterKey(1)})
+
+			ciphertext, err := be.Encrypt(ctx, sha, plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			if bytes.Contains(ciphertext, plaintext) {
+				t.Fatalf("ciphertext contains the plaintext")
+			}
+
+			decryptSHA, data := tt.tamper(t, be, ciphertext)
+			got, err := be.Decrypt(ctx, decryptSHA, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, plaintext) {
+				t.Errorf("Decrypt() = %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestBlobEncryptionUnencryptedBlob(t *testing.T) {
+	_, db := newTestDB(t)
+	be := newBlobEncryption(db, "k1", map[string][]byte{"k1": testMasterKey(1)})
+
+	got, err := be.Decrypt(context.Background(), "not-encrypted", []byte("stored before encryption"))
+	if err != nil || string(got) != "stored before encryption" {
+		t.Errorf("Decrypt() = %q, %v, want the data unchanged", got, err)
+	}
+}
+
+func TestBlobEncryptionRotateKeys(t *testing.T) {
+	_, db := newTestDB(t)
+	ctx := context.Background()
+	blobs := map[string][]byte{
+		"1111111111111111111111111111111111111111111111111111111111111111": []byte("first"),
+		"2222222222222222222222222222222222222222222222222222222222222222": []byte("second"),
+	}
+
+	old := newBlobEncryption(db, "k1", map[string][]byte{"k1": testMasterKey(1)})
+	ciphertexts := make(map[string][]byte)
+	for sha, plaintext := range blobs {
+		ciphertext, err := old.Encrypt(ctx, sha, plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+		ciphertexts[sha] = ciphertext
+	}
+	// A data key wrapped with a master key that is no longer configured is skipped
+	if _, err := db.Exec(`INSERT INTO blob_encryption (sha256, algorithm, key_id, wrapped_key, nonce) VALUES (?, ?, ?, ?, ?)`,
+		"orphan", blobEncryptionAlgorithm, "k0", []byte("wrapped"), []byte("nonce")); err != nil {
+		t.Fatalf("failed to store data key: %v", err)
+	}
+
+	rotating := newBlobEncryption(db, "k2", map[string][]byte{"k1": testMasterKey(1), "k2": testMasterKey(2)})
+	rotated, err := rotating.RotateKeys(ctx)
+	if err != nil {
+		t.Fatalf("RotateKeys() error = %v", err)
+	}
+	if rotated != len(blobs) {
+		t.Errorf("RotateKeys() rotated %d keys, want %d", rotated, len(blobs))
+	}
+	if rotated, err := rotating.RotateKeys(ctx); err != nil || rotated != 0 {
+		t.Errorf("second RotateKeys() = %d, %v, want nothing left to rotate", rotated, err)
+	}
+
+	// The old master key can be dropped once every data key is re-wrapped
+	rotatedOnly := newBlobEncryption(db, "k2", map[string][]byte{"k2": testMasterKey(2)})
+	for sha, plaintext := range blobs {
+		got, err := rotatedOnly.Decrypt(ctx, sha, ciphertexts[sha])
+		if err != nil {
+			t.Fatalf("Decrypt() after rotation error = %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Decrypt() after rotation = %q, want %q", got, plaintext)
+		}
+	}
+}
+
+func TestPrivateBlobsEncryptedStorage(t *testing.T) {
+	_, db := newTestDB(t)
+	node, privateShell := newFakeIPFS(t)
+	_, publicShell := newFakeIPFS(t)
+	ctx := context.WithValue(context.Background(), privateUploadKey, true)
+
+	pb := &privateBlobs{
+		mode:       privateModeOptIn,
+		db:         db,
+		ipfsShell:  privateShell,
+		encryption: newBlobEncryption(db, "k1", map[string][]byte{"k1": testMasterKey(1)}),
+	}
+
+	content := []byte("private content")
+	hash := sha256.Sum256(content)
+	sha := hex.EncodeToString(hash[:])
+
+	storeShell, storeBody, err := pb.prepareStorage(ctx, sha, content, publicShell)
+	if err != nil {
+		t.Fatalf("prepareStorage() error = %v", err)
+	}
+	if storeShell != privateShell {
+		t.Fatalf("private blob isn't stored on the private node")
+	}
+	cid, err := storeBlobInIPFS(ctx, storeShell, db, sha, ".txt", storeBody)
+	if err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+
+	stored, _ := node.get(cid)
+	if bytes.Contains(stored, content) {
+		t.Errorf("private node holds the plaintext")
+	}
+
+	reader, err := pb.load(ctx, sha, ".txt")
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	got, _ := io.ReadAll(reader)
+	if !bytes.Equal(got, content) {
+		t.Errorf("load() = %q, want %q", got, content)
+	}
+
+	// Without master keys the ciphertext must not be served as if it were the blob
+	pb.encryption = nil
+	if _, err := pb.load(ctx, sha, ".txt"); err == nil {
+		t.Errorf("load() of an encrypted blob without master keys succeeded")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// fileMetadataPublisher signs NIP-94 kind 1063 file metadata events for public blobs with the
+// server key and stores them in the built-in relay, so clients can discover content with REQ filters
+type fileMetadataPublisher struct {
+	relay      *khatru.Relay
+	store      eventstore.Store
+	db         *sql.DB
+	secretKey  string
+	pubkey     string
+	gatewayURL string
+}
+
+// parseServerKey parses the server secret key from an nsec or hex string, returning it as hex
+func parseServerKey(keyStr string) (string, error) {
+	keyStr = strings.TrimSpace(keyStr)
+	if strings.HasPrefix(keyStr, "nsec") {
+		prefix, value, err := nip19.Decode(keyStr)
+		if err != nil || prefix != "nsec" {
+			return "", errors.New("invalid nsec")
+		}
+		return value.(string), nil
+	}
+	if !nostr.IsValid32ByteHex(keyStr) {
+		return "", errors.New("secret key must be an nsec or 64 hex characters")
+	}
+	return strings.ToLower(keyStr), nil
+}
+
+// newFileMetadataPublisher creates the publisher signing with the given hex secret key
+func newFileMetadataPublisher(relay *khatru.Relay, store eventstore.Store, db *sql.DB, secretKey string, gatewayURL string) (*fileMetadataPublisher, error) {
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server key: %w", err)
+	}
+	return &fileMetadataPublisher{
+		relay:      relay,
+		store:      store,
+		db:         db,
+		secretKey:  secretKey,
+		pubkey:     pubkey,
+		gatewayURL: gatewayURL,
+	}, nil
+}
+
+// Publish signs and stores the kind 1063 event of a stored blob and sends it to live subscriptions
+func (fp *fileMetadataPublisher) Publish(ctx context.Context, sha256 string, ext string, size int) error {
+	cid, err := lookupBlobCID(ctx, fp.db, sha256)
+	if err != nil {
+		return err
+	}
+	if cid == "" {
+		return fmt.Errorf("blob %s is not stored", sha256)
+	}
+
+	gatewayURL := fp.gatewayURL + cid
+	if ext != "" {
+		gatewayURL += "?filename=" + url.QueryEscape("file"+ext)
+	}
+	tags := nostr.Tags{
+		{"url", gatewayURL},
+		{"m", typeForExtension(ext)},
+		{"x", sha256},
+		{"size", strconv.Itoa(size)},
+		{"cid", cid},
+	}
+	previews := map[string]interface{}{"sha256": sha256}
+	addBlobPreviews(ctx, fp.db, fp.gatewayURL, previews)
+	for _, name := range []string{"dim", "blurhash", "thumb"} {
+		if value, ok := previews[name].(string); ok {
+			tags = append(tags, nostr.Tag{name, value})
+		}
+	}
+
+	evt := nostr.Event{
+		Kind:      nostr.KindFileMetadata,
+		CreatedAt: nostr.Now(),
+		Tags:      tags,
+	}
+	if err := evt.Sign(fp.secretKey); err != nil {
+		return fmt.Errorf("failed to sign file metadata: %w", err)
+	}
+	if err := fp.store.SaveEvent(ctx, &evt); err != nil && err != eventstore.ErrDupEvent {
+		return fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	fp.relay.BroadcastEvent(&evt)
+
+	log.Printf("Published file metadata %s for sha256=%s", evt.ID, sha256)
+	return nil
+}
+
+// Remove deletes the file metadata events of a blob that is no longer served
+// It does nothing when publishing is disabled
+func (fp *fileMetadataPublisher) Remove(ctx context.Context, sha256 string) error {
+	if fp == nil {
+		return nil
+	}
+
+	ch, err := fp.store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{nostr.KindFileMetadata},
+		Authors: []string{fp.pubkey},
+		Tags:    nostr.TagMap{"x": []string{sha256}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query file metadata: %w", err)
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	for _, evt := range events {
+		if err := fp.store.DeleteEvent(ctx, evt); err != nil {
+			return fmt.Errorf("failed to delete file metadata: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestParseServerKey(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	nsec, _ := nip19.EncodePrivateKey(sk)
+	npub, _ := nip19.EncodePublicKey(sk)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "hex", input: sk, want: sk},
+		{name: "nsec", input: " " + nsec + "\n", want: sk},
+		{name: "npub", input: npub, wantErr: true},
+		{name: "broken nsec", input: nsec[:len(nsec)-1], wantErr: true},
+		{name: "short hex", input: sk[:62], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerKey(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServerKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseServerKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileMetadataPublisher(t *testing.T) {
+	ctx := context.Background()
+	store, db := newTestDB(t)
+	_, ipfsShell := newFakeIPFS(t)
+	sk, _ := newTestKey(t)
+	fp, err := newFileMetadataPublisher(khatru.NewRelay(), store, db, sk, "https://gateway.example.com/ipfs/")
+	if err != nil {
+		t.Fatalf("newFileMetadataPublisher() error = %v", err)
+	}
+
+	image := encodeTestImage(t, "png", 200, 100)
+	imageSHA := sha256Hex(image)
+	if _, err := storeBlobInIPFS(ctx, ipfsShell, db, imageSHA, ".png", image); err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+	if err := newPreviewGenerator(db, ipfsShell, []int{32}, 1_000_000).Generate(ctx, imageSHA, ".png", image); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	text := []byte("plain file")
+	textSHA := sha256Hex(text)
+	if _, err := storeBlobInIPFS(ctx, ipfsShell, db, textSHA, ".txt", text); err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		sha256   string
+		ext      string
+		size     int
+		wantErr  bool
+		wantTags []string
+	}{
+		{name: "image with previews", sha256: imageSHA, ext: ".png", size: len(image), wantTags: []string{"url", "m", "x", "size", "cid", "dim", "blurhash", "thumb"}},
+		{name: "plain file", sha256: textSHA, ext: ".txt", size: len(text), wantTags: []string{"url", "m", "x", "size", "cid"}},
+		{name: "not stored", sha256: sha256Hex([]byte("missing")), ext: ".txt", size: 7, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fp.Publish(ctx, tt.sha256, tt.ext, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			events := queryFileMetadata(t, fp, tt.sha256)
+			if tt.wantErr {
+				if len(events) != 0 {
+					t.Errorf("metadata was published for a blob that isn't stored")
+				}
+				return
+			}
+			if len(events) != 1 {
+				t.Fatalf("found %d metadata events, want 1", len(events))
+			}
+			evt := events[0]
+			if ok, _ := evt.CheckSignature(); !ok || evt.PubKey != fp.pubkey || evt.Kind != nostr.KindFileMetadata {
+				t.Errorf("event %+v isn't a kind %d event signed by the server key", evt, nostr.KindFileMetadata)
+			}
+			if len(evt.Tags) != len(tt.wantTags) {
+				t.Errorf("tags = %v, want %v", evt.Tags, tt.wantTags)
+			}
+			for _, name := range tt.wantTags {
+				if evt.Tags.Find(name) == nil {
+					t.Errorf("missing %q tag in %v", name, evt.Tags)
+				}
+			}
+
+			if err := fp.Remove(ctx, tt.sha256); err != nil {
+				t.Fatalf("Remove() error = %v", err)
+			}
+			if events := queryFileMetadata(t, fp, tt.sha256); len(events) != 0 {
+				t.Errorf("%d metadata events remain after Remove()", len(events))
+			}
+		})
+	}
+
+	// Removal is a no-op when publishing is disabled
+	var disabled *fileMetadataPublisher
+	if err := disabled.Remove(ctx, imageSHA); err != nil {
+		t.Errorf("Remove() on disabled publisher error = %v", err)
+	}
+}
+
+func TestBlocklistRemovesFileMetadata(t *testing.T) {
+	ctx := context.Background()
+	store, db := newTestDB(t)
+	_, ipfsShell := newFakeIPFS(t)
+	sk, _ := newTestKey(t)
+	fp, err := newFileMetadataPublisher(khatru.NewRelay(), store, db, sk, "https://gateway.example.com/ipfs/")
+	if err != nil {
+		t.Fatalf("newFileMetadataPublisher() error = %v", err)
+	}
+	bl := newBlocklist(db, ipfsShell, &privateBlobs{db: db}, false, nil, nil, nil)
+	bl.metadata = fp
+
+	content := []byte("content published then blocked")
+	sha := sha256Hex(content)
+	if _, err := storeBlobInIPFS(ctx, ipfsShell, db, sha, ".txt", content); err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+	if err := fp.Publish(ctx, sha, ".txt", len(content)); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if _, err := bl.Block(ctx, blockTargetSHA256, sha, "test", "admin", "test"); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+	if events := queryFileMetadata(t, fp, sha); len(events) != 0 {
+		t.Errorf("metadata of blocked blob is still served")
+	}
+}
+
+// queryFileMetadata returns the file metadata events the publisher stored for a blob
+func queryFileMetadata(t *testing.T, fp *fileMetadataPublisher, sha256 string) []*nostr.Event {
+	t.Helper()
+	ch, err := fp.store.QueryEvents(context.Background(), nostr.Filter{
+		Kinds: []int{nostr.KindFileMetadata},
+		Tags:  nostr.TagMap{"x": []string{sha256}},
+	})
+	if err != nil {
+		t.Fatalf("QueryEvents() error = %v", err)
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Trustless gateway response formats
+const (
+	gatewayFormatRaw = "raw"
+	gatewayFormatCAR = "car"
+
+	gatewayContentTypeRaw = "application/vnd.ipld.raw"
+	gatewayContentTypeCAR = "application/vnd.ipld.car"
+)
+
+// gatewayResponseFormat picks the response format of a GET /ipfs/<cid> request from its
+// format query parameter, which takes precedence, or its Accept header
+// An empty format means the deserialized blob content
+func gatewayResponseFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+	case gatewayFormatRaw, gatewayFormatCAR:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported format %q", format)
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case gatewayContentTypeRaw:
+			return gatewayFormatRaw, nil
+		case gatewayContentTypeCAR:
+			if version, ok := params["version"]; ok && version != "1" {
+				return "", fmt.Errorf("unsupported CAR version %q", version)
+			}
+			return gatewayFormatCAR, nil
+		}
+	}
+	return "", nil
+}
+
+// serveIPFS handles GET and HEAD /ipfs/<cid> as a trustless gateway limited to the CIDs of
+// public blobs stored on this server, so it can't be used as an open gateway
+func (cl *cidLookup) serveIPFS(w http.ResponseWriter, r *http.Request, cidStr string) {
+	if strings.Contains(cidStr, "/") {
+		w.Header().Set("X-Reason", "paths inside a cid are not supported")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	format, err := gatewayResponseFormat(r)
+	if err != nil {
+		w.Header().Set("X-Reason", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	forms, err := cidForms(cidStr)
+	if err != nil {
+		w.Header().Set("X-Reason", "invalid cid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sha256, err := lookupBlobByCID(r.Context(), cl.db, forms)
+	if err != nil {
+		log.Printf("Failed to look up cid=%s: %v", cidStr, err)
+		w.Header().Set("X-Reason", "failed to look up cid")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if sha256 == "" {
+		w.Header().Set("X-Reason", "cid is not stored on this server")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if banned, err := isCIDBanned(r.Context(), cl.db, cidStr); err == nil && banned {
+		w.Header().Set("X-Reason", errBlobBanned.Error())
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+		return
+	}
+	if !cl.checkServable(w, r, sha256) {
+		return
+	}
+	if r.Method == "GET" {
+		cl.retention.RecordAccess(r.Context(), sha256)
+	}
+
+	// Content behind a CID never changes
+	w.Header().Set("X-Ipfs-Path", "/ipfs/"+cidStr)
+	w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Vary", "Accept")
+
+	switch format {
+	case gatewayFormatRaw:
+		cl.streamIPFS(w, r, "block/get", cidStr, gatewayContentTypeRaw, cidStr+".bin", `"`+cidStr+`.raw"`)
+	case gatewayFormatCAR:
+		cl.streamIPFS(w, r, "dag/export", cidStr, gatewayContentTypeCAR+"; version=1", cidStr+".car", `"`+cidStr+`.car"`)
+	default:
+		var ext string
+		cl.db.QueryRowContext(r.Context(), `SELECT COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&ext)
+		content, err := loadBlobFromIPFS(r.Context(), cl.publicShell, cl.db, sha256, ext)
+		if err != nil {
+			log.Printf("Failed to load cid=%s from IPFS: %v", cidStr, err)
+			w.Header().Set("X-Reason", "failed to load blob from IPFS")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", typeForExtension(ext))
+		w.Header().Set("Etag", `"`+cidStr+`"`)
+		http.ServeContent(w, r, "", time.Time{}, content)
+	}
+}
+
+// streamIPFS streams the output of an IPFS API command run on a CID as the response body
+func (cl *cidLookup) streamIPFS(w http.ResponseWriter, r *http.Request, command string, cidStr string, contentType string, filename string, etag string) {
+	if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.Header().Set("Etag", etag)
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	resp, err := cl.publicShell.Request(command, cidStr).Send(r.Context())
+	if err == nil && resp.Error != nil {
+		resp.Close()
+		err = resp.Error
+	}
+	if err != nil {
+		log.Printf("Failed to run %s for cid=%s: %v", command, cidStr, err)
+		w.Header().Del("Content-Disposition")
+		w.Header().Set("X-Reason", "failed to load content from IPFS")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Close()
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, resp.Output); err != nil {
+		log.Printf("Failed to stream %s of cid=%s: %v", command, cidStr, err)
+	}
+}
+
+// ipfsGatewayMiddleware serves GET and HEAD /ipfs/<cid> from the blobs stored on this server
+func ipfsGatewayMiddleware(next http.Handler, cl *cidLookup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != "GET" && r.Method != "HEAD") || !strings.HasPrefix(r.URL.Path, "/ipfs/") || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cl.serveIPFS(w, r, strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGatewayResponseFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		want    string
+		wantErr bool
+	}{
+		{name: "blob content"},
+		{name: "browser accept", accept: "text/html,application/xhtml+xml,*/*;q=0.8"},
+		{name: "raw query", query: "?format=raw", want: gatewayFormatRaw},
+		{name: "car query", query: "?format=car", want: gatewayFormatCAR},
+		{name: "raw accept", accept: gatewayContentTypeRaw, want: gatewayFormatRaw},
+		{name: "car accept", accept: "application/vnd.ipld.car; version=1", want: gatewayFormatCAR},
+		{name: "query wins over accept", query: "?format=raw", accept: gatewayContentTypeCAR, want: gatewayFormatRaw},
+		{name: "unsupported query", query: "?format=tar", wantErr: true},
+		{name: "unsupported CAR version", accept: "application/vnd.ipld.car; version=2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ipfs/cid"+tt.query, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			got, err := gatewayResponseFormat(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gatewayResponseFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("gatewayResponseFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPFSGatewayMiddleware(t *testing.T) {
+	ctx := context.Background()
+	_, db := newTestDB(t)
+	_, ipfsShell := newFakeIPFS(t)
+	private := &privateBlobs{db: db}
+
+	public := []byte("public gateway content")
+	publicCID, err := storeBlobInIPFS(ctx, ipfsShell, db, sha256Hex(public), ".txt", public)
+	if err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+	hidden := []byte("private gateway content")
+	hiddenCID, err := storeBlobInIPFS(ctx, ipfsShell, db, sha256Hex(hidden), ".txt", hidden)
+	if err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+	if err := private.MarkPrivate(ctx, sha256Hex(hidden)); err != nil {
+		t.Fatalf("MarkPrivate() error = %v", err)
+	}
+	// Stored on the node but not uploaded here: the gateway must not serve it
+	foreign, _ := newFakeIPFS(t)
+	foreignCID := foreign.put([]byte("someone else's content"))
+
+	handler := ipfsGatewayMiddleware(http.NotFoundHandler(), &cidLookup{db: db, private: private, publicShell: ipfsShell, gatewayURL: "https://gateway.example.com/ipfs/"})
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		accept          string
+		ifNoneMatch     string
+		wantStatus      int
+		wantContentType string
+		wantBody        []byte
+	}{
+		{name: "blob content", path: "/ipfs/" + publicCID, wantStatus: http.StatusOK, wantContentType: "text/plain", wantBody: public},
+		{name: "raw block", path: "/ipfs/" + publicCID + "?format=raw", wantStatus: http.StatusOK, wantContentType: gatewayContentTypeRaw, wantBody: public},
+		{name: "car export", path: "/ipfs/" + publicCID, accept: gatewayContentTypeCAR, wantStatus: http.StatusOK, wantContentType: gatewayContentTypeCAR + "; version=1", wantBody: public},
+		{name: "head raw block", method: "HEAD", path: "/ipfs/" + publicCID + "?format=raw", wantStatus: http.StatusOK, wantContentType: gatewayContentTypeRaw},
+		{name: "raw block not modified", path: "/ipfs/" + publicCID + "?format=raw", ifNoneMatch: `"` + publicCID + `.raw"`, wantStatus: http.StatusNotModified},
+		{name: "private blob", path: "/ipfs/" + hiddenCID, wantStatus: http.StatusNotFound},
+		{name: "not stored here", path: "/ipfs/" + foreignCID, wantStatus: http.StatusNotFound},
+		{name: "path inside cid", path: "/ipfs/" + publicCID + "/file.txt", wantStatus: http.StatusNotFound},
+		{name: "invalid cid", path: "/ipfs/nonsense", wantStatus: http.StatusBadRequest},
+		{name: "unsupported format", path: "/ipfs/" + publicCID + "?format=tar", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			if contentType := rec.Header().Get("Content-Type"); contentType != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", contentType, tt.wantContentType)
+			}
+			if rec.Header().Get("Cache-Control") != "public, max-age=29030400, immutable" {
+				t.Errorf("Cache-Control = %q, want immutable", rec.Header().Get("Cache-Control"))
+			}
+			if !bytes.Contains(rec.Body.Bytes(), tt.wantBody) || (tt.wantBody == nil && rec.Body.Len() != 0) {
+				t.Errorf("body = %q, want it to hold %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
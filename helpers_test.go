@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/multiformats/go-multihash"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestDB opens a fresh database holding the eventstore and every table the server creates
+func newTestDB(t *testing.T) (*sqlite3.SQLite3Backend, *sql.DB) {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	store := &sqlite3.SQLite3Backend{DatabaseURL: dbPath}
+	if err := store.Init(); err != nil {
+		t.Fatalf("failed to initialize eventstore: %v", err)
+	}
+	t.Cleanup(store.Close)
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, create := range []func(*sql.DB) error{
+		createMappingTable,
+		createManagementTables,
+		createWoTTable,
+		createNIP05Table,
+		createUsageTable,
+		createPrivateBlobsTable,
+		createEncryptionTable,
+		createDownloadLinksTable,
+		createRetentionTables,
+		createBlocklistTables,
+		createReportTables,
+		createPreviewTables,
+		createMFSLinksTable,
+		createIPNSNamesTable,
+	} {
+		if err := create(db); err != nil {
+			t.Fatalf("failed to create tables: %v", err)
+		}
+	}
+	return store, db
+}
+
+// newTestKey returns a fresh secret key and its pubkey
+func newTestKey(t *testing.T) (string, string) {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		t.Fatalf("failed to derive pubkey: %v", err)
+	}
+	return sk, pk
+}
+
+// signTestEvent signs an event of the given kind, tags and content created now
+func signTestEvent(t *testing.T, sk string, kind int, tags nostr.Tags, content string) *nostr.Event {
+	t.Helper()
+	evt := &nostr.Event{
+		Kind:      kind,
+		Tags:      tags,
+		Content:   content,
+		CreatedAt: nostr.Now(),
+	}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatalf("failed to sign event: %v", err)
+	}
+	return evt
+}
+
+// authHeader encodes a signed event as an Authorization header value
+func authHeader(t *testing.T, evt *nostr.Event) string {
+	t.Helper()
+	eventJSON, err := json.Marshal(evt)
+	if err != nil {
+		t.Fatalf("failed to encode auth event: %v", err)
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(eventJSON)
+}
+
+// nip98Nonce numbers the NIP-98 events signed by tests
+var nip98Nonce atomic.Int64
+
+// nip98AuthHeader signs a NIP-98 event for a URL and method, with the payload hash of body when it isn't nil
+func nip98AuthHeader(t *testing.T, sk string, url string, method string, body []byte) string {
+	t.Helper()
+	// The nonce keeps identical requests signed within a second from being rejected as replays
+	tags := nostr.Tags{{"u", url}, {"method", method}, {"nonce", strconv.FormatInt(nip98Nonce.Add(1), 10)}}
+	if body != nil {
+		hash := sha256.Sum256(body)
+		tags = append(tags, nostr.Tag{"payload", hex.EncodeToString(hash[:])})
+	}
+	return authHeader(t, signTestEvent(t, sk, nostr.KindHTTPAuth, tags, ""))
+}
+
+// blossomAuthHeader signs a BUD auth event for an action with the given extra tags
+// and returns it as an Authorization header value
+func blossomAuthHeader(t *testing.T, sk string, action string, tags ...nostr.Tag) string {
+	t.Helper()
+	tags = append(tags, nostr.Tag{"t", action}, nostr.Tag{"expiration", strconv.FormatInt(int64(nostr.Now())+60, 10)})
+	return authHeader(t, signTestEvent(t, sk, 24242, tags, action))
+}
+
+// fakeIPFS is an in-memory stand-in for the Kubo RPC API holding raw blocks
+type fakeIPFS struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	pins   map[string]bool
+	// files maps MFS paths to the CIDs linked there
+	files map[string]string
+	// keys maps keystore key names to their IPNS names, published records the name/publish calls
+	keys      map[string]string
+	published []string
+}
+
+// newFakeIPFS starts a fake IPFS node and returns it with a shell talking to it
+func newFakeIPFS(t *testing.T) (*fakeIPFS, *shell.Shell) {
+	t.Helper()
+	node := &fakeIPFS{blocks: make(map[string][]byte), pins: make(map[string]bool), files: make(map[string]string), keys: make(map[string]string)}
+	server := httptest.NewServer(node)
+	t.Cleanup(server.Close)
+	return node, shell.NewShell(server.URL)
+}
+
+// rawCID returns the CIDv1 of data stored as a single raw block
+func rawCID(data []byte) string {
+	hash, _ := multihash.Sum(data, multihash.SHA2_256, -1)
+	return cid.NewCidV1(cid.Raw, hash).String()
+}
+
+// put stores data as a raw block and returns its CID
+func (f *fakeIPFS) put(data []byte) string {
+	c := rawCID(data)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blocks[c] = data
+	return c
+}
+
+// get returns the block of a CID
+func (f *fakeIPFS) get(c string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.blocks[c]
+	return data, ok
+}
+
+// file returns the CID linked at an MFS path
+func (f *fakeIPFS) file(mfsPath string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.files[mfsPath]
+	return c, ok
+}
+
+// publications returns the "<key> <path>" of every name/publish call so far
+func (f *fakeIPFS) publications() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.published...)
+}
+
+// pinned reports whether a CID is pinned
+func (f *fakeIPFS) pinned(c string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pins[c]
+}
+
+func (f *fakeIPFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	arg := r.URL.Query().Get("arg")
+	switch r.URL.Path {
+	case "/api/v0/version":
+		json.NewEncoder(w).Encode(map[string]string{"Version": "0.30.0"})
+
+	case "/api/v0/add":
+		reader, err := r.MultipartReader()
+		if err != nil {
+			f.fail(w, err)
+			return
+		}
+		part, err := reader.NextPart()
+		if err != nil {
+			f.fail(w, err)
+			return
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			f.fail(w, err)
+			return
+		}
+		if r.URL.Query().Get("only-hash") == "true" {
+			c := rawCID(data)
+			json.NewEncoder(w).Encode(map[string]string{"Name": c, "Hash": c, "Size": strconv.Itoa(len(data))})
+			return
+		}
+		c := f.put(data)
+		if r.URL.Query().Get("pin") != "false" {
+			f.mu.Lock()
+			f.pins[c] = true
+			f.mu.Unlock()
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Name": c, "Hash": c, "Size": strconv.Itoa(len(data))})
+
+	case "/api/v0/cat":
+		data, ok := f.get(arg)
+		if !ok {
+			f.fail(w, fmt.Errorf("block %s not found", arg))
+			return
+		}
+		w.Write(data)
+
+	case "/api/v0/block/get":
+		data, ok := f.get(arg)
+		if !ok {
+			f.fail(w, fmt.Errorf("block %s not found", arg))
+			return
+		}
+		w.Write(data)
+
+	case "/api/v0/dag/export":
+		data, ok := f.get(arg)
+		if !ok {
+			f.fail(w, fmt.Errorf("block %s not found", arg))
+			return
+		}
+		c, _ := cid.Decode(arg)
+		cw := &carWriter{w: w, seen: make(map[string]bool)}
+		if err := cw.writeHeader([]cid.Cid{c}); err == nil {
+			cw.writeBlock(c, data)
+		}
+
+	case "/api/v0/dag/import":
+		reader, err := r.MultipartReader()
+		if err != nil {
+			f.fail(w, err)
+			return
+		}
+		part, err := reader.NextPart()
+		if err != nil {
+			f.fail(w, err)
+			return
+		}
+		cr, err := newCARReader(part)
+		if err != nil {
+			f.fail(w, err)
+			return
+		}
+		for {
+			c, data, err := cr.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.fail(w, err)
+				return
+			}
+			f.mu.Lock()
+			f.blocks[c.String()] = data
+			f.mu.Unlock()
+		}
+
+	case "/api/v0/pin/add":
+		if _, ok := f.get(arg); !ok {
+			f.fail(w, fmt.Errorf("block %s not found", arg))
+			return
+		}
+		f.mu.Lock()
+		f.pins[arg] = true
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {arg}})
+
+	case "/api/v0/pin/rm":
+		f.mu.Lock()
+		pinned := f.pins[arg]
+		delete(f.pins, arg)
+		f.mu.Unlock()
+		if !pinned {
+			f.fail(w, fmt.Errorf("%s is not pinned", arg))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {arg}})
+
+	case "/api/v0/pin/ls":
+		if !f.pinned(arg) {
+			f.fail(w, fmt.Errorf("path '%s' is not pinned", arg))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Keys": map[string]interface{}{arg: map[string]string{"Type": "recursive"}}})
+
+	case "/api/v0/files/cp":
+		args := r.URL.Query()["arg"]
+		if len(args) != 2 || !strings.HasPrefix(args[0], "/ipfs/") {
+			f.fail(w, fmt.Errorf("invalid arguments %v", args))
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, exists := f.files[args[1]]; exists {
+			f.fail(w, fmt.Errorf("cp: cannot put node in path %s: directory already has entry by that name", args[1]))
+			return
+		}
+		f.files[args[1]] = strings.TrimPrefix(args[0], "/ipfs/")
+
+	case "/api/v0/files/rm":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, exists := f.files[arg]; !exists {
+			f.fail(w, fmt.Errorf("%s: file does not exist", arg))
+			return
+		}
+		delete(f.files, arg)
+
+	case "/api/v0/files/stat":
+		// A directory's stand-in CID hashes the paths and CIDs below it, so it changes with them
+		f.mu.Lock()
+		var entries []string
+		for mfsPath, c := range f.files {
+			if strings.HasPrefix(mfsPath, arg+"/") {
+				entries = append(entries, mfsPath+"="+c)
+			}
+		}
+		f.mu.Unlock()
+		if len(entries) == 0 {
+			f.fail(w, fmt.Errorf("file does not exist"))
+			return
+		}
+		sort.Strings(entries)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Hash": rawCID([]byte(strings.Join(entries, "\n"))), "Type": "directory"})
+
+	case "/api/v0/key/gen":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, exists := f.keys[arg]; exists {
+			f.fail(w, fmt.Errorf("key with name '%s' already exists", arg))
+			return
+		}
+		f.keys[arg] = "k51" + sha256Hex([]byte(arg))[:20]
+		json.NewEncoder(w).Encode(map[string]string{"Name": arg, "Id": f.keys[arg]})
+
+	case "/api/v0/key/list":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		keys := []map[string]string{{"Name": "self", "Id": "k51self"}}
+		for name, id := range f.keys {
+			keys = append(keys, map[string]string{"Name": name, "Id": id})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Keys": keys})
+
+	case "/api/v0/name/publish":
+		key := r.URL.Query().Get("key")
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		id, ok := f.keys[key]
+		if !ok {
+			f.fail(w, fmt.Errorf("no key named %s was found", key))
+			return
+		}
+		f.published = append(f.published, key+" "+arg)
+		json.NewEncoder(w).Encode(map[string]string{"Name": id, "Value": arg})
+
+	default:
+		f.fail(w, fmt.Errorf("unknown command %s", r.URL.Path))
+	}
+}
+
+// fail answers a request with an RPC API error
+func (f *fakeIPFS) fail(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]interface{}{"Message": err.Error(), "Code": 0, "Type": "error"})
+}
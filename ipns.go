@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ipnsEmptyDirectoryCID is the CID of an empty UnixFS directory, published for users without blobs
+const ipnsEmptyDirectoryCID = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+
+// ipnsPublishTimeout bounds a single IPNS publication
+const ipnsPublishTimeout = 2 * time.Minute
+
+// ipnsPublisher maintains an IPNS name per pubkey pointing at the pubkey's MFS directory
+// The keys are generated in the keystore of the public IPFS node and recorded in ipns_names
+// Changes are published once a pubkey's directory has been left unchanged for the debounce delay,
+// or at the latest maxDelay after the first unpublished change
+type ipnsPublisher struct {
+	db        *sql.DB
+	ipfsShell *shell.Shell
+	mfs       *mfsOrganizer
+	debounce  time.Duration
+	maxDelay  time.Duration
+
+	mu     sync.Mutex
+	timers map[string]*ipnsSchedule
+}
+
+// ipnsSchedule is a scheduled publication, which can't be postponed past its deadline
+type ipnsSchedule struct {
+	timer    *time.Timer
+	deadline time.Time
+}
+
+// createIPNSNamesTable creates the table recording the IPNS names of pubkeys if it doesn't exist
+func createIPNSNamesTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS ipns_names (
+		pubkey TEXT PRIMARY KEY,
+		key_name TEXT NOT NULL,
+		ipns_name TEXT NOT NULL,
+		cid TEXT NOT NULL DEFAULT '',
+		published_at INTEGER NOT NULL DEFAULT 0
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// newIPNSPublisher creates the publisher for the directories of an MFS organizer
+// maxDelay is raised to the debounce delay if it is shorter
+func newIPNSPublisher(db *sql.DB, ipfsShell *shell.Shell, mfs *mfsOrganizer, debounce time.Duration, maxDelay time.Duration) *ipnsPublisher {
+	return &ipnsPublisher{
+		db:        db,
+		ipfsShell: ipfsShell,
+		mfs:       mfs,
+		debounce:  debounce,
+		maxDelay:  max(maxDelay, debounce),
+		timers:    make(map[string]*ipnsSchedule),
+	}
+}
+
+// MarkDirty schedules the publication of a pubkey's directory after the debounce delay,
+// postponing any publication already scheduled up to maxDelay after the first change, so
+// a steady stream of uploads still gets published. It does nothing when IPNS publishing is disabled
+func (ip *ipnsPublisher) MarkDirty(pubkey string) {
+	if ip == nil {
+		return
+	}
+
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	// A timer that can't be stopped has already fired, and its publication may have read the
+	// directory before this change, so a new one is scheduled instead
+	if scheduled, ok := ip.timers[pubkey]; ok && scheduled.timer.Stop() {
+		delay := ip.debounce
+		if untilDeadline := time.Until(scheduled.deadline); untilDeadline < delay {
+			delay = max(untilDeadline, 0)
+		}
+		scheduled.timer.Reset(delay)
+		return
+	}
+	scheduled := &ipnsSchedule{deadline: time.Now().Add(ip.maxDelay)}
+	ip.timers[pubkey] = scheduled
+	scheduled.timer = time.AfterFunc(ip.debounce, func() {
+		ip.mu.Lock()
+		if ip.timers[pubkey] == scheduled {
+			delete(ip.timers, pubkey)
+		}
+		ip.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), ipnsPublishTimeout)
+		defer cancel()
+		if err := ip.Publish(ctx, pubkey); err != nil {
+			log.Printf("Failed to publish IPNS name of %s: %v", pubkey, err)
+		}
+	})
+}
+
+// Publish points the IPNS name of a pubkey at the current CID of its directory,
+// generating the name's key first if needed. Unchanged directories aren't republished
+func (ip *ipnsPublisher) Publish(ctx context.Context, pubkey string) error {
+	dirCID := ipnsEmptyDirectoryCID
+	stat, err := ip.ipfsShell.FilesStat(ctx, path.Join(ip.mfs.root, pubkey))
+	if err != nil && !strings.Contains(err.Error(), "does not exist") {
+		return fmt.Errorf("failed to stat directory: %w", err)
+	}
+	if err == nil {
+		dirCID = stat.Hash
+	}
+
+	keyName, ipnsName, publishedCID, err := ip.name(ctx, pubkey)
+	if err != nil {
+		return err
+	}
+	if publishedCID == dirCID {
+		return nil
+	}
+
+	// Publishing works without peers: the node announces the record once it is connected
+	var resp shell.PublishResponse
+	err = ip.ipfsShell.Request("name/publish", "/ipfs/"+dirCID).
+		Option("key", keyName).
+		Option("allow-offline", true).
+		Exec(ctx, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+
+	query := `UPDATE ipns_names SET cid = ?, published_at = ? WHERE pubkey = ?`
+	if _, err := ip.db.ExecContext(ctx, query, dirCID, time.Now().Unix(), pubkey); err != nil {
+		return fmt.Errorf("failed to record publication: %w", err)
+	}
+	log.Printf("Published IPNS name %s of %s -> %s", ipnsName, pubkey, dirCID)
+	return nil
+}
+
+// name returns the key name, IPNS name and last published CID of a pubkey,
+// generating a key in the IPFS keystore if the pubkey doesn't have one yet
+func (ip *ipnsPublisher) name(ctx context.Context, pubkey string) (string, string, string, error) {
+	var keyName, ipnsName, publishedCID string
+	err := ip.db.QueryRowContext(ctx, `SELECT key_name, ipns_name, cid FROM ipns_names WHERE pubkey = ?`, pubkey).Scan(&keyName, &ipnsName, &publishedCID)
+	if err == nil {
+		return keyName, ipnsName, publishedCID, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", "", "", fmt.Errorf("failed to query IPNS name: %w", err)
+	}
+
+	keyName = "blossom-" + pubkey
+	key, err := ip.ipfsShell.KeyGen(ctx, keyName)
+	if err != nil {
+		// The key survives in the keystore if the database was reset
+		if !strings.Contains(err.Error(), "already exists") {
+			return "", "", "", fmt.Errorf("failed to generate key: %w", err)
+		}
+		keys, err := ip.ipfsShell.KeyList(ctx)
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to list keys: %w", err)
+		}
+		for _, k := range keys {
+			if k.Name == keyName {
+				key = k
+			}
+		}
+		if key == nil {
+			return "", "", "", fmt.Errorf("key %s not found", keyName)
+		}
+	}
+
+	query := `INSERT INTO ipns_names (pubkey, key_name, ipns_name) VALUES (?, ?, ?)`
+	if _, err := ip.db.ExecContext(ctx, query, pubkey, keyName, key.Id); err != nil {
+		return "", "", "", fmt.Errorf("failed to record IPNS name: %w", err)
+	}
+	return keyName, key.Id, "", nil
+}
+
+// Refresh schedules the publication of every pubkey with linked blobs or an IPNS name,
+// so directories that changed while the server was down get republished
+func (ip *ipnsPublisher) Refresh(ctx context.Context) {
+	rows, err := ip.db.QueryContext(ctx, `SELECT pubkey FROM mfs_links UNION SELECT pubkey FROM ipns_names`)
+	if err != nil {
+		log.Printf("Failed to list pubkeys to publish IPNS names for: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			log.Printf("Failed to scan pubkey to publish IPNS name for: %v", err)
+			continue
+		}
+		ip.MarkDirty(pubkey)
+	}
+}
+
+// lookupIPNSName returns the IPNS name of a pubkey, or an empty string if it has none
+func lookupIPNSName(ctx context.Context, db *sql.DB, pubkey string) (string, error) {
+	var ipnsName string
+	err := db.QueryRowContext(ctx, `SELECT ipns_name FROM ipns_names WHERE pubkey = ?`, pubkey).Scan(&ipnsName)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return ipnsName, err
+}
+
+// ipnsListMiddleware adds the IPNS name of the listed pubkey to /list/<pubkey> responses,
+// in the X-IPNS-Name header and the "ipns_name" field of every listed blob
+func ipnsListMiddleware(next http.Handler, db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || !strings.HasPrefix(r.URL.Path, "/list/") || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pubkey := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/list/"))
+		if !nostr.IsValid32ByteHex(pubkey) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ipnsName, err := lookupIPNSName(r.Context(), db, pubkey)
+		if err != nil || ipnsName == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		capturedWriter := &responseCapturer{
+			ResponseWriter: w,
+			statusCode:     200,
+			body:           &bytes.Buffer{},
+			headers:        make(http.Header),
+		}
+		next.ServeHTTP(capturedWriter, r)
+
+		body := capturedWriter.body.Bytes()
+		var items []map[string]interface{}
+		rewrite := capturedWriter.statusCode >= 200 && capturedWriter.statusCode < 300 && json.Unmarshal(body, &items) == nil
+		for key, values := range capturedWriter.headers {
+			if rewrite && key == "Content-Length" {
+				continue
+			}
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		w.Header().Set("X-IPNS-Name", ipnsName)
+		w.WriteHeader(capturedWriter.statusCode)
+		if !rewrite {
+			w.Write(body)
+			return
+		}
+		for _, item := range items {
+			item["ipns_name"] = ipnsName
+		}
+		json.NewEncoder(w).Encode(items)
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIPNSPublisherPublish(t *testing.T) {
+	ctx := context.Background()
+	_, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	mo, err := newMFSOrganizer(db, ipfsShell, &privateBlobs{db: db}, "/blossom")
+	if err != nil {
+		t.Fatalf("newMFSOrganizer() error = %v", err)
+	}
+	ip := newIPNSPublisher(db, ipfsShell, mo, time.Hour, time.Hour)
+	_, alice := newTestKey(t)
+	keyName := "blossom-" + alice
+
+	link := func(content string) {
+		t.Helper()
+		sha := sha256Hex([]byte(content))
+		if _, err := storeBlobInIPFS(ctx, ipfsShell, db, sha, ".txt", []byte(content)); err != nil {
+			t.Fatalf("storeBlobInIPFS() error = %v", err)
+		}
+		if err := mo.Link(ctx, sha, alice, time.Now().Unix()); err != nil {
+			t.Fatalf("Link() error = %v", err)
+		}
+	}
+
+	steps := []struct {
+		name          string
+		prepare       func()
+		wantPublished bool
+		wantEmpty     bool
+	}{
+		{name: "no blobs yet", wantPublished: true, wantEmpty: true},
+		{name: "unchanged", wantPublished: false},
+		{name: "blob linked", prepare: func() { link("first blob") }, wantPublished: true},
+		{name: "unchanged after link", wantPublished: false},
+		{name: "another blob linked", prepare: func() { link("second blob") }, wantPublished: true},
+		// The key survives in the keystore when the database is reset
+		{name: "database reset", prepare: func() { db.Exec(`DELETE FROM ipns_names`) }, wantPublished: true},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if step.prepare != nil {
+				step.prepare()
+			}
+			before := len(node.publications())
+			if err := ip.Publish(ctx, alice); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+			publications := node.publications()
+			if published := len(publications) > before; published != step.wantPublished {
+				t.Fatalf("published = %v, want %v", published, step.wantPublished)
+			}
+			if !step.wantPublished {
+				return
+			}
+
+			last := publications[len(publications)-1]
+			if !strings.HasPrefix(last, keyName+" /ipfs/") {
+				t.Errorf("publication = %q, want one with key %s", last, keyName)
+			}
+			if empty := last == keyName+" /ipfs/"+ipnsEmptyDirectoryCID; empty != step.wantEmpty {
+				t.Errorf("published empty directory = %v, want %v", empty, step.wantEmpty)
+			}
+			var cid string
+			db.QueryRow(`SELECT cid FROM ipns_names WHERE pubkey = ?`, alice).Scan(&cid)
+			if last != keyName+" /ipfs/"+cid {
+				t.Errorf("recorded cid %q doesn't match publication %q", cid, last)
+			}
+			if name, _ := lookupIPNSName(ctx, db, alice); name != node.keys[keyName] {
+				t.Errorf("lookupIPNSName() = %q, want %q", name, node.keys[keyName])
+			}
+		})
+	}
+}
+
+func TestIPNSPublisherMarkDirty(t *testing.T) {
+	_, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	mo, err := newMFSOrganizer(db, ipfsShell, &privateBlobs{db: db}, "/blossom")
+	if err != nil {
+		t.Fatalf("newMFSOrganizer() error = %v", err)
+	}
+	ip := newIPNSPublisher(db, ipfsShell, mo, 50*time.Millisecond, time.Hour)
+	_, alice := newTestKey(t)
+	_, bob := newTestKey(t)
+
+	// Repeated changes within the debounce delay lead to a single publication per pubkey
+	for i := 0; i < 5; i++ {
+		ip.MarkDirty(alice)
+		time.Sleep(10 * time.Millisecond)
+	}
+	ip.MarkDirty(bob)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(node.publications()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if publications := node.publications(); len(publications) != 2 {
+		t.Errorf("publications = %v, want one for each pubkey", publications)
+	}
+
+	// Publishing is a no-op when disabled
+	var disabled *ipnsPublisher
+	disabled.MarkDirty(alice)
+}
+
+func TestIPNSPublisherMarkDirtyMaxDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		debounce time.Duration
+		maxDelay time.Duration
+		changes  int
+		// wantDuring is whether a publication happens while the changes keep coming
+		wantDuring bool
+	}{
+		{name: "changes within the debounce delay", debounce: 150 * time.Millisecond, maxDelay: time.Hour, changes: 15},
+		{name: "changes past the max delay", debounce: 150 * time.Millisecond, maxDelay: 200 * time.Millisecond, changes: 15, wantDuring: true},
+		{name: "max delay below the debounce delay", debounce: 150 * time.Millisecond, maxDelay: time.Millisecond, changes: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			_, db := newTestDB(t)
+			node, ipfsShell := newFakeIPFS(t)
+			mo, err := newMFSOrganizer(db, ipfsShell, &privateBlobs{db: db}, "/blossom")
+			if err != nil {
+				t.Fatalf("newMFSOrganizer() error = %v", err)
+			}
+			ip := newIPNSPublisher(db, ipfsShell, mo, tt.debounce, tt.maxDelay)
+			_, alice := newTestKey(t)
+
+			// A blob is linked every 25ms, each change postponing the publication
+			for i := 0; i < tt.changes; i++ {
+				content := []byte(fmt.Sprintf("blob %d", i))
+				sha := sha256Hex(content)
+				if _, err := storeBlobInIPFS(ctx, ipfsShell, db, sha, ".txt", content); err != nil {
+					t.Fatalf("storeBlobInIPFS() error = %v", err)
+				}
+				if err := mo.Link(ctx, sha, alice, time.Now().Unix()); err != nil {
+					t.Fatalf("Link() error = %v", err)
+				}
+				ip.MarkDirty(alice)
+				time.Sleep(25 * time.Millisecond)
+			}
+			if during := len(node.publications()) > 0; during != tt.wantDuring {
+				t.Errorf("published while changes kept coming = %v, want %v", during, tt.wantDuring)
+			}
+
+			// The last change is always published once things settle
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				var cid string
+				db.QueryRow(`SELECT cid FROM ipns_names WHERE pubkey = ?`, alice).Scan(&cid)
+				if stat, err := ipfsShell.FilesStat(ctx, "/blossom/"+alice); err == nil && cid == stat.Hash {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Errorf("last change was never published")
+		})
+	}
+}
+
+func TestIPNSListMiddleware(t *testing.T) {
+	_, db := newTestDB(t)
+	_, alice := newTestKey(t)
+	_, bob := newTestKey(t)
+	query := `INSERT INTO ipns_names (pubkey, key_name, ipns_name) VALUES (?, ?, ?)`
+	if _, err := db.Exec(query, alice, "blossom-"+alice, "k51alice"); err != nil {
+		t.Fatalf("failed to record IPNS name: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantName string
+	}{
+		{name: "pubkey with name", method: "GET", path: "/list/" + alice, wantName: "k51alice"},
+		{name: "uppercase pubkey", method: "GET", path: "/list/" + strings.ToUpper(alice), wantName: "k51alice"},
+		{name: "pubkey without name", method: "GET", path: "/list/" + bob},
+		{name: "invalid pubkey", method: "GET", path: "/list/nobody"},
+		{name: "other endpoint", method: "GET", path: "/" + alice},
+	}
+
+	const list = `[{"sha256":"aa","size":1},{"sha256":"bb","size":2}]`
+	handler := ipnsListMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(list)))
+		w.Write([]byte(list))
+	}), db)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if name := rec.Header().Get("X-IPNS-Name"); name != tt.wantName {
+				t.Errorf("X-IPNS-Name = %q, want %q", name, tt.wantName)
+			}
+			if rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("Content-Type = %q, want it kept", rec.Header().Get("Content-Type"))
+			}
+
+			var items []map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil || len(items) != 2 {
+				t.Fatalf("invalid list %q: %v", rec.Body.String(), err)
+			}
+			for _, item := range items {
+				if name, _ := item["ipns_name"].(string); name != tt.wantName {
+					t.Errorf("ipns_name of %v = %q, want %q", item["sha256"], name, tt.wantName)
+				}
+			}
+		})
+	}
+}
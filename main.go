@@ -12,9 +12,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fiatjaf/eventstore/sqlite3"
@@ -78,6 +80,234 @@ func main() {
 		log.Printf("No pubkey whitelist configured - authentication not required")
 	}
 
+	// Parse admin pubkeys for the NIP-86 management API
+	adminPubkeys, err := parsePubkeyWhitelist(os.Getenv("ADMIN_PUBKEYS"))
+	if err != nil {
+		log.Fatalf("Failed to parse ADMIN_PUBKEYS: %v", err)
+	}
+	if len(adminPubkeys) > 0 {
+		log.Printf("NIP-86 management API enabled with %d admin keys", len(adminPubkeys))
+	}
+
+	// Parse web of trust configuration from environment
+	wotRoots, err := parsePubkeyWhitelist(os.Getenv("WOT_ROOT_PUBKEYS"))
+	if err != nil {
+		log.Fatalf("Failed to parse WOT_ROOT_PUBKEYS: %v", err)
+	}
+	wotDepth := 1
+	if wotDepthStr := os.Getenv("WOT_DEPTH"); wotDepthStr != "" {
+		if val, err := strconv.Atoi(wotDepthStr); err == nil && val >= 0 {
+			wotDepth = val
+		}
+	}
+	wotRefreshInterval := time.Hour
+	if intervalStr := os.Getenv("WOT_REFRESH_INTERVAL"); intervalStr != "" {
+		if val, err := time.ParseDuration(intervalStr); err == nil && val > 0 {
+			wotRefreshInterval = val
+		}
+	}
+	wotRelays := parseRelayList(os.Getenv("WOT_RELAYS"))
+
+	// Parse NIP-05 domain authorization configuration from environment
+	nip05Domains, err := parseNIP05Domains(os.Getenv("NIP05_ALLOWED_DOMAINS"))
+	if err != nil {
+		log.Fatalf("Failed to parse NIP05_ALLOWED_DOMAINS: %v", err)
+	}
+	nip05CacheTTL := time.Hour
+	if ttlStr := os.Getenv("NIP05_CACHE_TTL"); ttlStr != "" {
+		if val, err := time.ParseDuration(ttlStr); err == nil && val > 0 {
+			nip05CacheTTL = val
+		}
+	}
+	nip05Relays := parseRelayList(os.Getenv("NIP05_RELAYS"))
+
+	// Read default upload quotas from environment (0 = unlimited)
+	defaultQuota := quotaLimits{
+		MaxBlobSize:      parseEnvInt64("QUOTA_MAX_BLOB_SIZE_MB") * 1024 * 1024,
+		MaxTotalBytes:    parseEnvInt64("QUOTA_MAX_TOTAL_MB") * 1024 * 1024,
+		MaxBlobs:         parseEnvInt64("QUOTA_MAX_BLOBS"),
+		MaxUploadsPerDay: parseEnvInt64("QUOTA_MAX_UPLOADS_PER_DAY"),
+	}
+
+	// Read upload content policy from environment
+	uploadPolicy := newContentPolicy(
+		os.Getenv("UPLOAD_ALLOWED_TYPES"),
+		os.Getenv("UPLOAD_DENIED_TYPES"),
+		os.Getenv("UPLOAD_ALLOWED_EXTENSIONS"),
+		os.Getenv("UPLOAD_DENIED_EXTENSIONS"),
+	)
+	if uploadPolicy.Enabled() {
+		log.Printf("Upload content policy enabled")
+	}
+
+	// Read rate limits ("<count>/<interval>") and trusted proxies from environment
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Failed to parse TRUSTED_PROXIES: %v", err)
+	}
+	forwardedHeaderProxies = trustedProxies
+	rateLimits := map[string]string{
+		rateLimitUploads:     os.Getenv("RATE_LIMIT_UPLOADS"),
+		rateLimitReads:       os.Getenv("RATE_LIMIT_READS"),
+		rateLimitLists:       os.Getenv("RATE_LIMIT_LISTS"),
+		rateLimitRelayReq:    os.Getenv("RATE_LIMIT_RELAY_REQ"),
+		rateLimitRelayEvents: os.Getenv("RATE_LIMIT_RELAY_EVENTS"),
+	}
+
+	// Initialize metrics and rate limiting
+	metrics := newMetricsRegistry()
+	limiter, err := newRateLimiter(rateLimits, trustedProxies, metrics)
+	if err != nil {
+		log.Fatalf("Failed to configure rate limits: %v", err)
+	}
+
+	// Read private blob mode from environment
+	privateMode := os.Getenv("PRIVATE_MODE")
+	if privateMode == "" {
+		privateMode = privateModeOff
+	}
+	if privateMode != privateModeOff && privateMode != privateModeOptIn && privateMode != privateModeAll {
+		log.Fatalf("PRIVATE_MODE must be one of %s, %s or %s", privateModeOff, privateModeOptIn, privateModeAll)
+	}
+	privateIPFSAPIURL := os.Getenv("PRIVATE_IPFS_API_URL")
+	if privateMode != privateModeOff && privateIPFSAPIURL == "" {
+		log.Fatal("PRIVATE_IPFS_API_URL environment variable is required when PRIVATE_MODE is enabled")
+	}
+
+	// Read blob retention configuration from environment (empty TTL = keep forever)
+	var retentionDefaultTTL time.Duration
+	if ttlStr := os.Getenv("RETENTION_DEFAULT_TTL"); ttlStr != "" {
+		if val, err := time.ParseDuration(ttlStr); err == nil && val > 0 {
+			retentionDefaultTTL = val
+		}
+	}
+	retentionUnusedDays := int(parseEnvInt64("RETENTION_UNUSED_DAYS"))
+	retentionReapInterval := time.Hour
+	if intervalStr := os.Getenv("RETENTION_REAP_INTERVAL"); intervalStr != "" {
+		if val, err := time.ParseDuration(intervalStr); err == nil && val > 0 {
+			retentionReapInterval = val
+		}
+	}
+
+	// Read blocklist configuration from environment
+	blocklistUnpin := strings.EqualFold(os.Getenv("BLOCKLIST_UNPIN"), "true")
+	blocklistFiles := parseBlocklistFiles(os.Getenv("BLOCKLIST_FILES"))
+	blocklistNostrLists, err := parseNostrLists(os.Getenv("BLOCKLIST_NOSTR_LISTS"))
+	if err != nil {
+		log.Fatalf("Failed to parse BLOCKLIST_NOSTR_LISTS: %v", err)
+	}
+	blocklistRelays := parseRelayList(os.Getenv("BLOCKLIST_RELAYS"))
+	blocklistRefreshInterval := time.Hour
+	if intervalStr := os.Getenv("BLOCKLIST_REFRESH_INTERVAL"); intervalStr != "" {
+		if val, err := time.ParseDuration(intervalStr); err == nil && val > 0 {
+			blocklistRefreshInterval = val
+		}
+	}
+
+	// Read the number of distinct reporters that quarantines a blob (0 = never)
+	reportQuarantineThreshold := int(parseEnvInt64("REPORT_QUARANTINE_THRESHOLD"))
+	// Read the report budget of each pubkey ("none" = unlimited)
+	reportRateLimit := "10/1h"
+	if val := os.Getenv("REPORT_RATE_LIMIT"); strings.EqualFold(val, "none") {
+		reportRateLimit = ""
+	} else if val != "" {
+		reportRateLimit = val
+	}
+
+	// Read BUD-04 mirror limits from environment
+	mirrorMaxSize := int64(mirrorDefaultMaxSize)
+	if val := parseEnvInt64("MIRROR_MAX_SIZE"); val > 0 {
+		mirrorMaxSize = val
+	}
+	mirrorTimeout := time.Minute
+	if timeoutStr := os.Getenv("MIRROR_TIMEOUT"); timeoutStr != "" {
+		if val, err := time.ParseDuration(timeoutStr); err == nil && val > 0 {
+			mirrorTimeout = val
+		}
+	}
+	mirrorAllowPrivate := strings.EqualFold(os.Getenv("MIRROR_ALLOW_PRIVATE_IPS"), "true")
+
+	// Read BUD-05 media optimization limits from environment
+	mediaMaxSize := int64(50 * 1024 * 1024)
+	if val := parseEnvInt64("MEDIA_MAX_SIZE"); val > 0 {
+		mediaMaxSize = val
+	}
+	mediaMaxWidth, mediaMaxHeight := 2048, 2048
+	if val := parseEnvInt64("MEDIA_MAX_WIDTH"); val > 0 {
+		mediaMaxWidth = int(val)
+	}
+	if val := parseEnvInt64("MEDIA_MAX_HEIGHT"); val > 0 {
+		mediaMaxHeight = int(val)
+	}
+	mediaMaxPixels := 50_000_000
+	if val := parseEnvInt64("MEDIA_MAX_PIXELS"); val > 0 {
+		mediaMaxPixels = int(val)
+	}
+	mediaJPEGQuality := 85
+	if val := parseEnvInt64("MEDIA_JPEG_QUALITY"); val > 0 && val <= 100 {
+		mediaJPEGQuality = int(val)
+	}
+
+	// Read the NIP-96 upload size limit from environment
+	nip96MaxSize := int64(100 * 1024 * 1024)
+	if val := parseEnvInt64("NIP96_MAX_SIZE"); val > 0 {
+		nip96MaxSize = val
+	}
+
+	// Read thumbnail sizes for image previews from environment
+	thumbnailSizesStr := os.Getenv("THUMBNAIL_SIZES")
+	if thumbnailSizesStr == "" {
+		thumbnailSizesStr = "256,640"
+	}
+	thumbnailSizes, err := parseThumbnailSizes(thumbnailSizesStr)
+	if err != nil {
+		log.Fatalf("Failed to parse THUMBNAIL_SIZES: %v", err)
+	}
+
+	// Read the server key used to sign NIP-94 file metadata events from environment
+	publishFileMetadata := strings.EqualFold(os.Getenv("PUBLISH_FILE_METADATA"), "true")
+	var serverKey string
+	if keyStr := os.Getenv("SERVER_PRIVATE_KEY"); keyStr != "" {
+		serverKey, err = parseServerKey(keyStr)
+		if err != nil {
+			log.Fatalf("Failed to parse SERVER_PRIVATE_KEY: %v", err)
+		}
+	}
+	if publishFileMetadata && serverKey == "" {
+		log.Fatal("SERVER_PRIVATE_KEY environment variable is required when PUBLISH_FILE_METADATA is enabled")
+	}
+
+	// Read MFS organisation settings from environment
+	mfsOrganize := strings.EqualFold(os.Getenv("MFS_ORGANIZE"), "true")
+	mfsRoot := os.Getenv("MFS_ROOT")
+	if mfsRoot == "" {
+		mfsRoot = "/blossom"
+	}
+
+	// Read per-user IPNS publishing settings from environment
+	ipnsPublish := strings.EqualFold(os.Getenv("IPNS_PUBLISH"), "true")
+	ipnsDebounce := time.Minute
+	if debounceStr := os.Getenv("IPNS_DEBOUNCE"); debounceStr != "" {
+		if val, err := time.ParseDuration(debounceStr); err == nil && val > 0 {
+			ipnsDebounce = val
+		}
+	}
+	ipnsMaxDelay := 10 * time.Minute
+	if maxDelayStr := os.Getenv("IPNS_MAX_DELAY"); maxDelayStr != "" {
+		if val, err := time.ParseDuration(maxDelayStr); err == nil && val > 0 {
+			ipnsMaxDelay = val
+		}
+	}
+	if ipnsPublish && !mfsOrganize {
+		log.Fatal("MFS_ORGANIZE must be enabled when IPNS_PUBLISH is enabled")
+	}
+
+	// Read master keys for encrypting private blobs from environment
+	currentMasterKeyID, masterKeys, err := parseMasterKeys(os.Getenv("ENCRYPTION_MASTER_KEYS"))
+	if err != nil {
+		log.Fatalf("Failed to parse ENCRYPTION_MASTER_KEYS: %v", err)
+	}
+
 	// Initialize SQLite3 backend for event storage
 	db := &sqlite3.SQLite3Backend{DatabaseURL: dbPath}
 	if err := db.Init(); err != nil {
@@ -92,6 +322,12 @@ func main() {
 	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
 	relay.ReplaceEvent = append(relay.ReplaceEvent, db.ReplaceEvent)
 
+	// Rate limit relay REQ and EVENT messages
+	if limiter.Enabled() {
+		relay.RejectFilter = append(relay.RejectFilter, limiter.RejectFilter)
+		relay.RejectEvent = append(relay.RejectEvent, limiter.RejectEvent)
+	}
+
 	// Initialize IPFS client
 	ipfsShell := shell.NewShell(ipfsAPIURL)
 
@@ -112,38 +348,431 @@ func main() {
 		log.Fatalf("Failed to create mapping table: %v", err)
 	}
 
+	// Set up thumbnails and blurhashes for image uploads
+	if err := createPreviewTables(sqlDB); err != nil {
+		log.Fatalf("Failed to create preview tables: %v", err)
+	}
+	previews := newPreviewGenerator(sqlDB, ipfsShell, thumbnailSizes, mediaMaxPixels)
+
+	// Publish NIP-94 file metadata events for public blobs, signed with the server key
+	var metadata *fileMetadataPublisher
+	if publishFileMetadata {
+		metadata, err = newFileMetadataPublisher(relay, db, sqlDB, serverKey, ipfsGatewayURL)
+		if err != nil {
+			log.Fatalf("Failed to set up file metadata publishing: %v", err)
+		}
+		if relay.Info.PubKey == "" {
+			relay.Info.PubKey = metadata.pubkey
+		}
+		log.Printf("Publishing file metadata events as %s", metadata.pubkey)
+	}
+
+	// Create management tables and restore relay information changed through NIP-86
+	if err := createManagementTables(sqlDB); err != nil {
+		log.Fatalf("Failed to create management tables: %v", err)
+	}
+	if err := loadRelaySettings(sqlDB, relay.Info); err != nil {
+		log.Fatalf("Failed to load relay settings: %v", err)
+	}
+	if len(adminPubkeys) > 0 {
+		setupManagementAPI(relay, db, sqlDB, adminPubkeys, allowedPubkeys)
+	}
+
+	// Create usage table and load per-pubkey/role quotas
+	if err := createUsageTable(sqlDB); err != nil {
+		log.Fatalf("Failed to create usage table: %v", err)
+	}
+	quotas, err := loadQuotaPolicy(sqlDB, defaultQuota, os.Getenv("QUOTA_CONFIG_FILE"), adminPubkeys, allowedPubkeys)
+	if err != nil {
+		log.Fatalf("Failed to load quota policy: %v", err)
+	}
+
+	// Create retention tables and load per-pubkey/MIME type TTLs
+	if err := createRetentionTables(sqlDB); err != nil {
+		log.Fatalf("Failed to create retention tables: %v", err)
+	}
+	retention, err := loadRetentionPolicy(sqlDB, retentionDefaultTTL, retentionUnusedDays, os.Getenv("RETENTION_CONFIG_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load retention policy: %v", err)
+	}
+
+	// Set up private blobs, stored on an IPFS node that doesn't announce to the DHT
+	if err := createPrivateBlobsTable(sqlDB); err != nil {
+		log.Fatalf("Failed to create private blobs table: %v", err)
+	}
+	private := &privateBlobs{
+		mode:                 privateMode,
+		db:                   sqlDB,
+		adminPubkeys:         adminPubkeys,
+		staticAllowedPubkeys: allowedPubkeys,
+	}
+	if privateIPFSAPIURL != "" {
+		private.ipfsShell = shell.NewShell(privateIPFSAPIURL)
+		if !private.ipfsShell.IsUp() {
+			log.Fatalf("Private IPFS API at %s is not accessible", privateIPFSAPIURL)
+		}
+		log.Printf("Private blobs enabled (mode %s)", privateMode)
+	}
+
+	// Set up envelope encryption of private blobs, re-wrapping data keys after a master key rotation
+	if err := createEncryptionTable(sqlDB); err != nil {
+		log.Fatalf("Failed to create encryption table: %v", err)
+	}
+	if len(masterKeys) > 0 {
+		private.encryption = newBlobEncryption(sqlDB, currentMasterKeyID, masterKeys)
+		if _, err := private.encryption.RotateKeys(context.Background()); err != nil {
+			log.Fatalf("Failed to rotate data keys: %v", err)
+		}
+		log.Printf("Private blob encryption enabled with master key %s", currentMasterKeyID)
+	}
+
+	// Link public blobs into MFS by owner and month
+	if err := createMFSLinksTable(sqlDB); err != nil {
+		log.Fatalf("Failed to create MFS links table: %v", err)
+	}
+	var mfs *mfsOrganizer
+	if mfsOrganize {
+		mfs, err = newMFSOrganizer(sqlDB, ipfsShell, private, mfsRoot)
+		if err != nil {
+			log.Fatalf("Failed to parse MFS_ROOT: %v", err)
+		}
+		log.Printf("Linking public blobs into MFS under %s", mfs.root)
+	}
+
+	// Publish an IPNS name per pubkey pointing at its MFS directory
+	if err := createIPNSNamesTable(sqlDB); err != nil {
+		log.Fatalf("Failed to create IPNS names table: %v", err)
+	}
+	if ipnsPublish {
+		mfs.ipns = newIPNSPublisher(sqlDB, ipfsShell, mfs, ipnsDebounce, ipnsMaxDelay)
+		log.Printf("Publishing per-user IPNS names %s after directory changes (at most %s after the first)", ipnsDebounce, max(ipnsMaxDelay, ipnsDebounce))
+	}
+
+	// Set up the sha256/CID blocklist and import shared blocklists in the background
+	if err := createBlocklistTables(sqlDB); err != nil {
+		log.Fatalf("Failed to create blocklist tables: %v", err)
+	}
+	blocks := newBlocklist(sqlDB, ipfsShell, private, blocklistUnpin, blocklistFiles, blocklistNostrLists, blocklistRelays)
+	blocks.metadata = metadata
+	blocks.mfs = mfs
+	blocks.Start(context.Background(), blocklistRefreshInterval)
+
+	// Upload authorizers grant upload access beyond the pubkey whitelist
+	var uploadAuthorizers []uploadAuthorizer
+
+	// Set up web of trust upload authorization
+	if len(wotRoots) > 0 {
+		if err := createWoTTable(sqlDB); err != nil {
+			log.Fatalf("Failed to create web of trust table: %v", err)
+		}
+		wot := newWebOfTrust(sqlDB, db, wotRoots, wotDepth, wotRelays)
+		if err := wot.LoadCache(); err != nil {
+			log.Printf("Failed to load web of trust cache: %v", err)
+		}
+		wot.Start(context.Background(), wotRefreshInterval)
+		uploadAuthorizers = append(uploadAuthorizers, wot.Authorize)
+		log.Printf("Web of trust enabled with %d roots, depth %d, %d remote relays, refresh every %s",
+			len(wotRoots), wotDepth, len(wotRelays), wotRefreshInterval)
+	}
+
+	// Set up NIP-05 domain upload authorization
+	if len(nip05Domains) > 0 {
+		if err := createNIP05Table(sqlDB); err != nil {
+			log.Fatalf("Failed to create NIP-05 table: %v", err)
+		}
+		nip05Auth := newNIP05Authorizer(sqlDB, db, nip05Domains, nip05CacheTTL, nip05Relays)
+		uploadAuthorizers = append(uploadAuthorizers, nip05Auth.Authorize)
+		log.Printf("NIP-05 upload authorization enabled for %d domains, cache TTL %s", len(nip05Domains), nip05CacheTTL)
+	}
+
+	// Set up BUD-09 reports and the review queue
+	// Only admins, allowed pubkeys and pubkeys trusted by the upload authorizers count towards auto-quarantine
+	if err := createReportTables(sqlDB); err != nil {
+		log.Fatalf("Failed to create report tables: %v", err)
+	}
+	var reportLimiter *tokenBucketLimiter
+	if count, interval, err := parseRateLimit(reportRateLimit); err != nil {
+		log.Fatalf("Failed to parse REPORT_RATE_LIMIT: %v", err)
+	} else if count > 0 {
+		reportLimiter = newTokenBucketLimiter(count, interval)
+	}
+	reports := newBlobReports(sqlDB, db, blocks, reportQuarantineThreshold, adminPubkeys, allowedPubkeys, uploadAuthorizers, reportLimiter)
+	if reportQuarantineThreshold > 0 {
+		log.Printf("Blobs reported by %d trusted pubkeys are quarantined", reportQuarantineThreshold)
+	}
+
+	// Reject events from banned pubkeys and banned event ids
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if banned, err := isPubkeyBanned(ctx, sqlDB, event.PubKey); err != nil {
+			return true, "error: failed to check pubkey ban"
+		} else if banned {
+			return true, "blocked: pubkey is banned"
+		}
+		if banned, err := isEventBanned(ctx, sqlDB, event.ID); err != nil {
+			return true, "error: failed to check event ban"
+		} else if banned {
+			return true, "blocked: event is banned"
+		}
+		return false, ""
+	})
+
 	// Initialize blossom
 	serviceURL := fmt.Sprintf("http://localhost:%s", port)
 	bl := blossom.New(relay, serviceURL)
-	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: bl.ServiceURL}
+	bl.Store = retentionTrackingIndex{
+		BlobIndex: mfsTrackingIndex{
+			BlobIndex: usageTrackingIndex{
+				BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: bl.ServiceURL},
+				db:        sqlDB,
+			},
+			mfs: mfs,
+		},
+		retention: retention,
+	}
+
+	// Reap expired blobs in the background
+	retention.store = bl.Store
+	retention.publicShell = ipfsShell
+	retention.private = private
+	retention.metadata = metadata
+	retention.mfs = mfs
+	retention.Start(context.Background(), retentionReapInterval)
+
+	// Link blobs stored before MFS organisation was enabled, then republish changed directories
+	if mfs != nil {
+		go func() {
+			mfs.Sync(context.Background())
+			if mfs.ipns != nil {
+				mfs.ipns.Refresh(context.Background())
+			}
+		}()
+	}
 
 	// Set up StoreBlob handler
 	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, ext string, body []byte) error {
-		_, err := storeBlobInIPFS(ctx, ipfsShell, sqlDB, sha256, ext, body)
-		return err
+		if err := blocks.CheckUpload(ctx, sha256, body); err != nil {
+			return err
+		}
+		// Never trust the client-provided extension: derive it from the sniffed content type
+		ext = normalizeExtension(sniffContentType(body), ext)
+		// Private blobs go to the private IPFS node, encrypted if a master key is configured
+		storeShell, storeBody, err := private.prepareStorage(ctx, sha256, body, ipfsShell)
+		if err != nil {
+			return err
+		}
+		_, added, err := addBlobToIPFS(ctx, storeShell, sqlDB, sha256, ext, storeBody)
+		if err != nil {
+			return err
+		}
+		// Uploads of known blobs only record the new owner, which the blob index already did
+		if !added {
+			return nil
+		}
+		// Previews and file metadata are public, so they are only generated for public blobs
+		if storeShell == ipfsShell {
+			if err := previews.Generate(ctx, sha256, ext, body); err != nil {
+				log.Printf("Failed to generate previews for sha256=%s: %v", sha256, err)
+			}
+			if metadata != nil {
+				if err := metadata.Publish(ctx, sha256, ext, len(body)); err != nil {
+					log.Printf("Failed to publish file metadata for sha256=%s: %v", sha256, err)
+				}
+			}
+			// The owners were recorded before the blob was stored, so they are linked now
+			if err := mfs.LinkOwners(ctx, sha256); err != nil {
+				log.Printf("Failed to link sha256=%s into MFS: %v", sha256, err)
+			}
+		}
+		return nil
 	})
 
 	// Set up LoadBlob handler
+	// Private blobs are only served by the private blob middleware, after checking auth
 	bl.LoadBlob = append(bl.LoadBlob, func(ctx context.Context, sha256 string, ext string) (io.ReadSeeker, error) {
+		if isPrivate, err := private.IsPrivate(ctx, sha256); err != nil || isPrivate {
+			return nil, fmt.Errorf("blob is private: sha256=%s", sha256)
+		}
 		return loadBlobFromIPFS(ctx, ipfsShell, sqlDB, sha256, ext)
 	})
 
-	// Set up RejectUpload hook for whitelist authentication (uploads only)
-	if len(allowedPubkeys) > 0 {
+	// Refuse to serve banned blobs
+	bl.RejectGet = append(bl.RejectGet, func(ctx context.Context, auth *nostr.Event, sha256 string, ext string) (bool, string, int) {
+		if banned, err := isBlobBanned(ctx, sqlDB, sha256); err != nil {
+			return true, "failed to check blob ban", http.StatusInternalServerError
+		} else if banned {
+			return true, errBlobBanned.Error(), http.StatusUnavailableForLegalReasons
+		}
+		return false, "", 0
+	})
+
+	// Set up RejectUpload hook for banned pubkeys and whitelist authentication (uploads only)
+	// The whitelist is ALLOWED_PUBKEYS plus any pubkey allowed through NIP-86, and
+	// upload authorizers (web of trust, NIP-05 domains) can grant access to other pubkeys
+	uploadWhitelist := len(allowedPubkeys) > 0 || strings.EqualFold(os.Getenv("UPLOAD_WHITELIST"), "true")
+	bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+		if auth != nil {
+			if banned, err := isPubkeyBanned(ctx, sqlDB, auth.PubKey); err != nil {
+				return true, "failed to check pubkey ban", http.StatusInternalServerError
+			} else if banned {
+				return true, "pubkey is banned", http.StatusForbidden
+			}
+		}
+
+		code, reason, err := checkUploadWhitelist(ctx, sqlDB, auth, allowedPubkeys, uploadWhitelist, uploadAuthorizers)
+		if err != nil {
+			log.Printf("Failed to check upload whitelist: %v", err)
+			return true, "failed to load pubkey whitelist", http.StatusInternalServerError
+		}
+		if code != 0 {
+			return true, reason, code
+		}
+		return false, "", 0
+	})
+
+	// Enforce the content policy on the extension detected by blossom (the body is sniffed separately)
+	if uploadPolicy.Enabled() {
 		bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
-			if err := checkPubkeyAuthFromEvent(auth, allowedPubkeys); err != nil {
-				return true, err.Error(), http.StatusForbidden
+			// The type of a mirrored blob is only known once it is downloaded
+			if precheck, _ := ctx.Value(uploadPrecheckKey).(bool); precheck {
+				return false, "", 0
+			}
+			if reason := uploadPolicy.Check(typeForExtension(ext), ext); reason != "" {
+				return true, reason, http.StatusUnsupportedMediaType
 			}
 			return false, "", 0
 		})
 	}
 
+	// Enforce per-pubkey quotas before the body is read
+	bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+		if auth == nil {
+			return false, "", 0
+		}
+		code, reason, err := quotas.CheckUpload(ctx, auth.PubKey, int64(size))
+		if err != nil {
+			log.Printf("Failed to check quota for pubkey %s: %v", auth.PubKey, err)
+			return true, "failed to check quota", http.StatusInternalServerError
+		}
+		if code != 0 {
+			log.Printf("Rejected upload from pubkey %s: %s", auth.PubKey, reason)
+			return true, reason, code
+		}
+		return false, "", 0
+	})
+
+	// Set up signed, expiring download links
+	if err := createDownloadLinksTable(sqlDB); err != nil {
+		log.Fatalf("Failed to create download links table: %v", err)
+	}
+	links, err := newDownloadLinks(sqlDB, os.Getenv("DOWNLOAD_LINK_SECRET"), adminPubkeys)
+	if err != nil {
+		log.Fatalf("Failed to set up download links: %v", err)
+	}
+	private.links = links
+
+	// Serve the blob moderation extensions of NIP-86 in front of the relay
+	var relayHandler http.Handler = relay
+	if len(adminPubkeys) > 0 {
+		relayHandler = nip86Handler(relay, blocks, reports, adminPubkeys)
+	}
+
+	// Mirror remote blobs with SSRF protection instead of the blossom library's handler
+	relayHandler = mirrorMiddleware(relayHandler, newBlobMirror(bl, mirrorMaxSize, mirrorTimeout, mirrorAllowPrivate))
+
+	// Optimize images uploaded to /media instead of redirecting them to /upload
+	media := newMediaOptimizer(bl, blocks, mediaMaxSize, mediaMaxWidth, mediaMaxHeight, mediaMaxPixels, mediaJPEGQuality)
+	relayHandler = mediaMiddleware(relayHandler, media)
+
+	// Evaluate upload preflight requests against all upload policies
+	relayHandler = preflightMiddleware(relayHandler, bl, sqlDB, private)
+
+	// Accept body-less uploads of blobs that are already stored
+	relayHandler = dedupUploadMiddleware(relayHandler, bl, sqlDB, private)
+
 	// Wrap the relay with middleware to modify blossom responses
-	handler := modifyBlossomResponse(relay, sqlDB, ipfsGatewayURL)
+	handler := modifyBlossomResponse(relayHandler, sqlDB, ipfsGatewayURL, links)
+
+	// Announce the IPNS name of listed pubkeys
+	handler = ipnsListMiddleware(handler, sqlDB)
+
+	// Resolve blobs by CID and serve them as a trustless gateway
+	lookup := &cidLookup{server: bl, db: sqlDB, private: private, publicShell: ipfsShell, gatewayURL: ipfsGatewayURL, retention: retention}
+	handler = cidLookupMiddleware(handler, lookup)
+	handler = ipfsGatewayMiddleware(handler, lookup)
+
+	// Serve the NIP-96 file storage API for clients that don't speak Blossom
+	handler = nip96Middleware(handler, newNIP96Server(bl, sqlDB, private, blocks, media, ipfsGatewayURL, nip96MaxSize))
+
+	// Count successful uploads against the daily quota and release blobs kept by failed ones
+	handler = uploadAccountingMiddleware(handler, bl.Store, sqlDB)
+
+	// Require authentication for private blobs and hide their CIDs
+	handler = privateBlobMiddleware(handler, private)
+
+	// Pass upload expirations to the blob index, record downloads and answer 410 for reaped blobs
+	handler = retentionMiddleware(handler, retention)
+
+	// Receive BUD-09 reports and stop serving quarantined blobs
+	handler = reportMiddleware(handler, reports)
+
+	// Reject uploads of blocked blobs with 451, before blossom reads their body
+	handler = blocklistMiddleware(handler, blocks)
+
+	// Sniff upload bodies and reject disallowed content before blossom reads them
+	if uploadPolicy.Enabled() {
+		handler = enforceContentPolicy(handler, uploadPolicy)
+	}
+
+	// Rate limit uploads, blob reads and list calls before doing any other work
+	if limiter.Enabled() {
+		handler = rateLimitMiddleware(handler, limiter)
+	}
+
+	// Export and import blobs as CAR archives, from the command line or the admin API
+	archive := &blobArchive{db: sqlDB, publicShell: ipfsShell, store: bl.Store, blocks: blocks, previews: previews, metadata: metadata}
+
+	// Track the progress of imports from other Blossom servers
+	if err := createBlossomImportTable(sqlDB); err != nil {
+		log.Fatalf("Failed to create blossom import table: %v", err)
+	}
+
+	// Run a command instead of serving when one is given on the command line
+	if len(os.Args) > 1 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		var err error
+		switch os.Args[1] {
+		case "import-blossom":
+			importer := &blossomImporter{
+				db:          sqlDB,
+				publicShell: ipfsShell,
+				store:       bl.Store,
+				blocks:      blocks,
+				previews:    previews,
+				metadata:    metadata,
+				mirror:      newBlobMirror(bl, mirrorMaxSize, mirrorTimeout, mirrorAllowPrivate),
+			}
+			err = runBlossomImportCommand(ctx, importer, os.Args[2:])
+		default:
+			err = runArchiveCommand(ctx, archive, os.Args[1:])
+		}
+		stop()
+		if err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
 
 	// Add healthcheck endpoint and home page
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", healthCheckHandler(sqlDB, ipfsShell, maxMemoryMB, maxGoroutines))
+	mux.HandleFunc("/usage", usageHandler(quotas))
+	mux.HandleFunc("/links", downloadLinksHandler(links))
+	mux.HandleFunc("/links/", downloadLinksHandler(links))
+	mux.HandleFunc("/metrics", metrics.Handler())
+	if len(adminPubkeys) > 0 {
+		mux.HandleFunc("/admin/export", archiveHandler(archive, adminPubkeys))
+		mux.HandleFunc("/admin/import", archiveHandler(archive, adminPubkeys))
+	}
 	mux.HandleFunc("/", homePageHandler(sqlDB, ipfsShell, maxMemoryMB, maxGoroutines, ipfsGatewayURL, handler))
 
 	log.Printf("Running blossom server on :%s", port)
@@ -153,8 +782,14 @@ func main() {
 }
 
 // modifyBlossomResponse wraps the relay to intercept and modify blossom JSON responses
-func modifyBlossomResponse(relay http.Handler, db *sql.DB, gatewayURL string) http.Handler {
+func modifyBlossomResponse(relay http.Handler, db *sql.DB, gatewayURL string, links *downloadLinks) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Relay protocol requests are passed through untouched (websockets can't be captured)
+		if isRelayProtocolRequest(r) {
+			relay.ServeHTTP(w, r)
+			return
+		}
+
 		// Check if this is a GET request to a blob URL (pattern: /sha256.ext)
 		if r.Method == "GET" {
 			path := strings.TrimPrefix(r.URL.Path, "/")
@@ -165,18 +800,37 @@ func modifyBlossomResponse(relay http.Handler, db *sql.DB, gatewayURL string) ht
 				lastDot := strings.LastIndex(path, ".")
 				if lastDot > 0 {
 					sha256 := path[:lastDot]
-					ext := path[lastDot:]
 
 					// SHA256 should be 64 hex characters
 					if len(sha256) == 64 {
-						// Look up CID from database
-						var ipfsCID string
-						query := `SELECT ipfs_cid FROM ipfs_blossom_mapping WHERE sha256 = ?`
-						err := db.QueryRow(query, sha256).Scan(&ipfsCID)
+						// Banned blobs are never redirected
+						if banned, err := isBlobBanned(r.Context(), db, sha256); err == nil && banned {
+							log.Printf("Refusing to serve banned blob sha256=%s", sha256)
+							w.Header().Set("X-Reason", errBlobBanned.Error())
+							w.WriteHeader(http.StatusUnavailableForLegalReasons)
+							return
+						}
+
+						// Signed download links must be valid before the blob is handed out
+						if hasLink(r) {
+							if err := links.Redeem(r, sha256); err != nil {
+								log.Printf("Refusing download link for sha256=%s: %v", sha256, err)
+								writeLinkError(w, err)
+								return
+							}
+						}
+
+						// Look up CID and stored extension from database
+						// The extension in the URL is ignored so the filename can't lie about the content
+						var ipfsCID, ext string
+						query := `SELECT ipfs_cid, COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`
+						err := db.QueryRow(query, sha256).Scan(&ipfsCID, &ext)
 						if err == nil && ipfsCID != "" {
 							// Build gateway URL with filename
-							filename := "file" + ext
-							gatewayURLWithFile := gatewayURL + ipfsCID + "?filename=" + url.QueryEscape(filename)
+							gatewayURLWithFile := gatewayURL + ipfsCID
+							if ext != "" {
+								gatewayURLWithFile += "?filename=" + url.QueryEscape("file"+ext)
+							}
 
 							// Redirect to IPFS gateway
 							log.Printf("DEBUG: Redirecting blob request sha256=%s to IPFS gateway: %s", sha256, gatewayURLWithFile)
@@ -250,6 +904,7 @@ func modifyBlossomResponse(relay http.Handler, db *sql.DB, gatewayURL string) ht
 								}
 								// Replace the url field with the gateway URL
 								responseArray[i]["url"] = gatewayURLWithFile
+								addBlobPreviews(r.Context(), db, gatewayURL, responseArray[i])
 								modified = true
 							}
 						}
@@ -340,6 +995,7 @@ func modifyBlossomResponse(relay http.Handler, db *sql.DB, gatewayURL string) ht
 							}
 							// Replace the url field with the gateway URL
 							item["url"] = gatewayURLWithFile
+							addBlobPreviews(r.Context(), db, gatewayURL, item)
 							log.Printf("DEBUG: Replaced URL with gateway URL: %s", gatewayURLWithFile)
 						} else {
 							log.Printf("DEBUG: CID is empty for sha256=%s", sha256)
@@ -401,6 +1057,7 @@ func modifyBlossomResponse(relay http.Handler, db *sql.DB, gatewayURL string) ht
 							}
 							// Replace the url field with the gateway URL
 							responseArray[i]["url"] = gatewayURLWithFile
+							addBlobPreviews(r.Context(), db, gatewayURL, responseArray[i])
 							modified = true
 						}
 					}
@@ -445,6 +1102,7 @@ func modifyBlossomResponse(relay http.Handler, db *sql.DB, gatewayURL string) ht
 							}
 							// Replace the url field with the gateway URL
 							responseData["url"] = gatewayURLWithFile
+							addBlobPreviews(r.Context(), db, gatewayURL, responseData)
 
 							// Copy headers from captured response
 							for key, values := range capturedWriter.headers {
@@ -510,7 +1168,8 @@ func createMappingTable(db *sql.DB) error {
 		ipfs_cid TEXT NOT NULL,
 		extension TEXT,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
+	);
+	CREATE INDEX IF NOT EXISTS idx_ipfs_blossom_mapping_cid ON ipfs_blossom_mapping(ipfs_cid);`
 	_, err := db.Exec(query)
 	return err
 }
@@ -518,13 +1177,27 @@ func createMappingTable(db *sql.DB) error {
 // storeBlobInIPFS uploads a blob to IPFS and stores the mapping in the database
 // Returns the CID for use in response modification
 func storeBlobInIPFS(ctx context.Context, ipfsShell *shell.Shell, db *sql.DB, sha256 string, ext string, body []byte) (string, error) {
+	cid, _, err := addBlobToIPFS(ctx, ipfsShell, db, sha256, ext, body)
+	return cid, err
+}
+
+// addBlobToIPFS is storeBlobInIPFS also reporting whether the blob was added, or was already stored
+func addBlobToIPFS(ctx context.Context, ipfsShell *shell.Shell, db *sql.DB, sha256 string, ext string, body []byte) (string, bool, error) {
+	// Known blobs are already in IPFS: keep the existing CID and metadata
+	if cid, err := lookupBlobCID(ctx, db, sha256); err != nil {
+		return "", false, err
+	} else if cid != "" {
+		log.Printf("Blob already stored: sha256=%s -> cid=%s", sha256, cid)
+		return cid, false, nil
+	}
+
 	log.Printf("Storing blob: sha256=%s, ext=%s, size=%d", sha256, ext, len(body))
 
 	// Upload to IPFS
 	reader := bytes.NewReader(body)
 	cid, err := ipfsShell.Add(reader)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload to IPFS: %w", err)
+		return "", false, fmt.Errorf("failed to upload to IPFS: %w", err)
 	}
 
 	log.Printf("Uploaded to IPFS: sha256=%s -> cid=%s", sha256, cid)
@@ -533,9 +1206,22 @@ func storeBlobInIPFS(ctx context.Context, ipfsShell *shell.Shell, db *sql.DB, sh
 	query := `INSERT OR REPLACE INTO ipfs_blossom_mapping (sha256, ipfs_cid, extension) VALUES (?, ?, ?)`
 	_, err = db.ExecContext(ctx, query, sha256, cid, ext)
 	if err != nil {
-		return "", fmt.Errorf("failed to store mapping: %w", err)
+		return "", false, fmt.Errorf("failed to store mapping: %w", err)
 	}
 
+	return cid, true, nil
+}
+
+// lookupBlobCID returns the IPFS CID a blob is mapped to, or an empty string if it isn't stored
+func lookupBlobCID(ctx context.Context, db *sql.DB, sha256 string) (string, error) {
+	var cid string
+	err := db.QueryRowContext(ctx, `SELECT ipfs_cid FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&cid)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query mapping: %w", err)
+	}
 	return cid, nil
 }
 
@@ -580,6 +1266,20 @@ func min(a, b int) int {
 	return b
 }
 
+// parseEnvInt64 reads a non-negative integer from an environment variable, returning 0 if unset or invalid
+func parseEnvInt64(name string) int64 {
+	valStr := os.Getenv(name)
+	if valStr == "" {
+		return 0
+	}
+	val, err := strconv.ParseInt(valStr, 10, 64)
+	if err != nil || val < 0 {
+		log.Printf("Ignoring invalid %s=%q", name, valStr)
+		return 0
+	}
+	return val
+}
+
 // parsePubkeyWhitelist parses a comma-separated list of pubkeys from environment variable
 // Supports both npub (bech32) and hex formats
 func parsePubkeyWhitelist(whitelistStr string) (map[string]bool, error) {
@@ -669,6 +1369,36 @@ func checkPubkeyAuthFromEvent(auth *nostr.Event, allowedPubkeys map[string]bool)
 	return nil
 }
 
+// uploadAuthorizer grants upload access to an authenticated (hex) pubkey that is not in the whitelist
+type uploadAuthorizer func(ctx context.Context, pubkey string) (bool, error)
+
+// checkUploadAuthorization verifies that the pubkey from the auth event is in the whitelist
+// or is granted access by one of the upload authorizers
+func checkUploadAuthorization(ctx context.Context, auth *nostr.Event, allowedPubkeys map[string]bool, authorizers []uploadAuthorizer) error {
+	err := checkPubkeyAuthFromEvent(auth, allowedPubkeys)
+	if err == nil || auth == nil || auth.PubKey == "" {
+		return err
+	}
+
+	normalizedPubkey, err := normalizePubkey(auth.PubKey)
+	if err != nil {
+		return fmt.Errorf("failed to normalize authenticated pubkey: %w", err)
+	}
+
+	for _, authorize := range authorizers {
+		ok, err := authorize(ctx, normalizedPubkey)
+		if err != nil {
+			log.Printf("Upload authorizer failed for pubkey %s: %v", normalizedPubkey, err)
+			continue
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("pubkey %s is not authorized to upload", normalizedPubkey)
+}
+
 // healthCheckHandler returns a health check endpoint handler
 func healthCheckHandler(db *sql.DB, ipfsShell *shell.Shell, maxMemoryMB int, maxGoroutines int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -762,8 +1492,8 @@ func healthCheckHandler(db *sql.DB, ipfsShell *shell.Shell, maxMemoryMB int, max
 // homePageHandler returns a home page handler that displays usage and health information
 func homePageHandler(db *sql.DB, ipfsShell *shell.Shell, maxMemoryMB int, maxGoroutines int, gatewayURL string, mainHandler http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Only serve home page for root path
-		if r.URL.Path != "/" {
+		// Only serve home page for root path (relay protocol requests go to the relay)
+		if r.URL.Path != "/" || isRelayProtocolRequest(r) {
 			mainHandler.ServeHTTP(w, r)
 			return
 		}
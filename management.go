@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// nip86ContentType is the content type used by NIP-86 relay management requests
+const nip86ContentType = "application/nostr+json+rpc"
+
+// blossomManagementMethods are the NIP-86 extension methods for moderating blobs
+var blossomManagementMethods = map[string]bool{
+	"banblob":            true,
+	"unbanblob":          true,
+	"listbannedblobs":    true,
+	"bancid":             true,
+	"unbancid":           true,
+	"listbannedcids":     true,
+	"listblocklistaudit": true,
+	"listreportedblobs":  true,
+	"listblobreports":    true,
+	"quarantineblob":     true,
+	"releaseblob":        true,
+}
+
+// BlobReason is a banned blob entry returned by the listbannedblobs method
+type BlobReason struct {
+	SHA256 string `json:"sha256"`
+	Reason string `json:"reason"`
+}
+
+// CIDReason is a banned CID entry returned by the listbannedcids method
+type CIDReason struct {
+	CID    string `json:"cid"`
+	Reason string `json:"reason"`
+}
+
+// createManagementTables creates the tables backing the NIP-86 management API if they don't exist
+func createManagementTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS banned_pubkeys (
+		pubkey TEXT PRIMARY KEY,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS allowed_pubkeys (
+		pubkey TEXT PRIMARY KEY,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS banned_events (
+		id TEXT PRIMARY KEY,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS banned_blobs (
+		sha256 TEXT PRIMARY KEY,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS relay_settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// setupManagementAPI wires the NIP-86 management methods of the relay to the database
+// Only pubkeys in adminPubkeys are allowed to call them
+func setupManagementAPI(relay *khatru.Relay, store eventstore.Store, db *sql.DB, adminPubkeys map[string]bool, staticAllowedPubkeys map[string]bool) {
+	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall, func(ctx context.Context, mp nip86.MethodParams) (bool, string) {
+		pubkey := khatru.GetAuthed(ctx)
+		if !adminPubkeys[pubkey] {
+			log.Printf("Rejected NIP-86 call %s from non-admin pubkey %s", mp.MethodName(), pubkey)
+			return true, "pubkey is not authorized to manage this server"
+		}
+		return false, ""
+	})
+
+	relay.ManagementAPI.BanPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		normalized, err := normalizePubkey(pubkey)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO banned_pubkeys (pubkey, reason) VALUES (?, ?)`, normalized, reason); err != nil {
+			return fmt.Errorf("failed to ban pubkey: %w", err)
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM allowed_pubkeys WHERE pubkey = ?`, normalized); err != nil {
+			return fmt.Errorf("failed to remove pubkey from allowed list: %w", err)
+		}
+		log.Printf("Banned pubkey %s (reason: %s) by %s", normalized, reason, khatru.GetAuthed(ctx))
+		return nil
+	}
+
+	relay.ManagementAPI.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return listPubkeyReasons(ctx, db, `SELECT pubkey, COALESCE(reason, '') FROM banned_pubkeys ORDER BY created_at`)
+	}
+
+	relay.ManagementAPI.AllowPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		normalized, err := normalizePubkey(pubkey)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO allowed_pubkeys (pubkey, reason) VALUES (?, ?)`, normalized, reason); err != nil {
+			return fmt.Errorf("failed to allow pubkey: %w", err)
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM banned_pubkeys WHERE pubkey = ?`, normalized); err != nil {
+			return fmt.Errorf("failed to remove pubkey from banned list: %w", err)
+		}
+		log.Printf("Allowed pubkey %s (reason: %s) by %s", normalized, reason, khatru.GetAuthed(ctx))
+		return nil
+	}
+
+	relay.ManagementAPI.ListAllowedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		result, err := listPubkeyReasons(ctx, db, `SELECT pubkey, COALESCE(reason, '') FROM allowed_pubkeys ORDER BY created_at`)
+		if err != nil {
+			return nil, err
+		}
+		for pubkey := range staticAllowedPubkeys {
+			result = append(result, nip86.PubKeyReason{PubKey: pubkey, Reason: "ALLOWED_PUBKEYS"})
+		}
+		return result, nil
+	}
+
+	relay.ManagementAPI.BanEvent = func(ctx context.Context, id string, reason string) error {
+		if !nostr.IsValid32ByteHex(id) {
+			return fmt.Errorf("invalid event id: %s", id)
+		}
+		if _, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO banned_events (id, reason) VALUES (?, ?)`, id, reason); err != nil {
+			return fmt.Errorf("failed to ban event: %w", err)
+		}
+
+		// Remove the event from the store if we already have it
+		ch, err := store.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			return fmt.Errorf("failed to query banned event: %w", err)
+		}
+		for evt := range ch {
+			if err := store.DeleteEvent(ctx, evt); err != nil {
+				return fmt.Errorf("failed to delete banned event: %w", err)
+			}
+		}
+
+		log.Printf("Banned event %s (reason: %s) by %s", id, reason, khatru.GetAuthed(ctx))
+		return nil
+	}
+
+	relay.ManagementAPI.AllowEvent = func(ctx context.Context, id string, reason string) error {
+		if _, err := db.ExecContext(ctx, `DELETE FROM banned_events WHERE id = ?`, id); err != nil {
+			return fmt.Errorf("failed to allow event: %w", err)
+		}
+		log.Printf("Allowed event %s (reason: %s) by %s", id, reason, khatru.GetAuthed(ctx))
+		return nil
+	}
+
+	relay.ManagementAPI.ListBannedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		rows, err := db.QueryContext(ctx, `SELECT id, COALESCE(reason, '') FROM banned_events ORDER BY created_at`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list banned events: %w", err)
+		}
+		defer rows.Close()
+
+		result := []nip86.IDReason{}
+		for rows.Next() {
+			var item nip86.IDReason
+			if err := rows.Scan(&item.ID, &item.Reason); err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+		}
+		return result, rows.Err()
+	}
+
+	relay.ManagementAPI.ChangeRelayName = func(ctx context.Context, name string) error {
+		relay.Info.Name = name
+		return saveRelaySetting(ctx, db, "name", name)
+	}
+
+	relay.ManagementAPI.ChangeRelayDescription = func(ctx context.Context, desc string) error {
+		relay.Info.Description = desc
+		return saveRelaySetting(ctx, db, "description", desc)
+	}
+
+	relay.ManagementAPI.ChangeRelayIcon = func(ctx context.Context, icon string) error {
+		relay.Info.Icon = icon
+		return saveRelaySetting(ctx, db, "icon", icon)
+	}
+}
+
+// listPubkeyReasons runs a query returning (pubkey, reason) rows
+func listPubkeyReasons(ctx context.Context, db *sql.DB, query string) ([]nip86.PubKeyReason, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pubkeys: %w", err)
+	}
+	defer rows.Close()
+
+	result := []nip86.PubKeyReason{}
+	for rows.Next() {
+		var item nip86.PubKeyReason
+		if err := rows.Scan(&item.PubKey, &item.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// saveRelaySetting persists a relay information field changed through NIP-86
+func saveRelaySetting(ctx context.Context, db *sql.DB, key string, value string) error {
+	_, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO relay_settings (key, value) VALUES (?, ?)`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to save relay setting %s: %w", key, err)
+	}
+	return nil
+}
+
+// loadRelaySettings applies relay information previously changed through NIP-86
+func loadRelaySettings(db *sql.DB, info *nip11.RelayInformationDocument) error {
+	rows, err := db.Query(`SELECT key, value FROM relay_settings`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		switch key {
+		case "name":
+			info.Name = value
+		case "description":
+			info.Description = value
+		case "icon":
+			info.Icon = value
+		}
+	}
+	return rows.Err()
+}
+
+// isPubkeyBanned checks whether a pubkey was banned through the management API
+func isPubkeyBanned(ctx context.Context, db *sql.DB, pubkey string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM banned_pubkeys WHERE pubkey = ?`, pubkey).Scan(&count)
+	return count > 0, err
+}
+
+// isEventBanned checks whether an event id was banned through the management API
+func isEventBanned(ctx context.Context, db *sql.DB, id string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM banned_events WHERE id = ?`, id).Scan(&count)
+	return count > 0, err
+}
+
+// isBlobBanned checks whether a blob sha256, or the IPFS CID it is stored under, is on the blocklist
+func isBlobBanned(ctx context.Context, db *sql.DB, sha256 string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM banned_blobs WHERE sha256 = ?`, strings.ToLower(sha256)).Scan(&count)
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	// Thumbnails are banned along with their original
+	if original, err := thumbnailOriginal(ctx, db, strings.ToLower(sha256)); err != nil {
+		return false, err
+	} else if original != "" {
+		if banned, err := isBlobBanned(ctx, db, original); err != nil || banned {
+			return banned, err
+		}
+	}
+
+	var ipfsCID string
+	err = db.QueryRowContext(ctx, `SELECT ipfs_cid FROM ipfs_blossom_mapping WHERE sha256 = ?`, strings.ToLower(sha256)).Scan(&ipfsCID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return isCIDBanned(ctx, db, ipfsCID)
+}
+
+// effectiveAllowedPubkeys merges the ALLOWED_PUBKEYS whitelist with pubkeys allowed through NIP-86
+func effectiveAllowedPubkeys(ctx context.Context, db *sql.DB, staticAllowedPubkeys map[string]bool) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT pubkey FROM allowed_pubkeys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allowed := make(map[string]bool, len(staticAllowedPubkeys))
+	for pubkey := range staticAllowedPubkeys {
+		allowed[pubkey] = true
+	}
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, err
+		}
+		allowed[pubkey] = true
+	}
+	return allowed, rows.Err()
+}
+
+// checkUploadWhitelist enforces the upload whitelist (ALLOWED_PUBKEYS plus the pubkeys allowed through NIP-86)
+// It only restricts uploads when enabled by ALLOWED_PUBKEYS or UPLOAD_WHITELIST, or when upload authorizers
+// are configured, so allowing a pubkey through NIP-86 doesn't close an open server
+// Returns the HTTP status and reason when the upload must be rejected
+func checkUploadWhitelist(ctx context.Context, db *sql.DB, auth *nostr.Event, staticAllowedPubkeys map[string]bool, whitelistEnabled bool, authorizers []uploadAuthorizer) (int, string, error) {
+	if !whitelistEnabled && len(authorizers) == 0 {
+		return 0, "", nil
+	}
+	allowed, err := effectiveAllowedPubkeys(ctx, db, staticAllowedPubkeys)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to load pubkey whitelist: %w", err)
+	}
+	if err := checkUploadAuthorization(ctx, auth, allowed, authorizers); err != nil {
+		return http.StatusForbidden, err.Error(), nil
+	}
+	return 0, "", nil
+}
+
+// callBlossomManagementMethod executes one of the blob moderation extension methods
+func callBlossomManagementMethod(ctx context.Context, bl *blocklist, reports *blobReports, adminPubkey string, req nip86.Request) (any, error) {
+	switch req.Method {
+	case "banblob", "unbanblob", "bancid", "unbancid":
+		if len(req.Params) == 0 {
+			return nil, fmt.Errorf("invalid number of params for '%s'", req.Method)
+		}
+		target, _ := req.Params[0].(string)
+		reason := ""
+		if len(req.Params) >= 2 {
+			reason, _ = req.Params[1].(string)
+		}
+
+		targetType := blockTargetSHA256
+		if req.Method == "bancid" || req.Method == "unbancid" {
+			normalized, err := normalizeCID(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cid param for '%s'", req.Method)
+			}
+			targetType, target = blockTargetCID, normalized
+		} else if !nostr.IsValid32ByteHex(target) {
+			return nil, fmt.Errorf("invalid sha256 param for '%s'", req.Method)
+		} else {
+			target = strings.ToLower(target)
+		}
+
+		if strings.HasPrefix(req.Method, "un") {
+			if err := bl.Unblock(ctx, targetType, target, reason, adminPubkey, "nip86"); err != nil {
+				return nil, err
+			}
+		} else if _, err := bl.Block(ctx, targetType, target, reason, adminPubkey, "nip86"); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	case "listbannedblobs":
+		rows, err := bl.db.QueryContext(ctx, `SELECT sha256, COALESCE(reason, '') FROM banned_blobs ORDER BY created_at`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list banned blobs: %w", err)
+		}
+		defer rows.Close()
+
+		result := []BlobReason{}
+		for rows.Next() {
+			var item BlobReason
+			if err := rows.Scan(&item.SHA256, &item.Reason); err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+		}
+		return result, rows.Err()
+
+	case "listbannedcids":
+		rows, err := bl.db.QueryContext(ctx, `SELECT cid, COALESCE(reason, '') FROM banned_cids ORDER BY created_at`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list banned cids: %w", err)
+		}
+		defer rows.Close()
+
+		result := []CIDReason{}
+		for rows.Next() {
+			var item CIDReason
+			if err := rows.Scan(&item.CID, &item.Reason); err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+		}
+		return result, rows.Err()
+
+	case "listblocklistaudit":
+		limit := 100
+		if len(req.Params) >= 1 {
+			if val, ok := req.Params[0].(float64); ok && val > 0 {
+				limit = int(val)
+			}
+		}
+		return bl.AuditLog(ctx, limit)
+
+	case "listreportedblobs":
+		status := ""
+		if len(req.Params) >= 1 {
+			status, _ = req.Params[0].(string)
+		}
+		return reports.Queue(ctx, status)
+
+	case "listblobreports", "quarantineblob", "releaseblob":
+		if len(req.Params) == 0 {
+			return nil, fmt.Errorf("invalid number of params for '%s'", req.Method)
+		}
+		sha256, ok := req.Params[0].(string)
+		if !ok || !nostr.IsValid32ByteHex(sha256) {
+			return nil, fmt.Errorf("invalid sha256 param for '%s'", req.Method)
+		}
+		sha256 = strings.ToLower(sha256)
+		if req.Method == "listblobreports" {
+			return reports.Events(ctx, sha256)
+		}
+
+		reason := ""
+		if len(req.Params) >= 2 {
+			reason, _ = req.Params[1].(string)
+		}
+		status := reviewQuarantined
+		if req.Method == "releaseblob" {
+			status = reviewReleased
+		}
+		if err := reports.Decide(ctx, sha256, status, reason, adminPubkey); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+
+	return nil, fmt.Errorf("method '%s' not known", req.Method)
+}
+
+// nip86Handler wraps the relay to serve the blob moderation extensions of NIP-86
+// Standard methods are forwarded to khatru, which rejects unknown method names
+func nip86Handler(relay http.Handler, bl *blocklist, reports *blobReports, adminPubkeys map[string]bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != nip86ContentType {
+			relay.ServeHTTP(w, r)
+			return
+		}
+
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(payload))
+
+		var req nip86.Request
+		if err := json.Unmarshal(payload, &req); err != nil {
+			relay.ServeHTTP(w, r)
+			return
+		}
+
+		if req.Method == "supportedmethods" {
+			// Let khatru authenticate and list its methods, then append ours
+			capturedWriter := &responseCapturer{
+				ResponseWriter: w,
+				statusCode:     200,
+				body:           &bytes.Buffer{},
+				headers:        make(http.Header),
+			}
+			relay.ServeHTTP(capturedWriter, r)
+
+			var resp nip86.Response
+			if err := json.Unmarshal(capturedWriter.body.Bytes(), &resp); err == nil {
+				if methods, ok := resp.Result.([]any); ok {
+					for method := range blossomManagementMethods {
+						methods = append(methods, method)
+					}
+					resp.Result = methods
+				}
+			}
+			w.Header().Set("Content-Type", nip86ContentType)
+			w.WriteHeader(capturedWriter.statusCode)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		if !blossomManagementMethods[req.Method] {
+			relay.ServeHTTP(w, r)
+			return
+		}
+
+		var resp nip86.Response
+		auth, err := readNIP86Auth(r, payload)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if !adminPubkeys[auth.PubKey] {
+			log.Printf("Rejected NIP-86 call %s from non-admin pubkey %s", req.Method, auth.PubKey)
+			resp.Error = "pubkey is not authorized to manage this server"
+		} else if result, err := callBlossomManagementMethod(r.Context(), bl, reports, auth.PubKey, req); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result = result
+		}
+
+		w.Header().Set("Content-Type", nip86ContentType)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// isRelayProtocolRequest reports whether a request targets the nostr relay itself
+// (websocket, NIP-11 information document or NIP-86 management) rather than a blob route
+func isRelayProtocolRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") == "websocket" ||
+		r.Header.Get("Accept") == "application/nostr+json" ||
+		r.Header.Get("Content-Type") == nip86ContentType
+}
+
+// errBlobBanned is returned when trying to store or serve a banned blob
+var errBlobBanned = errors.New("blob is banned on this server")
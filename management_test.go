@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+func TestNIP86BlobMethods(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+	tests := []struct {
+		name       string
+		admin      bool
+		method     string
+		params     []any
+		banned     bool // the blob is banned before the call
+		wantError  bool
+		wantBanned bool
+		wantRelay  bool // the call is forwarded to khatru
+
+		wantBannedCID bool
+	}{
+		{name: "ban blob", admin: true, method: "banblob", params: []any{sha256, "spam"}, wantBanned: true},
+		{name: "unban blob", admin: true, method: "unbanblob", params: []any{sha256}, banned: true},
+		{name: "ban blob without params", admin: true, method: "banblob", wantError: true},
+		{name: "ban invalid hash", admin: true, method: "banblob", params: []any{"not-a-hash"}, wantError: true},
+		{name: "ban blob as non-admin", method: "banblob", params: []any{sha256}, wantError: true},
+		{name: "unban blob as non-admin", method: "unbanblob", params: []any{sha256}, banned: true, wantError: true, wantBanned: true},
+		{name: "ban cid", admin: true, method: "bancid", params: []any{testBlockedCID, "spam"}, wantBannedCID: true},
+		{name: "ban invalid cid", admin: true, method: "bancid", params: []any{"not-a-cid"}, wantError: true},
+		{name: "list banned blobs", admin: true, method: "listbannedblobs", banned: true, wantBanned: true},
+		{name: "standard method", admin: true, method: "banpubkey", params: []any{sha256}, wantRelay: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			adminSK, admin := newTestKey(t)
+			sk := adminSK
+			if !tt.admin {
+				sk, _ = newTestKey(t)
+			}
+			if tt.banned {
+				if _, err := db.Exec(`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`, sha256, "test"); err != nil {
+					t.Fatalf("failed to ban blob: %v", err)
+				}
+			}
+
+			relayCalled := false
+			relay := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				relayCalled = true
+			})
+			bl := newBlocklist(db, nil, &privateBlobs{db: db}, false, nil, nil, nil)
+			reports := newBlobReports(db, nil, bl, 0, nil, nil, nil, nil)
+			handler := nip86Handler(relay, bl, reports, map[string]bool{admin: true})
+
+			body, _ := json.Marshal(nip86.Request{Method: tt.method, Params: tt.params})
+			req := httptest.NewRequest("POST", "https://blossom.example.com/", bytes.NewReader(body))
+			req.Header.Set("Content-Type", nip86ContentType)
+			req.Header.Set("Authorization", nip98AuthHeader(t, sk, "https://blossom.example.com", "POST", body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if relayCalled != tt.wantRelay {
+				t.Fatalf("forwarded to the relay = %v, want %v", relayCalled, tt.wantRelay)
+			}
+			if tt.wantRelay {
+				return
+			}
+
+			var resp nip86.Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+			}
+			if (resp.Error != "") != tt.wantError {
+				t.Errorf("error = %q, wantError %v", resp.Error, tt.wantError)
+			}
+			banned, err := isBlobBanned(context.Background(), db, sha256)
+			if err != nil {
+				t.Fatalf("isBlobBanned() error = %v", err)
+			}
+			if banned != tt.wantBanned {
+				t.Errorf("banned = %v, want %v", banned, tt.wantBanned)
+			}
+			bannedCID, err := isCIDBanned(context.Background(), db, testBlockedCID)
+			if err != nil {
+				t.Fatalf("isCIDBanned() error = %v", err)
+			}
+			if bannedCID != tt.wantBannedCID {
+				t.Errorf("cid banned = %v, want %v", bannedCID, tt.wantBannedCID)
+			}
+
+			// Every change made through the API is audited with the admin as actor
+			entries, err := bl.AuditLog(context.Background(), 10)
+			if err != nil {
+				t.Fatalf("AuditLog() error = %v", err)
+			}
+			changed := tt.admin && !tt.wantError && strings.Contains(tt.method, "ban") && !strings.HasPrefix(tt.method, "list")
+			if changed && (len(entries) != 1 || entries[0].Actor != admin || entries[0].Source != "nip86") {
+				t.Errorf("audit log = %+v, want one entry by the admin", entries)
+			} else if !changed && len(entries) != 0 {
+				t.Errorf("audit log = %+v, want no entries", entries)
+			}
+		})
+	}
+}
+
+func TestEffectiveAllowedPubkeys(t *testing.T) {
+	_, db := newTestDB(t)
+	_, static := newTestKey(t)
+	_, dynamic := newTestKey(t)
+	ctx := context.Background()
+
+	allowed, err := effectiveAllowedPubkeys(ctx, db, nil)
+	if err != nil {
+		t.Fatalf("effectiveAllowedPubkeys() error = %v", err)
+	}
+	if len(allowed) != 0 {
+		t.Errorf("allowed = %v, want no restriction", allowed)
+	}
+
+	if _, err := db.Exec(`INSERT INTO allowed_pubkeys (pubkey, reason) VALUES (?, ?)`, dynamic, "test"); err != nil {
+		t.Fatalf("failed to allow pubkey: %v", err)
+	}
+	allowed, err = effectiveAllowedPubkeys(ctx, db, map[string]bool{static: true})
+	if err != nil {
+		t.Fatalf("effectiveAllowedPubkeys() error = %v", err)
+	}
+	if len(allowed) != 2 || !allowed[static] || !allowed[dynamic] {
+		t.Errorf("allowed = %v, want both the static and the NIP-86 pubkey", allowed)
+	}
+}
+
+func TestCheckUploadWhitelist(t *testing.T) {
+	_, db := newTestDB(t)
+	staticSK, static := newTestKey(t)
+	dynamicSK, dynamic := newTestKey(t)
+	otherSK, _ := newTestKey(t)
+	ctx := context.Background()
+	if _, err := db.Exec(`INSERT INTO allowed_pubkeys (pubkey, reason) VALUES (?, ?)`, dynamic, "test"); err != nil {
+		t.Fatalf("failed to allow pubkey: %v", err)
+	}
+	trustOther := func(ctx context.Context, pubkey string) (bool, error) {
+		return pubkey != static && pubkey != dynamic, nil
+	}
+
+	tests := []struct {
+		name        string
+		sk          string // "" for an anonymous upload
+		static      map[string]bool
+		enabled     bool
+		authorizers []uploadAuthorizer
+		wantCode    int
+	}{
+		// Pubkeys allowed through NIP-86 don't restrict an open server on their own
+		{name: "open server, anonymous", wantCode: 0},
+		{name: "open server, unlisted pubkey", sk: otherSK, wantCode: 0},
+		{name: "UPLOAD_WHITELIST, NIP-86 pubkey", sk: dynamicSK, enabled: true, wantCode: 0},
+		{name: "UPLOAD_WHITELIST, unlisted pubkey", sk: otherSK, enabled: true, wantCode: http.StatusForbidden},
+		{name: "UPLOAD_WHITELIST, anonymous", enabled: true, wantCode: http.StatusForbidden},
+		{name: "ALLOWED_PUBKEYS, static pubkey", sk: staticSK, static: map[string]bool{static: true}, enabled: true, wantCode: 0},
+		{name: "ALLOWED_PUBKEYS, NIP-86 pubkey", sk: dynamicSK, static: map[string]bool{static: true}, enabled: true, wantCode: 0},
+		{name: "authorizer, trusted pubkey", sk: otherSK, authorizers: []uploadAuthorizer{trustOther}, wantCode: 0},
+		{name: "authorizer, NIP-86 pubkey", sk: dynamicSK, authorizers: []uploadAuthorizer{trustOther}, wantCode: 0},
+		{name: "authorizer, untrusted pubkey", sk: staticSK, authorizers: []uploadAuthorizer{trustOther}, wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auth *nostr.Event
+			if tt.sk != "" {
+				auth = signTestEvent(t, tt.sk, 24242, nostr.Tags{{"t", "upload"}}, "")
+			}
+			code, reason, err := checkUploadWhitelist(ctx, db, auth, tt.static, tt.enabled, tt.authorizers)
+			if err != nil {
+				t.Fatalf("checkUploadWhitelist() error = %v", err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("code = %d (%s), want %d", code, reason, tt.wantCode)
+			}
+		})
+	}
+}
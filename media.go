@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+
+	_ "image/gif"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// errMediaUnsupported is returned for uploads that aren't an image format the optimizer handles
+var errMediaUnsupported = errors.New("media optimization only supports JPEG, PNG, WebP and GIF images, use /upload for other files")
+
+// errMediaTooLarge is returned for images with more pixels than the optimizer will decode
+var errMediaTooLarge = errors.New("image dimensions are too large")
+
+// mediaOptimizer implements BUD-05 PUT /media: images are decoded, resized to the configured
+// maximums and re-encoded before being stored, which drops EXIF (GPS included) and other metadata
+// GIFs are stored unchanged, since re-encoding would lose their animation
+type mediaOptimizer struct {
+	server      *blossom.BlossomServer
+	blocks      *blocklist
+	maxSize     int64
+	maxWidth    int
+	maxHeight   int
+	maxPixels   int
+	jpegQuality int
+}
+
+// newMediaOptimizer creates the /media handler with the given limits
+func newMediaOptimizer(server *blossom.BlossomServer, blocks *blocklist, maxSize int64, maxWidth, maxHeight, maxPixels, jpegQuality int) *mediaOptimizer {
+	return &mediaOptimizer{
+		server:      server,
+		blocks:      blocks,
+		maxSize:     maxSize,
+		maxWidth:    maxWidth,
+		maxHeight:   maxHeight,
+		maxPixels:   maxPixels,
+		jpegQuality: jpegQuality,
+	}
+}
+
+// Optimize re-encodes an image in its own format, returning the new content and extension
+func (m *mediaOptimizer) Optimize(data []byte) ([]byte, string, error) {
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && format == "gif" {
+		return data, ".gif", nil
+	}
+
+	// The EXIF orientation is dropped with the rest of the metadata, so it is applied to the pixels
+	img, format, err := decodeImage(data, m.maxPixels)
+	if err != nil {
+		return nil, "", err
+	}
+	img = scaleToFit(img, m.maxWidth, m.maxHeight)
+
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: m.jpegQuality})
+		return out.Bytes(), ".jpg", err
+	case "png":
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&out, img)
+		return out.Bytes(), ".png", err
+	case "webp":
+		err = nativewebp.Encode(&out, img, nil)
+		return out.Bytes(), ".webp", err
+	}
+	return nil, "", errMediaUnsupported
+}
+
+// decodeImage decodes an image with its EXIF orientation applied, refusing images over maxPixels (0 = unbounded)
+func decodeImage(data []byte, maxPixels int) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, "", errMediaUnsupported
+		}
+		return nil, "", fmt.Errorf("invalid image: %w", err)
+	}
+	if maxPixels > 0 && config.Width*config.Height > maxPixels {
+		return nil, "", errMediaTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image: %w", err)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, format, nil
+}
+
+// scaleToFit scales an image down to fit the maximum width and height (0 = unbounded), keeping its aspect ratio
+func scaleToFit(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	if scale >= 1 {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale))))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, returning 1 (upright) if there is none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		// Start of scan: no metadata after this point
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF-encoded EXIF block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation transforms an image so it displays upright for the given EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	// Orientations 5 to 8 are rotated by 90 degrees, so width and height swap
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // rotated 180
+				dx, dy = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = height-1-y, x
+			case 7: // transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// mediaMiddleware serves PUT /media in place of the blossom library's redirect to /upload
+// It must sit inside modifyBlossomResponse so the descriptor gets the CID and gateway URL
+func mediaMiddleware(next http.Handler, m *mediaOptimizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/media" || r.Method != "PUT" || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth, err := readBlossomAuth(r)
+		if err != nil {
+			w.Header().Set("X-Reason", "invalid \"Authorization\": "+err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			w.Header().Set("X-Reason", "missing \"Authorization\" header")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if auth.Tags.FindWithValue("t", "media") == nil && auth.Tags.FindWithValue("t", "upload") == nil {
+			w.Header().Set("X-Reason", "invalid \"Authorization\" event \"t\" tag")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if auth.Tags.Find("x") == nil {
+			w.Header().Set("X-Reason", "\"Authorization\" event must have an \"x\" tag with the blob hash")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		reader := io.Reader(r.Body)
+		if m.maxSize > 0 {
+			reader = io.LimitReader(r.Body, m.maxSize+1)
+		}
+		original, err := io.ReadAll(reader)
+		if err != nil {
+			w.Header().Set("X-Reason", "failed to read upload body: "+err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if m.maxSize > 0 && int64(len(original)) > m.maxSize {
+			w.Header().Set("X-Reason", fmt.Sprintf("media is larger than %d bytes", m.maxSize))
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		originalHash := sha256.Sum256(original)
+		originalSHA256 := hex.EncodeToString(originalHash[:])
+
+		// A banned original can't be laundered through re-encoding
+		if err := m.blocks.CheckUpload(r.Context(), originalSHA256, original); err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			if errors.Is(err, errBlobBanned) {
+				w.WriteHeader(http.StatusUnavailableForLegalReasons)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		data, ext, err := m.Optimize(original)
+		if err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			switch {
+			case errors.Is(err, errMediaUnsupported):
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+			case errors.Is(err, errMediaTooLarge):
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+		optimizedHash := sha256.Sum256(data)
+		hash := hex.EncodeToString(optimizedHash[:])
+
+		// BUD-05 clients sign the hash of the original, but the optimized hash is accepted too
+		if auth.Tags.FindWithValue("x", originalSHA256) == nil && auth.Tags.FindWithValue("x", hash) == nil {
+			w.Header().Set("X-Reason", "blob hash does not match any \"x\" tag in authorization event")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		for _, reject := range m.server.RejectUpload {
+			if rejected, reason, code := reject(r.Context(), auth, len(data), ext); rejected {
+				w.Header().Set("X-Reason", reason)
+				w.WriteHeader(code)
+				return
+			}
+		}
+
+		descriptor := blossom.BlobDescriptor{
+			URL:      m.server.ServiceURL + "/" + hash + ext,
+			SHA256:   hash,
+			Size:     len(data),
+			Type:     typeForExtension(ext),
+			Uploaded: nostr.Now(),
+		}
+		if err := m.server.Store.Keep(r.Context(), descriptor, auth.PubKey); err != nil {
+			w.Header().Set("X-Reason", "failed to save metadata: "+err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, store := range m.server.StoreBlob {
+			if err := store(r.Context(), hash, ext, data); err != nil {
+				w.Header().Set("X-Reason", "failed to save blob: "+err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		log.Printf("Optimized media sha256=%s (%d bytes) to sha256=%s (%d bytes) for %s",
+			originalSHA256, len(original), hash, len(data), auth.PubKey)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(descriptor)
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testImage returns a width x height image with a gradient, so encoders can't collapse it
+func testImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// encodeTestImage encodes a test image in the given format
+func encodeTestImage(t *testing.T, format string, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, testImage(width, height), nil)
+	case "png":
+		err = png.Encode(&buf, testImage(width, height))
+	case "gif":
+		err = gif.Encode(&buf, testImage(width, height), nil)
+	}
+	if err != nil {
+		t.Fatalf("failed to encode %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+// withEXIFOrientation inserts an EXIF APP1 segment with an orientation tag after the JPEG SOI marker
+func withEXIFOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00") // little endian, first IFD at offset 8
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112) // orientation tag
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)      // SHORT
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // value padding and next IFD offset
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	return append(out, data[2:]...)
+}
+
+func TestMediaOptimizerOptimize(t *testing.T) {
+	m := newMediaOptimizer(nil, nil, 0, 100, 50, 1_000_000, 85)
+	jpegData := encodeTestImage(t, "jpeg", 40, 20)
+	gifData := encodeTestImage(t, "gif", 300, 300)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantExt    string
+		wantWidth  int
+		wantHeight int
+		wantErr    error
+		wantSame   bool
+	}{
+		{name: "small png", data: encodeTestImage(t, "png", 40, 20), wantExt: ".png", wantWidth: 40, wantHeight: 20},
+		{name: "wide png", data: encodeTestImage(t, "png", 400, 20), wantExt: ".png", wantWidth: 100, wantHeight: 5},
+		{name: "tall jpeg", data: encodeTestImage(t, "jpeg", 20, 400), wantExt: ".jpg", wantWidth: 2, wantHeight: 50},
+		{name: "rotated jpeg", data: withEXIFOrientation(jpegData, 6), wantExt: ".jpg", wantWidth: 20, wantHeight: 40},
+		{name: "mirrored jpeg", data: withEXIFOrientation(jpegData, 2), wantExt: ".jpg", wantWidth: 40, wantHeight: 20},
+		{name: "gif is kept", data: gifData, wantExt: ".gif", wantWidth: 300, wantHeight: 300, wantSame: true},
+		{name: "too many pixels", data: encodeTestImage(t, "png", 2000, 600), wantErr: errMediaTooLarge},
+		{name: "not an image", data: []byte("%PDF-1.4 not an image"), wantErr: errMediaUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, ext, err := m.Optimize(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("Optimize() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ext != tt.wantExt {
+				t.Errorf("ext = %q, want %q", ext, tt.wantExt)
+			}
+			if tt.wantSame != bytes.Equal(data, tt.data) {
+				t.Errorf("content unchanged = %v, want %v", !tt.wantSame, tt.wantSame)
+			}
+			if bytes.Contains(data, []byte("Exif\x00\x00")) {
+				t.Errorf("EXIF metadata was kept")
+			}
+			config, _, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("optimized image can't be decoded: %v", err)
+			}
+			if config.Width != tt.wantWidth || config.Height != tt.wantHeight {
+				t.Errorf("size = %dx%d, want %dx%d", config.Width, config.Height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 2x1 image: red on the left, blue on the right
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	img.Set(0, 0, red)
+	img.Set(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		wantBounds  image.Rectangle
+		wantRedAt   image.Point
+	}{
+		{orientation: 1, wantBounds: image.Rect(0, 0, 2, 1), wantRedAt: image.Pt(0, 0)},
+		{orientation: 2, wantBounds: image.Rect(0, 0, 2, 1), wantRedAt: image.Pt(1, 0)},
+		{orientation: 3, wantBounds: image.Rect(0, 0, 2, 1), wantRedAt: image.Pt(1, 0)},
+		{orientation: 6, wantBounds: image.Rect(0, 0, 1, 2), wantRedAt: image.Pt(0, 0)},
+		{orientation: 8, wantBounds: image.Rect(0, 0, 1, 2), wantRedAt: image.Pt(0, 1)},
+	}
+
+	for _, tt := range tests {
+		got := applyOrientation(img, tt.orientation)
+		if got.Bounds() != tt.wantBounds {
+			t.Errorf("orientation %d: bounds = %v, want %v", tt.orientation, got.Bounds(), tt.wantBounds)
+			continue
+		}
+		if r, _, _, _ := got.At(tt.wantRedAt.X, tt.wantRedAt.Y).RGBA(); r == 0 {
+			t.Errorf("orientation %d: red pixel isn't at %v", tt.orientation, tt.wantRedAt)
+		}
+	}
+
+	if orientation := jpegOrientation(withEXIFOrientation(encodeTestImage(t, "jpeg", 2, 1), 6)); orientation != 6 {
+		t.Errorf("jpegOrientation() = %d, want 6", orientation)
+	}
+	if orientation := jpegOrientation(encodeTestImage(t, "jpeg", 2, 1)); orientation != 1 {
+		t.Errorf("jpegOrientation() without EXIF = %d, want 1", orientation)
+	}
+}
+
+func TestMediaMiddleware(t *testing.T) {
+	original := encodeTestImage(t, "png", 400, 20)
+	hash := sha256.Sum256(original)
+	originalSHA256 := hex.EncodeToString(hash[:])
+	otherHash := sha256.Sum256([]byte("other"))
+
+	tests := []struct {
+		name       string
+		body       []byte
+		action     string
+		xTag       string
+		maxSize    int64
+		banned     bool
+		wantStatus int
+	}{
+		{name: "optimized", body: original, action: "media", xTag: originalSHA256, wantStatus: http.StatusOK},
+		{name: "upload action", body: original, action: "upload", xTag: originalSHA256, wantStatus: http.StatusOK},
+		{name: "wrong action", body: original, action: "delete", xTag: originalSHA256, wantStatus: http.StatusForbidden},
+		{name: "hash mismatch", body: original, action: "media", xTag: hex.EncodeToString(otherHash[:]), wantStatus: http.StatusForbidden},
+		{name: "too large", body: original, action: "media", xTag: originalSHA256, maxSize: 100, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "not an image", body: []byte("plain text"), action: "media", xTag: originalSHA256, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "banned original", body: original, action: "media", xTag: originalSHA256, banned: true, wantStatus: http.StatusUnavailableForLegalReasons},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, db := newTestDB(t)
+			sk, _ := newTestKey(t)
+			if tt.banned {
+				if _, err := db.Exec(`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`, originalSHA256, "test"); err != nil {
+					t.Fatalf("failed to ban blob: %v", err)
+				}
+			}
+
+			stored := make(map[string][]byte)
+			server := &blossom.BlossomServer{
+				ServiceURL: "https://blossom.example.com",
+				Store:      blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://blossom.example.com"},
+			}
+			server.StoreBlob = append(server.StoreBlob, func(ctx context.Context, sha256 string, ext string, body []byte) error {
+				stored[sha256] = body
+				return nil
+			})
+			blocks := newBlocklist(db, nil, &privateBlobs{db: db}, false, nil, nil, nil)
+			m := newMediaOptimizer(server, blocks, tt.maxSize, 100, 100, 1_000_000, 85)
+
+			req := httptest.NewRequest("PUT", "/media", bytes.NewReader(tt.body))
+			req.Header.Set("Authorization", blossomAuthHeader(t, sk, tt.action, nostr.Tag{"x", tt.xTag}))
+			rec := httptest.NewRecorder()
+			mediaMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("media request was passed to the next handler")
+			}), m).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				if len(stored) != 0 {
+					t.Errorf("rejected media was stored")
+				}
+				return
+			}
+
+			var descriptor blossom.BlobDescriptor
+			if err := json.Unmarshal(rec.Body.Bytes(), &descriptor); err != nil {
+				t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+			}
+			if descriptor.SHA256 == originalSHA256 || stored[descriptor.SHA256] == nil {
+				t.Errorf("descriptor %+v doesn't point at the stored optimized image", descriptor)
+			}
+			if descriptor.Type != "image/png" {
+				t.Errorf("type = %q, want image/png", descriptor.Type)
+			}
+		})
+	}
+}
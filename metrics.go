@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry keeps monotonically increasing counters and exposes them in the
+// Prometheus text exposition format
+type metricsRegistry struct {
+	mu       sync.Mutex
+	help     map[string]string
+	counters map[string]map[string]uint64
+}
+
+// newMetricsRegistry creates an empty metrics registry
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		help:     make(map[string]string),
+		counters: make(map[string]map[string]uint64),
+	}
+}
+
+// Describe sets the help text of a counter and makes it appear in the output even before it is incremented
+func (m *metricsRegistry) Describe(name string, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.help[name] = help
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]uint64)
+	}
+}
+
+// Inc increments a counter with the given label pairs (name1, value1, name2, value2, ...)
+func (m *metricsRegistry) Inc(name string, labels ...string) {
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	key := strings.Join(parts, ",")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]uint64)
+	}
+	m.counters[name][key]++
+}
+
+// Handler returns an HTTP handler serving all counters
+func (m *metricsRegistry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		names := make([]string, 0, len(m.counters))
+		for name := range m.counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, name := range names {
+			if help := m.help[name]; help != "" {
+				fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+			}
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+			keys := make([]string, 0, len(m.counters[name]))
+			for key := range m.counters[name] {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if key == "" {
+					fmt.Fprintf(w, "%s %d\n", name, m.counters[name][key])
+				} else {
+					fmt.Fprintf(w, "%s{%s} %d\n", name, key, m.counters[name][key])
+				}
+			}
+		}
+	}
+}
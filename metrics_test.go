@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// containsLine reports whether output has a line exactly equal to line
+func containsLine(output string, line string) bool {
+	for _, l := range strings.Split(output, "\n") {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetricsRegistryHandler(t *testing.T) {
+	metrics := newMetricsRegistry()
+	metrics.Describe("test_described_total", "A counter never incremented")
+	metrics.Inc("test_requests_total", "path", "/upload")
+	metrics.Inc("test_requests_total", "path", "/upload")
+	metrics.Inc("test_requests_total", "path", `a"b`)
+	metrics.Inc("test_plain_total")
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	output := rec.Body.String()
+
+	for _, line := range []string{
+		"# HELP test_described_total A counter never incremented",
+		"# TYPE test_described_total counter",
+		`test_requests_total{path="/upload"} 2`,
+		`test_requests_total{path="a\"b"} 1`,
+		"test_plain_total 1",
+	} {
+		if !containsLine(output, line) {
+			t.Errorf("output is missing %q:\n%s", line, output)
+		}
+	}
+}
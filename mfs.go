@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// mfsOrganizer links public blobs into the MFS of the public IPFS node at
+// <root>/<pubkey>/<yyyy-mm>/<sha256><ext>, one path per owner, so they can be browsed per user
+// Links are recorded in mfs_links so they can be removed when ownership ends
+type mfsOrganizer struct {
+	db        *sql.DB
+	ipfsShell *shell.Shell
+	private   *privateBlobs
+	root      string
+	ipns      *ipnsPublisher
+}
+
+// createMFSLinksTable creates the table recording the MFS paths of blobs if it doesn't exist
+func createMFSLinksTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS mfs_links (
+		sha256 TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		path TEXT NOT NULL,
+		PRIMARY KEY (sha256, pubkey)
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// newMFSOrganizer creates the organizer linking blobs under root, an absolute MFS path
+func newMFSOrganizer(db *sql.DB, ipfsShell *shell.Shell, private *privateBlobs, root string) (*mfsOrganizer, error) {
+	root = path.Clean("/" + strings.TrimSpace(root))
+	if root == "/" {
+		return nil, fmt.Errorf("MFS root must not be the MFS root directory")
+	}
+	return &mfsOrganizer{db: db, ipfsShell: ipfsShell, private: private, root: root}, nil
+}
+
+// blobPath returns the MFS path of a blob owned by a pubkey
+func (mo *mfsOrganizer) blobPath(pubkey string, uploadedAt int64, sha256 string, ext string) string {
+	month := time.Unix(uploadedAt, 0).UTC().Format("2006-01")
+	return path.Join(mo.root, pubkey, month, sha256+ext)
+}
+
+// Link links a blob into the directory of an owner
+// Blobs that aren't stored yet or are private are skipped; it does nothing when MFS organisation is disabled
+func (mo *mfsOrganizer) Link(ctx context.Context, sha256 string, pubkey string, uploadedAt int64) error {
+	if mo == nil {
+		return nil
+	}
+
+	var ipfsCID, ext string
+	err := mo.db.QueryRowContext(ctx, `SELECT ipfs_cid, COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&ipfsCID, &ext)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query mapping: %w", err)
+	}
+	if private, err := mo.private.IsPrivate(ctx, sha256); err != nil {
+		return fmt.Errorf("failed to check blob visibility: %w", err)
+	} else if private {
+		return nil
+	}
+
+	var linked bool
+	err = mo.db.QueryRowContext(ctx, `SELECT 1 FROM mfs_links WHERE sha256 = ? AND pubkey = ?`, sha256, pubkey).Scan(&linked)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to query MFS links: %w", err)
+	}
+
+	mfsPath := mo.blobPath(pubkey, uploadedAt, sha256, ext)
+	// Kubo reports an existing destination as "directory already has entry by that name"
+	if err := mo.ipfsShell.FilesCp(ctx, "/ipfs/"+ipfsCID, mfsPath, shell.FilesCp.Parents(true)); err != nil && !strings.Contains(err.Error(), "already has entry") {
+		return fmt.Errorf("failed to link %s: %w", mfsPath, err)
+	}
+	query := `INSERT OR REPLACE INTO mfs_links (sha256, pubkey, path) VALUES (?, ?, ?)`
+	if _, err := mo.db.ExecContext(ctx, query, sha256, pubkey, mfsPath); err != nil {
+		return fmt.Errorf("failed to record MFS link: %w", err)
+	}
+	mo.ipns.MarkDirty(pubkey)
+	return nil
+}
+
+// LinkOwners links a newly stored blob into the directories of all its owners
+func (mo *mfsOrganizer) LinkOwners(ctx context.Context, sha256 string) error {
+	if mo == nil {
+		return nil
+	}
+
+	rows, err := mo.db.QueryContext(ctx, `SELECT pubkey, uploaded_at FROM blob_usage WHERE sha256 = ?`, sha256)
+	if err != nil {
+		return fmt.Errorf("failed to query owners: %w", err)
+	}
+	type owner struct {
+		pubkey     string
+		uploadedAt int64
+	}
+	var owners []owner
+	for rows.Next() {
+		var o owner
+		if err := rows.Scan(&o.pubkey, &o.uploadedAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan owner: %w", err)
+		}
+		owners = append(owners, o)
+	}
+	rows.Close()
+
+	for _, o := range owners {
+		if err := mo.Link(ctx, sha256, o.pubkey, o.uploadedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unlink removes a blob from the directory of an owner
+func (mo *mfsOrganizer) Unlink(ctx context.Context, sha256 string, pubkey string) error {
+	if mo == nil {
+		return nil
+	}
+	return mo.unlink(ctx, `SELECT pubkey, path FROM mfs_links WHERE sha256 = ? AND pubkey = ?`, sha256, pubkey)
+}
+
+// Remove removes a blob that is no longer served from the directories of all its owners
+func (mo *mfsOrganizer) Remove(ctx context.Context, sha256 string) error {
+	if mo == nil {
+		return nil
+	}
+	return mo.unlink(ctx, `SELECT pubkey, path FROM mfs_links WHERE sha256 = ?`, sha256)
+}
+
+// unlink removes the MFS links selected by a query on mfs_links returning pubkey and path
+func (mo *mfsOrganizer) unlink(ctx context.Context, query string, args ...interface{}) error {
+	rows, err := mo.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query MFS links: %w", err)
+	}
+	type link struct {
+		pubkey string
+		path   string
+	}
+	var links []link
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.pubkey, &l.path); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan MFS link: %w", err)
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+
+	for _, l := range links {
+		if err := mo.ipfsShell.FilesRm(ctx, l.path, true); err != nil && !strings.Contains(err.Error(), "does not exist") {
+			return fmt.Errorf("failed to unlink %s: %w", l.path, err)
+		}
+		if _, err := mo.db.ExecContext(ctx, `DELETE FROM mfs_links WHERE path = ?`, l.path); err != nil {
+			return fmt.Errorf("failed to forget MFS link: %w", err)
+		}
+		mo.ipns.MarkDirty(l.pubkey)
+	}
+	return nil
+}
+
+// Sync links the owned public blobs that aren't linked yet, such as blobs stored before
+// MFS organisation was enabled
+func (mo *mfsOrganizer) Sync(ctx context.Context) {
+	query := `
+	SELECT u.sha256, u.pubkey, u.uploaded_at FROM blob_usage u
+	JOIN ipfs_blossom_mapping m ON m.sha256 = u.sha256
+	WHERE u.sha256 NOT IN (SELECT sha256 FROM private_blobs)
+	AND NOT EXISTS (SELECT 1 FROM mfs_links l WHERE l.sha256 = u.sha256 AND l.pubkey = u.pubkey)`
+	rows, err := mo.db.QueryContext(ctx, query)
+	if err != nil {
+		log.Printf("Failed to list blobs to link into MFS: %v", err)
+		return
+	}
+	type link struct {
+		sha256     string
+		pubkey     string
+		uploadedAt int64
+	}
+	var links []link
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.sha256, &l.pubkey, &l.uploadedAt); err != nil {
+			log.Printf("Failed to scan blob to link into MFS: %v", err)
+			continue
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+
+	linked := 0
+	for _, l := range links {
+		if err := mo.Link(ctx, l.sha256, l.pubkey, l.uploadedAt); err != nil {
+			log.Printf("Failed to link sha256=%s of %s into MFS: %v", l.sha256, l.pubkey, err)
+			continue
+		}
+		linked++
+	}
+	if len(links) > 0 {
+		log.Printf("Linked %d of %d unlinked blobs into MFS under %s", linked, len(links), mo.root)
+	}
+}
+
+// mfsTrackingIndex wraps the blob index to link blobs into MFS when a pubkey keeps them
+// and unlink them when the pubkey deletes them
+// New blobs aren't stored yet when they are kept: they are linked once stored, with LinkOwners
+type mfsTrackingIndex struct {
+	blossom.BlobIndex
+	mfs *mfsOrganizer
+}
+
+func (idx mfsTrackingIndex) Keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string) error {
+	if err := idx.BlobIndex.Keep(ctx, blob, pubkey); err != nil {
+		return err
+	}
+	if err := idx.mfs.Link(ctx, blob.SHA256, pubkey, int64(blob.Uploaded)); err != nil {
+		log.Printf("Failed to link sha256=%s of %s into MFS: %v", blob.SHA256, pubkey, err)
+	}
+	return nil
+}
+
+func (idx mfsTrackingIndex) Delete(ctx context.Context, sha256 string, pubkey string) error {
+	if err := idx.BlobIndex.Delete(ctx, sha256, pubkey); err != nil {
+		return err
+	}
+	if err := idx.mfs.Unlink(ctx, sha256, pubkey); err != nil {
+		log.Printf("Failed to unlink sha256=%s of %s from MFS: %v", sha256, pubkey, err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestNewMFSOrganizer(t *testing.T) {
+	tests := []struct {
+		root     string
+		wantRoot string
+		wantErr  bool
+	}{
+		{root: "/blossom", wantRoot: "/blossom"},
+		{root: "blossom/", wantRoot: "/blossom"},
+		{root: " /a/../b ", wantRoot: "/b"},
+		{root: "/", wantErr: true},
+		{root: "/a/..", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.root, func(t *testing.T) {
+			mo, err := newMFSOrganizer(nil, nil, nil, tt.root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newMFSOrganizer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && mo.root != tt.wantRoot {
+				t.Errorf("root = %q, want %q", mo.root, tt.wantRoot)
+			}
+		})
+	}
+}
+
+func TestMFSOrganizer(t *testing.T) {
+	ctx := context.Background()
+	store, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	private := &privateBlobs{db: db}
+	mo, err := newMFSOrganizer(db, ipfsShell, private, "/blossom")
+	if err != nil {
+		t.Fatalf("newMFSOrganizer() error = %v", err)
+	}
+	index := mfsTrackingIndex{
+		BlobIndex: usageTrackingIndex{BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://blossom.example.com"}, db: db},
+		mfs:       mo,
+	}
+	_, alice := newTestKey(t)
+	_, bob := newTestKey(t)
+	january := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC).Unix()
+	march := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	// keep records an owner like an upload: before the blob is stored
+	keep := func(content []byte, ext string, pubkey string, uploadedAt int64) string {
+		t.Helper()
+		sha := sha256Hex(content)
+		blob := blossom.BlobDescriptor{SHA256: sha, Size: len(content), Type: typeForExtension(ext), Uploaded: nostr.Timestamp(uploadedAt)}
+		if err := index.Keep(ctx, blob, pubkey); err != nil {
+			t.Fatalf("Keep() error = %v", err)
+		}
+		return sha
+	}
+	storeBlob := func(content []byte, ext string) string {
+		t.Helper()
+		cidStr, err := storeBlobInIPFS(ctx, ipfsShell, db, sha256Hex(content), ext, content)
+		if err != nil {
+			t.Fatalf("storeBlobInIPFS() error = %v", err)
+		}
+		return cidStr
+	}
+
+	shared := []byte("blob owned by two pubkeys")
+	sharedSHA := keep(shared, ".txt", alice, january)
+	if len(node.files) != 0 {
+		t.Fatalf("blob was linked before it was stored")
+	}
+	sharedCID := storeBlob(shared, ".txt")
+	if err := mo.LinkOwners(ctx, sharedSHA); err != nil {
+		t.Fatalf("LinkOwners() error = %v", err)
+	}
+	// Already stored, so the second owner is linked when keeping it
+	keep(shared, ".txt", bob, march)
+
+	hidden := []byte("private blob")
+	hiddenSHA := sha256Hex(hidden)
+	storeBlob(hidden, ".txt")
+	if err := private.MarkPrivate(ctx, hiddenSHA); err != nil {
+		t.Fatalf("MarkPrivate() error = %v", err)
+	}
+	keep(hidden, ".txt", alice, january)
+
+	// Stored and owned before MFS organisation was enabled
+	earlier := []byte("blob stored earlier")
+	earlierSHA := sha256Hex(earlier)
+	earlierCID := storeBlob(earlier, ".bin")
+	query := `INSERT INTO blob_usage (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(query, alice, earlierSHA, len(earlier), march); err != nil {
+		t.Fatalf("failed to record usage: %v", err)
+	}
+	mo.Sync(ctx)
+
+	links := []struct {
+		name    string
+		path    string
+		wantCID string
+	}{
+		// Linked from blob_usage, which records when the owner kept the blob
+		{name: "first owner", path: "/blossom/" + alice + "/" + time.Now().UTC().Format("2006-01") + "/" + sharedSHA + ".txt", wantCID: sharedCID},
+		{name: "second owner", path: "/blossom/" + bob + "/2025-03/" + sharedSHA + ".txt", wantCID: sharedCID},
+		{name: "synced", path: "/blossom/" + alice + "/2025-03/" + earlierSHA + ".bin", wantCID: earlierCID},
+		{name: "private", path: "/blossom/" + alice + "/2025-01/" + hiddenSHA + ".txt"},
+	}
+	for _, link := range links {
+		if c, _ := node.file(link.path); c != link.wantCID {
+			t.Errorf("%s: %s links %q, want %q", link.name, link.path, c, link.wantCID)
+		}
+	}
+	if len(node.files) != 3 {
+		t.Errorf("MFS has %d links, want 3: %v", len(node.files), node.files)
+	}
+
+	// A deleting owner loses their link only; a removed blob loses all of them
+	if err := index.Delete(ctx, sharedSHA, alice); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, ok := node.file(links[0].path); ok {
+		t.Errorf("link of the deleting owner remains")
+	}
+	if _, ok := node.file(links[1].path); !ok {
+		t.Errorf("link of the other owner was removed")
+	}
+	if err := mo.Remove(ctx, sharedSHA); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, ok := node.file(links[1].path); ok {
+		t.Errorf("link of removed blob remains")
+	}
+	var remaining int
+	db.QueryRow(`SELECT COUNT(*) FROM mfs_links WHERE sha256 = ?`, sharedSHA).Scan(&remaining)
+	if remaining != 0 {
+		t.Errorf("%d MFS links of removed blob are still recorded", remaining)
+	}
+
+	// A link lost from MFS but still recorded is relinked without error
+	if _, err := db.Exec(`DELETE FROM mfs_links WHERE sha256 = ?`, earlierSHA); err != nil {
+		t.Fatalf("failed to forget link: %v", err)
+	}
+	if err := mo.Link(ctx, earlierSHA, alice, march); err != nil {
+		t.Errorf("Link() over an existing MFS entry error = %v", err)
+	}
+	// Linking it again finds the recorded link and does nothing
+	if err := mo.Link(ctx, earlierSHA, alice, march); err != nil {
+		t.Errorf("Link() of a recorded link error = %v", err)
+	}
+	var recorded int
+	db.QueryRow(`SELECT COUNT(*) FROM mfs_links WHERE sha256 = ?`, earlierSHA).Scan(&recorded)
+	if recorded != 1 {
+		t.Errorf("%d MFS links recorded for a blob linked twice, want 1", recorded)
+	}
+
+	// Everything is a no-op when MFS organisation is disabled
+	var disabled *mfsOrganizer
+	if err := disabled.Link(ctx, sharedSHA, alice, january); err != nil {
+		t.Errorf("disabled Link() error = %v", err)
+	}
+	if err := disabled.Remove(ctx, sharedSHA); err != nil {
+		t.Errorf("disabled Remove() error = %v", err)
+	}
+}
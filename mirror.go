@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// mirrorMaxRedirects bounds how many redirects a mirror download may follow
+const mirrorMaxRedirects = 5
+
+// mirrorDefaultMaxSize is the size limit of mirror downloads when none is configured
+const mirrorDefaultMaxSize = 100 * 1024 * 1024
+
+// errMirrorPrivateAddress is returned when a mirror URL resolves to a non-public address
+var errMirrorPrivateAddress = errors.New("mirror URL resolves to a private address")
+
+// blobMirror implements BUD-04 PUT /mirror: it downloads a remote blob, verifies its hash
+// while streaming and stores it through the same hooks as uploads
+// The download client refuses to connect to private addresses, unless allowPrivate is set
+type blobMirror struct {
+	server  *blossom.BlossomServer
+	client  *http.Client
+	maxSize int64
+}
+
+// newBlobMirror creates the mirror with a download client enforcing the timeout and SSRF protection
+// A maxSize of 0 or less uses mirrorDefaultMaxSize: downloads are never unbounded
+func newBlobMirror(server *blossom.BlossomServer, maxSize int64, timeout time.Duration, allowPrivate bool) *blobMirror {
+	if maxSize <= 0 {
+		maxSize = mirrorDefaultMaxSize
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		// Checked after DNS resolution, so hostnames pointing at internal addresses are refused too
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if addr, err := netip.ParseAddr(host); err != nil || !isPublicIP(addr) {
+				return errMirrorPrivateAddress
+			}
+			return nil
+		},
+	}
+
+	return &blobMirror{
+		server:  server,
+		maxSize: maxSize,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				// No proxy from the environment: it would be dialed instead of the checked address
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: timeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= mirrorMaxRedirects {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// nonPublicPrefixes are the ranges isPublicIP refuses on top of the net.IP classifications
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT, not covered by IsPrivate
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which translates to any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+}
+
+// isPublicIP reports whether an IP is a globally routable unicast address
+// IPv4-mapped IPv6 addresses are refused outright rather than classified by their IPv4 part
+func isPublicIP(addr netip.Addr) bool {
+	if !addr.IsValid() || addr.Is4In6() {
+		return false
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr.WithZone("")) {
+			return false
+		}
+	}
+	return true
+}
+
+// download fetches a URL, hashing the body as it is read and enforcing the size limit
+func (m *blobMirror) download(ctx context.Context, rawURL string) ([]byte, string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("origin answered %s", resp.Status)
+	}
+	if resp.ContentLength > m.maxSize {
+		return nil, "", "", fmt.Errorf("blob is larger than %d bytes", m.maxSize)
+	}
+
+	// The body is hashed as it is copied into a buffer that never grows past the size limit
+	var body bytes.Buffer
+	if resp.ContentLength > 0 {
+		body.Grow(int(resp.ContentLength))
+	}
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(&body, hasher), io.LimitReader(resp.Body, m.maxSize+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if n > m.maxSize {
+		return nil, "", "", fmt.Errorf("blob is larger than %d bytes", m.maxSize)
+	}
+
+	return body.Bytes(), hex.EncodeToString(hasher.Sum(nil)), resp.Header.Get("Content-Type"), nil
+}
+
+// mirrorMiddleware serves PUT /mirror in place of the blossom library's unrestricted handler
+// It must sit inside modifyBlossomResponse so the descriptor gets the CID and gateway URL
+func mirrorMiddleware(next http.Handler, m *blobMirror) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mirror" || r.Method != "PUT" || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth, err := readBlossomAuth(r)
+		if err != nil {
+			w.Header().Set("X-Reason", "invalid \"Authorization\": "+err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			w.Header().Set("X-Reason", "missing \"Authorization\" header")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if auth.Tags.FindWithValue("t", "upload") == nil {
+			w.Header().Set("X-Reason", "invalid \"Authorization\" event \"t\" tag")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if auth.Tags.Find("x") == nil {
+			w.Header().Set("X-Reason", "\"Authorization\" event must have an \"x\" tag with the blob hash")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 8192)).Decode(&body); err != nil {
+			w.Header().Set("X-Reason", "invalid request body: "+err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		remote, err := url.Parse(body.URL)
+		if err != nil || (remote.Scheme != "http" && remote.Scheme != "https") || remote.Host == "" {
+			w.Header().Set("X-Reason", "url must be an absolute http(s) URL")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Refuse banned, unauthorized and over-quota pubkeys before fetching anything on their behalf
+		// The size and type are unknown until the blob is downloaded, so they are checked again then
+		precheckCtx := context.WithValue(r.Context(), uploadPrecheckKey, true)
+		for _, reject := range m.server.RejectUpload {
+			if rejected, reason, code := reject(precheckCtx, auth, 0, ""); rejected {
+				w.Header().Set("X-Reason", reason)
+				w.WriteHeader(code)
+				return
+			}
+		}
+
+		data, hash, contentType, err := m.download(r.Context(), remote.String())
+		if err != nil {
+			log.Printf("Failed to mirror %s: %v", remote.Redacted(), err)
+			w.Header().Set("X-Reason", "failed to download blob: "+err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if auth.Tags.FindWithValue("x", hash) == nil {
+			w.Header().Set("X-Reason", "blob hash does not match any \"x\" tag in authorization event")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// Declared extension from the origin's Content-Type or URL, checked against the sniffed type
+		declaredExt := path.Ext(remote.Path)
+		if contentType != "" {
+			if exts, _ := mime.ExtensionsByType(baseMIMEType(contentType)); len(exts) > 0 {
+				declaredExt = exts[0]
+			}
+		}
+		sniffedType := sniffContentType(data)
+		ext := normalizeExtension(sniffedType, declaredExt)
+
+		for _, reject := range m.server.RejectUpload {
+			if rejected, reason, code := reject(r.Context(), auth, len(data), ext); rejected {
+				w.Header().Set("X-Reason", reason)
+				w.WriteHeader(code)
+				return
+			}
+		}
+
+		descriptor := blossom.BlobDescriptor{
+			URL:      m.server.ServiceURL + "/" + hash + ext,
+			SHA256:   hash,
+			Size:     len(data),
+			Type:     typeForExtension(ext),
+			Uploaded: nostr.Now(),
+		}
+		if err := m.server.Store.Keep(r.Context(), descriptor, auth.PubKey); err != nil {
+			w.Header().Set("X-Reason", "failed to save metadata: "+err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, store := range m.server.StoreBlob {
+			if err := store(r.Context(), hash, ext, data); err != nil {
+				w.Header().Set("X-Reason", "failed to save blob: "+err.Error())
+				if errors.Is(err, errBlobBanned) {
+					w.WriteHeader(http.StatusUnavailableForLegalReasons)
+				} else {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				return
+			}
+		}
+
+		log.Printf("Mirrored %s as sha256=%s (%d bytes) for %s", remote.Redacted(), hash, len(data), auth.PubKey)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(descriptor)
+	})
+}
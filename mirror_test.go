@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMirrorMiddleware(t *testing.T) {
+	const content = "mirrored content"
+	hash := sha256.Sum256([]byte(content))
+	contentHash := hex.EncodeToString(hash[:])
+	otherHash := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name         string
+		url          string // the origin URL is substituted for $origin
+		authHash     string
+		allowPrivate bool
+		maxSize      int64
+		streamed     bool // the origin sends no Content-Length
+		banned       bool
+		blobBanned   bool
+		noAuth       bool
+		wantStatus   int
+		wantReason   string
+		wantFetch    bool
+	}{
+		{name: "mirrored", url: "$origin/blob", authHash: contentHash, allowPrivate: true, wantStatus: http.StatusOK, wantFetch: true},
+		{name: "loopback origin", url: "$origin/blob", authHash: contentHash, wantStatus: http.StatusBadGateway, wantReason: "private address"},
+		{name: "private network origin", url: "http://10.0.0.1/blob", authHash: contentHash, wantStatus: http.StatusBadGateway, wantReason: "private address"},
+		{name: "link-local origin", url: "http://169.254.169.254/latest/meta-data", authHash: contentHash, wantStatus: http.StatusBadGateway, wantReason: "private address"},
+		{name: "unsupported scheme", url: "ftp://example.com/blob", authHash: contentHash, wantStatus: http.StatusBadRequest},
+		{name: "relative URL", url: "/blob", authHash: contentHash, wantStatus: http.StatusBadRequest},
+		{name: "hash mismatch", url: "$origin/blob", authHash: hex.EncodeToString(otherHash[:]), allowPrivate: true, wantStatus: http.StatusForbidden, wantReason: "does not match", wantFetch: true},
+		{name: "blob too large", url: "$origin/blob", authHash: contentHash, allowPrivate: true, maxSize: 4, wantStatus: http.StatusBadGateway, wantReason: "larger than", wantFetch: true},
+		{name: "streamed blob too large", url: "$origin/blob", authHash: contentHash, allowPrivate: true, maxSize: 4, streamed: true, wantStatus: http.StatusBadGateway, wantReason: "larger than", wantFetch: true},
+		{name: "streamed blob", url: "$origin/blob", authHash: contentHash, allowPrivate: true, streamed: true, wantStatus: http.StatusOK, wantFetch: true},
+		{name: "missing authorization", url: "$origin/blob", noAuth: true, allowPrivate: true, wantStatus: http.StatusUnauthorized},
+		{name: "rejected before downloading", url: "$origin/blob", authHash: contentHash, allowPrivate: true, banned: true, wantStatus: http.StatusForbidden, wantReason: "banned"},
+		{name: "banned blob", url: "$origin/blob", authHash: contentHash, allowPrivate: true, blobBanned: true, wantStatus: http.StatusUnavailableForLegalReasons, wantReason: "banned", wantFetch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _ := newTestDB(t)
+			sk, pubkey := newTestKey(t)
+
+			fetched := false
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetched = true
+				w.Header().Set("Content-Type", "text/plain")
+				if tt.streamed {
+					w.(http.Flusher).Flush()
+				}
+				w.Write([]byte(content))
+			}))
+			defer origin.Close()
+
+			stored := make(map[string][]byte)
+			server := &blossom.BlossomServer{
+				ServiceURL: "https://blossom.example.com",
+				Store:      blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://blossom.example.com"},
+			}
+			server.RejectUpload = append(server.RejectUpload, func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+				if tt.banned && auth.PubKey == pubkey {
+					return true, "pubkey is banned", http.StatusForbidden
+				}
+				return false, "", 0
+			})
+			server.StoreBlob = append(server.StoreBlob, func(ctx context.Context, sha256 string, ext string, body []byte) error {
+				if tt.blobBanned {
+					return errBlobBanned
+				}
+				stored[sha256] = body
+				return nil
+			})
+
+			mirror := newBlobMirror(server, tt.maxSize, 5*time.Second, tt.allowPrivate)
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("mirror request was passed to the next handler")
+			})
+
+			body := `{"url":"` + strings.Replace(tt.url, "$origin", origin.URL, 1) + `"}`
+			req := httptest.NewRequest("PUT", "/mirror", strings.NewReader(body))
+			if !tt.noAuth {
+				req.Header.Set("Authorization", blossomAuthHeader(t, sk, "upload", nostr.Tag{"x", tt.authHash}))
+			}
+			rec := httptest.NewRecorder()
+			mirrorMiddleware(next, mirror).ServeHTTP(rec, req)
+
+			reason := rec.Header().Get("X-Reason")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, reason, tt.wantStatus)
+			}
+			if !strings.Contains(reason, tt.wantReason) {
+				t.Errorf("X-Reason = %q, want it to mention %q", reason, tt.wantReason)
+			}
+			if fetched != tt.wantFetch {
+				t.Errorf("origin fetched = %v, want %v", fetched, tt.wantFetch)
+			}
+
+			_, ok := stored[contentHash]
+			if ok != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("blob stored = %v, want %v", ok, tt.wantStatus == http.StatusOK)
+			}
+			// Owners kept for blobs that fail to be stored are released by the upload accounting middleware
+			if owner, _ := server.Store.Get(context.Background(), contentHash); (owner != nil) != (ok || tt.blobBanned) {
+				t.Errorf("blob kept = %v, want %v", owner != nil, ok)
+			}
+		})
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::101:101", false},
+		{"64:ff9b:1::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:1.1.1.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isPublicIP(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
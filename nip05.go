@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+)
+
+// nip05FetchTimeout bounds metadata lookups and .well-known/nostr.json requests
+const nip05FetchTimeout = 10 * time.Second
+
+// nip05WellKnownFetcher fetches the .well-known/nostr.json document for a NIP-05 identifier
+// and returns it together with the local part of the identifier
+type nip05WellKnownFetcher func(ctx context.Context, identifier string) (nip05.WellKnownResponse, string, error)
+
+// nip05Authorizer authorizes uploads for pubkeys with a verified NIP-05 identifier under allowed domains
+type nip05Authorizer struct {
+	domains map[string]bool
+	ttl     time.Duration
+	db      *sql.DB
+	store   eventstore.Store
+	relays  []string
+	pool    *nostr.SimplePool
+
+	// fetch is nip05.Fetch by default and can be replaced to mock the well-known lookup
+	fetch nip05WellKnownFetcher
+}
+
+// newNIP05Authorizer creates a NIP-05 authorizer for the given domains
+// Profiles (kind 0) are read from the local eventstore and, if any are configured, from remote relays
+func newNIP05Authorizer(db *sql.DB, store eventstore.Store, domains map[string]bool, ttl time.Duration, relays []string) *nip05Authorizer {
+	authorizer := &nip05Authorizer{
+		domains: domains,
+		ttl:     ttl,
+		db:      db,
+		store:   store,
+		relays:  relays,
+		fetch:   nip05.Fetch,
+	}
+	if len(relays) > 0 {
+		authorizer.pool = nostr.NewSimplePool(context.Background())
+	}
+	return authorizer
+}
+
+// createNIP05Table creates the table caching NIP-05 verification results if it doesn't exist
+func createNIP05Table(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS nip05_verifications (
+		pubkey TEXT PRIMARY KEY,
+		identifier TEXT,
+		verified INTEGER NOT NULL,
+		checked_at INTEGER NOT NULL
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// parseNIP05Domains parses a comma-separated list of allowed NIP-05 domains from environment variable
+// Entries may be plain domains ("ourteam.org") or wildcard identifiers ("*@ourteam.org")
+func parseNIP05Domains(domainsStr string) (map[string]bool, error) {
+	if domainsStr == "" {
+		return nil, nil
+	}
+
+	domains := make(map[string]bool)
+	for _, domain := range strings.Split(domainsStr, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		domain = strings.TrimPrefix(domain, "*@")
+		if strings.Contains(domain, "@") || !nip05.IsValidIdentifier(domain) {
+			return nil, fmt.Errorf("invalid NIP-05 domain %q", domain)
+		}
+		domains[domain] = true
+	}
+	return domains, nil
+}
+
+// Authorize implements uploadAuthorizer for NIP-05 domains
+// Results are cached for the configured TTL and re-checked once they expire
+func (na *nip05Authorizer) Authorize(ctx context.Context, pubkey string) (bool, error) {
+	var identifier string
+	var verified bool
+	var checkedAt int64
+	query := `SELECT COALESCE(identifier, ''), verified, checked_at FROM nip05_verifications WHERE pubkey = ?`
+	err := na.db.QueryRowContext(ctx, query, pubkey).Scan(&identifier, &verified, &checkedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to query NIP-05 cache: %w", err)
+	}
+	if err == nil && time.Since(time.Unix(checkedAt, 0)) < na.ttl {
+		return verified, nil
+	}
+
+	identifier, verified, err = na.verify(ctx, pubkey)
+	if err != nil {
+		return false, err
+	}
+
+	query = `INSERT OR REPLACE INTO nip05_verifications (pubkey, identifier, verified, checked_at) VALUES (?, ?, ?, ?)`
+	if _, err := na.db.ExecContext(ctx, query, pubkey, identifier, verified, time.Now().Unix()); err != nil {
+		return false, fmt.Errorf("failed to store NIP-05 verification: %w", err)
+	}
+
+	log.Printf("NIP-05 verification for pubkey %s: identifier=%q verified=%v", pubkey, identifier, verified)
+	return verified, nil
+}
+
+// verify looks up the NIP-05 identifier of a pubkey and checks it against its domain
+// Network failures are returned as errors so they don't get cached as negative results
+func (na *nip05Authorizer) verify(ctx context.Context, pubkey string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, nip05FetchTimeout)
+	defer cancel()
+
+	identifier, err := na.lookupIdentifier(ctx, pubkey)
+	if err != nil {
+		return "", false, err
+	}
+	if identifier == "" {
+		return "", false, nil
+	}
+
+	name, domain, err := nip05.ParseIdentifier(identifier)
+	if err != nil {
+		return identifier, false, nil
+	}
+	if !na.domains[strings.ToLower(domain)] {
+		return identifier, false, nil
+	}
+
+	result, name, err := na.fetch(ctx, identifier)
+	if err != nil {
+		return identifier, false, fmt.Errorf("failed to fetch NIP-05 document for %s: %w", identifier, err)
+	}
+
+	return identifier, strings.EqualFold(result.Names[name], pubkey), nil
+}
+
+// lookupIdentifier returns the nip05 field from the latest profile (kind 0) of a pubkey
+func (na *nip05Authorizer) lookupIdentifier(ctx context.Context, pubkey string) (string, error) {
+	latest := make(map[string]*nostr.Event)
+	filter := nostr.Filter{Authors: []string{pubkey}, Kinds: []int{nostr.KindProfileMetadata}}
+
+	ch, err := na.store.QueryEvents(ctx, filter)
+	if err != nil {
+		return "", fmt.Errorf("failed to query profile: %w", err)
+	}
+	for evt := range ch {
+		keepLatestEvent(latest, evt)
+	}
+
+	if na.pool != nil {
+		for ie := range na.pool.FetchMany(ctx, na.relays, filter) {
+			if ok, _ := ie.Event.CheckSignature(); ok {
+				keepLatestEvent(latest, ie.Event)
+			}
+		}
+	}
+
+	evt, ok := latest[pubkey]
+	if !ok {
+		return "", nil
+	}
+
+	var metadata struct {
+		NIP05 string `json:"nip05"`
+	}
+	if err := json.Unmarshal([]byte(evt.Content), &metadata); err != nil {
+		return "", nil
+	}
+	return strings.TrimSpace(metadata.NIP05), nil
+}
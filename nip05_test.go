@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+)
+
+func TestNIP05AuthorizerAuthorize(t *testing.T) {
+	tests := []struct {
+		name      string
+		nip05     string // nip05 field of the profile, no profile when empty
+		names     map[string]string
+		fetchErr  error
+		want      bool
+		wantErr   bool
+		wantFetch bool
+	}{
+		{name: "verified identifier", nip05: "alice@ourteam.org", names: map[string]string{"alice": "$pubkey"}, want: true, wantFetch: true},
+		{name: "wildcard name", nip05: "_@ourteam.org", names: map[string]string{"_": "$pubkey"}, want: true, wantFetch: true},
+		{name: "document lists another pubkey", nip05: "alice@ourteam.org", names: map[string]string{"alice": "00" + nostr.GeneratePrivateKey()[2:]}, wantFetch: true},
+		{name: "domain not allowed", nip05: "alice@elsewhere.org", names: map[string]string{"alice": "$pubkey"}},
+		{name: "no profile"},
+		{name: "fetch failure", nip05: "alice@ourteam.org", fetchErr: errors.New("connection refused"), wantErr: true, wantFetch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, db := newTestDB(t)
+			sk, pubkey := newTestKey(t)
+			ctx := context.Background()
+
+			if tt.nip05 != "" {
+				profile := signTestEvent(t, sk, nostr.KindProfileMetadata, nil, `{"nip05":"`+tt.nip05+`"}`)
+				if err := store.SaveEvent(ctx, profile); err != nil {
+					t.Fatalf("failed to save profile: %v", err)
+				}
+			}
+
+			authorizer := newNIP05Authorizer(db, store, map[string]bool{"ourteam.org": true}, time.Hour, nil)
+			fetches := 0
+			authorizer.fetch = func(ctx context.Context, identifier string) (nip05.WellKnownResponse, string, error) {
+				fetches++
+				if identifier != tt.nip05 {
+					t.Errorf("fetched %q, want %q", identifier, tt.nip05)
+				}
+				name, _, _ := nip05.ParseIdentifier(identifier)
+				names := make(map[string]string)
+				for k, v := range tt.names {
+					if v == "$pubkey" {
+						v = pubkey
+					}
+					names[k] = v
+				}
+				return nip05.WellKnownResponse{Names: names}, name, tt.fetchErr
+			}
+
+			got, err := authorizer.Authorize(ctx, pubkey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Authorize() = %v, want %v", got, tt.want)
+			}
+			if (fetches > 0) != tt.wantFetch {
+				t.Errorf("fetched the document %d times, want fetch %v", fetches, tt.wantFetch)
+			}
+
+			// Results are cached until the TTL expires, failures aren't
+			fetches = 0
+			if _, err := authorizer.Authorize(ctx, pubkey); (err != nil) != tt.wantErr {
+				t.Fatalf("second Authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && fetches == 0 {
+				t.Errorf("failed verification was cached")
+			}
+			if !tt.wantErr && fetches > 0 {
+				t.Errorf("cached verification was fetched again")
+			}
+		})
+	}
+}
+
+func TestParseNIP05Domains(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: ""},
+		{input: "ourteam.org", want: []string{"ourteam.org"}},
+		{input: " OurTeam.org , *@partner.net ", want: []string{"ourteam.org", "partner.net"}},
+		{input: "alice@ourteam.org", wantErr: true},
+		{input: "not a domain", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			domains, err := parseNIP05Domains(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNIP05Domains() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(domains) != len(tt.want) {
+				t.Fatalf("parseNIP05Domains() = %v, want %v", domains, tt.want)
+			}
+			for _, domain := range tt.want {
+				if !domains[domain] {
+					t.Errorf("parseNIP05Domains() = %v, want it to contain %s", domains, domain)
+				}
+			}
+		})
+	}
+}
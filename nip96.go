@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nip96APIPath is the NIP-96 api_url path, relative to the server root
+const nip96APIPath = "/n96"
+
+// nip96MaxListCount bounds the page size of NIP-96 list requests
+const nip96MaxListCount = 500
+
+// nip96FormOverhead is how much an upload body may exceed the file size limit, for the
+// multipart framing and the other form fields
+const nip96FormOverhead = 1024 * 1024
+
+// nip96Server is a NIP-96 HTTP file storage front end for clients that don't speak Blossom
+// Uploads go through the same policies and storage hooks as Blossom uploads, authenticated with NIP-98
+type nip96Server struct {
+	server     *blossom.BlossomServer
+	db         *sql.DB
+	private    *privateBlobs
+	blocks     *blocklist
+	media      *mediaOptimizer
+	gatewayURL string
+	maxSize    int64
+}
+
+// nip96File is a file entry in NIP-96 upload and list responses
+type nip96File struct {
+	Tags      nostr.Tags      `json:"tags"`
+	Content   string          `json:"content"`
+	CreatedAt nostr.Timestamp `json:"created_at,omitempty"`
+}
+
+// nip96Response is the body of NIP-96 upload and delete responses
+type nip96Response struct {
+	Status     string     `json:"status"`
+	Message    string     `json:"message"`
+	NIP94Event *nip96File `json:"nip94_event,omitempty"`
+}
+
+// newNIP96Server creates the NIP-96 front end
+func newNIP96Server(server *blossom.BlossomServer, db *sql.DB, private *privateBlobs, blocks *blocklist, media *mediaOptimizer, gatewayURL string, maxSize int64) *nip96Server {
+	return &nip96Server{
+		server:     server,
+		db:         db,
+		private:    private,
+		blocks:     blocks,
+		media:      media,
+		gatewayURL: gatewayURL,
+		maxSize:    maxSize,
+	}
+}
+
+// writeNIP96ReadError answers a request whose body couldn't be read, with 413 when it went
+// over the size limit
+func writeNIP96ReadError(w http.ResponseWriter, message string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeNIP96Error(w, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeNIP96Error(w, message+": "+err.Error(), http.StatusBadRequest)
+}
+
+// writeNIP96Error writes a NIP-96 error response
+func writeNIP96Error(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Reason", message)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(nip96Response{Status: "error", Message: message})
+}
+
+// serveInfo serves the /.well-known/nostr/nip96.json discovery document
+func (n *nip96Server) serveInfo(w http.ResponseWriter, r *http.Request) {
+	baseURL := requestBaseURL(r)
+	info := map[string]interface{}{
+		"api_url":        baseURL + nip96APIPath,
+		"download_url":   baseURL,
+		"supported_nips": []int{94, 96, 98},
+		"plans": map[string]interface{}{
+			"free": map[string]interface{}{
+				"name":              "Default",
+				"is_nip98_required": true,
+				"max_byte_size":     n.maxSize,
+				"file_expiration":   []int{0, 0},
+				"media_transformations": map[string]interface{}{
+					"image": []string{"resizing"},
+				},
+			},
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(info)
+}
+
+// upload handles a multipart NIP-96 upload of the "file" field
+func (n *nip96Server) upload(w http.ResponseWriter, r *http.Request) {
+	// The auth event is checked before the body is read, so unauthenticated clients can't make
+	// the server buffer uploads; only its payload tag has to wait for the body
+	auth, err := readNIP98Auth(r, nil)
+	if err != nil {
+		writeNIP96Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		writeNIP96Error(w, "request must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	// The body is read once, with some room for the other form fields. Clients either hash
+	// the whole request body or only the file for the payload tag, so both are hashed on the way
+	rawHash := sha256.New()
+	body := io.TeeReader(http.MaxBytesReader(w, r.Body, n.maxSize+nip96FormOverhead), rawHash)
+	parts := multipart.NewReader(body, params["boundary"])
+
+	var original []byte
+	var originalSHA256, filename, fileType string
+	hasFile := false
+	fields := make(map[string]string)
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeNIP96ReadError(w, "invalid multipart body", err)
+			return
+		}
+		switch name := part.FormName(); {
+		case name == "file" && !hasFile:
+			fileHash := sha256.New()
+			original, err = io.ReadAll(io.TeeReader(io.LimitReader(part, n.maxSize+1), fileHash))
+			if err != nil {
+				writeNIP96ReadError(w, "failed to read file", err)
+				return
+			}
+			if int64(len(original)) > n.maxSize {
+				writeNIP96Error(w, fmt.Sprintf("file is larger than %d bytes", n.maxSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			hasFile = true
+			originalSHA256 = hex.EncodeToString(fileHash.Sum(nil))
+			filename, fileType = part.FileName(), part.Header.Get("Content-Type")
+		case name != "" && part.FileName() == "":
+			value, err := io.ReadAll(part)
+			if err != nil {
+				writeNIP96ReadError(w, "invalid multipart body", err)
+				return
+			}
+			if _, ok := fields[name]; !ok {
+				fields[name] = string(value)
+			}
+		}
+		part.Close()
+	}
+	if !hasFile {
+		writeNIP96Error(w, "missing \"file\" field", http.StatusBadRequest)
+		return
+	}
+	// Anything after the closing boundary is still part of the signed body
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		writeNIP96ReadError(w, "failed to read request body", err)
+		return
+	}
+
+	if payloadTag := auth.Tags.Find("payload"); payloadTag != nil {
+		if payloadTag[1] != originalSHA256 && payloadTag[1] != hex.EncodeToString(rawHash.Sum(nil)) {
+			writeNIP96Error(w, "invalid auth event payload hash", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// A banned original can't be laundered through re-encoding
+	if err := n.blocks.CheckUpload(r.Context(), originalSHA256, original); err != nil {
+		if errors.Is(err, errBlobBanned) {
+			writeNIP96Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+		} else {
+			writeNIP96Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Images are optimized like on /media unless the client opts out
+	data := original
+	declaredExt := path.Ext(filename)
+	for _, contentType := range []string{fileType, fields["content_type"]} {
+		if exts, _ := mime.ExtensionsByType(baseMIMEType(contentType)); len(exts) > 0 {
+			declaredExt = exts[0]
+		}
+	}
+	ext := normalizeExtension(sniffContentType(original), declaredExt)
+	if !strings.EqualFold(fields["no_transform"], "true") {
+		optimized, optimizedExt, err := n.media.Optimize(original)
+		switch {
+		case err == nil:
+			data, ext = optimized, optimizedExt
+		case errors.Is(err, errMediaTooLarge):
+			writeNIP96Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case !errors.Is(err, errMediaUnsupported):
+			writeNIP96Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	hash := sha256.Sum256(data)
+	sha256Hex := hex.EncodeToString(hash[:])
+
+	for _, reject := range n.server.RejectUpload {
+		if rejected, reason, code := reject(r.Context(), auth, len(data), ext); rejected {
+			writeNIP96Error(w, reason, code)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	if n.private.wantsPrivate(r) {
+		ctx = context.WithValue(ctx, privateUploadKey, true)
+	}
+	if expirationStr := fields["expiration"]; expirationStr != "" {
+		if expiration, err := strconv.ParseInt(expirationStr, 10, 64); err == nil && expiration > 0 {
+			ctx = context.WithValue(ctx, blobExpirationKey, expiration)
+		}
+	}
+
+	existing, err := lookupBlobCID(ctx, n.db, sha256Hex)
+	if err != nil {
+		writeNIP96Error(w, "failed to check blob", http.StatusInternalServerError)
+		return
+	}
+
+	descriptor := blossom.BlobDescriptor{
+		URL:      n.server.ServiceURL + "/" + sha256Hex + ext,
+		SHA256:   sha256Hex,
+		Size:     len(data),
+		Type:     typeForExtension(ext),
+		Uploaded: nostr.Now(),
+	}
+	if err := n.server.Store.Keep(ctx, descriptor, auth.PubKey); err != nil {
+		writeNIP96Error(w, "failed to save metadata: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, store := range n.server.StoreBlob {
+		if err := store(ctx, sha256Hex, ext, data); err != nil {
+			writeNIP96Error(w, "failed to save blob: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	entry, err := n.fileEntry(ctx, requestBaseURL(r), descriptor)
+	if err != nil {
+		writeNIP96Error(w, "failed to describe blob: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entry.Tags = append(entry.Tags, nostr.Tag{"ox", originalSHA256})
+	if alt := fields["alt"]; alt != "" {
+		entry.Tags = append(entry.Tags, nostr.Tag{"alt", alt})
+	}
+	entry.Content = fields["caption"]
+
+	log.Printf("NIP-96 upload sha256=%s (original %s, %d bytes) for %s", sha256Hex, originalSHA256, len(data), auth.PubKey)
+	code := http.StatusCreated
+	if existing != "" {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(nip96Response{Status: "success", Message: "Upload successful.", NIP94Event: entry})
+}
+
+// fileEntry builds the NIP-94 tags of a stored blob: its gateway URL and CID, the server URL as a
+// fallback, and the image previews. Private blobs only get the server URL
+func (n *nip96Server) fileEntry(ctx context.Context, baseURL string, descriptor blossom.BlobDescriptor) (*nip96File, error) {
+	var cid, ext string
+	query := `SELECT ipfs_cid, COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`
+	if err := n.db.QueryRowContext(ctx, query, descriptor.SHA256).Scan(&cid, &ext); err != nil {
+		return nil, err
+	}
+	private, err := n.private.IsPrivate(ctx, descriptor.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	serverURL := baseURL + "/" + descriptor.SHA256 + ext
+	tags := nostr.Tags{}
+	if private {
+		tags = append(tags, nostr.Tag{"url", serverURL})
+	} else {
+		gatewayURL := n.gatewayURL + cid
+		if ext != "" {
+			gatewayURL += "?filename=" + url.QueryEscape("file"+ext)
+		}
+		tags = append(tags,
+			nostr.Tag{"url", gatewayURL},
+			nostr.Tag{"fallback", serverURL},
+			nostr.Tag{"cid", cid},
+		)
+	}
+	tags = append(tags,
+		nostr.Tag{"m", typeForExtension(ext)},
+		nostr.Tag{"x", descriptor.SHA256},
+		nostr.Tag{"size", strconv.Itoa(descriptor.Size)},
+	)
+
+	if !private {
+		previews := map[string]interface{}{"sha256": descriptor.SHA256}
+		addBlobPreviews(ctx, n.db, n.gatewayURL, previews)
+		for _, name := range []string{"dim", "blurhash", "thumb"} {
+			if value, ok := previews[name].(string); ok {
+				tags = append(tags, nostr.Tag{name, value})
+			}
+		}
+	}
+
+	return &nip96File{Tags: tags, CreatedAt: descriptor.Uploaded}, nil
+}
+
+// list serves the files uploaded by the authenticated pubkey, newest first
+func (n *nip96Server) list(w http.ResponseWriter, r *http.Request, pubkey string) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+	if page < 0 {
+		page = 0
+	}
+	if count <= 0 || count > nip96MaxListCount {
+		count = nip96MaxListCount
+	}
+
+	ch, err := n.server.Store.List(r.Context(), pubkey)
+	if err != nil {
+		writeNIP96Error(w, "failed to list files", http.StatusInternalServerError)
+		return
+	}
+	var descriptors []blossom.BlobDescriptor
+	for descriptor := range ch {
+		if banned, err := isBlobBanned(r.Context(), n.db, descriptor.SHA256); err != nil || banned {
+			continue
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	sort.Slice(descriptors, func(i, j int) bool {
+		return descriptors[i].Uploaded > descriptors[j].Uploaded
+	})
+
+	files := []*nip96File{}
+	baseURL := requestBaseURL(r)
+	for i := page * count; i < len(descriptors) && i < (page+1)*count; i++ {
+		entry, err := n.fileEntry(r.Context(), baseURL, descriptors[i])
+		if err != nil {
+			log.Printf("Failed to describe blob sha256=%s: %v", descriptors[i].SHA256, err)
+			continue
+		}
+		files = append(files, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(files),
+		"total": len(descriptors),
+		"page":  page,
+		"files": files,
+	})
+}
+
+// delete removes the authenticated pubkey's ownership of a file, like a Blossom delete
+func (n *nip96Server) delete(w http.ResponseWriter, r *http.Request, auth *nostr.Event) {
+	name := strings.TrimPrefix(r.URL.Path, nip96APIPath+"/")
+	sha256Hex := strings.ToLower(strings.SplitN(name, ".", 2)[0])
+	if !nostr.IsValid32ByteHex(sha256Hex) {
+		writeNIP96Error(w, "invalid file hash", http.StatusBadRequest)
+		return
+	}
+
+	var owned int
+	query := `SELECT COUNT(*) FROM blob_usage WHERE pubkey = ? AND sha256 = ?`
+	if err := n.db.QueryRowContext(r.Context(), query, auth.PubKey, sha256Hex).Scan(&owned); err != nil {
+		writeNIP96Error(w, "failed to check file owner", http.StatusInternalServerError)
+		return
+	}
+	if owned == 0 {
+		writeNIP96Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	var ext string
+	n.db.QueryRowContext(r.Context(), `SELECT COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256Hex).Scan(&ext)
+	for _, reject := range n.server.RejectDelete {
+		if rejected, reason, code := reject(r.Context(), auth, sha256Hex, ext); rejected {
+			writeNIP96Error(w, reason, code)
+			return
+		}
+	}
+
+	if err := n.server.Store.Delete(r.Context(), sha256Hex, auth.PubKey); err != nil {
+		writeNIP96Error(w, "failed to delete file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The blob itself is only deleted once no one else owns it
+	if descriptor, err := n.server.Store.Get(r.Context(), sha256Hex); err == nil && descriptor == nil {
+		for _, del := range n.server.DeleteBlob {
+			if err := del(r.Context(), sha256Hex, ext); err != nil {
+				writeNIP96Error(w, "failed to delete file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	log.Printf("NIP-96 delete sha256=%s by %s", sha256Hex, auth.PubKey)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nip96Response{Status: "success", Message: "File deleted."})
+}
+
+// nip96Middleware serves the NIP-96 discovery document and API in front of the blossom handlers
+func nip96Middleware(next http.Handler, n *nip96Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/.well-known/nostr/nip96.json" && r.Method == "GET":
+			n.serveInfo(w, r)
+
+		case r.URL.Path == nip96APIPath && r.Method == "POST":
+			n.upload(w, r)
+
+		case r.URL.Path == nip96APIPath && r.Method == "GET":
+			auth, err := readNIP98Auth(r, nil)
+			if err != nil {
+				writeNIP96Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			n.list(w, r, auth.PubKey)
+
+		case strings.HasPrefix(r.URL.Path, nip96APIPath+"/") && r.Method == "DELETE":
+			auth, err := readNIP98Auth(r, nil)
+			if err != nil {
+				writeNIP96Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			n.delete(w, r, auth)
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// nip96Form builds a multipart NIP-96 upload body with a file and extra form fields
+func nip96Form(t *testing.T, filename string, file []byte, fields map[string]string) ([]byte, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			t.Fatalf("failed to write field: %v", err)
+		}
+	}
+	if file != nil {
+		part, err := form.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatalf("failed to create file part: %v", err)
+		}
+		part.Write(file)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatalf("failed to close form: %v", err)
+	}
+	return body.Bytes(), form.FormDataContentType()
+}
+
+// newTestNIP96Server creates a NIP-96 server storing blobs on a fake IPFS node
+func newTestNIP96Server(t *testing.T, maxSize int64) (*nip96Server, *fakeIPFS) {
+	t.Helper()
+	store, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	server := &blossom.BlossomServer{
+		ServiceURL: "https://example.com",
+		Store:      usageTrackingIndex{BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "https://example.com"}, db: db},
+	}
+	server.StoreBlob = append(server.StoreBlob, func(ctx context.Context, sha256 string, ext string, body []byte) error {
+		_, err := storeBlobInIPFS(ctx, ipfsShell, db, sha256, ext, body)
+		return err
+	})
+	blocks := newBlocklist(db, ipfsShell, &privateBlobs{db: db}, false, nil, nil, nil)
+	media := newMediaOptimizer(server, blocks, maxSize, 100, 100, 1_000_000, 85)
+	return newNIP96Server(server, db, &privateBlobs{db: db}, blocks, media, "https://gateway.example.com/ipfs/", maxSize), node
+}
+
+func TestNIP96Upload(t *testing.T) {
+	const uploadURL = "https://example.com" + nip96APIPath
+	text := []byte("hello nip-96")
+	image := encodeTestImage(t, "png", 400, 20)
+	banned := []byte("banned content")
+
+	tests := []struct {
+		name        string
+		file        []byte
+		fields      map[string]string
+		payload     string // "body", "file", "wrong" or "" for no payload tag
+		authURL     string
+		noAuth      bool
+		contentType string
+		wantStatus  int
+		wantType    string
+		wantOrig    bool
+	}{
+		{name: "payload of body", file: text, payload: "body", wantStatus: http.StatusCreated, wantType: "text/plain", wantOrig: true},
+		{name: "payload of file", file: text, payload: "file", wantStatus: http.StatusCreated, wantType: "text/plain", wantOrig: true},
+		{name: "image is optimized", file: image, payload: "file", wantStatus: http.StatusCreated, wantType: "image/png"},
+		{name: "image kept with no_transform", file: image, fields: map[string]string{"no_transform": "true"}, payload: "file", wantStatus: http.StatusCreated, wantType: "image/png", wantOrig: true},
+		{name: "wrong payload", file: text, payload: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "wrong url", file: text, payload: "file", authURL: "https://other.example.com" + nip96APIPath, wantStatus: http.StatusUnauthorized},
+		{name: "missing auth", file: text, noAuth: true, wantStatus: http.StatusUnauthorized},
+		{name: "missing file", payload: "body", wantStatus: http.StatusBadRequest},
+		{name: "not multipart", file: text, payload: "body", contentType: "application/json", wantStatus: http.StatusBadRequest},
+		{name: "payload of body with fields", file: text, fields: map[string]string{"alt": "a greeting", "caption": "hello"}, payload: "body", wantStatus: http.StatusCreated, wantType: "text/plain", wantOrig: true},
+		{name: "too large", file: bytes.Repeat([]byte("x"), 2000), payload: "file", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "body too large", file: text, fields: map[string]string{"caption": strings.Repeat("x", nip96FormOverhead+1000)}, payload: "file", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "banned original", file: banned, payload: "file", wantStatus: http.StatusUnavailableForLegalReasons},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, node := newTestNIP96Server(t, 1000)
+			if _, err := n.db.Exec(`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`, sha256Hex(banned), "test"); err != nil {
+				t.Fatalf("failed to ban blob: %v", err)
+			}
+			sk, _ := newTestKey(t)
+			body, contentType := nip96Form(t, "file.bin", tt.file, tt.fields)
+			if tt.contentType != "" {
+				contentType = tt.contentType
+			}
+
+			req := httptest.NewRequest("POST", nip96APIPath, bytes.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			if !tt.noAuth {
+				authURL := uploadURL
+				if tt.authURL != "" {
+					authURL = tt.authURL
+				}
+				var payload []byte
+				switch tt.payload {
+				case "body":
+					payload = body
+				case "file":
+					payload = tt.file
+				case "wrong":
+					payload = []byte("something else")
+				}
+				req.Header.Set("Authorization", nip98AuthHeader(t, sk, authURL, "POST", payload))
+			}
+			rec := httptest.NewRecorder()
+			nip96Middleware(http.NotFoundHandler(), n).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			var resp nip96Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+			}
+			if rec.Code >= 300 {
+				if resp.Status != "error" {
+					t.Errorf("status field = %q, want error", resp.Status)
+				}
+				return
+			}
+
+			tags := resp.NIP94Event.Tags
+			if m := tags.Find("m"); m == nil || m[1] != tt.wantType {
+				t.Errorf("m tag = %v, want %s", m, tt.wantType)
+			}
+			x, ox := tags.Find("x"), tags.Find("ox")
+			if x == nil || ox == nil || ox[1] != sha256Hex(tt.file) || (x[1] == ox[1]) != tt.wantOrig {
+				t.Errorf("x tag = %v, ox tag = %v, want original kept = %v", x, ox, tt.wantOrig)
+			}
+			if cid := tags.Find("cid"); cid == nil || !node.pinned(cid[1]) {
+				t.Errorf("cid tag %v doesn't point at a pinned blob", cid)
+			}
+
+			// Uploading the same file again succeeds without creating anything
+			req = httptest.NewRequest("POST", nip96APIPath, bytes.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Authorization", nip98AuthHeader(t, sk, uploadURL, "POST", body))
+			rec = httptest.NewRecorder()
+			nip96Middleware(http.NotFoundHandler(), n).ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("repeated upload status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestNIP96ListAndDelete(t *testing.T) {
+	const apiURL = "https://example.com" + nip96APIPath
+	n, _ := newTestNIP96Server(t, 1000)
+	aliceSK, _ := newTestKey(t)
+	bobSK, _ := newTestKey(t)
+	handler := nip96Middleware(http.NotFoundHandler(), n)
+
+	var hashes []string
+	for _, content := range []string{"first file", "second file"} {
+		body, contentType := nip96Form(t, "file.txt", []byte(content), nil)
+		req := httptest.NewRequest("POST", nip96APIPath, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", nip98AuthHeader(t, aliceSK, apiURL, "POST", body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("upload status = %d (%s)", rec.Code, rec.Header().Get("X-Reason"))
+		}
+		hashes = append(hashes, sha256Hex([]byte(content)))
+	}
+
+	list := func(sk string, query string) (int, []*nip96File) {
+		req := httptest.NewRequest("GET", nip96APIPath+query, nil)
+		req.Header.Set("Authorization", nip98AuthHeader(t, sk, apiURL+query, "GET", nil))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var resp struct {
+			Total int          `json:"total"`
+			Files []*nip96File `json:"files"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Total, resp.Files
+	}
+
+	tests := []struct {
+		name      string
+		sk        string
+		query     string
+		wantTotal int
+		wantFiles int
+	}{
+		{name: "all files", sk: aliceSK, wantTotal: 2, wantFiles: 2},
+		{name: "paged", sk: aliceSK, query: "?page=1&count=1", wantTotal: 2, wantFiles: 1},
+		{name: "past the end", sk: aliceSK, query: "?page=2&count=1", wantTotal: 2},
+		{name: "other pubkey", sk: bobSK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, files := list(tt.sk, tt.query)
+			if total != tt.wantTotal || len(files) != tt.wantFiles {
+				t.Errorf("list = %d of %d files, want %d of %d", len(files), total, tt.wantFiles, tt.wantTotal)
+			}
+		})
+	}
+
+	deleteFile := func(sk string, sha256 string) int {
+		req := httptest.NewRequest("DELETE", nip96APIPath+"/"+sha256, nil)
+		req.Header.Set("Authorization", nip98AuthHeader(t, sk, apiURL+"/"+sha256, "DELETE", nil))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := deleteFile(bobSK, hashes[0]); code != http.StatusNotFound {
+		t.Errorf("delete of another pubkey's file status = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := deleteFile(aliceSK, "nothex"); code != http.StatusBadRequest {
+		t.Errorf("delete of invalid hash status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := deleteFile(aliceSK, hashes[0]); code != http.StatusOK {
+		t.Errorf("delete status = %d, want %d", code, http.StatusOK)
+	}
+	if total, files := list(aliceSK, ""); total != 1 || len(files) != 1 || files[0].Tags.FindWithValue("x", hashes[1]) == nil {
+		t.Errorf("files after delete = %d, want the second file only", total)
+	}
+}
+
+func TestNIP96Info(t *testing.T) {
+	n, _ := newTestNIP96Server(t, 1000)
+	rec := httptest.NewRecorder()
+	nip96Middleware(http.NotFoundHandler(), n).ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/nostr/nip96.json", nil))
+
+	var info struct {
+		APIURL string `json:"api_url"`
+		Plans  map[string]struct {
+			MaxByteSize int64 `json:"max_byte_size"`
+		} `json:"plans"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("invalid info %q: %v", rec.Body.String(), err)
+	}
+	if info.APIURL != "https://example.com"+nip96APIPath || info.Plans["free"].MaxByteSize != 1000 {
+		t.Errorf("info = %+v", info)
+	}
+}
+
+// countingReader records how many bytes were read from it
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestNIP96UploadChecksAuthBeforeReading(t *testing.T) {
+	const uploadURL = "https://example.com" + nip96APIPath
+	n, _ := newTestNIP96Server(t, 1000)
+	sk, _ := newTestKey(t)
+	form, contentType := nip96Form(t, "file.txt", []byte("unauthenticated"), nil)
+
+	tests := []struct {
+		name string
+		auth string
+	}{
+		{name: "missing auth"},
+		{name: "other url", auth: nip98AuthHeader(t, sk, "https://other.example.com"+nip96APIPath, "POST", form)},
+		{name: "other method", auth: nip98AuthHeader(t, sk, uploadURL, "GET", form)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &countingReader{r: bytes.NewReader(form)}
+			req := httptest.NewRequest("POST", nip96APIPath, body)
+			req.Header.Set("Content-Type", contentType)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			nip96Middleware(http.NotFoundHandler(), n).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), http.StatusUnauthorized)
+			}
+			if body.read != 0 {
+				t.Errorf("read %d bytes of an unauthenticated upload", body.read)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// preflightMiddleware serves BUD-06 HEAD /upload (and HEAD /media) in place of the blossom library's
+// handler: the X-SHA-256, X-Content-Length and X-Content-Type headers and the auth event are run
+// through every RejectUpload policy, so clients learn whether an upload would be accepted
+// before sending the body. Blobs that can be uploaded without their body are answered right away
+func preflightMiddleware(next http.Handler, server *blossom.BlossomServer, db *sql.DB, private *privateBlobs) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || (r.URL.Path != "/upload" && r.URL.Path != "/media") || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sha256 := strings.ToLower(r.Header.Get("X-SHA-256"))
+		if sha256 != "" && !nostr.IsValid32ByteHex(sha256) {
+			w.Header().Set("X-Reason", "invalid X-SHA-256 header")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lengthStr := r.Header.Get("X-Content-Length")
+		if lengthStr == "" {
+			w.Header().Set("X-Reason", "missing X-Content-Length header")
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		size, err := strconv.Atoi(lengthStr)
+		if err != nil || size < 0 {
+			w.Header().Set("X-Reason", "invalid X-Content-Length header")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		auth, err := readBlossomAuth(r)
+		if err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if auth == nil {
+			w.Header().Set("X-Reason", "missing \"Authorization\" header")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if auth.Tags.FindWithValue("t", "upload") == nil {
+			w.Header().Set("X-Reason", "invalid \"Authorization\" event \"t\" tag")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if sha256 != "" && auth.Tags.Find("x") != nil && auth.Tags.FindWithValue("x", sha256) == nil {
+			w.Header().Set("X-Reason", "X-SHA-256 does not match any \"x\" tag in authorization event")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		// Same extension the upload would get, so the content policy sees the same type
+		ext := ""
+		if contentType := r.Header.Get("X-Content-Type"); contentType != "" {
+			ext = extensionForType(contentType)
+		}
+
+		for _, reject := range server.RejectUpload {
+			if rejected, reason, code := reject(r.Context(), auth, size, ext); rejected {
+				log.Printf("Upload preflight rejected for pubkey %s: %s", auth.PubKey, reason)
+				w.Header().Set("X-Reason", reason)
+				w.WriteHeader(code)
+				return
+			}
+		}
+
+		// Already stored and claimable by hash: the upload will be accepted without its body
+		if sha256 != "" {
+			var count int
+			if err := db.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&count); err == nil && count > 0 {
+				if claimable, err := claimableWithoutBody(r.Context(), db, private, sha256); err != nil || !claimable {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				w.Header().Set("X-Reason", "blob already stored")
+				w.Header().Set("X-Blob-Exists", "true")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
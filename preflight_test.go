@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPreflightMiddleware(t *testing.T) {
+	const stored = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	const fresh = "0000000000000000000000000000000000000000000000000000000000000000"
+	const privateBlob = "1111111111111111111111111111111111111111111111111111111111111111"
+
+	_, db := newTestDB(t)
+	_, ipfsShell := newFakeIPFS(t)
+	query := `INSERT INTO ipfs_blossom_mapping (sha256, ipfs_cid, extension) VALUES (?, ?, ?)`
+	for _, sha256 := range []string{stored, privateBlob} {
+		if _, err := db.Exec(query, sha256, rawCID([]byte(sha256)), ".png"); err != nil {
+			t.Fatalf("failed to store mapping: %v", err)
+		}
+	}
+	private := &privateBlobs{mode: privateModeOptIn, db: db, ipfsShell: ipfsShell}
+	if err := private.MarkPrivate(context.Background(), privateBlob); err != nil {
+		t.Fatalf("MarkPrivate() error = %v", err)
+	}
+
+	sk, _ := newTestKey(t)
+	bannedSK, banned := newTestKey(t)
+	server := &blossom.BlossomServer{}
+	server.RejectUpload = append(server.RejectUpload,
+		func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+			if auth.PubKey == banned {
+				return true, "pubkey is banned", http.StatusForbidden
+			}
+			return false, "", 0
+		},
+		func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+			if size > 1000 {
+				return true, "blob too large", http.StatusRequestEntityTooLarge
+			}
+			if ext == ".html" {
+				return true, "content type text/html is not allowed", http.StatusUnsupportedMediaType
+			}
+			return false, "", 0
+		},
+	)
+
+	tests := []struct {
+		name        string
+		path        string
+		sha256      string
+		length      string
+		contentType string
+		auth        string
+		wantStatus  int
+		wantExists  bool
+	}{
+		{name: "accepted", path: "/upload", sha256: fresh, length: "100", contentType: "image/png", auth: blossomAuthHeader(t, sk, "upload", nostr.Tag{"x", fresh}), wantStatus: http.StatusOK},
+		{name: "media upload", path: "/media", length: "100", auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusOK},
+		{name: "already stored", path: "/upload", sha256: stored, length: "100", auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusOK, wantExists: true},
+		{name: "stored as private", path: "/upload", sha256: privateBlob, length: "100", auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusOK},
+		{name: "too large", path: "/upload", sha256: fresh, length: "1001", auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "disallowed type", path: "/upload", sha256: fresh, length: "100", contentType: "text/html", auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusUnsupportedMediaType},
+		{name: "banned pubkey", path: "/upload", sha256: fresh, length: "100", auth: blossomAuthHeader(t, bannedSK, "upload"), wantStatus: http.StatusForbidden},
+		{name: "hash not authorized", path: "/upload", sha256: fresh, length: "100", auth: blossomAuthHeader(t, sk, "upload", nostr.Tag{"x", stored}), wantStatus: http.StatusForbidden},
+		{name: "wrong action", path: "/upload", sha256: fresh, length: "100", auth: blossomAuthHeader(t, sk, "delete"), wantStatus: http.StatusForbidden},
+		{name: "missing authorization", path: "/upload", sha256: fresh, length: "100", wantStatus: http.StatusUnauthorized},
+		{name: "missing length", path: "/upload", sha256: fresh, auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusLengthRequired},
+		{name: "invalid length", path: "/upload", sha256: fresh, length: "-1", auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusBadRequest},
+		{name: "invalid hash", path: "/upload", sha256: "abc", length: "100", auth: blossomAuthHeader(t, sk, "upload"), wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("HEAD", tt.path, nil)
+			for header, value := range map[string]string{
+				"X-SHA-256":        tt.sha256,
+				"X-Content-Length": tt.length,
+				"X-Content-Type":   tt.contentType,
+				"Authorization":    tt.auth,
+			} {
+				if value != "" {
+					req.Header.Set(header, value)
+				}
+			}
+			rec := httptest.NewRecorder()
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("preflight request was passed to the next handler")
+			})
+			preflightMiddleware(next, server, db, private).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			if exists := rec.Header().Get("X-Blob-Exists") == "true"; exists != tt.wantExists {
+				t.Errorf("X-Blob-Exists = %v, want %v", exists, tt.wantExists)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// thumbnailJPEGQuality is the quality of JPEG thumbnails
+const thumbnailJPEGQuality = 80
+
+// blurhashAlphabet is the base83 alphabet of blurhash strings
+const blurhashAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// previewGenerator records the dimensions and blurhash of public image uploads and stores
+// thumbnails of them as blobs of their own, linked to the original in blob_thumbnails
+type previewGenerator struct {
+	db        *sql.DB
+	ipfsShell *shell.Shell
+
+	// sizes are the bounding boxes of the thumbnails, smallest first (nil = previews disabled)
+	sizes     []int
+	maxPixels int
+}
+
+// blobThumbnail is a thumbnail variant of a blob
+type blobThumbnail struct {
+	Size   int
+	SHA256 string
+	CID    string
+	Ext    string
+	Width  int
+	Height int
+}
+
+// createPreviewTables creates the image preview and thumbnail tables if they don't exist
+func createPreviewTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS blob_previews (
+		sha256 TEXT PRIMARY KEY,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		blurhash TEXT
+	);
+	CREATE TABLE IF NOT EXISTS blob_thumbnails (
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		thumb_sha256 TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		PRIMARY KEY (sha256, size)
+	);
+	CREATE INDEX IF NOT EXISTS idx_blob_thumbnails_thumb ON blob_thumbnails(thumb_sha256);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// parseThumbnailSizes parses a comma-separated list of thumbnail sizes in pixels
+// "none" disables previews altogether
+func parseThumbnailSizes(sizesStr string) ([]int, error) {
+	if strings.EqualFold(strings.TrimSpace(sizesStr), "none") {
+		return nil, nil
+	}
+
+	var sizes []int
+	for _, sizeStr := range strings.Split(sizesStr, ",") {
+		sizeStr = strings.TrimSpace(sizeStr)
+		if sizeStr == "" {
+			continue
+		}
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid thumbnail size %q", sizeStr)
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// newPreviewGenerator creates the preview generator storing thumbnails on the public IPFS node
+func newPreviewGenerator(db *sql.DB, ipfsShell *shell.Shell, sizes []int, maxPixels int) *previewGenerator {
+	return &previewGenerator{
+		db:        db,
+		ipfsShell: ipfsShell,
+		sizes:     sizes,
+		maxPixels: maxPixels,
+	}
+}
+
+// Generate computes the dimensions and blurhash of an image blob and stores its thumbnails
+// Only thumbnails smaller than the image are created. Other files are ignored
+func (pg *previewGenerator) Generate(ctx context.Context, sha256 string, ext string, body []byte) error {
+	if len(pg.sizes) == 0 || !strings.HasPrefix(typeForExtension(ext), "image/") {
+		return nil
+	}
+
+	img, _, err := decodeImage(body, pg.maxPixels)
+	if err != nil {
+		if errors.Is(err, errMediaUnsupported) {
+			return nil
+		}
+		return err
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	for _, size := range pg.sizes {
+		if width <= size && height <= size {
+			break
+		}
+		if err := pg.storeThumbnail(ctx, sha256, size, scaleToFit(img, size, size)); err != nil {
+			return err
+		}
+	}
+
+	blurhash := encodeBlurhash(scaleToFit(img, 64, 64))
+	query := `INSERT OR REPLACE INTO blob_previews (sha256, width, height, blurhash) VALUES (?, ?, ?, ?)`
+	if _, err := pg.db.ExecContext(ctx, query, sha256, width, height, blurhash); err != nil {
+		return fmt.Errorf("failed to store preview: %w", err)
+	}
+	log.Printf("Generated previews for sha256=%s (%dx%d, blurhash %s)", sha256, width, height, blurhash)
+	return nil
+}
+
+// storeThumbnail encodes a thumbnail, JPEG if it is opaque and PNG otherwise, and stores it as a blob
+func (pg *previewGenerator) storeThumbnail(ctx context.Context, sha256 string, size int, thumb image.Image) error {
+	var out bytes.Buffer
+	ext := ".jpg"
+	if opaque, ok := thumb.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		ext = ".png"
+		if err := png.Encode(&out, thumb); err != nil {
+			return fmt.Errorf("failed to encode thumbnail: %w", err)
+		}
+	} else if err := jpeg.Encode(&out, thumb, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	hash := sha256Hex(out.Bytes())
+	if _, err := storeBlobInIPFS(ctx, pg.ipfsShell, pg.db, hash, ext, out.Bytes()); err != nil {
+		return fmt.Errorf("failed to store thumbnail: %w", err)
+	}
+
+	bounds := thumb.Bounds()
+	query := `INSERT OR REPLACE INTO blob_thumbnails (sha256, size, thumb_sha256, width, height) VALUES (?, ?, ?, ?, ?)`
+	if _, err := pg.db.ExecContext(ctx, query, sha256, size, hash, bounds.Dx(), bounds.Dy()); err != nil {
+		return fmt.Errorf("failed to link thumbnail: %w", err)
+	}
+	return nil
+}
+
+// sha256Hex returns the hex-encoded sha256 of data
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// blobThumbnails returns the thumbnails of a blob, smallest first
+func blobThumbnails(ctx context.Context, db *sql.DB, sha256 string) ([]blobThumbnail, error) {
+	query := `
+	SELECT t.size, t.thumb_sha256, m.ipfs_cid, COALESCE(m.extension, ''), t.width, t.height
+	FROM blob_thumbnails t
+	JOIN ipfs_blossom_mapping m ON m.sha256 = t.thumb_sha256
+	WHERE t.sha256 = ?
+	ORDER BY t.size`
+	rows, err := db.QueryContext(ctx, query, sha256)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var thumbs []blobThumbnail
+	for rows.Next() {
+		var thumb blobThumbnail
+		if err := rows.Scan(&thumb.Size, &thumb.SHA256, &thumb.CID, &thumb.Ext, &thumb.Width, &thumb.Height); err != nil {
+			return nil, err
+		}
+		thumbs = append(thumbs, thumb)
+	}
+	return thumbs, rows.Err()
+}
+
+// thumbnailOriginal returns the blob a thumbnail was generated from, or "" if sha256 isn't a thumbnail
+func thumbnailOriginal(ctx context.Context, db *sql.DB, sha256 string) (string, error) {
+	var original string
+	err := db.QueryRowContext(ctx, `SELECT sha256 FROM blob_thumbnails WHERE thumb_sha256 = ? LIMIT 1`, sha256).Scan(&original)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return original, err
+}
+
+// addBlobPreviews adds the NIP-94 style dim, blurhash and thumb fields to a blob descriptor,
+// plus a thumbs list with every thumbnail size
+func addBlobPreviews(ctx context.Context, db *sql.DB, gatewayURL string, item map[string]interface{}) {
+	sha256, ok := item["sha256"].(string)
+	if !ok {
+		return
+	}
+
+	var width, height int
+	var blurhash string
+	query := `SELECT width, height, COALESCE(blurhash, '') FROM blob_previews WHERE sha256 = ?`
+	if err := db.QueryRowContext(ctx, query, sha256).Scan(&width, &height, &blurhash); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to look up previews of sha256=%s: %v", sha256, err)
+		}
+		return
+	}
+	item["dim"] = fmt.Sprintf("%dx%d", width, height)
+	if blurhash != "" {
+		item["blurhash"] = blurhash
+	}
+
+	thumbs, err := blobThumbnails(ctx, db, sha256)
+	if err != nil {
+		log.Printf("Failed to look up thumbnails of sha256=%s: %v", sha256, err)
+		return
+	}
+	if len(thumbs) == 0 {
+		return
+	}
+	variants := make([]map[string]interface{}, 0, len(thumbs))
+	for _, thumb := range thumbs {
+		thumbURL := gatewayURL + thumb.CID
+		if thumb.Ext != "" {
+			thumbURL += "?filename=" + url.QueryEscape("file"+thumb.Ext)
+		}
+		variants = append(variants, map[string]interface{}{
+			"url":    thumbURL,
+			"sha256": thumb.SHA256,
+			"cid":    thumb.CID,
+			"dim":    fmt.Sprintf("%dx%d", thumb.Width, thumb.Height),
+		})
+	}
+	item["thumb"] = variants[0]["url"]
+	item["thumbs"] = variants
+}
+
+// removeBlobPreviews deletes the previews of a blob and unpins thumbnails that aren't used otherwise
+func removeBlobPreviews(ctx context.Context, db *sql.DB, ipfsShell *shell.Shell, sha256 string) error {
+	thumbs, err := blobThumbnails(ctx, db, sha256)
+	if err != nil {
+		return fmt.Errorf("failed to query thumbnails: %w", err)
+	}
+	for _, query := range []string{
+		`DELETE FROM blob_thumbnails WHERE sha256 = ?`,
+		`DELETE FROM blob_previews WHERE sha256 = ?`,
+	} {
+		if _, err := db.ExecContext(ctx, query, sha256); err != nil {
+			return fmt.Errorf("failed to delete previews: %w", err)
+		}
+	}
+
+	for _, thumb := range thumbs {
+		// The same bytes may have been uploaded as a blob, or be the thumbnail of another blob
+		var uses int
+		query := `SELECT (SELECT COUNT(*) FROM blob_usage WHERE sha256 = ?) + (SELECT COUNT(*) FROM blob_thumbnails WHERE thumb_sha256 = ?)`
+		if err := db.QueryRowContext(ctx, query, thumb.SHA256, thumb.SHA256).Scan(&uses); err != nil || uses > 0 {
+			continue
+		}
+		if err := ipfsShell.Unpin(thumb.CID); err != nil {
+			log.Printf("Failed to unpin thumbnail cid=%s of sha256=%s: %v", thumb.CID, sha256, err)
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM ipfs_blossom_mapping WHERE sha256 = ?`, thumb.SHA256); err != nil {
+			return fmt.Errorf("failed to delete thumbnail mapping: %w", err)
+		}
+	}
+	return nil
+}
+
+// encodeBlurhash computes the blurhash of an image, with 4 components along its longest side
+// Callers should pass a downscaled image: the cost grows with the number of pixels
+func encodeBlurhash(img image.Image) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	xComponents, yComponents := 4, 3
+	if height > width {
+		xComponents, yComponents = 3, 4
+	}
+
+	// Linear RGB of every pixel, computed once for all components
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			pixels[y*width+x] = [3]float64{
+				srgbToLinear(int(r >> 8)),
+				srgbToLinear(int(g >> 8)),
+				srgbToLinear(int(b >> 8)),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					pixel := pixels[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(factor[0]), math.Max(math.Abs(factor[1]), math.Abs(factor[2]))))
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, factor := range ac {
+		quantise := func(value float64) int {
+			signed := math.Copysign(math.Pow(math.Abs(value/maximumValue), 0.5), value)
+			return int(math.Max(0, math.Min(18, math.Floor(signed*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2))
+	}
+	return hash.String()
+}
+
+// encodeBase83 encodes a value as a fixed number of base83 digits
+func encodeBase83(value int, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = blurhashAlphabet[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+// srgbToLinear converts an 8-bit sRGB channel to linear light
+func srgbToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts a linear light channel to 8-bit sRGB
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseThumbnailSizes(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []int
+		wantErr bool
+	}{
+		{input: "256,640", want: []int{256, 640}},
+		{input: " 640 , 128,", want: []int{128, 640}},
+		{input: "none"},
+		{input: "NONE"},
+		{input: "256,zero", wantErr: true},
+		{input: "0", wantErr: true},
+		{input: "-10", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseThumbnailSizes(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseThumbnailSizes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseThumbnailSizes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeBlurhash(t *testing.T) {
+	solid := func(width, height int) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.Set(x, y, color.NRGBA{R: 255, A: 255})
+			}
+		}
+		return img
+	}
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		wantSize byte
+		wantDC   string
+	}{
+		// 4x3 components: size flag 3+2*9 = 21
+		{name: "landscape", img: solid(40, 20), wantSize: 'L', wantDC: encodeBase83(255<<16, 4)},
+		// 3x4 components: size flag 2+3*9 = 29
+		{name: "portrait", img: solid(20, 40), wantSize: 'T', wantDC: encodeBase83(255<<16, 4)},
+		{name: "gradient", img: testImage(64, 32), wantSize: 'L'},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := encodeBlurhash(tt.img)
+			// Flag, maximum, DC and 11 AC components of 2 digits
+			if len(hash) != 28 {
+				t.Fatalf("blurhash %q has length %d, want 28", hash, len(hash))
+			}
+			if hash[0] != tt.wantSize {
+				t.Errorf("blurhash %q size flag = %c, want %c", hash, hash[0], tt.wantSize)
+			}
+			if tt.wantDC != "" && hash[2:6] != tt.wantDC {
+				t.Errorf("blurhash %q average color = %q, want %q", hash, hash[2:6], tt.wantDC)
+			}
+			if strings.Trim(hash, blurhashAlphabet) != "" {
+				t.Errorf("blurhash %q has characters outside the base83 alphabet", hash)
+			}
+		})
+	}
+}
+
+func TestPreviewGeneratorGenerate(t *testing.T) {
+	const gatewayURL = "https://gateway.example.com/ipfs/"
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		data       []byte
+		ext        string
+		sizes      []int
+		wantDim    string
+		wantThumbs []string
+	}{
+		{name: "large png", data: encodeTestImage(t, "png", 200, 100), ext: ".png", sizes: []int{32, 128}, wantDim: "200x100", wantThumbs: []string{"32x16", "128x64"}},
+		{name: "medium jpeg", data: encodeTestImage(t, "jpeg", 100, 200), ext: ".jpg", sizes: []int{32, 256}, wantDim: "100x200", wantThumbs: []string{"16x32"}},
+		{name: "smaller than thumbnails", data: encodeTestImage(t, "png", 20, 20), ext: ".png", sizes: []int{32, 128}, wantDim: "20x20"},
+		{name: "previews disabled", data: encodeTestImage(t, "png", 200, 100), ext: ".png"},
+		{name: "not an image", data: []byte("plain text"), ext: ".txt", sizes: []int{32}},
+		{name: "unsupported image", data: []byte("RIFF....WEBP"), ext: ".webp", sizes: []int{32}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			node, ipfsShell := newFakeIPFS(t)
+			pg := newPreviewGenerator(db, ipfsShell, tt.sizes, 1_000_000)
+			sha := sha256Hex(tt.data)
+
+			if err := pg.Generate(ctx, sha, tt.ext, tt.data); err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+
+			item := map[string]interface{}{"sha256": sha}
+			addBlobPreviews(ctx, db, gatewayURL, item)
+			if dim, _ := item["dim"].(string); dim != tt.wantDim {
+				t.Errorf("dim = %q, want %q", dim, tt.wantDim)
+			}
+			if _, ok := item["blurhash"]; ok != (tt.wantDim != "") {
+				t.Errorf("blurhash present = %v, want %v", ok, tt.wantDim != "")
+			}
+
+			thumbs, _ := item["thumbs"].([]map[string]interface{})
+			if len(thumbs) != len(tt.wantThumbs) {
+				t.Fatalf("thumbs = %v, want %v", thumbs, tt.wantThumbs)
+			}
+			for i, thumb := range thumbs {
+				if thumb["dim"] != tt.wantThumbs[i] {
+					t.Errorf("thumbnail %d dim = %v, want %s", i, thumb["dim"], tt.wantThumbs[i])
+				}
+				cidStr := thumb["cid"].(string)
+				if !node.pinned(cidStr) {
+					t.Errorf("thumbnail %s isn't pinned", cidStr)
+				}
+				if !strings.HasPrefix(thumb["url"].(string), gatewayURL+cidStr) {
+					t.Errorf("thumbnail url = %v", thumb["url"])
+				}
+				if original, _ := thumbnailOriginal(ctx, db, thumb["sha256"].(string)); original != sha {
+					t.Errorf("thumbnailOriginal() = %q, want %q", original, sha)
+				}
+			}
+			if len(thumbs) > 0 && item["thumb"] != thumbs[0]["url"] {
+				t.Errorf("thumb = %v, want the smallest thumbnail", item["thumb"])
+			}
+		})
+	}
+}
+
+func TestRemoveBlobPreviews(t *testing.T) {
+	ctx := context.Background()
+	data := encodeTestImage(t, "png", 200, 100)
+	sha := sha256Hex(data)
+
+	tests := []struct {
+		name         string
+		alsoBlob     bool
+		wantUnpinned bool
+	}{
+		{name: "thumbnail only used as preview", wantUnpinned: true},
+		{name: "thumbnail also uploaded as blob", alsoBlob: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			node, ipfsShell := newFakeIPFS(t)
+			pg := newPreviewGenerator(db, ipfsShell, []int{32}, 1_000_000)
+			if err := pg.Generate(ctx, sha, ".png", data); err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			thumbs, err := blobThumbnails(ctx, db, sha)
+			if err != nil || len(thumbs) != 1 {
+				t.Fatalf("blobThumbnails() = %v, %v, want one thumbnail", thumbs, err)
+			}
+			if tt.alsoBlob {
+				if _, err := db.Exec(`INSERT INTO blob_usage (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`, "owner", thumbs[0].SHA256, 100, 0); err != nil {
+					t.Fatalf("failed to record usage: %v", err)
+				}
+			}
+
+			if err := removeBlobPreviews(ctx, db, ipfsShell, sha); err != nil {
+				t.Fatalf("removeBlobPreviews() error = %v", err)
+			}
+			if remaining, _ := blobThumbnails(ctx, db, sha); len(remaining) != 0 {
+				t.Errorf("thumbnails remain after removal: %v", remaining)
+			}
+			if pinned := node.pinned(thumbs[0].CID); pinned == tt.wantUnpinned {
+				t.Errorf("thumbnail pinned = %v, want %v", pinned, !tt.wantUnpinned)
+			}
+			item := map[string]interface{}{"sha256": sha}
+			addBlobPreviews(ctx, db, "https://gateway.example.com/ipfs/", item)
+			if _, ok := item["dim"]; ok {
+				t.Errorf("preview remains after removal")
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Private mode settings
+const (
+	privateModeOff   = "off"
+	privateModeOptIn = "optin"
+	privateModeAll   = "all"
+)
+
+// contextKey is the type of request context keys set by this server's middlewares
+type contextKey int
+
+const (
+	privateUploadKey contextKey = iota
+	blobExpirationKey
+	uploadAccountingKey
+	uploadPrecheckKey
+)
+
+// privateBlobs controls access to blobs that must not be publicly downloadable
+// Private blobs are stored on a separate IPFS node that doesn't announce content to the DHT,
+// are never redirected to the public gateway and are only served through our authenticated proxy
+type privateBlobs struct {
+	mode      string
+	db        *sql.DB
+	ipfsShell *shell.Shell
+
+	// encryption, when configured, encrypts private blobs before they are added to IPFS
+	encryption *blobEncryption
+
+	// links grants access to private blobs through signed download links
+	links *downloadLinks
+
+	adminPubkeys         map[string]bool
+	staticAllowedPubkeys map[string]bool
+}
+
+// createPrivateBlobsTable creates the table marking private blobs if it doesn't exist
+func createPrivateBlobsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS private_blobs (
+		sha256 TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// IsPrivate reports whether a blob is private
+func (pb *privateBlobs) IsPrivate(ctx context.Context, sha256 string) (bool, error) {
+	var count int
+	err := pb.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM private_blobs WHERE sha256 = ?`, sha256).Scan(&count)
+	return count > 0, err
+}
+
+// MarkPrivate marks a blob as private
+func (pb *privateBlobs) MarkPrivate(ctx context.Context, sha256 string) error {
+	_, err := pb.db.ExecContext(ctx, `INSERT OR IGNORE INTO private_blobs (sha256) VALUES (?)`, sha256)
+	return err
+}
+
+// CanRead reports whether a pubkey may download or list a private blob:
+// its owners, admins and whitelisted pubkeys can
+func (pb *privateBlobs) CanRead(ctx context.Context, pubkey string, sha256 string) (bool, error) {
+	if pb.adminPubkeys[pubkey] {
+		return true, nil
+	}
+
+	var count int
+	query := `SELECT COUNT(*) FROM blob_usage WHERE pubkey = ? AND sha256 = ?`
+	if err := pb.db.QueryRowContext(ctx, query, pubkey, sha256).Scan(&count); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	allowed, err := effectiveAllowedPubkeys(ctx, pb.db, pb.staticAllowedPubkeys)
+	if err != nil {
+		return false, err
+	}
+	return allowed[pubkey], nil
+}
+
+// wantsPrivate reports whether an upload request should be stored as private
+func (pb *privateBlobs) wantsPrivate(r *http.Request) bool {
+	switch pb.mode {
+	case privateModeAll:
+		return true
+	case privateModeOptIn:
+		return strings.EqualFold(r.Header.Get("X-Private"), "true")
+	}
+	return false
+}
+
+// isPrivateUpload reports whether the upload in ctx was requested as private
+func isPrivateUpload(ctx context.Context) bool {
+	private, _ := ctx.Value(privateUploadKey).(bool)
+	return private
+}
+
+// privateBlobMiddleware enforces authentication for private blobs and keeps their CIDs
+// and gateway URLs out of upload and list responses
+func privateBlobMiddleware(next http.Handler, pb *privateBlobs) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := r.URL.Path
+		switch {
+		case r.Method == "PUT" && (path == "/upload" || path == "/media" || path == "/mirror"):
+			if pb.wantsPrivate(r) {
+				r = r.WithContext(context.WithValue(r.Context(), privateUploadKey, true))
+			}
+			pb.rewriteResponse(w, r, next, "")
+
+		case strings.HasPrefix(path, "/list/") && r.Method == "GET":
+			auth, err := readBlossomAuth(r)
+			if err != nil {
+				w.Header().Set("X-Reason", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reader := ""
+			if auth != nil && auth.Tags.FindWithValue("t", "list") != nil {
+				reader = auth.PubKey
+			}
+			pb.rewriteResponse(w, r, next, reader)
+
+		case (r.Method == "GET" || r.Method == "HEAD") && (len(path) == 65 || strings.Index(path, ".") == 65) && !strings.Contains(path[1:], "/"):
+			sha256 := path[1:65]
+			private, err := pb.IsPrivate(r.Context(), sha256)
+			if err != nil {
+				w.Header().Set("X-Reason", "failed to check blob visibility")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !private {
+				next.ServeHTTP(w, r)
+				return
+			}
+			pb.serve(w, r, sha256)
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serve checks the download link or BUD auth event of a request for a private blob and proxies the content
+func (pb *privateBlobs) serve(w http.ResponseWriter, r *http.Request, sha256 string) {
+	if banned, err := isBlobBanned(r.Context(), pb.db, sha256); err != nil || banned {
+		w.Header().Set("X-Reason", errBlobBanned.Error())
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	var reader string
+	if hasLink(r) {
+		if err := pb.links.Redeem(r, sha256); err != nil {
+			log.Printf("Denied private blob sha256=%s through download link: %v", sha256, err)
+			writeLinkError(w, err)
+			return
+		}
+		reader = "link " + r.URL.Query().Get("link")
+	} else if pubkey, ok := pb.checkReadAuth(w, r, sha256); ok {
+		reader = "pubkey " + pubkey
+	} else {
+		return
+	}
+
+	var ext string
+	query := `SELECT COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`
+	if err := pb.db.QueryRowContext(r.Context(), query, sha256).Scan(&ext); err != nil {
+		w.Header().Set("X-Reason", "file not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	content, err := pb.load(r.Context(), sha256, ext)
+	if err != nil {
+		log.Printf("Failed to load private blob sha256=%s: %v", sha256, err)
+		w.Header().Set("X-Reason", "failed to load blob")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Serving private blob sha256=%s to %s", sha256, reader)
+	w.Header().Set("ETag", sha256)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, sha256+ext, time.Unix(0, 0), content)
+}
+
+// checkReadAuth checks the BUD auth event of a request for a private blob, answering the
+// request when it is missing or not allowed. Returns the authenticated pubkey
+func (pb *privateBlobs) checkReadAuth(w http.ResponseWriter, r *http.Request, sha256 string) (string, bool) {
+	auth, err := readBlossomAuth(r)
+	if err != nil {
+		w.Header().Set("X-Reason", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+	if auth == nil {
+		w.Header().Set("X-Reason", "authorization required for private blob")
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+	if auth.Tags.FindWithValue("t", "get") == nil {
+		w.Header().Set("X-Reason", "invalid \"Authorization\" event \"t\" tag")
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+	if auth.Tags.FindWithValue("x", sha256) == nil && !authHasServerTag(auth, r) {
+		w.Header().Set("X-Reason", "invalid \"Authorization\" event \"x\" or \"server\" tag")
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+
+	allowed, err := pb.CanRead(r.Context(), auth.PubKey, sha256)
+	if err != nil {
+		w.Header().Set("X-Reason", "failed to check access")
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", false
+	}
+	if !allowed {
+		log.Printf("Denied private blob sha256=%s to pubkey %s", sha256, auth.PubKey)
+		w.Header().Set("X-Reason", "pubkey is not allowed to read this blob")
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+	return auth.PubKey, true
+}
+
+// authHasServerTag checks whether a BUD auth event is scoped to this server with a "server" tag
+func authHasServerTag(auth *nostr.Event, r *http.Request) bool {
+	base := nostr.NormalizeURL(requestBaseURL(r))
+	for _, tag := range auth.Tags {
+		if len(tag) >= 2 && tag[0] == "server" {
+			if nostr.NormalizeURL(tag[1]) == base || strings.EqualFold(tag[1], r.Host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rewriteResponse runs the next handler and replaces the gateway URL and CID of private blobs
+// in the JSON response with our proxy URL. In lists, private blobs the reader can't access are omitted
+func (pb *privateBlobs) rewriteResponse(w http.ResponseWriter, r *http.Request, next http.Handler, reader string) {
+	capturedWriter := &responseCapturer{
+		ResponseWriter: w,
+		statusCode:     200,
+		body:           &bytes.Buffer{},
+		headers:        make(http.Header),
+	}
+	next.ServeHTTP(capturedWriter, r)
+
+	body := capturedWriter.body.Bytes()
+	if capturedWriter.statusCode >= 200 && capturedWriter.statusCode < 300 && len(body) > 0 {
+		baseURL := requestBaseURL(r)
+		var rewritten interface{}
+
+		if body[0] == '[' {
+			var items []map[string]interface{}
+			if err := json.Unmarshal(body, &items); err == nil {
+				visible := make([]map[string]interface{}, 0, len(items))
+				for _, item := range items {
+					keep, err := pb.rewriteDescriptor(r.Context(), item, baseURL, reader, true)
+					if err != nil {
+						log.Printf("Failed to check private blob in list: %v", err)
+						continue
+					}
+					if keep {
+						visible = append(visible, item)
+					}
+				}
+				rewritten = visible
+			}
+		} else if body[0] == '{' {
+			var item map[string]interface{}
+			if err := json.Unmarshal(body, &item); err == nil {
+				if _, err := pb.rewriteDescriptor(r.Context(), item, baseURL, reader, false); err == nil {
+					rewritten = item
+				}
+			}
+		}
+
+		if rewritten != nil {
+			for key, values := range capturedWriter.headers {
+				if key == "Content-Length" {
+					continue
+				}
+				for _, value := range values {
+					w.Header().Add(key, value)
+				}
+			}
+			w.WriteHeader(capturedWriter.statusCode)
+			json.NewEncoder(w).Encode(rewritten)
+			return
+		}
+	}
+
+	for key, values := range capturedWriter.headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(capturedWriter.statusCode)
+	w.Write(body)
+}
+
+// rewriteDescriptor points a private blob descriptor at our proxy and drops its CID
+// When checkAccess is set, it returns false if the reader may not see the blob or it is blocked
+func (pb *privateBlobs) rewriteDescriptor(ctx context.Context, item map[string]interface{}, baseURL string, reader string, checkAccess bool) (bool, error) {
+	sha256, ok := item["sha256"].(string)
+	if !ok {
+		return true, nil
+	}
+	if checkAccess {
+		if banned, err := isBlobBanned(ctx, pb.db, sha256); err != nil || banned {
+			return false, err
+		}
+	}
+	private, err := pb.IsPrivate(ctx, sha256)
+	if err != nil {
+		return false, err
+	}
+	if !private {
+		return true, nil
+	}
+
+	if checkAccess {
+		if reader == "" {
+			return false, nil
+		}
+		allowed, err := pb.CanRead(ctx, reader, sha256)
+		if err != nil || !allowed {
+			return false, err
+		}
+	}
+
+	var ext string
+	pb.db.QueryRowContext(ctx, `SELECT COALESCE(extension, '') FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&ext)
+	item["url"] = fmt.Sprintf("%s/%s%s", baseURL, sha256, ext)
+	item["private"] = true
+	delete(item, "cid")
+	return true, nil
+}
+
+// load reads a private blob from the private IPFS node, decrypting it if it was stored encrypted
+func (pb *privateBlobs) load(ctx context.Context, sha256 string, ext string) (io.ReadSeeker, error) {
+	reader, err := loadBlobFromIPFS(ctx, pb.ipfsShell, pb.db, sha256, ext)
+	if err != nil {
+		return nil, err
+	}
+	if pb.encryption == nil {
+		// Never hand out the ciphertext of blobs encrypted before the master keys were removed
+		var encrypted bool
+		err := pb.db.QueryRowContext(ctx, `SELECT 1 FROM blob_encryption WHERE sha256 = ?`, sha256).Scan(&encrypted)
+		if err == sql.ErrNoRows {
+			return reader, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query data key: %w", err)
+		}
+		return nil, errors.New("blob is encrypted but no master key is configured")
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private blob: %w", err)
+	}
+	plaintext, err := pb.encryption.Decrypt(ctx, sha256, data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(plaintext), nil
+}
+
+// prepareStorage decides which IPFS node stores a blob, marks private uploads and
+// encrypts private content when encryption is configured
+// Blobs that are already private stay on the private node; a private upload of content
+// that is already public stays public, since its CID has been handed out anyway
+func (pb *privateBlobs) prepareStorage(ctx context.Context, sha256 string, body []byte, publicShell *shell.Shell) (*shell.Shell, []byte, error) {
+	storeShell, err := pb.storageShell(ctx, sha256, publicShell)
+	if err != nil || storeShell == publicShell || pb.encryption == nil {
+		return storeShell, body, err
+	}
+
+	ciphertext, err := pb.encryption.Encrypt(ctx, sha256, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return storeShell, ciphertext, nil
+}
+
+// storageShell decides which IPFS node stores a blob and marks private uploads
+func (pb *privateBlobs) storageShell(ctx context.Context, sha256 string, publicShell *shell.Shell) (*shell.Shell, error) {
+	private, err := pb.IsPrivate(ctx, sha256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check blob visibility: %w", err)
+	}
+
+	if !private && isPrivateUpload(ctx) {
+		var count int
+		query := `SELECT COUNT(*) FROM ipfs_blossom_mapping WHERE sha256 = ?`
+		if err := pb.db.QueryRowContext(ctx, query, sha256).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to query mapping: %w", err)
+		}
+		if count > 0 {
+			log.Printf("Private upload of already public blob sha256=%s, keeping it public", sha256)
+			return publicShell, nil
+		}
+		if err := pb.MarkPrivate(ctx, sha256); err != nil {
+			return nil, fmt.Errorf("failed to mark blob private: %w", err)
+		}
+		private = true
+	}
+
+	if !private {
+		return publicShell, nil
+	}
+	if pb.ipfsShell == nil {
+		return nil, fmt.Errorf("private blob storage is not configured")
+	}
+	return pb.ipfsShell, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setupPrivateBlob stores content as a private blob owned by a new pubkey
+// Returns the private blobs, the blob hash and the secret key of its owner
+func setupPrivateBlob(t *testing.T, content string) (*privateBlobs, string, string) {
+	t.Helper()
+	_, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	ownerSK, owner := newTestKey(t)
+
+	hash := sha256.Sum256([]byte(content))
+	sha256Hex := hex.EncodeToString(hash[:])
+	query := `INSERT INTO ipfs_blossom_mapping (sha256, ipfs_cid, extension) VALUES (?, ?, ?)`
+	if _, err := db.Exec(query, sha256Hex, node.put([]byte(content)), ".txt"); err != nil {
+		t.Fatalf("failed to store mapping: %v", err)
+	}
+	query = `INSERT INTO blob_usage (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(query, owner, sha256Hex, len(content), nostr.Now()); err != nil {
+		t.Fatalf("failed to record usage: %v", err)
+	}
+
+	pb := &privateBlobs{
+		mode:                 privateModeOptIn,
+		db:                   db,
+		ipfsShell:            ipfsShell,
+		adminPubkeys:         map[string]bool{},
+		staticAllowedPubkeys: map[string]bool{},
+	}
+	if err := pb.MarkPrivate(context.Background(), sha256Hex); err != nil {
+		t.Fatalf("MarkPrivate() error = %v", err)
+	}
+	return pb, sha256Hex, ownerSK
+}
+
+func TestPrivateBlobMiddlewareAuth(t *testing.T) {
+	const content = "private content"
+
+	tests := []struct {
+		name       string
+		auth       func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string
+		wantStatus int
+	}{
+		{
+			name:       "no authorization",
+			auth:       func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string { return "" },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "owner",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				return blossomAuthHeader(t, ownerSK, "get", nostr.Tag{"x", sha256Hex})
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "owner with a server tag",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				return blossomAuthHeader(t, ownerSK, "get", nostr.Tag{"server", "https://blossom.example.com"})
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "owner authorizing another action",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				return blossomAuthHeader(t, ownerSK, "upload", nostr.Tag{"x", sha256Hex})
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "owner authorizing another blob",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				other := sha256.Sum256([]byte("other"))
+				return blossomAuthHeader(t, ownerSK, "get", nostr.Tag{"x", hex.EncodeToString(other[:])})
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "stranger",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				sk, _ := newTestKey(t)
+				return blossomAuthHeader(t, sk, "get", nostr.Tag{"x", sha256Hex})
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "admin",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				sk, pubkey := newTestKey(t)
+				pb.adminPubkeys[pubkey] = true
+				return blossomAuthHeader(t, sk, "get", nostr.Tag{"x", sha256Hex})
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "whitelisted pubkey",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				sk, pubkey := newTestKey(t)
+				pb.staticAllowedPubkeys[pubkey] = true
+				return blossomAuthHeader(t, sk, "get", nostr.Tag{"x", sha256Hex})
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "banned blob",
+			auth: func(t *testing.T, pb *privateBlobs, sha256Hex string, ownerSK string) string {
+				if _, err := pb.db.Exec(`INSERT INTO banned_blobs (sha256, reason) VALUES (?, ?)`, sha256Hex, "test"); err != nil {
+					t.Fatalf("failed to ban blob: %v", err)
+				}
+				return blossomAuthHeader(t, ownerSK, "get", nostr.Tag{"x", sha256Hex})
+			},
+			wantStatus: http.StatusUnavailableForLegalReasons,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb, sha256Hex, ownerSK := setupPrivateBlob(t, content)
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("private blob was passed to the public handler")
+			})
+
+			req := httptest.NewRequest("GET", "https://blossom.example.com/"+sha256Hex+".txt", nil)
+			if auth := tt.auth(t, pb, sha256Hex, ownerSK); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+			privateBlobMiddleware(next, pb).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			if rec.Code == http.StatusOK {
+				if body := rec.Body.String(); body != content {
+					t.Errorf("body = %q, want %q", body, content)
+				}
+				if cc := rec.Header().Get("Cache-Control"); cc != "private, no-store" {
+					t.Errorf("Cache-Control = %q, want private, no-store", cc)
+				}
+			}
+		})
+	}
+}
+
+func TestPrivateBlobMiddlewarePublicBlob(t *testing.T) {
+	pb, _, _ := setupPrivateBlob(t, "private content")
+	public := sha256.Sum256([]byte("public content"))
+
+	served := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	})
+	req := httptest.NewRequest("GET", "/"+hex.EncodeToString(public[:])+".txt", nil)
+	privateBlobMiddleware(next, pb).ServeHTTP(httptest.NewRecorder(), req)
+	if !served {
+		t.Errorf("public blob wasn't passed to the public handler")
+	}
+}
+
+func TestPrivateBlobMiddlewareMarksUploads(t *testing.T) {
+	tests := []struct {
+		method      string
+		path        string
+		wantPrivate bool
+	}{
+		{method: "PUT", path: "/upload", wantPrivate: true},
+		{method: "PUT", path: "/media", wantPrivate: true},
+		{method: "PUT", path: "/mirror", wantPrivate: true},
+		{method: "HEAD", path: "/upload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			pb := &privateBlobs{mode: privateModeAll}
+			var private bool
+			handler := privateBlobMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				private = isPrivateUpload(r.Context())
+			}), pb)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+			if private != tt.wantPrivate {
+				t.Errorf("private upload = %v, want %v", private, tt.wantPrivate)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// quotaLimits holds upload limits for a pubkey; zero means unlimited
+type quotaLimits struct {
+	MaxBlobSize      int64 `json:"max_blob_size"`
+	MaxTotalBytes    int64 `json:"max_total_bytes"`
+	MaxBlobs         int64 `json:"max_blobs"`
+	MaxUploadsPerDay int64 `json:"max_uploads_per_day"`
+}
+
+// quotaUsage is the current storage usage of a pubkey
+type quotaUsage struct {
+	TotalBytes   int64 `json:"total_bytes"`
+	Blobs        int64 `json:"blobs"`
+	UploadsToday int64 `json:"uploads_today"`
+}
+
+// quotaPolicy resolves the limits that apply to a pubkey
+// Precedence is: per-pubkey limits, then the "admin" role, then the "allowed" role, then the defaults
+type quotaPolicy struct {
+	Default quotaLimits            `json:"default"`
+	Roles   map[string]quotaLimits `json:"roles"`
+	Pubkeys map[string]quotaLimits `json:"pubkeys"`
+
+	db                   *sql.DB
+	adminPubkeys         map[string]bool
+	staticAllowedPubkeys map[string]bool
+}
+
+// loadQuotaPolicy builds the quota policy from default limits and an optional JSON config file
+// The file may override "default" and define "roles" ("admin", "allowed") and "pubkeys" (npub or hex)
+func loadQuotaPolicy(db *sql.DB, defaults quotaLimits, configPath string, adminPubkeys map[string]bool, staticAllowedPubkeys map[string]bool) (*quotaPolicy, error) {
+	policy := &quotaPolicy{
+		Default:              defaults,
+		Roles:                make(map[string]quotaLimits),
+		Pubkeys:              make(map[string]quotaLimits),
+		db:                   db,
+		adminPubkeys:         adminPubkeys,
+		staticAllowedPubkeys: staticAllowedPubkeys,
+	}
+
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read quota config: %w", err)
+		}
+		if err := json.Unmarshal(data, policy); err != nil {
+			return nil, fmt.Errorf("failed to parse quota config: %w", err)
+		}
+
+		// Normalize pubkeys to hex
+		pubkeys := make(map[string]quotaLimits, len(policy.Pubkeys))
+		for key, limits := range policy.Pubkeys {
+			normalized, err := normalizePubkey(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pubkey %q in quota config: %w", key, err)
+			}
+			pubkeys[normalized] = limits
+		}
+		policy.Pubkeys = pubkeys
+	}
+
+	return policy, nil
+}
+
+// createUsageTable creates the tables tracking per-pubkey storage usage and successful uploads if they don't exist
+// upload_log is append-only so deleting and re-uploading blobs doesn't reset the daily upload count
+func createUsageTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS blob_usage (
+		pubkey TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		uploaded_at INTEGER NOT NULL,
+		PRIMARY KEY (pubkey, sha256)
+	);
+	CREATE INDEX IF NOT EXISTS idx_blob_usage_uploaded_at ON blob_usage (pubkey, uploaded_at);
+	CREATE TABLE IF NOT EXISTS upload_log (
+		pubkey TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		uploaded_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_upload_log_uploaded_at ON upload_log (pubkey, uploaded_at);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// LimitsFor returns the limits that apply to a (hex) pubkey
+func (qp *quotaPolicy) LimitsFor(ctx context.Context, pubkey string) (quotaLimits, error) {
+	if limits, ok := qp.Pubkeys[pubkey]; ok {
+		return limits, nil
+	}
+	if limits, ok := qp.Roles["admin"]; ok && qp.adminPubkeys[pubkey] {
+		return limits, nil
+	}
+	if limits, ok := qp.Roles["allowed"]; ok {
+		allowed, err := effectiveAllowedPubkeys(ctx, qp.db, qp.staticAllowedPubkeys)
+		if err != nil {
+			return quotaLimits{}, err
+		}
+		if allowed[pubkey] {
+			return limits, nil
+		}
+	}
+	return qp.Default, nil
+}
+
+// CheckUpload enforces the quota of the uploader before the body is read
+// Returns the HTTP status (413 or 429) and reason when the upload must be rejected
+func (qp *quotaPolicy) CheckUpload(ctx context.Context, pubkey string, size int64) (int, string, error) {
+	limits, err := qp.LimitsFor(ctx, pubkey)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to resolve quota: %w", err)
+	}
+
+	if limits.MaxBlobSize > 0 && size > limits.MaxBlobSize {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("blob size %d exceeds the maximum of %d bytes", size, limits.MaxBlobSize), nil
+	}
+
+	usage, err := getQuotaUsage(ctx, qp.db, pubkey)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to query usage: %w", err)
+	}
+
+	if limits.MaxTotalBytes > 0 && usage.TotalBytes+size > limits.MaxTotalBytes {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("storage quota exceeded: %d of %d bytes used", usage.TotalBytes, limits.MaxTotalBytes), nil
+	}
+	if limits.MaxBlobs > 0 && usage.Blobs >= limits.MaxBlobs {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("blob count quota exceeded: %d of %d blobs stored", usage.Blobs, limits.MaxBlobs), nil
+	}
+	if limits.MaxUploadsPerDay > 0 && usage.UploadsToday >= limits.MaxUploadsPerDay {
+		return http.StatusTooManyRequests, fmt.Sprintf("daily upload limit of %d reached", limits.MaxUploadsPerDay), nil
+	}
+
+	return 0, "", nil
+}
+
+// getQuotaUsage returns the storage usage of a pubkey
+func getQuotaUsage(ctx context.Context, db *sql.DB, pubkey string) (quotaUsage, error) {
+	var usage quotaUsage
+	query := `SELECT COALESCE(SUM(size), 0), COUNT(*) FROM blob_usage WHERE pubkey = ?`
+	if err := db.QueryRowContext(ctx, query, pubkey).Scan(&usage.TotalBytes, &usage.Blobs); err != nil {
+		return usage, err
+	}
+
+	since := time.Now().Add(-24 * time.Hour).Unix()
+	query = `SELECT COUNT(*) FROM upload_log WHERE pubkey = ? AND uploaded_at >= ?`
+	if err := db.QueryRowContext(ctx, query, pubkey, since).Scan(&usage.UploadsToday); err != nil {
+		return usage, err
+	}
+
+	return usage, nil
+}
+
+// usageTrackingIndex wraps the blob index to record usage when a pubkey keeps a blob
+// and release it when the pubkey deletes it
+// Keeping a blob the pubkey already owns keeps its original upload time
+type usageTrackingIndex struct {
+	blossom.BlobIndex
+	db *sql.DB
+}
+
+func (idx usageTrackingIndex) Keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string) error {
+	var owned bool
+	err := idx.db.QueryRowContext(ctx, `SELECT 1 FROM blob_usage WHERE pubkey = ? AND sha256 = ?`, pubkey, blob.SHA256).Scan(&owned)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to query usage: %w", err)
+	}
+
+	if err := idx.BlobIndex.Keep(ctx, blob, pubkey); err != nil {
+		return err
+	}
+
+	query := `INSERT OR IGNORE INTO blob_usage (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+	if _, err := idx.db.ExecContext(ctx, query, pubkey, blob.SHA256, blob.Size, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	if accounting, ok := ctx.Value(uploadAccountingKey).(*uploadAccounting); ok {
+		accounting.add(keptUpload{pubkey: pubkey, sha256: blob.SHA256, size: int64(blob.Size), owned: owned})
+	}
+	return nil
+}
+
+func (idx usageTrackingIndex) Delete(ctx context.Context, sha256 string, pubkey string) error {
+	if err := idx.BlobIndex.Delete(ctx, sha256, pubkey); err != nil {
+		return err
+	}
+
+	query := `DELETE FROM blob_usage WHERE pubkey = ? AND sha256 = ?`
+	if _, err := idx.db.ExecContext(ctx, query, pubkey, sha256); err != nil {
+		log.Printf("Failed to release usage for pubkey=%s sha256=%s: %v", pubkey, sha256, err)
+	}
+	return nil
+}
+
+// keptUpload is a blob kept by a pubkey during an upload request
+type keptUpload struct {
+	pubkey string
+	sha256 string
+	size   int64
+	owned  bool // the pubkey already owned the blob before the request
+}
+
+// uploadAccounting collects the blobs kept while handling an upload request
+// The blob index is updated before the blob is stored, so uploads are only accounted for
+// once the whole request has succeeded
+type uploadAccounting struct {
+	mu   sync.Mutex
+	kept []keptUpload
+}
+
+func (ua *uploadAccounting) add(upload keptUpload) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	ua.kept = append(ua.kept, upload)
+}
+
+// statusRecorder records the status code of a response while writing it through
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.statusCode == 0 {
+		sr.statusCode = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.statusCode == 0 {
+		sr.statusCode = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// uploadAccountingMiddleware logs the blobs kept by successful upload requests in upload_log,
+// which the daily upload quota counts, and releases the ownership that failed requests
+// granted before their blob was rejected or couldn't be stored
+func uploadAccountingMiddleware(next http.Handler, store blossom.BlobIndex, db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" && r.Method != "POST" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accounting := &uploadAccounting{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), uploadAccountingKey, accounting)))
+
+		ctx := context.WithoutCancel(r.Context())
+		succeeded := recorder.statusCode >= 200 && recorder.statusCode < 300
+		now := time.Now().Unix()
+		for _, upload := range accounting.kept {
+			if !succeeded {
+				if upload.owned {
+					continue
+				}
+				if err := store.Delete(ctx, upload.sha256, upload.pubkey); err != nil {
+					log.Printf("Failed to release sha256=%s of %s after a failed upload: %v", upload.sha256, upload.pubkey, err)
+				}
+				continue
+			}
+
+			query := `INSERT INTO upload_log (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+			if _, err := db.ExecContext(ctx, query, upload.pubkey, upload.sha256, upload.size, now); err != nil {
+				log.Printf("Failed to log upload of sha256=%s by %s: %v", upload.sha256, upload.pubkey, err)
+			}
+			// Only the last day of the log is ever counted
+			query = `DELETE FROM upload_log WHERE pubkey = ? AND uploaded_at < ?`
+			if _, err := db.ExecContext(ctx, query, upload.pubkey, now-24*60*60); err != nil {
+				log.Printf("Failed to prune upload log of %s: %v", upload.pubkey, err)
+			}
+		}
+	})
+}
+
+// usageHandler returns the storage usage and limits of the pubkey authenticated with NIP-98
+func usageHandler(policy *quotaPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		auth, err := readNIP98Auth(r, nil)
+		if err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		pubkey, err := normalizePubkey(auth.PubKey)
+		if err != nil {
+			w.Header().Set("X-Reason", err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		limits, err := policy.LimitsFor(r.Context(), pubkey)
+		if err != nil {
+			http.Error(w, "failed to resolve quota", http.StatusInternalServerError)
+			return
+		}
+		usage, err := getQuotaUsage(r.Context(), policy.db, pubkey)
+		if err != nil {
+			http.Error(w, "failed to query usage", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"pubkey":    pubkey,
+			"usage":     usage,
+			"limits":    limits,
+			"timestamp": nostr.Now(),
+		}
+		if ipnsName, err := lookupIPNSName(r.Context(), policy.db, pubkey); err != nil {
+			log.Printf("Failed to look up IPNS name of %s: %v", pubkey, err)
+		} else if ipnsName != "" {
+			response["ipns_name"] = ipnsName
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
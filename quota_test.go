@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestQuotaPolicyCheckUpload(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     quotaLimits
+		size       int64
+		stored     int64 // bytes already stored in one blob
+		uploads    int   // uploads logged in the last day
+		wantStatus int
+	}{
+		{name: "unlimited", size: 1 << 30, stored: 1 << 30, uploads: 100},
+		{name: "blob too large", limits: quotaLimits{MaxBlobSize: 1000}, size: 1001, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "blob at the size limit", limits: quotaLimits{MaxBlobSize: 1000}, size: 1000},
+		{name: "storage quota exceeded", limits: quotaLimits{MaxTotalBytes: 2000}, size: 1000, stored: 1500, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "blob count quota exceeded", limits: quotaLimits{MaxBlobs: 1}, size: 10, stored: 10, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "daily limit reached", limits: quotaLimits{MaxUploadsPerDay: 2}, size: 10, uploads: 2, wantStatus: http.StatusTooManyRequests},
+		{name: "daily limit not reached", limits: quotaLimits{MaxUploadsPerDay: 2}, size: 10, uploads: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			_, pubkey := newTestKey(t)
+			ctx := context.Background()
+			now := nostr.Now()
+
+			if tt.stored > 0 {
+				query := `INSERT INTO blob_usage (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+				if _, err := db.Exec(query, pubkey, "stored", tt.stored, now); err != nil {
+					t.Fatalf("failed to record usage: %v", err)
+				}
+			}
+			for i := 0; i < tt.uploads; i++ {
+				query := `INSERT INTO upload_log (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+				if _, err := db.Exec(query, pubkey, "logged", 10, now); err != nil {
+					t.Fatalf("failed to log upload: %v", err)
+				}
+			}
+			// Uploads older than a day aren't counted
+			query := `INSERT INTO upload_log (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+			if _, err := db.Exec(query, pubkey, "old", 10, now-25*60*60); err != nil {
+				t.Fatalf("failed to log upload: %v", err)
+			}
+
+			policy, err := loadQuotaPolicy(db, tt.limits, "", nil, nil)
+			if err != nil {
+				t.Fatalf("loadQuotaPolicy() error = %v", err)
+			}
+			status, reason, err := policy.CheckUpload(ctx, pubkey, tt.size)
+			if err != nil {
+				t.Fatalf("CheckUpload() error = %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("CheckUpload() status = %d (%s), want %d", status, reason, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUploadAccounting(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+	tests := []struct {
+		name        string
+		owned       bool  // the uploader already owns the blob
+		statuses    []int // final status of each upload request in turn
+		deleteFirst bool  // the uploader deletes the blob before uploading it again
+		wantBlobs   int64
+		wantToday   int64
+	}{
+		{name: "successful upload", statuses: []int{http.StatusOK}, wantBlobs: 1, wantToday: 1},
+		{name: "upload failing after keep", statuses: []int{http.StatusInternalServerError}, wantBlobs: 0, wantToday: 0},
+		{name: "rejected upload of an owned blob", owned: true, statuses: []int{http.StatusForbidden}, wantBlobs: 1, wantToday: 0},
+		{name: "upload of an owned blob", owned: true, statuses: []int{http.StatusOK}, wantBlobs: 1, wantToday: 1},
+		{name: "delete and upload again", owned: true, deleteFirst: true, statuses: []int{http.StatusOK}, wantBlobs: 1, wantToday: 1},
+		{name: "repeated uploads", statuses: []int{http.StatusOK, http.StatusOK, http.StatusBadRequest}, wantBlobs: 1, wantToday: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, db := newTestDB(t)
+			_, pubkey := newTestKey(t)
+			ctx := context.Background()
+
+			index := usageTrackingIndex{
+				BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "http://localhost"},
+				db:        db,
+			}
+			blob := blossom.BlobDescriptor{SHA256: sha256, Size: 1024, Type: "image/png", Uploaded: nostr.Now()}
+			if tt.owned {
+				if err := index.Keep(ctx, blob, pubkey); err != nil {
+					t.Fatalf("Keep() error = %v", err)
+				}
+			}
+			if tt.deleteFirst {
+				if err := index.Delete(ctx, sha256, pubkey); err != nil {
+					t.Fatalf("Delete() error = %v", err)
+				}
+			}
+
+			for _, status := range tt.statuses {
+				// The blob index is updated before the blob is stored, as in the blossom upload handler
+				upload := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if err := index.Keep(r.Context(), blob, pubkey); err != nil {
+						t.Fatalf("Keep() error = %v", err)
+					}
+					w.WriteHeader(status)
+				})
+				handler := uploadAccountingMiddleware(upload, index, db)
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/upload", nil))
+			}
+
+			usage, err := getQuotaUsage(ctx, db, pubkey)
+			if err != nil {
+				t.Fatalf("getQuotaUsage() error = %v", err)
+			}
+			if usage.Blobs != tt.wantBlobs {
+				t.Errorf("Blobs = %d, want %d", usage.Blobs, tt.wantBlobs)
+			}
+			if usage.UploadsToday != tt.wantToday {
+				t.Errorf("UploadsToday = %d, want %d", usage.UploadsToday, tt.wantToday)
+			}
+
+			owner, err := index.BlobIndex.Get(ctx, sha256)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if (owner != nil) != (tt.wantBlobs > 0) {
+				t.Errorf("blob indexed = %v, want %v", owner != nil, tt.wantBlobs > 0)
+			}
+		})
+	}
+}
+
+func TestQuotaPolicyLimitsFor(t *testing.T) {
+	_, db := newTestDB(t)
+	_, admin := newTestKey(t)
+	_, allowed := newTestKey(t)
+	_, custom := newTestKey(t)
+	_, stranger := newTestKey(t)
+	npub, err := nip19.EncodePublicKey(custom)
+	if err != nil {
+		t.Fatalf("failed to encode npub: %v", err)
+	}
+
+	config := map[string]interface{}{
+		"default": quotaLimits{MaxBlobSize: 1},
+		"roles": map[string]quotaLimits{
+			"admin":   {MaxBlobSize: 2},
+			"allowed": {MaxBlobSize: 3},
+		},
+		"pubkeys": map[string]quotaLimits{npub: {MaxBlobSize: 4}},
+	}
+	data, _ := json.Marshal(config)
+	configPath := filepath.Join(t.TempDir(), "quotas.json")
+	if err := os.WriteFile(configPath, data, 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	policy, err := loadQuotaPolicy(db, quotaLimits{MaxBlobSize: 100}, configPath, map[string]bool{admin: true}, map[string]bool{allowed: true})
+	if err != nil {
+		t.Fatalf("loadQuotaPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		pubkey string
+		want   int64
+	}{
+		{name: "per-pubkey limits", pubkey: custom, want: 4},
+		{name: "admin role", pubkey: admin, want: 2},
+		{name: "allowed role", pubkey: allowed, want: 3},
+		{name: "default", pubkey: stranger, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits, err := policy.LimitsFor(context.Background(), tt.pubkey)
+			if err != nil {
+				t.Fatalf("LimitsFor() error = %v", err)
+			}
+			if limits.MaxBlobSize != tt.want {
+				t.Errorf("MaxBlobSize = %d, want %d", limits.MaxBlobSize, tt.want)
+			}
+		})
+	}
+
+	if _, err := loadQuotaPolicy(db, quotaLimits{}, filepath.Join(t.TempDir(), "missing.json"), nil, nil); err == nil {
+		t.Errorf("loadQuotaPolicy() accepted a missing config file")
+	}
+}
+
+func TestUsageTrackingIndex(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	store, db := newTestDB(t)
+	_, pubkey := newTestKey(t)
+	ctx := context.Background()
+
+	index := usageTrackingIndex{
+		BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "http://localhost"},
+		db:        db,
+	}
+	blob := blossom.BlobDescriptor{SHA256: sha256, Size: 1024, Type: "image/png", Uploaded: nostr.Now()}
+
+	steps := []struct {
+		name      string
+		run       func() error
+		wantBytes int64
+		wantBlobs int64
+	}{
+		{name: "keep", run: func() error { return index.Keep(ctx, blob, pubkey) }, wantBytes: 1024, wantBlobs: 1},
+		{name: "keep again", run: func() error { return index.Keep(ctx, blob, pubkey) }, wantBytes: 1024, wantBlobs: 1},
+		{name: "delete", run: func() error { return index.Delete(ctx, sha256, pubkey) }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: error = %v", step.name, err)
+		}
+		usage, err := getQuotaUsage(ctx, db, pubkey)
+		if err != nil {
+			t.Fatalf("getQuotaUsage() error = %v", err)
+		}
+		if usage.TotalBytes != step.wantBytes || usage.Blobs != step.wantBlobs {
+			t.Errorf("%s: usage = %+v, want %d bytes in %d blobs", step.name, usage, step.wantBytes, step.wantBlobs)
+		}
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	_, db := newTestDB(t)
+	sk, pubkey := newTestKey(t)
+	otherSK, otherPubkey := newTestKey(t)
+	query := `INSERT INTO blob_usage (pubkey, sha256, size, uploaded_at) VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(query, pubkey, "stored", 42, nostr.Now()); err != nil {
+		t.Fatalf("failed to record usage: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO ipns_names (pubkey, key_name, ipns_name) VALUES (?, ?, ?)`, pubkey, "blossom-"+pubkey, "k51user"); err != nil {
+		t.Fatalf("failed to record IPNS name: %v", err)
+	}
+	policy, err := loadQuotaPolicy(db, quotaLimits{MaxBlobs: 10}, "", nil, nil)
+	if err != nil {
+		t.Fatalf("loadQuotaPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		auth       string
+		wantStatus int
+		wantPubkey string
+		wantUsage  int64
+		wantIPNS   string
+	}{
+		{name: "authenticated", method: "GET", auth: nip98AuthHeader(t, sk, "https://blossom.example.com/usage", "GET", nil), wantStatus: http.StatusOK, wantPubkey: pubkey, wantUsage: 42, wantIPNS: "k51user"},
+		{name: "without IPNS name", method: "GET", auth: nip98AuthHeader(t, otherSK, "https://blossom.example.com/usage", "GET", nil), wantStatus: http.StatusOK, wantPubkey: otherPubkey},
+		{name: "unauthenticated", method: "GET", wantStatus: http.StatusUnauthorized},
+		{name: "other method", method: "POST", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "https://blossom.example.com/usage", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			usageHandler(policy).ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Pubkey   string      `json:"pubkey"`
+				Usage    quotaUsage  `json:"usage"`
+				Limits   quotaLimits `json:"limits"`
+				IPNSName string      `json:"ipns_name"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+			}
+			if resp.Pubkey != tt.wantPubkey || resp.Usage.TotalBytes != tt.wantUsage || resp.Limits.MaxBlobs != 10 || resp.IPNSName != tt.wantIPNS {
+				t.Errorf("response = %+v", resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Rate limit categories, each with its own budget
+const (
+	rateLimitUploads     = "uploads"
+	rateLimitReads       = "reads"
+	rateLimitLists       = "lists"
+	rateLimitRelayReq    = "relay_req"
+	rateLimitRelayEvents = "relay_events"
+)
+
+// rateLimitBucketIdleTimeout is how long an untouched bucket is kept before being dropped
+const rateLimitBucketIdleTimeout = 10 * time.Minute
+
+// tokenBucket is the state of a single rate limit key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketLimiter is a keyed token bucket rate limiter
+type tokenBucketLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newTokenBucketLimiter creates a limiter allowing count requests per interval, with bursts of up to count
+func newTokenBucketLimiter(count int, interval time.Duration) *tokenBucketLimiter {
+	l := &tokenBucketLimiter{
+		rate:    float64(count) / interval.Seconds(),
+		burst:   float64(count),
+		buckets: make(map[string]*tokenBucket),
+	}
+	go l.cleanup()
+	return l
+}
+
+// Allow takes a token for key. When none is available it returns false and how long to wait for one
+func (l *tokenBucketLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// cleanup periodically drops idle buckets so memory doesn't grow with every client ever seen
+func (l *tokenBucketLimiter) cleanup() {
+	ticker := time.NewTicker(rateLimitBucketIdleTimeout)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.last) > rateLimitBucketIdleTimeout {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// parseRateLimit parses a rate limit of the form "<count>/<interval>", e.g. "30/1m"
+// An empty string disables the limit
+func parseRateLimit(limitStr string) (int, time.Duration, error) {
+	if limitStr == "" {
+		return 0, 0, nil
+	}
+	countStr, intervalStr, ok := strings.Cut(limitStr, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("rate limit %q must be in <count>/<interval> format", limitStr)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil || count <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit count in %q", limitStr)
+	}
+	interval, err := time.ParseDuration(strings.TrimSpace(intervalStr))
+	if err != nil || interval <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit interval in %q", limitStr)
+	}
+	return count, interval, nil
+}
+
+// rateLimiter enforces per-IP and per-pubkey budgets for each request category
+type rateLimiter struct {
+	limiters       map[string]*tokenBucketLimiter
+	trustedProxies []*net.IPNet
+	metrics        *metricsRegistry
+
+	// chargedReqs holds the REQs already charged: khatru calls RejectFilter once per
+	// filter, all with the same context, and a REQ should only cost one token
+	reqsMu      sync.Mutex
+	chargedReqs map[context.Context]struct{}
+}
+
+// newRateLimiter creates a rate limiter from "<count>/<interval>" limits keyed by category
+func newRateLimiter(limits map[string]string, trustedProxies []*net.IPNet, metrics *metricsRegistry) (*rateLimiter, error) {
+	rl := &rateLimiter{
+		limiters:       make(map[string]*tokenBucketLimiter),
+		trustedProxies: trustedProxies,
+		metrics:        metrics,
+		chargedReqs:    make(map[context.Context]struct{}),
+	}
+	for category, limitStr := range limits {
+		count, interval, err := parseRateLimit(limitStr)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			rl.limiters[category] = newTokenBucketLimiter(count, interval)
+			log.Printf("Rate limit for %s: %d per %s", category, count, interval)
+		}
+	}
+
+	metrics.Describe("blossom_rate_limit_allowed_total", "Requests allowed by the rate limiter")
+	metrics.Describe("blossom_rate_limit_rejected_total", "Requests rejected by the rate limiter")
+	return rl, nil
+}
+
+// Enabled reports whether any category has a limit
+func (rl *rateLimiter) Enabled() bool {
+	return len(rl.limiters) > 0
+}
+
+// Allow checks the IP and (if known) pubkey budgets of a category
+// Both must have a token available; the returned duration is the suggested Retry-After
+func (rl *rateLimiter) Allow(category string, ip string, pubkey string) (bool, time.Duration) {
+	limiter, ok := rl.limiters[category]
+	if !ok {
+		return true, 0
+	}
+
+	if ip != "" {
+		if allowed, wait := limiter.Allow("ip:" + ip); !allowed {
+			rl.metrics.Inc("blossom_rate_limit_rejected_total", "category", category, "key", "ip")
+			return false, wait
+		}
+	}
+	if pubkey != "" {
+		if allowed, wait := limiter.Allow("pubkey:" + pubkey); !allowed {
+			rl.metrics.Inc("blossom_rate_limit_rejected_total", "category", category, "key", "pubkey")
+			return false, wait
+		}
+	}
+
+	rl.metrics.Inc("blossom_rate_limit_allowed_total", "category", category)
+	return true, 0
+}
+
+// ClientIP returns the IP of the client, only honouring X-Forwarded-For when the
+// request comes from a trusted proxy
+func (rl *rateLimiter) ClientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if !rl.isTrustedProxy(remoteIP) {
+		return remoteIP
+	}
+
+	// Walk X-Forwarded-For from the closest hop, skipping our own proxies
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !rl.isTrustedProxy(hop) {
+			return hop
+		}
+		remoteIP = hop
+	}
+	return remoteIP
+}
+
+// isTrustedProxy checks an IP against the trusted proxy networks
+func (rl *rateLimiter) isTrustedProxy(ipStr string) bool {
+	return ipInNetworks(ipStr, rl.trustedProxies)
+}
+
+// ipInNetworks checks whether an IP belongs to one of the networks
+func ipInNetworks(ipStr string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of IPs or CIDRs from environment variable
+func parseTrustedProxies(proxiesStr string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(proxiesStr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// httpRateLimitCategory classifies a blossom HTTP request into a rate limit category
+func httpRateLimitCategory(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case (path == "/upload" || path == "/media" || path == "/mirror" || path == "/report") && (r.Method == "PUT" || r.Method == "HEAD"):
+		return rateLimitUploads
+	case path == nip96APIPath && r.Method == "POST":
+		return rateLimitUploads
+	case strings.HasPrefix(path, "/list/") && (r.Method == "GET" || r.Method == "HEAD"):
+		return rateLimitLists
+	case path == nip96APIPath && r.Method == "GET":
+		return rateLimitLists
+	case (len(path) == 65 || strings.Index(path, ".") == 65) && !strings.Contains(path[1:], "/") && (r.Method == "GET" || r.Method == "HEAD"):
+		return rateLimitReads
+	case (strings.HasPrefix(path, "/cid/") || (len(path) == 69 && strings.HasSuffix(path, "/cid"))) && r.Method == "GET":
+		return rateLimitReads
+	case strings.HasPrefix(path, "/ipfs/") && (r.Method == "GET" || r.Method == "HEAD"):
+		return rateLimitReads
+	}
+	return ""
+}
+
+// rateLimitMiddleware wraps a handler to enforce upload, read and list budgets with 429 responses
+func rateLimitMiddleware(next http.Handler, rl *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		category := httpRateLimitCategory(r)
+		if category == "" || isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed, wait := rl.Allow(category, rl.ClientIP(r), readAuthPubkey(r)); !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			w.Header().Set("X-Reason", "rate limited: too many "+category+" requests, slow down")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// relayClientIP returns the IP of the websocket client behind a relay context
+func (rl *rateLimiter) relayClientIP(ctx context.Context) string {
+	if conn := khatru.GetConnection(ctx); conn != nil && conn.Request != nil {
+		return rl.ClientIP(conn.Request)
+	}
+	return ""
+}
+
+// firstFilterOfReq reports whether ctx is a REQ that hasn't been charged yet, remembering
+// it until the REQ is closed
+func (rl *rateLimiter) firstFilterOfReq(ctx context.Context) bool {
+	rl.reqsMu.Lock()
+	defer rl.reqsMu.Unlock()
+	if _, charged := rl.chargedReqs[ctx]; charged {
+		return false
+	}
+	rl.chargedReqs[ctx] = struct{}{}
+	context.AfterFunc(ctx, func() {
+		rl.reqsMu.Lock()
+		delete(rl.chargedReqs, ctx)
+		rl.reqsMu.Unlock()
+	})
+	return true
+}
+
+// RejectFilter is a khatru hook enforcing the REQ budget, charged once per REQ
+// however many filters it has
+func (rl *rateLimiter) RejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	if _, limited := rl.limiters[rateLimitRelayReq]; !limited || !rl.firstFilterOfReq(ctx) {
+		return false, ""
+	}
+	if allowed, _ := rl.Allow(rateLimitRelayReq, rl.relayClientIP(ctx), khatru.GetAuthed(ctx)); !allowed {
+		return true, "rate-limited: too many requests, slow down"
+	}
+	return false, ""
+}
+
+// RejectEvent is a khatru hook enforcing the EVENT budget
+func (rl *rateLimiter) RejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if allowed, _ := rl.Allow(rateLimitRelayEvents, rl.relayClientIP(ctx), event.PubKey); !allowed {
+		return true, "rate-limited: too many events, slow down"
+	}
+	return false, ""
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		limit        string
+		wantCount    int
+		wantInterval time.Duration
+		wantErr      bool
+	}{
+		{limit: "", wantCount: 0},
+		{limit: "30/1m", wantCount: 30, wantInterval: time.Minute},
+		{limit: " 5 / 10s ", wantCount: 5, wantInterval: 10 * time.Second},
+		{limit: "30", wantErr: true},
+		{limit: "0/1m", wantErr: true},
+		{limit: "-1/1m", wantErr: true},
+		{limit: "x/1m", wantErr: true},
+		{limit: "30/soon", wantErr: true},
+		{limit: "30/0s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.limit, func(t *testing.T) {
+			count, interval, err := parseRateLimit(tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRateLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (count != tt.wantCount || interval != tt.wantInterval) {
+				t.Errorf("parseRateLimit() = %d, %s, want %d, %s", count, interval, tt.wantCount, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	limiter := newTokenBucketLimiter(2, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("a"); !allowed {
+			t.Fatalf("request %d within the burst was rejected", i+1)
+		}
+	}
+	allowed, wait := limiter.Allow("a")
+	if allowed {
+		t.Fatalf("request beyond the burst was allowed")
+	}
+	if wait <= 0 || wait > 30*time.Minute {
+		t.Errorf("wait = %s, want about 30m", wait)
+	}
+	if allowed, _ := limiter.Allow("b"); !allowed {
+		t.Errorf("another key shares the exhausted budget")
+	}
+
+	// Tokens refill over time
+	limiter.buckets["a"].last = time.Now().Add(-30 * time.Minute)
+	if allowed, _ := limiter.Allow("a"); !allowed {
+		t.Errorf("request after refill was rejected")
+	}
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies() error = %v", err)
+	}
+	rl := &rateLimiter{trustedProxies: proxies}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		wantClientIP string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.7:1234", wantClientIP: "203.0.113.7"},
+		{name: "spoofed header from untrusted peer", remoteAddr: "203.0.113.7:1234", forwardedFor: "198.51.100.1", wantClientIP: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: "198.51.100.1", wantClientIP: "198.51.100.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.1.2.3:1234", forwardedFor: "198.51.100.1, 192.168.1.1", wantClientIP: "198.51.100.1"},
+		{name: "spoofed first hop behind proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: "1.1.1.1, 198.51.100.1", wantClientIP: "198.51.100.1"},
+		{name: "garbage header behind proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: "not-an-ip", wantClientIP: "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if ip := rl.ClientIP(req); ip != tt.wantClientIP {
+				t.Errorf("ClientIP() = %q, want %q", ip, tt.wantClientIP)
+			}
+		})
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("parseTrustedProxies() accepted an invalid CIDR")
+	}
+}
+
+func TestHTTPRateLimitCategory(t *testing.T) {
+	const sha = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{method: "PUT", path: "/upload", want: rateLimitUploads},
+		{method: "HEAD", path: "/upload", want: rateLimitUploads},
+		{method: "PUT", path: "/media", want: rateLimitUploads},
+		{method: "PUT", path: "/mirror", want: rateLimitUploads},
+		{method: "PUT", path: "/report", want: rateLimitUploads},
+		{method: "GET", path: "/list/" + sha[:64], want: rateLimitLists},
+		{method: "GET", path: "/" + sha, want: rateLimitReads},
+		{method: "HEAD", path: "/" + sha + ".png", want: rateLimitReads},
+		{method: "DELETE", path: "/" + sha},
+		{method: "GET", path: "/"},
+		{method: "GET", path: "/metrics"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if got := httpRateLimitCategory(req); got != tt.want {
+				t.Errorf("httpRateLimitCategory() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	metrics := newMetricsRegistry()
+	rl, err := newRateLimiter(map[string]string{rateLimitUploads: "1/1h"}, nil, metrics)
+	if err != nil {
+		t.Fatalf("newRateLimiter() error = %v", err)
+	}
+	handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), rl)
+	sk, _ := newTestKey(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		remoteAddr string
+		signed     bool
+		wantStatus int
+	}{
+		{name: "first upload", method: "PUT", path: "/upload", remoteAddr: "203.0.113.1:1", signed: true, wantStatus: http.StatusOK},
+		{name: "same IP", method: "PUT", path: "/upload", remoteAddr: "203.0.113.1:1", wantStatus: http.StatusTooManyRequests},
+		{name: "same pubkey from another IP", method: "PUT", path: "/upload", remoteAddr: "203.0.113.2:1", signed: true, wantStatus: http.StatusTooManyRequests},
+		{name: "another client", method: "PUT", path: "/upload", remoteAddr: "203.0.113.3:1", wantStatus: http.StatusOK},
+		{name: "unlimited category", method: "GET", path: "/list/abc", remoteAddr: "203.0.113.1:1", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.signed {
+				req.Header.Set("Authorization", blossomAuthHeader(t, sk, "upload"))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+			if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+				t.Errorf("429 without Retry-After")
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`blossom_rate_limit_allowed_total{category="uploads"} 2`,
+		`blossom_rate_limit_rejected_total{category="uploads",key="ip"} 1`,
+		`blossom_rate_limit_rejected_total{category="uploads",key="pubkey"} 1`,
+	} {
+		if !containsLine(rec.Body.String(), line) {
+			t.Errorf("metrics output is missing %q:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestRateLimitMiddlewareAuthPubkey(t *testing.T) {
+	const uploadURL = "https://blossom.example.com" + nip96APIPath
+
+	tests := []struct {
+		name string
+		// auth signs the Authorization header of a request, or returns "" to send none
+		auth              func(t *testing.T, sk string) string
+		wantPubkeyLimited bool
+	}{
+		{
+			name:              "blossom auth",
+			auth:              func(t *testing.T, sk string) string { return blossomAuthHeader(t, sk, "upload") },
+			wantPubkeyLimited: true,
+		},
+		{
+			name:              "NIP-98 auth",
+			auth:              func(t *testing.T, sk string) string { return nip98AuthHeader(t, sk, uploadURL, "POST", nil) },
+			wantPubkeyLimited: true,
+		},
+		{
+			name: "stale NIP-98 auth",
+			auth: func(t *testing.T, sk string) string {
+				evt := &nostr.Event{Kind: nostr.KindHTTPAuth, Tags: nostr.Tags{{"u", uploadURL}, {"method", "POST"}}, CreatedAt: nostr.Now() - 3600}
+				if err := evt.Sign(sk); err != nil {
+					t.Fatalf("failed to sign event: %v", err)
+				}
+				return authHeader(t, evt)
+			},
+		},
+		{
+			name: "forged NIP-98 auth",
+			auth: func(t *testing.T, sk string) string {
+				evt := signTestEvent(t, sk, nostr.KindHTTPAuth, nostr.Tags{{"u", uploadURL}, {"method", "POST"}}, "")
+				evt.Sig = strings.Repeat("0", 128)
+				return authHeader(t, evt)
+			},
+		},
+		{
+			name: "no auth",
+			auth: func(t *testing.T, sk string) string { return "" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, err := newRateLimiter(map[string]string{rateLimitUploads: "1/1h"}, nil, newMetricsRegistry())
+			if err != nil {
+				t.Fatalf("newRateLimiter() error = %v", err)
+			}
+			handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), rl)
+			sk, _ := newTestKey(t)
+
+			// The same signer from two IPs: the second request only fails on the pubkey budget
+			var statuses []int
+			for _, remoteAddr := range []string{"203.0.113.1:1", "203.0.113.2:1"} {
+				req := httptest.NewRequest("POST", nip96APIPath, nil)
+				req.RemoteAddr = remoteAddr
+				if header := tt.auth(t, sk); header != "" {
+					req.Header.Set("Authorization", header)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				statuses = append(statuses, rec.Code)
+			}
+
+			if statuses[0] != http.StatusOK {
+				t.Fatalf("first request status = %d, want %d", statuses[0], http.StatusOK)
+			}
+			if limited := statuses[1] == http.StatusTooManyRequests; limited != tt.wantPubkeyLimited {
+				t.Errorf("second request limited = %v, want %v", limited, tt.wantPubkeyLimited)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRejectFilterChargesOncePerReq(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   string
+		filters []int // number of filters in each REQ, sent in order
+		wantOK  []bool
+	}{
+		{name: "single filter REQs", limit: "2/1h", filters: []int{1, 1, 1}, wantOK: []bool{true, true, false}},
+		{name: "multi filter REQs", limit: "2/1h", filters: []int{3, 5, 2}, wantOK: []bool{true, true, false}},
+		{name: "one REQ with many filters", limit: "1/1h", filters: []int{10}, wantOK: []bool{true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, err := newRateLimiter(map[string]string{rateLimitRelayReq: tt.limit}, nil, newMetricsRegistry())
+			if err != nil {
+				t.Fatalf("newRateLimiter() error = %v", err)
+			}
+			relay := khatru.NewRelay()
+			relay.RejectFilter = append(relay.RejectFilter, rl.RejectFilter)
+			server := httptest.NewServer(relay)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+			if err != nil {
+				t.Fatalf("failed to connect to relay: %v", err)
+			}
+			defer conn.Close()
+
+			for i, n := range tt.filters {
+				filters := make(nostr.Filters, n)
+				for j := range filters {
+					filters[j] = nostr.Filter{Kinds: []int{j + 1}}
+				}
+				sub, err := conn.Subscribe(ctx, filters)
+				if err != nil {
+					t.Fatalf("failed to subscribe: %v", err)
+				}
+				select {
+				case <-sub.EndOfStoredEvents:
+					if !tt.wantOK[i] {
+						t.Errorf("REQ %d was accepted, want it rate limited", i)
+					}
+				case reason := <-sub.ClosedReason:
+					if tt.wantOK[i] {
+						t.Errorf("REQ %d was closed (%s), want it accepted", i, reason)
+					}
+				case <-ctx.Done():
+					t.Fatalf("REQ %d got no answer", i)
+				}
+				sub.Unsub()
+			}
+		})
+	}
+}
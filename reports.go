@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// reportMaxBodySize bounds the size of a BUD-09 report event
+const reportMaxBodySize = 64 * 1024
+
+// Review states of a reported blob
+const (
+	reviewPending     = "pending"
+	reviewQuarantined = "quarantined"
+	reviewReleased    = "released"
+)
+
+// errReportRateLimited is returned when a pubkey sends reports faster than its budget
+var errReportRateLimited = errors.New("rate limited: too many reports, slow down")
+
+// blobReports receives BUD-09 reports, keeps a per-blob review queue and quarantines
+// blobs once enough distinct trusted pubkeys reported them
+type blobReports struct {
+	db     *sql.DB
+	store  eventstore.Store
+	blocks *blocklist
+
+	// threshold is the number of distinct trusted reporters that quarantines a blob (0 = never)
+	threshold int
+
+	// Reporters count towards the threshold when they are admins, allowed pubkeys
+	// or granted upload access by an authorizer (web of trust, NIP-05 domains)
+	adminPubkeys         map[string]bool
+	staticAllowedPubkeys map[string]bool
+	authorizers          []uploadAuthorizer
+
+	// limiter bounds how many reports each pubkey may send (nil = unlimited)
+	limiter *tokenBucketLimiter
+}
+
+// reportedBlob is an entry of the review queue returned by the listreportedblobs method
+type reportedBlob struct {
+	SHA256       string   `json:"sha256"`
+	Status       string   `json:"status"`
+	Reports      int      `json:"reports"`
+	ReportTypes  []string `json:"report_types"`
+	LastReportAt int64    `json:"last_report_at"`
+	DecidedBy    string   `json:"decided_by,omitempty"`
+}
+
+// createReportTables creates the report and review queue tables if they don't exist
+func createReportTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS blob_reports (
+		sha256 TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		report_type TEXT,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (sha256, pubkey)
+	);
+	CREATE TABLE IF NOT EXISTS blob_reviews (
+		sha256 TEXT PRIMARY KEY,
+		status TEXT NOT NULL,
+		decided_by TEXT,
+		updated_at INTEGER NOT NULL
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// newBlobReports creates the report handling with the given auto-quarantine threshold
+func newBlobReports(db *sql.DB, store eventstore.Store, blocks *blocklist, threshold int, adminPubkeys map[string]bool, staticAllowedPubkeys map[string]bool, authorizers []uploadAuthorizer, limiter *tokenBucketLimiter) *blobReports {
+	return &blobReports{
+		db:                   db,
+		store:                store,
+		blocks:               blocks,
+		threshold:            threshold,
+		adminPubkeys:         adminPubkeys,
+		staticAllowedPubkeys: staticAllowedPubkeys,
+		authorizers:          authorizers,
+		limiter:              limiter,
+	}
+}
+
+// isTrustedReporter reports whether a pubkey's reports count towards auto-quarantine
+func (br *blobReports) isTrustedReporter(ctx context.Context, pubkey string) (bool, error) {
+	if br.adminPubkeys[pubkey] {
+		return true, nil
+	}
+	allowed, err := effectiveAllowedPubkeys(ctx, br.db, br.staticAllowedPubkeys)
+	if err != nil {
+		return false, err
+	}
+	if allowed[pubkey] {
+		return true, nil
+	}
+	for _, authorize := range br.authorizers {
+		if ok, err := authorize(ctx, pubkey); err != nil {
+			log.Printf("Upload authorizer failed for reporter %s: %v", pubkey, err)
+		} else if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isBlobQuarantined checks whether a blob is quarantined pending an admin decision
+// Thumbnails are quarantined along with their original
+func isBlobQuarantined(ctx context.Context, db *sql.DB, sha256 string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM blob_reviews WHERE status = ? AND (sha256 = ? OR sha256 IN (SELECT sha256 FROM blob_thumbnails WHERE thumb_sha256 = ?))`
+	err := db.QueryRowContext(ctx, query, reviewQuarantined, sha256, sha256).Scan(&count)
+	return count > 0, err
+}
+
+// Receive validates a NIP-56 report event, stores it and queues the reported blobs for review
+// Returns the sha256 hashes of the reported blobs that are stored on this server
+func (br *blobReports) Receive(ctx context.Context, evt *nostr.Event) ([]string, error) {
+	if evt.Kind != nostr.KindReporting || !evt.CheckID() {
+		return nil, errors.New("invalid report event")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, errors.New("invalid report event signature")
+	}
+	if banned, err := isPubkeyBanned(ctx, br.db, evt.PubKey); err != nil {
+		return nil, fmt.Errorf("failed to check pubkey ban: %w", err)
+	} else if banned {
+		return nil, errors.New("pubkey is banned")
+	}
+	if br.limiter != nil {
+		if allowed, _ := br.limiter.Allow(evt.PubKey); !allowed {
+			return nil, errReportRateLimited
+		}
+	}
+
+	var reported []string
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "x" || !nostr.IsValid32ByteHex(tag[1]) {
+			continue
+		}
+		sha256 := strings.ToLower(tag[1])
+		var count int
+		if err := br.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&count); err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			continue
+		}
+
+		reportType := ""
+		if len(tag) >= 3 {
+			reportType = tag[2]
+		}
+		query := `INSERT OR REPLACE INTO blob_reports (sha256, pubkey, event_id, report_type, created_at) VALUES (?, ?, ?, ?, ?)`
+		if _, err := br.db.ExecContext(ctx, query, sha256, evt.PubKey, evt.ID, reportType, int64(evt.CreatedAt)); err != nil {
+			return nil, fmt.Errorf("failed to store report: %w", err)
+		}
+		if err := br.review(ctx, sha256); err != nil {
+			return nil, err
+		}
+		reported = append(reported, sha256)
+	}
+	if len(reported) == 0 {
+		return nil, errors.New("report doesn't reference any blob stored on this server")
+	}
+
+	if err := br.store.SaveEvent(ctx, evt); err != nil && err != eventstore.ErrDupEvent {
+		return nil, fmt.Errorf("failed to store report event: %w", err)
+	}
+	log.Printf("Received report %s from %s for %d blobs", evt.ID, evt.PubKey, len(reported))
+	return reported, nil
+}
+
+// review queues a reported blob and quarantines it when it reaches the threshold
+// A decision taken by an admin (released) isn't overridden by further reports
+func (br *blobReports) review(ctx context.Context, sha256 string) error {
+	now := time.Now().Unix()
+	query := `INSERT OR IGNORE INTO blob_reviews (sha256, status, updated_at) VALUES (?, ?, ?)`
+	if _, err := br.db.ExecContext(ctx, query, sha256, reviewPending, now); err != nil {
+		return fmt.Errorf("failed to queue blob for review: %w", err)
+	}
+	if br.threshold <= 0 {
+		return nil
+	}
+
+	reporters, err := br.trustedReporters(ctx, sha256)
+	if err != nil {
+		return err
+	}
+	if reporters < br.threshold {
+		return nil
+	}
+
+	query = `UPDATE blob_reviews SET status = ?, decided_by = ?, updated_at = ? WHERE sha256 = ? AND status = ?`
+	result, err := br.db.ExecContext(ctx, query, reviewQuarantined, "auto", now, sha256, reviewPending)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine blob: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		reason := fmt.Sprintf("reported by %d trusted pubkeys", reporters)
+		log.Printf("Quarantined blob sha256=%s: %s", sha256, reason)
+		return br.blocks.audit(ctx, "quarantine", blockTargetSHA256, sha256, reason, "auto", "reports")
+	}
+	return nil
+}
+
+// trustedReporters counts the distinct trusted pubkeys that reported a blob
+func (br *blobReports) trustedReporters(ctx context.Context, sha256 string) (int, error) {
+	rows, err := br.db.QueryContext(ctx, `SELECT pubkey FROM blob_reports WHERE sha256 = ?`, sha256)
+	if err != nil {
+		return 0, err
+	}
+	var pubkeys []string
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	trusted := 0
+	for _, pubkey := range pubkeys {
+		ok, err := br.isTrustedReporter(ctx, pubkey)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check reporter: %w", err)
+		}
+		if ok {
+			trusted++
+		}
+	}
+	return trusted, nil
+}
+
+// Decide sets the review status of a blob on behalf of an admin
+func (br *blobReports) Decide(ctx context.Context, sha256 string, status string, reason string, adminPubkey string) error {
+	query := `INSERT OR REPLACE INTO blob_reviews (sha256, status, decided_by, updated_at) VALUES (?, ?, ?, ?)`
+	if _, err := br.db.ExecContext(ctx, query, sha256, status, adminPubkey, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to update review: %w", err)
+	}
+
+	action := "quarantine"
+	if status == reviewReleased {
+		action = "release"
+	}
+	log.Printf("Blob sha256=%s %s by %s (reason: %s)", sha256, status, adminPubkey, reason)
+	return br.blocks.audit(ctx, action, blockTargetSHA256, sha256, reason, adminPubkey, "nip86")
+}
+
+// Queue returns the reported blobs, most reported first, optionally filtered by status
+func (br *blobReports) Queue(ctx context.Context, status string) ([]reportedBlob, error) {
+	query := `
+	SELECT v.sha256, v.status, COALESCE(v.decided_by, ''), COUNT(r.pubkey), COALESCE(GROUP_CONCAT(DISTINCT r.report_type), ''), COALESCE(MAX(r.created_at), 0)
+	FROM blob_reviews v
+	LEFT JOIN blob_reports r ON r.sha256 = v.sha256
+	WHERE ? = '' OR v.status = ?
+	GROUP BY v.sha256
+	ORDER BY COUNT(r.pubkey) DESC, MAX(r.created_at) DESC`
+	rows, err := br.db.QueryContext(ctx, query, status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queue := []reportedBlob{}
+	for rows.Next() {
+		var item reportedBlob
+		var types string
+		if err := rows.Scan(&item.SHA256, &item.Status, &item.DecidedBy, &item.Reports, &types, &item.LastReportAt); err != nil {
+			return nil, err
+		}
+		item.ReportTypes = []string{}
+		for _, reportType := range strings.Split(types, ",") {
+			if reportType != "" {
+				item.ReportTypes = append(item.ReportTypes, reportType)
+			}
+		}
+		queue = append(queue, item)
+	}
+	return queue, rows.Err()
+}
+
+// Events returns the stored report events for a blob
+func (br *blobReports) Events(ctx context.Context, sha256 string) ([]*nostr.Event, error) {
+	ch, err := br.store.QueryEvents(ctx, nostr.Filter{
+		Kinds: []int{nostr.KindReporting},
+		Tags:  nostr.TagMap{"x": []string{sha256}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*nostr.Event{}
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events, nil
+}
+
+// reportMiddleware serves BUD-09 PUT /report and stops serving quarantined blobs
+// The report endpoint of the blossom library can't read request bodies, so it is replaced here
+func reportMiddleware(next http.Handler, br *blobReports) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := r.URL.Path
+		switch {
+		case path == "/report" && r.Method == "PUT":
+			body, err := io.ReadAll(io.LimitReader(r.Body, reportMaxBodySize))
+			if err != nil {
+				w.Header().Set("X-Reason", "can't read request body")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var evt nostr.Event
+			if err := json.Unmarshal(body, &evt); err != nil {
+				w.Header().Set("X-Reason", "can't parse event")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reported, err := br.Receive(r.Context(), &evt)
+			if err != nil {
+				w.Header().Set("X-Reason", err.Error())
+				if errors.Is(err, errReportRateLimited) {
+					w.WriteHeader(http.StatusTooManyRequests)
+				} else {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"reported": reported})
+			return
+
+		case (r.Method == "GET" || r.Method == "HEAD") && (len(path) == 65 || strings.Index(path, ".") == 65) && !strings.Contains(path[1:], "/"):
+			sha256 := path[1:65]
+			if quarantined, err := isBlobQuarantined(r.Context(), br.db, sha256); err == nil && quarantined {
+				w.Header().Set("X-Reason", "blob is quarantined pending review")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
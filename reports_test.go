@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// trustEveryone is an upload authorizer trusting every pubkey
+func trustEveryone(ctx context.Context, pubkey string) (bool, error) { return true, nil }
+
+// setupReportedBlob stores a blob mapping and returns the report handling with the given threshold
+// Every reporter is trusted
+func setupReportedBlob(t *testing.T, sha256 string, threshold int) *blobReports {
+	t.Helper()
+	br := setupUntrustedReportedBlob(t, sha256, threshold)
+	br.authorizers = []uploadAuthorizer{trustEveryone}
+	return br
+}
+
+// setupUntrustedReportedBlob is setupReportedBlob without any trusted reporters
+func setupUntrustedReportedBlob(t *testing.T, sha256 string, threshold int) *blobReports {
+	t.Helper()
+	store, db := newTestDB(t)
+	query := `INSERT INTO ipfs_blossom_mapping (sha256, ipfs_cid, extension) VALUES (?, ?, ?)`
+	if _, err := db.Exec(query, sha256, rawCID([]byte(sha256)), ".png"); err != nil {
+		t.Fatalf("failed to store mapping: %v", err)
+	}
+	blocks := newBlocklist(db, nil, &privateBlobs{db: db}, false, nil, nil, nil)
+	return newBlobReports(db, store, blocks, threshold, nil, nil, nil, nil)
+}
+
+// signReport signs a NIP-56 report of a blob
+func signReport(t *testing.T, sk string, sha256 string, reportType string) *nostr.Event {
+	t.Helper()
+	return signTestEvent(t, sk, nostr.KindReporting, nostr.Tags{{"x", sha256, reportType}}, "")
+}
+
+func TestBlobReportsQuarantine(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		threshold  int
+		reporters  int
+		trust      string // how reporters are trusted: "authorizer", "allowed", "admin" or "" for not at all
+		sameSender bool
+		wantStatus string
+	}{
+		{name: "below threshold", threshold: 3, reporters: 2, trust: "authorizer", wantStatus: reviewPending},
+		{name: "threshold reached", threshold: 3, reporters: 3, trust: "authorizer", wantStatus: reviewQuarantined},
+		{name: "allowed reporters", threshold: 3, reporters: 3, trust: "allowed", wantStatus: reviewQuarantined},
+		{name: "admin reporters", threshold: 3, reporters: 3, trust: "admin", wantStatus: reviewQuarantined},
+		{name: "untrusted reporters", threshold: 3, reporters: 5, wantStatus: reviewPending},
+		{name: "same reporter repeating", threshold: 3, reporters: 3, trust: "authorizer", sameSender: true, wantStatus: reviewPending},
+		{name: "auto-quarantine disabled", threshold: 0, reporters: 5, trust: "authorizer", wantStatus: reviewPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := setupUntrustedReportedBlob(t, sha256, tt.threshold)
+			br.adminPubkeys = map[string]bool{}
+			if tt.trust == "authorizer" {
+				br.authorizers = []uploadAuthorizer{trustEveryone}
+			}
+			sk, pubkey := newTestKey(t)
+			for i := 0; i < tt.reporters; i++ {
+				if !tt.sameSender {
+					sk, pubkey = newTestKey(t)
+				}
+				switch tt.trust {
+				case "allowed":
+					if _, err := br.db.Exec(`INSERT OR IGNORE INTO allowed_pubkeys (pubkey, reason) VALUES (?, ?)`, pubkey, "test"); err != nil {
+						t.Fatalf("failed to allow pubkey: %v", err)
+					}
+				case "admin":
+					br.adminPubkeys[pubkey] = true
+				}
+				if _, err := br.Receive(ctx, signReport(t, sk, sha256, "illegal")); err != nil {
+					t.Fatalf("Receive() error = %v", err)
+				}
+			}
+
+			queue, err := br.Queue(ctx, "")
+			if err != nil {
+				t.Fatalf("Queue() error = %v", err)
+			}
+			if len(queue) != 1 || queue[0].Status != tt.wantStatus {
+				t.Fatalf("queue = %+v, want one %s blob", queue, tt.wantStatus)
+			}
+			if quarantined, _ := isBlobQuarantined(ctx, br.db, sha256); quarantined != (tt.wantStatus == reviewQuarantined) {
+				t.Errorf("isBlobQuarantined() = %v", quarantined)
+			}
+		})
+	}
+}
+
+func TestBlobReportsRateLimit(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	ctx := context.Background()
+	br := setupReportedBlob(t, sha256, 0)
+	br.limiter = newTokenBucketLimiter(2, time.Hour)
+	sk, _ := newTestKey(t)
+	otherSK, _ := newTestKey(t)
+
+	tests := []struct {
+		name    string
+		sk      string
+		wantErr error
+	}{
+		{name: "first report", sk: sk},
+		{name: "second report", sk: sk},
+		{name: "over budget", sk: sk, wantErr: errReportRateLimited},
+		{name: "other pubkey", sk: otherSK},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Distinct contents, so the events aren't duplicates
+			evt := signTestEvent(t, tt.sk, nostr.KindReporting, nostr.Tags{{"x", sha256, "spam"}}, strconv.Itoa(i))
+			if _, err := br.Receive(ctx, evt); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Receive() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBlobReportsAdminDecision(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	ctx := context.Background()
+	br := setupReportedBlob(t, sha256, 1)
+	_, admin := newTestKey(t)
+
+	reporterSK, _ := newTestKey(t)
+	if _, err := br.Receive(ctx, signReport(t, reporterSK, sha256, "spam")); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if quarantined, _ := isBlobQuarantined(ctx, br.db, sha256); !quarantined {
+		t.Fatalf("blob wasn't quarantined")
+	}
+
+	// A release by an admin sticks even when more reports come in
+	if err := br.Decide(ctx, sha256, reviewReleased, "false positive", admin); err != nil {
+		t.Fatalf("Decide() error = %v", err)
+	}
+	otherSK, _ := newTestKey(t)
+	if _, err := br.Receive(ctx, signReport(t, otherSK, sha256, "spam")); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if quarantined, _ := isBlobQuarantined(ctx, br.db, sha256); quarantined {
+		t.Errorf("released blob was quarantined again")
+	}
+
+	events, err := br.Events(ctx, sha256)
+	if err != nil || len(events) != 2 {
+		t.Errorf("Events() = %d events, %v, want 2", len(events), err)
+	}
+	entries, err := br.blocks.AuditLog(ctx, 10)
+	if err != nil {
+		t.Fatalf("AuditLog() error = %v", err)
+	}
+	if len(entries) != 2 || entries[0].Action != "release" || entries[0].Actor != admin || entries[1].Action != "quarantine" || entries[1].Actor != "auto" {
+		t.Errorf("audit log = %+v, want an auto quarantine followed by the admin release", entries)
+	}
+}
+
+func TestReportMiddleware(t *testing.T) {
+	const sha256 = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	const unknown = "0000000000000000000000000000000000000000000000000000000000000000"
+	br := setupReportedBlob(t, sha256, 1)
+	sk, _ := newTestKey(t)
+	bannedSK, banned := newTestKey(t)
+	if _, err := br.db.Exec(`INSERT INTO banned_pubkeys (pubkey, reason) VALUES (?, ?)`, banned, "test"); err != nil {
+		t.Fatalf("failed to ban pubkey: %v", err)
+	}
+
+	tamperedReport := signReport(t, sk, sha256, "spam")
+	tamperedReport.Content = "changed after signing"
+
+	tests := []struct {
+		name       string
+		report     any
+		wantStatus int
+	}{
+		{name: "not an event", report: "nonsense", wantStatus: http.StatusBadRequest},
+		{name: "wrong kind", report: signTestEvent(t, sk, 1, nostr.Tags{{"x", sha256}}, ""), wantStatus: http.StatusBadRequest},
+		{name: "tampered event", report: tamperedReport, wantStatus: http.StatusBadRequest},
+		{name: "unknown blob", report: signReport(t, sk, unknown, "spam"), wantStatus: http.StatusBadRequest},
+		{name: "banned reporter", report: signReport(t, bannedSK, sha256, "spam"), wantStatus: http.StatusBadRequest},
+		{name: "valid report", report: signReport(t, sk, sha256, "spam"), wantStatus: http.StatusOK},
+	}
+
+	handler := reportMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), br)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.report)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/report", bytes.NewReader(body)))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", rec.Code, rec.Header().Get("X-Reason"), tt.wantStatus)
+			}
+		})
+	}
+
+	// The valid report reached the threshold, so the blob is no longer served
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/"+sha256+".png", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("download of quarantined blob status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
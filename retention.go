@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blobExpirationTag is the auth event tag carrying a NIP-40 style expiration for the uploaded blob
+// BUD-01 already uses "expiration" for the validity of the auth event itself, so it can't be reused
+const blobExpirationTag = "blob_expiration"
+
+// retentionUnusedSinceSetting is the relay_settings key of the time downloads started being
+// recorded for RETENTION_UNUSED_DAYS; blobs are never considered unused before it
+const retentionUnusedSinceSetting = "retention_unused_since"
+
+// retentionPolicy decides how long blobs are kept and reaps the ones that expired
+// Every upload of a blob gets its own expiration; a blob is removed once all of them passed,
+// or when it hasn't been downloaded for UnusedDays
+type retentionPolicy struct {
+	DefaultTTL time.Duration
+	Pubkeys    map[string]time.Duration
+	MimeTypes  map[string]time.Duration
+	UnusedDays int
+
+	unusedSince int64
+	db          *sql.DB
+	store       blossom.BlobIndex
+	publicShell *shell.Shell
+	private     *privateBlobs
+	metadata    *fileMetadataPublisher
+	mfs         *mfsOrganizer
+}
+
+// retentionConfig is the JSON format of RETENTION_CONFIG_FILE; TTLs are Go durations and "0" means forever
+type retentionConfig struct {
+	DefaultTTL string            `json:"default_ttl"`
+	Pubkeys    map[string]string `json:"pubkeys"`
+	MimeTypes  map[string]string `json:"mime_types"`
+}
+
+// loadRetentionPolicy builds the retention policy from the default TTL and an optional JSON config file
+func loadRetentionPolicy(db *sql.DB, defaultTTL time.Duration, unusedDays int, configPath string) (*retentionPolicy, error) {
+	policy := &retentionPolicy{
+		DefaultTTL: defaultTTL,
+		Pubkeys:    make(map[string]time.Duration),
+		MimeTypes:  make(map[string]time.Duration),
+		UnusedDays: unusedDays,
+		db:         db,
+	}
+	if err := policy.loadUnusedSince(); err != nil {
+		return nil, err
+	}
+	if configPath == "" {
+		return policy, nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retention config: %w", err)
+	}
+	var config retentionConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse retention config: %w", err)
+	}
+
+	if config.DefaultTTL != "" {
+		if policy.DefaultTTL, err = time.ParseDuration(config.DefaultTTL); err != nil {
+			return nil, fmt.Errorf("invalid default_ttl in retention config: %w", err)
+		}
+	}
+	for key, ttlStr := range config.Pubkeys {
+		pubkey, err := normalizePubkey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pubkey %q in retention config: %w", key, err)
+		}
+		if policy.Pubkeys[pubkey], err = time.ParseDuration(ttlStr); err != nil {
+			return nil, fmt.Errorf("invalid TTL for pubkey %q in retention config: %w", key, err)
+		}
+	}
+	for mimeType, ttlStr := range config.MimeTypes {
+		if policy.MimeTypes[strings.ToLower(mimeType)], err = time.ParseDuration(ttlStr); err != nil {
+			return nil, fmt.Errorf("invalid TTL for MIME type %q in retention config: %w", mimeType, err)
+		}
+	}
+	return policy, nil
+}
+
+// loadUnusedSince loads the time downloads started being recorded, starting now if
+// RETENTION_UNUSED_DAYS was just enabled. Downloads aren't recorded while it is disabled,
+// so the time is forgotten then and a later enable starts a new baseline
+func (rp *retentionPolicy) loadUnusedSince() error {
+	if rp.UnusedDays <= 0 {
+		_, err := rp.db.Exec(`DELETE FROM relay_settings WHERE key = ?`, retentionUnusedSinceSetting)
+		return err
+	}
+
+	var value string
+	err := rp.db.QueryRow(`SELECT value FROM relay_settings WHERE key = ?`, retentionUnusedSinceSetting).Scan(&value)
+	if err == sql.ErrNoRows {
+		rp.unusedSince = time.Now().Unix()
+		log.Printf("Recording blob downloads for RETENTION_UNUSED_DAYS from now on")
+		return saveRelaySetting(context.Background(), rp.db, retentionUnusedSinceSetting, strconv.FormatInt(rp.unusedSince, 10))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", retentionUnusedSinceSetting, err)
+	}
+	rp.unusedSince, err = strconv.ParseInt(value, 10, 64)
+	return err
+}
+
+// createRetentionTables creates the tables for blob expirations, accesses and tombstones if they don't exist
+func createRetentionTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS blob_retention (
+		pubkey TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (pubkey, sha256)
+	);
+	CREATE TABLE IF NOT EXISTS blob_access (
+		sha256 TEXT PRIMARY KEY,
+		last_accessed_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS blob_tombstones (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sha256 TEXT NOT NULL,
+		ipfs_cid TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		removed_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_blob_tombstones_sha256 ON blob_tombstones(sha256);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// TTLFor returns how long an upload by pubkey of the given MIME type is kept; zero means forever
+// Precedence is: per-pubkey TTL, then the MIME type (exact, then "type/*"), then the default
+func (rp *retentionPolicy) TTLFor(pubkey string, mimeType string) time.Duration {
+	if ttl, ok := rp.Pubkeys[pubkey]; ok {
+		return ttl
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	if ttl, ok := rp.MimeTypes[mimeType]; ok {
+		return ttl
+	}
+	if major, _, ok := strings.Cut(mimeType, "/"); ok {
+		if ttl, ok := rp.MimeTypes[major+"/*"]; ok {
+			return ttl
+		}
+	}
+	return rp.DefaultTTL
+}
+
+// ExpirationFor returns the unix time an upload expires at, or zero if it is kept forever
+// The expiration requested by the uploader can shorten the policy TTL but never extend it
+func (rp *retentionPolicy) ExpirationFor(pubkey string, mimeType string, requested int64, now time.Time) int64 {
+	var expiresAt int64
+	if ttl := rp.TTLFor(pubkey, mimeType); ttl > 0 {
+		expiresAt = now.Add(ttl).Unix()
+	}
+	if requested > 0 && (expiresAt == 0 || requested < expiresAt) {
+		expiresAt = requested
+	}
+	return expiresAt
+}
+
+// requestedBlobExpiration reads the blob expiration tag of an upload auth event
+func requestedBlobExpiration(auth *nostr.Event) int64 {
+	tag := auth.Tags.Find(blobExpirationTag)
+	if tag == nil {
+		return 0
+	}
+	expiration, _ := strconv.ParseInt(tag[1], 10, 64)
+	return expiration
+}
+
+// blobExpiration returns the expiration requested by the upload in ctx
+func blobExpiration(ctx context.Context) int64 {
+	expiration, _ := ctx.Value(blobExpirationKey).(int64)
+	return expiration
+}
+
+// retentionTrackingIndex wraps a blob index to record the expiration of every upload
+type retentionTrackingIndex struct {
+	blossom.BlobIndex
+	retention *retentionPolicy
+}
+
+// Keep records the blob in the wrapped index and stores the expiration of this upload
+func (idx retentionTrackingIndex) Keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string) error {
+	if err := idx.BlobIndex.Keep(ctx, blob, pubkey); err != nil {
+		return err
+	}
+
+	expiresAt := idx.retention.ExpirationFor(pubkey, blob.Type, blobExpiration(ctx), time.Now())
+	if expiresAt == 0 {
+		_, err := idx.retention.db.ExecContext(ctx, `DELETE FROM blob_retention WHERE pubkey = ? AND sha256 = ?`, pubkey, blob.SHA256)
+		return err
+	}
+	query := `INSERT OR REPLACE INTO blob_retention (pubkey, sha256, expires_at) VALUES (?, ?, ?)`
+	_, err := idx.retention.db.ExecContext(ctx, query, pubkey, blob.SHA256, expiresAt)
+	return err
+}
+
+// Delete removes the blob from the wrapped index and forgets the expiration of this upload
+func (idx retentionTrackingIndex) Delete(ctx context.Context, sha256 string, pubkey string) error {
+	if err := idx.BlobIndex.Delete(ctx, sha256, pubkey); err != nil {
+		return err
+	}
+	_, err := idx.retention.db.ExecContext(ctx, `DELETE FROM blob_retention WHERE pubkey = ? AND sha256 = ?`, pubkey, sha256)
+	return err
+}
+
+// Touch records that a blob was downloaded
+func (rp *retentionPolicy) Touch(ctx context.Context, sha256 string) error {
+	query := `INSERT OR REPLACE INTO blob_access (sha256, last_accessed_at) VALUES (?, ?)`
+	_, err := rp.db.ExecContext(ctx, query, sha256, time.Now().Unix())
+	return err
+}
+
+// RecordAccess touches a downloaded blob when unused blobs are reaped
+func (rp *retentionPolicy) RecordAccess(ctx context.Context, sha256 string) {
+	if rp == nil || rp.UnusedDays <= 0 {
+		return
+	}
+	if err := rp.Touch(ctx, sha256); err != nil {
+		log.Printf("Failed to record access of sha256=%s: %v", sha256, err)
+	}
+}
+
+// tombstoneReason returns why a blob that is no longer stored was removed, if it was reaped
+func (rp *retentionPolicy) tombstoneReason(ctx context.Context, sha256 string) (string, error) {
+	var reason string
+	query := `SELECT reason FROM blob_tombstones WHERE sha256 = ? AND NOT EXISTS (SELECT 1 FROM ipfs_blossom_mapping WHERE sha256 = ?) ORDER BY removed_at DESC LIMIT 1`
+	err := rp.db.QueryRowContext(ctx, query, sha256, sha256).Scan(&reason)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return reason, err
+}
+
+// retentionMiddleware passes upload expirations to the blob index, records blob downloads
+// and answers 410 Gone for blobs removed by the reaper
+func retentionMiddleware(next http.Handler, rp *retentionPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRelayProtocolRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := r.URL.Path
+		switch {
+		case r.Method == "PUT" && (path == "/upload" || path == "/media" || path == "/mirror"):
+			if auth, err := readBlossomAuth(r); err == nil && auth != nil {
+				if expiration := requestedBlobExpiration(auth); expiration > 0 {
+					r = r.WithContext(context.WithValue(r.Context(), blobExpirationKey, expiration))
+				}
+			}
+
+		case (r.Method == "GET" || r.Method == "HEAD") && (len(path) == 65 || strings.Index(path, ".") == 65) && !strings.Contains(path[1:], "/"):
+			sha256 := path[1:65]
+			reason, err := rp.tombstoneReason(r.Context(), sha256)
+			if err != nil {
+				log.Printf("Failed to check tombstone of sha256=%s: %v", sha256, err)
+			} else if reason != "" {
+				w.Header().Set("X-Reason", "blob was removed: "+reason)
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			if r.Method == "GET" {
+				rp.RecordAccess(r.Context(), sha256)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// expiredBlobs returns the blobs to reap with the reason for each
+func (rp *retentionPolicy) expiredBlobs(ctx context.Context, now time.Time) (map[string]string, error) {
+	expired := make(map[string]string)
+
+	// Blobs whose uploads all expired; owners without an expiration keep the blob forever
+	query := `
+	SELECT u.sha256 FROM blob_usage u
+	LEFT JOIN blob_retention r ON r.pubkey = u.pubkey AND r.sha256 = u.sha256
+	GROUP BY u.sha256
+	HAVING SUM(CASE WHEN r.expires_at IS NOT NULL AND r.expires_at <= ? THEN 0 ELSE 1 END) = 0`
+	if err := rp.collect(ctx, expired, "expired", query, now.Unix()); err != nil {
+		return nil, err
+	}
+
+	// Blobs that haven't been downloaded (or uploaded) for UnusedDays, counting from when
+	// downloads started being recorded at the earliest. Thumbnails are served from the gateway
+	// without being recorded, so they are left to be removed along with their original
+	if rp.UnusedDays > 0 {
+		query := `
+		SELECT m.sha256 FROM ipfs_blossom_mapping m
+		LEFT JOIN blob_access a ON a.sha256 = m.sha256
+		WHERE MAX(COALESCE(a.last_accessed_at, CAST(strftime('%s', m.created_at) AS INTEGER)), ?) <= ?
+		AND m.sha256 NOT IN (SELECT thumb_sha256 FROM blob_thumbnails)`
+		cutoff := now.AddDate(0, 0, -rp.UnusedDays).Unix()
+		if err := rp.collect(ctx, expired, fmt.Sprintf("not accessed for %d days", rp.UnusedDays), query, rp.unusedSince, cutoff); err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
+
+// collect adds the sha256 hashes returned by query to expired with the given reason
+func (rp *retentionPolicy) collect(ctx context.Context, expired map[string]string, reason string, query string, args ...any) error {
+	rows, err := rp.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sha256 string
+		if err := rows.Scan(&sha256); err != nil {
+			return err
+		}
+		if _, ok := expired[sha256]; !ok {
+			expired[sha256] = reason
+		}
+	}
+	return rows.Err()
+}
+
+// Reap removes every expired blob: it is deleted from the blob index, unpinned from IPFS,
+// its mapping is dropped and a tombstone records what was removed
+func (rp *retentionPolicy) Reap(ctx context.Context) (int, error) {
+	expired, err := rp.expiredBlobs(ctx, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired blobs: %w", err)
+	}
+
+	reaped := 0
+	for sha256, reason := range expired {
+		if err := rp.remove(ctx, sha256, reason); err != nil {
+			log.Printf("Failed to reap blob sha256=%s: %v", sha256, err)
+			continue
+		}
+		reaped++
+	}
+	return reaped, nil
+}
+
+// remove deletes a single blob and records a tombstone
+func (rp *retentionPolicy) remove(ctx context.Context, sha256 string, reason string) error {
+	var cid string
+	err := rp.db.QueryRowContext(ctx, `SELECT ipfs_cid FROM ipfs_blossom_mapping WHERE sha256 = ?`, sha256).Scan(&cid)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to query mapping: %w", err)
+	}
+
+	// Remove the blob descriptors of every owner, which also releases their quota usage
+	owners, err := blobOwners(ctx, rp.db, sha256)
+	if err != nil {
+		return fmt.Errorf("failed to query owners: %w", err)
+	}
+	for _, owner := range owners {
+		if err := rp.store.Delete(ctx, sha256, owner); err != nil {
+			return fmt.Errorf("failed to delete blob descriptor of %s: %w", owner, err)
+		}
+	}
+
+	if cid != "" {
+		ipfsShell := rp.publicShell
+		if isPrivate, err := rp.private.IsPrivate(ctx, sha256); err == nil && isPrivate && rp.private.ipfsShell != nil {
+			ipfsShell = rp.private.ipfsShell
+		}
+		if err := ipfsShell.Unpin(cid); err != nil {
+			log.Printf("Failed to unpin cid=%s of sha256=%s: %v", cid, sha256, err)
+		}
+	}
+
+	if err := removeBlobPreviews(ctx, rp.db, rp.publicShell, sha256); err != nil {
+		return err
+	}
+	if err := rp.metadata.Remove(ctx, sha256); err != nil {
+		return err
+	}
+	if err := rp.mfs.Remove(ctx, sha256); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM ipfs_blossom_mapping WHERE sha256 = ?`,
+		`DELETE FROM private_blobs WHERE sha256 = ?`,
+		`DELETE FROM blob_encryption WHERE sha256 = ?`,
+		`DELETE FROM blob_retention WHERE sha256 = ?`,
+		`DELETE FROM blob_access WHERE sha256 = ?`,
+	} {
+		if _, err := rp.db.ExecContext(ctx, query, sha256); err != nil {
+			return fmt.Errorf("failed to delete blob state: %w", err)
+		}
+	}
+
+	query := `INSERT INTO blob_tombstones (sha256, ipfs_cid, reason, removed_at) VALUES (?, ?, ?, ?)`
+	if _, err := rp.db.ExecContext(ctx, query, sha256, cid, reason, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to record tombstone: %w", err)
+	}
+
+	log.Printf("Reaped blob sha256=%s cid=%s (%s, %d owners)", sha256, cid, reason, len(owners))
+	return nil
+}
+
+// blobOwners returns the pubkeys that uploaded a blob
+func blobOwners(ctx context.Context, db *sql.DB, sha256 string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT pubkey FROM blob_usage WHERE sha256 = ?`, sha256)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var owners []string
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		owners = append(owners, owner)
+	}
+	return owners, rows.Err()
+}
+
+// Start reaps expired blobs periodically in the background
+func (rp *retentionPolicy) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if reaped, err := rp.Reap(ctx); err != nil {
+				log.Printf("Blob reaper failed: %v", err)
+			} else if reaped > 0 {
+				log.Printf("Blob reaper removed %d blobs", reaped)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRetentionPolicyExpirationFor(t *testing.T) {
+	_, db := newTestDB(t)
+	_, custom := newTestKey(t)
+	_, stranger := newTestKey(t)
+
+	configPath := filepath.Join(t.TempDir(), "retention.json")
+	config := `{
+		"default_ttl": "720h",
+		"pubkeys": {"` + custom + `": "0"},
+		"mime_types": {"video/*": "24h", "video/mp4": "48h"}
+	}`
+	if err := os.WriteFile(configPath, []byte(config), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	policy, err := loadRetentionPolicy(db, time.Hour, 0, configPath)
+	if err != nil {
+		t.Fatalf("loadRetentionPolicy() error = %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name      string
+		pubkey    string
+		mimeType  string
+		requested int64
+		want      int64
+	}{
+		{name: "default from config", pubkey: stranger, mimeType: "image/png", want: now.Add(720 * time.Hour).Unix()},
+		{name: "exact MIME type", pubkey: stranger, mimeType: "video/mp4; codecs=avc1", want: now.Add(48 * time.Hour).Unix()},
+		{name: "wildcard MIME type", pubkey: stranger, mimeType: "video/webm", want: now.Add(24 * time.Hour).Unix()},
+		{name: "pubkey kept forever", pubkey: custom, mimeType: "video/mp4"},
+		{name: "requested shorter", pubkey: stranger, mimeType: "image/png", requested: now.Add(time.Hour).Unix(), want: now.Add(time.Hour).Unix()},
+		{name: "requested longer is capped", pubkey: stranger, mimeType: "video/webm", requested: now.Add(1000 * time.Hour).Unix(), want: now.Add(24 * time.Hour).Unix()},
+		{name: "requested while kept forever", pubkey: custom, mimeType: "image/png", requested: now.Add(time.Hour).Unix(), want: now.Add(time.Hour).Unix()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.ExpirationFor(tt.pubkey, tt.mimeType, tt.requested, now); got != tt.want {
+				t.Errorf("ExpirationFor() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{`{"default_ttl": "soon"}`, `{"pubkeys": {"nobody": "1h"}}`, `{"mime_types": {"image/*": "x"}}`} {
+		if err := os.WriteFile(configPath, []byte(invalid), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		if _, err := loadRetentionPolicy(db, 0, 0, configPath); err == nil {
+			t.Errorf("loadRetentionPolicy() accepted %s", invalid)
+		}
+	}
+}
+
+func TestRetentionReap(t *testing.T) {
+	store, db := newTestDB(t)
+	node, ipfsShell := newFakeIPFS(t)
+	_, alice := newTestKey(t)
+	_, bob := newTestKey(t)
+	ctx := context.Background()
+
+	// Downloads have been recorded for longer than the unused days
+	since := strconv.FormatInt(time.Now().AddDate(0, 0, -40).Unix(), 10)
+	if err := saveRelaySetting(ctx, db, retentionUnusedSinceSetting, since); err != nil {
+		t.Fatalf("saveRelaySetting() error = %v", err)
+	}
+	policy, err := loadRetentionPolicy(db, 0, 30, "")
+	if err != nil {
+		t.Fatalf("loadRetentionPolicy() error = %v", err)
+	}
+	index := retentionTrackingIndex{
+		BlobIndex: usageTrackingIndex{
+			BlobIndex: blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "http://localhost"},
+			db:        db,
+		},
+		retention: policy,
+	}
+	policy.store = index
+	policy.publicShell = ipfsShell
+	policy.private = &privateBlobs{db: db}
+
+	expired := context.WithValue(ctx, blobExpirationKey, time.Now().Add(-time.Minute).Unix())
+
+	blobs := []struct {
+		name       string
+		owners     map[string]context.Context
+		storedDays int
+		accessed   bool
+		wantReaped string
+	}{
+		{name: "expired", owners: map[string]context.Context{alice: expired}, wantReaped: "expired"},
+		{name: "expired for one owner only", owners: map[string]context.Context{alice: expired, bob: ctx}},
+		{name: "unused", owners: map[string]context.Context{alice: ctx}, storedDays: 31, wantReaped: "not accessed for 30 days"},
+		{name: "old but downloaded", owners: map[string]context.Context{alice: ctx}, storedDays: 31, accessed: true},
+		{name: "recent", owners: map[string]context.Context{alice: ctx}},
+	}
+
+	hashes := make([]string, len(blobs))
+	cids := make([]string, len(blobs))
+	for i, b := range blobs {
+		hash := sha256.Sum256([]byte(b.name))
+		hashes[i] = hex.EncodeToString(hash[:])
+		if cids[i], err = storeBlobInIPFS(ctx, ipfsShell, db, hashes[i], ".txt", []byte(b.name)); err != nil {
+			t.Fatalf("storeBlobInIPFS() error = %v", err)
+		}
+		for owner, ownerCtx := range b.owners {
+			blob := blossom.BlobDescriptor{SHA256: hashes[i], Size: len(b.name), Type: "text/plain", Uploaded: nostr.Now()}
+			if err := index.Keep(ownerCtx, blob, owner); err != nil {
+				t.Fatalf("Keep() error = %v", err)
+			}
+		}
+		if b.storedDays > 0 {
+			query := `UPDATE ipfs_blossom_mapping SET created_at = datetime('now', ?) WHERE sha256 = ?`
+			if _, err := db.Exec(query, fmt.Sprintf("-%d days", b.storedDays), hashes[i]); err != nil {
+				t.Fatalf("failed to age mapping: %v", err)
+			}
+		}
+		if b.accessed {
+			if err := policy.Touch(ctx, hashes[i]); err != nil {
+				t.Fatalf("Touch() error = %v", err)
+			}
+		}
+	}
+
+	wantReaped := 0
+	for _, b := range blobs {
+		if b.wantReaped != "" {
+			wantReaped++
+		}
+	}
+	reaped, err := policy.Reap(ctx)
+	if err != nil {
+		t.Fatalf("Reap() error = %v", err)
+	}
+	if reaped != wantReaped {
+		t.Errorf("Reap() = %d, want %d", reaped, wantReaped)
+	}
+
+	handler := retentionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), policy)
+	for i, b := range blobs {
+		t.Run(b.name, func(t *testing.T) {
+			reason, err := policy.tombstoneReason(ctx, hashes[i])
+			if err != nil {
+				t.Fatalf("tombstoneReason() error = %v", err)
+			}
+			if reason != b.wantReaped {
+				t.Errorf("tombstone reason = %q, want %q", reason, b.wantReaped)
+			}
+
+			descriptor, err := index.Get(ctx, hashes[i])
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if (descriptor == nil) != (b.wantReaped != "") {
+				t.Errorf("blob descriptor present = %v, want %v", descriptor != nil, b.wantReaped == "")
+			}
+			if pinned := node.pinned(cids[i]); pinned != (b.wantReaped == "") {
+				t.Errorf("pinned = %v, want %v", pinned, b.wantReaped == "")
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/"+hashes[i]+".txt", nil))
+			wantStatus := http.StatusOK
+			if b.wantReaped != "" {
+				wantStatus = http.StatusGone
+			}
+			if rec.Code != wantStatus {
+				t.Errorf("download status = %d, want %d", rec.Code, wantStatus)
+			}
+		})
+	}
+}
+
+func TestRetentionUnusedSince(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		since      string // recorded start of download tracking, "" if never enabled
+		unusedDays int
+		wantReaped bool
+		wantSince  bool
+	}{
+		{name: "tracking just enabled", unusedDays: 30, wantSince: true},
+		{name: "tracking started recently", since: strconv.FormatInt(time.Now().AddDate(0, 0, -10).Unix(), 10), unusedDays: 30, wantSince: true},
+		{name: "tracking started long ago", since: strconv.FormatInt(time.Now().AddDate(0, 0, -40).Unix(), 10), unusedDays: 30, wantReaped: true, wantSince: true},
+		{name: "tracking disabled", since: "1", unusedDays: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := newTestDB(t)
+			_, ipfsShell := newFakeIPFS(t)
+			if tt.since != "" {
+				if err := saveRelaySetting(ctx, db, retentionUnusedSinceSetting, tt.since); err != nil {
+					t.Fatalf("saveRelaySetting() error = %v", err)
+				}
+			}
+			policy, err := loadRetentionPolicy(db, 0, tt.unusedDays, "")
+			if err != nil {
+				t.Fatalf("loadRetentionPolicy() error = %v", err)
+			}
+
+			// A blob stored long ago that was never downloaded
+			content := []byte("old blob")
+			sha := sha256Hex(content)
+			if _, err := storeBlobInIPFS(ctx, ipfsShell, db, sha, ".txt", content); err != nil {
+				t.Fatalf("storeBlobInIPFS() error = %v", err)
+			}
+			if _, err := db.Exec(`UPDATE ipfs_blossom_mapping SET created_at = datetime('now', '-60 days')`); err != nil {
+				t.Fatalf("failed to age mapping: %v", err)
+			}
+
+			expired, err := policy.expiredBlobs(ctx, time.Now())
+			if err != nil {
+				t.Fatalf("expiredBlobs() error = %v", err)
+			}
+			if _, reaped := expired[sha]; reaped != tt.wantReaped {
+				t.Errorf("reaped = %v, want %v", reaped, tt.wantReaped)
+			}
+
+			var value string
+			err = db.QueryRow(`SELECT value FROM relay_settings WHERE key = ?`, retentionUnusedSinceSetting).Scan(&value)
+			if (err == nil) != tt.wantSince {
+				t.Errorf("start of download tracking recorded = %v, want %v", err == nil, tt.wantSince)
+			}
+		})
+	}
+}
+
+func TestRetentionUnusedSkipsThumbnails(t *testing.T) {
+	ctx := context.Background()
+	_, db := newTestDB(t)
+	_, ipfsShell := newFakeIPFS(t)
+	since := strconv.FormatInt(time.Now().AddDate(0, 0, -40).Unix(), 10)
+	if err := saveRelaySetting(ctx, db, retentionUnusedSinceSetting, since); err != nil {
+		t.Fatalf("saveRelaySetting() error = %v", err)
+	}
+	policy, err := loadRetentionPolicy(db, 0, 30, "")
+	if err != nil {
+		t.Fatalf("loadRetentionPolicy() error = %v", err)
+	}
+
+	data := encodeTestImage(t, "png", 200, 100)
+	sha := sha256Hex(data)
+	if _, err := storeBlobInIPFS(ctx, ipfsShell, db, sha, ".png", data); err != nil {
+		t.Fatalf("storeBlobInIPFS() error = %v", err)
+	}
+	if err := newPreviewGenerator(db, ipfsShell, []int{32}, 1_000_000).Generate(ctx, sha, ".png", data); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	thumbs, err := blobThumbnails(ctx, db, sha)
+	if err != nil || len(thumbs) != 1 {
+		t.Fatalf("blobThumbnails() = %v, %v, want one thumbnail", thumbs, err)
+	}
+	if _, err := db.Exec(`UPDATE ipfs_blossom_mapping SET created_at = datetime('now', '-60 days')`); err != nil {
+		t.Fatalf("failed to age mappings: %v", err)
+	}
+
+	expired, err := policy.expiredBlobs(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("expiredBlobs() error = %v", err)
+	}
+	if _, ok := expired[sha]; !ok {
+		t.Errorf("unused original isn't reaped")
+	}
+	if _, ok := expired[thumbs[0].SHA256]; ok {
+		t.Errorf("thumbnail is reaped on its own")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// wotBatchSize is the number of authors requested per follow list query
+const wotBatchSize = 200
+
+// wotFetchTimeout bounds how long a single batch of follow lists is fetched from remote relays
+const wotFetchTimeout = 30 * time.Second
+
+// webOfTrust authorizes uploads for pubkeys followed by a set of root pubkeys,
+// up to a configurable number of hops
+type webOfTrust struct {
+	roots  map[string]bool
+	depth  int
+	store  eventstore.Store
+	relays []string
+	pool   *nostr.SimplePool
+	db     *sql.DB
+
+	mu      sync.RWMutex
+	trusted map[string]int
+}
+
+// newWebOfTrust creates a web of trust rooted at the given pubkeys
+// Follow lists are read from the local eventstore and, if any are configured, from remote relays
+func newWebOfTrust(db *sql.DB, store eventstore.Store, roots map[string]bool, depth int, relays []string) *webOfTrust {
+	wot := &webOfTrust{
+		roots:   roots,
+		depth:   depth,
+		store:   store,
+		relays:  relays,
+		db:      db,
+		trusted: make(map[string]int),
+	}
+	if len(relays) > 0 {
+		wot.pool = nostr.NewSimplePool(context.Background())
+	}
+	return wot
+}
+
+// createWoTTable creates the table caching the computed web of trust if it doesn't exist
+func createWoTTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS wot_trusted_pubkeys (
+		pubkey TEXT PRIMARY KEY,
+		depth INTEGER NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+	_, err := db.Exec(query)
+	return err
+}
+
+// LoadCache restores the last computed web of trust so uploads work before the first refresh finishes
+func (wot *webOfTrust) LoadCache() error {
+	rows, err := wot.db.Query(`SELECT pubkey, depth FROM wot_trusted_pubkeys`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	trusted := make(map[string]int)
+	for rows.Next() {
+		var pubkey string
+		var depth int
+		if err := rows.Scan(&pubkey, &depth); err != nil {
+			return err
+		}
+		trusted[pubkey] = depth
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	wot.mu.Lock()
+	wot.trusted = trusted
+	wot.mu.Unlock()
+
+	log.Printf("Loaded %d cached web of trust pubkeys", len(trusted))
+	return nil
+}
+
+// Refresh walks the follow graph from the roots and replaces the trusted set
+func (wot *webOfTrust) Refresh(ctx context.Context) error {
+	start := time.Now()
+	trusted := make(map[string]int)
+	for root := range wot.roots {
+		trusted[root] = 0
+	}
+
+	level := make([]string, 0, len(wot.roots))
+	for root := range wot.roots {
+		level = append(level, root)
+	}
+
+	for hop := 1; hop <= wot.depth && len(level) > 0; hop++ {
+		follows, err := wot.fetchFollows(ctx, level)
+		if err != nil {
+			return fmt.Errorf("failed to fetch follow lists at hop %d: %w", hop, err)
+		}
+
+		var next []string
+		for _, pubkey := range follows {
+			if _, seen := trusted[pubkey]; seen {
+				continue
+			}
+			trusted[pubkey] = hop
+			next = append(next, pubkey)
+		}
+		log.Printf("Web of trust hop %d: %d new pubkeys from %d follow lists", hop, len(next), len(level))
+		level = next
+	}
+
+	if err := wot.saveCache(ctx, trusted); err != nil {
+		return fmt.Errorf("failed to cache web of trust: %w", err)
+	}
+
+	wot.mu.Lock()
+	wot.trusted = trusted
+	wot.mu.Unlock()
+
+	log.Printf("Web of trust refreshed: %d trusted pubkeys in %s", len(trusted), time.Since(start))
+	return nil
+}
+
+// fetchFollows returns the pubkeys followed by the given authors, using their latest kind 3 event
+func (wot *webOfTrust) fetchFollows(ctx context.Context, authors []string) ([]string, error) {
+	var follows []string
+	for i := 0; i < len(authors); i += wotBatchSize {
+		batch := authors[i:min(i+wotBatchSize, len(authors))]
+		latest := make(map[string]*nostr.Event)
+		filter := nostr.Filter{Authors: batch, Kinds: []int{nostr.KindFollowList}}
+
+		// Local eventstore first
+		ch, err := wot.store.QueryEvents(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		for evt := range ch {
+			keepLatestEvent(latest, evt)
+		}
+
+		// Then configured relays
+		if wot.pool != nil {
+			fetchCtx, cancel := context.WithTimeout(ctx, wotFetchTimeout)
+			for ie := range wot.pool.FetchMany(fetchCtx, wot.relays, filter) {
+				if ok, _ := ie.Event.CheckSignature(); ok {
+					keepLatestEvent(latest, ie.Event)
+				}
+			}
+			cancel()
+		}
+
+		for _, evt := range latest {
+			for _, tag := range evt.Tags {
+				if len(tag) >= 2 && tag[0] == "p" && nostr.IsValid32ByteHex(tag[1]) {
+					follows = append(follows, strings.ToLower(tag[1]))
+				}
+			}
+		}
+	}
+	return follows, nil
+}
+
+// keepLatestEvent stores evt in latest if it is newer than the event already kept for its author
+func keepLatestEvent(latest map[string]*nostr.Event, evt *nostr.Event) {
+	if current, ok := latest[evt.PubKey]; !ok || evt.CreatedAt > current.CreatedAt {
+		latest[evt.PubKey] = evt
+	}
+}
+
+// saveCache replaces the cached trusted set in the database
+func (wot *webOfTrust) saveCache(ctx context.Context, trusted map[string]int) error {
+	tx, err := wot.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM wot_trusted_pubkeys`); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO wot_trusted_pubkeys (pubkey, depth) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for pubkey, depth := range trusted {
+		if _, err := stmt.ExecContext(ctx, pubkey, depth); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Start refreshes the web of trust immediately and then on every interval until ctx is done
+func (wot *webOfTrust) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := wot.Refresh(ctx); err != nil {
+				log.Printf("Failed to refresh web of trust: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// IsTrusted reports whether a (hex) pubkey is a root or within the configured number of hops
+func (wot *webOfTrust) IsTrusted(pubkey string) bool {
+	if wot.roots[pubkey] {
+		return true
+	}
+	wot.mu.RLock()
+	defer wot.mu.RUnlock()
+	_, ok := wot.trusted[pubkey]
+	return ok
+}
+
+// Authorize implements uploadAuthorizer for the web of trust
+func (wot *webOfTrust) Authorize(ctx context.Context, pubkey string) (bool, error) {
+	return wot.IsTrusted(pubkey), nil
+}
+
+// parseRelayList parses a comma-separated list of relay URLs from environment variable
+func parseRelayList(relaysStr string) []string {
+	var relays []string
+	for _, relayURL := range strings.Split(relaysStr, ",") {
+		relayURL = strings.TrimSpace(relayURL)
+		if relayURL == "" {
+			continue
+		}
+		relays = append(relays, nostr.NormalizeURL(relayURL))
+	}
+	return relays
+}
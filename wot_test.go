@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestWebOfTrustRefresh(t *testing.T) {
+	store, db := newTestDB(t)
+	ctx := context.Background()
+
+	// root follows alice, alice follows bob, bob follows carol
+	rootSK, root := newTestKey(t)
+	aliceSK, alice := newTestKey(t)
+	bobSK, bob := newTestKey(t)
+	_, carol := newTestKey(t)
+	_, stranger := newTestKey(t)
+	for _, follow := range []struct {
+		sk      string
+		follows string
+	}{
+		{rootSK, alice},
+		{aliceSK, bob},
+		{bobSK, carol},
+	} {
+		evt := signTestEvent(t, follow.sk, nostr.KindFollowList, nostr.Tags{{"p", follow.follows}}, "")
+		if err := store.SaveEvent(ctx, evt); err != nil {
+			t.Fatalf("failed to save follow list: %v", err)
+		}
+	}
+
+	// An older follow list of the root is ignored
+	old := &nostr.Event{Kind: nostr.KindFollowList, Tags: nostr.Tags{{"p", stranger}}, CreatedAt: nostr.Now() - 3600}
+	if err := old.Sign(rootSK); err != nil {
+		t.Fatalf("failed to sign event: %v", err)
+	}
+	if err := store.SaveEvent(ctx, old); err != nil {
+		t.Fatalf("failed to save follow list: %v", err)
+	}
+
+	tests := []struct {
+		depth       int
+		wantTrusted map[string]bool
+	}{
+		{depth: 0, wantTrusted: map[string]bool{root: true, alice: false}},
+		{depth: 1, wantTrusted: map[string]bool{root: true, alice: true, bob: false}},
+		{depth: 2, wantTrusted: map[string]bool{alice: true, bob: true, carol: false, stranger: false}},
+		{depth: 3, wantTrusted: map[string]bool{bob: true, carol: true, stranger: false}},
+	}
+
+	for _, tt := range tests {
+		wot := newWebOfTrust(db, store, map[string]bool{root: true}, tt.depth, nil)
+		if err := wot.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh() error = %v", err)
+		}
+		for pubkey, want := range tt.wantTrusted {
+			if got := wot.IsTrusted(pubkey); got != want {
+				t.Errorf("depth %d: IsTrusted(%s) = %v, want %v", tt.depth, pubkey, got, want)
+			}
+		}
+
+		// The computed set survives a restart through the cache
+		restarted := newWebOfTrust(db, store, map[string]bool{root: true}, tt.depth, nil)
+		if err := restarted.LoadCache(); err != nil {
+			t.Fatalf("LoadCache() error = %v", err)
+		}
+		for pubkey, want := range tt.wantTrusted {
+			if got := restarted.IsTrusted(pubkey); got != want {
+				t.Errorf("depth %d after restart: IsTrusted(%s) = %v, want %v", tt.depth, pubkey, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckUploadAuthorization(t *testing.T) {
+	_, allowed := newTestKey(t)
+	_, trusted := newTestKey(t)
+	_, stranger := newTestKey(t)
+
+	trustAuthorizer := func(ctx context.Context, pubkey string) (bool, error) {
+		return pubkey == trusted, nil
+	}
+	failingAuthorizer := func(ctx context.Context, pubkey string) (bool, error) {
+		return false, errors.New("lookup failed")
+	}
+
+	tests := []struct {
+		name        string
+		auth        *nostr.Event
+		authorizers []uploadAuthorizer
+		wantErr     bool
+	}{
+		{name: "whitelisted pubkey", auth: &nostr.Event{PubKey: allowed}},
+		{name: "authorized pubkey", auth: &nostr.Event{PubKey: trusted}, authorizers: []uploadAuthorizer{trustAuthorizer}},
+		{name: "authorized after a failing authorizer", auth: &nostr.Event{PubKey: trusted}, authorizers: []uploadAuthorizer{failingAuthorizer, trustAuthorizer}},
+		{name: "unknown pubkey", auth: &nostr.Event{PubKey: stranger}, authorizers: []uploadAuthorizer{trustAuthorizer}, wantErr: true},
+		{name: "no authorizers", auth: &nostr.Event{PubKey: trusted}, wantErr: true},
+		{name: "no auth event", authorizers: []uploadAuthorizer{trustAuthorizer}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkUploadAuthorization(context.Background(), tt.auth, map[string]bool{allowed: true}, tt.authorizers)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkUploadAuthorization() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}